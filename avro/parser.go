@@ -0,0 +1,295 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package avro
+
+import (
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+)
+
+// Record is an Avro value together with the schema it was written with, for
+// Parser to parse. kafka.ConfluentSource returns Records if its AvroRecords
+// is set.
+type Record struct {
+	Schema *Schema
+
+	// Datum is the value as decoded by Schema.Decode.
+	Datum interface{}
+
+	// Extra holds top level values which accompany Datum but aren't
+	// described by the schema, such as Kafka message metadata. Parser parses
+	// them as pdk.GenericParser would.
+	Extra map[string]interface{}
+}
+
+// TypeProperty is the custom property of an Avro field (or type) which
+// declares the type of the Pilosa field its values are indexed into, e.g.
+//
+//	{"name": "status", "type": "string", "pilosa.type": "mutex"}
+//
+// A field's doc may declare the type instead, with a word like
+// "pilosa.type=mutex". The types are set, mutex, bool, and int.
+const TypeProperty = "pilosa.type"
+
+// Parser is a pdk.RecordParser which parses Records by walking their schemas
+// alongside their values, rather than guessing types from the Go values as
+// pdk.GenericParser does. Unions are unwrapped to the value of their branch.
+// Timestamps and dates become pdk.Times, and times of day become integers in
+// the unit of their logical type. Decimals become F64s, and their scale is
+// hinted as the number of decimal places to keep. Enums are hinted as mutex
+// fields, and any field can declare its type with TypeProperty.
+type Parser struct {
+	// Generic parses values which aren't Records, and its EntitySubjecter (or
+	// failing that, its Subjecter) gets the subject of every record. The
+	// Subjecter is passed a Record's Datum.
+	Generic *pdk.GenericParser
+
+	// Hints receives the field types and decimal places which schemas
+	// declare. It should be shared with the mapper (see
+	// pdk.CollapsingMapper.Hints).
+	Hints *pdk.FieldHints
+}
+
+// NewParser returns a Parser which falls back to generic, with empty Hints.
+func NewParser(generic *pdk.GenericParser) *Parser {
+	return &Parser{
+		Generic: generic,
+		Hints:   pdk.NewFieldHints(),
+	}
+}
+
+// Parse implements pdk.RecordParser.
+func (p *Parser) Parse(data interface{}) (*pdk.Entity, error) {
+	rec, ok := data.(*Record)
+	if !ok {
+		return p.Generic.Parse(data)
+	}
+	def, ok := rec.Schema.root.(map[string]interface{})
+	if !ok || def["type"] != "record" {
+		return nil, errors.New("top level schema is not a record")
+	}
+	obj, err := p.parse(rec.Schema, def, "", rec.Datum, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	e, ok := obj.(*pdk.Entity)
+	if !ok {
+		return nil, errors.Errorf("record decoded to %T", rec.Datum)
+	}
+	if len(rec.Extra) > 0 {
+		generic := *p.Generic
+		generic.Subjecter, generic.EntitySubjecter, generic.SubjectAll = pdk.BlankSubjecter{}, nil, false
+		extra, err := generic.Parse(rec.Extra)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing extra values")
+		}
+		for prop, obj := range extra.Objects {
+			e.Objects[prop] = obj
+		}
+	}
+	if p.Generic.SubjectAll {
+		return e, nil
+	}
+	var subj string
+	if p.Generic.EntitySubjecter != nil {
+		subj, err = p.Generic.EntitySubjecter.Subject(e)
+	} else {
+		subj, err = p.Generic.Subjecter.Subject(rec.Datum)
+	}
+	e.Subject = pdk.IRI(subj)
+	return e, err
+}
+
+// parse converts v, which was decoded with schema in namespace ns, to the
+// Object at path. typ is the field type which the field holding v declares,
+// if any. A nil Object means there is nothing to index.
+func (p *Parser) parse(s *Schema, schema interface{}, ns string, v interface{}, path []string, typ pdk.FieldType) (pdk.Object, error) {
+	if v == nil {
+		return nil, nil
+	}
+	schema = s.resolve(schema, ns)
+	if union, ok := schema.([]interface{}); ok {
+		branch, v, ok := s.branch(union, ns, v)
+		if !ok {
+			return nil, errors.Errorf("value at %v matches no branch of its union", path)
+		}
+		return p.parse(s, branch, ns, v, path, typ)
+	}
+	def, ok := schema.(map[string]interface{})
+	if !ok {
+		return p.literal(v, path, typ)
+	}
+	if typ == "" {
+		var err error
+		if typ, err = declared(def); err != nil {
+			return nil, errors.Wrapf(err, "at %v", path)
+		}
+	}
+	switch def["type"] {
+	case "record":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("record at %v decoded to %T", path, v)
+		}
+		ns = namespace(def, ns)
+		ent := pdk.NewEntity()
+		for _, f := range fieldsOf(def) {
+			name := f["name"].(string)
+			ftyp, err := declared(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s", name)
+			}
+			obj, err := p.parse(s, f["type"], ns, m[name], append(path[:len(path):len(path)], name), ftyp)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s", name)
+			}
+			if obj != nil {
+				ent.Objects[pdk.Property(name)] = obj
+			}
+		}
+		return ent, nil
+	case "enum":
+		if typ == "" {
+			typ = pdk.FieldTypeMutex
+		}
+		return p.literal(v, path, typ)
+	case "array":
+		vs, ok := v.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("array at %v decoded to %T", path, v)
+		}
+		objs := make(pdk.Objects, 0, len(vs))
+		for _, item := range vs {
+			obj, err := p.parse(s, def["items"], ns, item, path, typ)
+			if err != nil {
+				return nil, err
+			}
+			if obj != nil {
+				objs = append(objs, obj)
+			}
+		}
+		return objs, nil
+	case "map":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("map at %v decoded to %T", path, v)
+		}
+		ent := pdk.NewEntity()
+		for k, item := range m {
+			obj, err := p.parse(s, def["values"], ns, item, append(path[:len(path):len(path)], k), typ)
+			if err != nil {
+				return nil, err
+			}
+			if obj != nil {
+				ent.Objects[pdk.Property(k)] = obj
+			}
+		}
+		return ent, nil
+	}
+	switch def["logicalType"] {
+	case "decimal":
+		if scale, ok := def["scale"].(float64); ok && p.Hints != nil {
+			p.Hints.SetDecimals(path, int(scale))
+		}
+		return p.literal(v, path, typ)
+	case "time-millis":
+		if d, ok := v.(time.Duration); ok {
+			return p.literal(int64(d/time.Millisecond), path, typ)
+		}
+	case "time-micros":
+		if d, ok := v.(time.Duration); ok {
+			return p.literal(int64(d/time.Microsecond), path, typ)
+		}
+	}
+	if t, ok := def["type"].(map[string]interface{}); ok {
+		return p.parse(s, t, ns, v, path, typ)
+	}
+	return p.literal(v, path, typ)
+}
+
+// literal converts the primitive value v at path, and hints that it belongs
+// in a field of type typ if that isn't empty.
+func (p *Parser) literal(v interface{}, path []string, typ pdk.FieldType) (pdk.Object, error) {
+	if typ != "" && p.Hints != nil {
+		p.Hints.SetType(path, typ)
+	}
+	switch tv := v.(type) {
+	case bool:
+		return pdk.B(tv), nil
+	case int32:
+		return pdk.I32(tv), nil
+	case int64:
+		return pdk.I64(tv), nil
+	case float32:
+		return pdk.F32(tv), nil
+	case float64:
+		return pdk.F64(tv), nil
+	case string:
+		return pdk.S(tv), nil
+	case []byte:
+		return pdk.S(tv), nil
+	case time.Time:
+		return pdk.Time(tv), nil
+	case *big.Rat:
+		f, _ := tv.Float64()
+		return pdk.F64(f), nil
+	}
+	return nil, errors.Errorf("unexpected %T at %v", v, path)
+}
+
+// declared returns the field type which def declares with TypeProperty,
+// either as a property or in its doc, or "" if it declares none.
+func declared(def map[string]interface{}) (pdk.FieldType, error) {
+	name, ok := def[TypeProperty].(string)
+	if !ok {
+		doc, _ := def["doc"].(string)
+		for _, word := range strings.Fields(doc) {
+			if strings.HasPrefix(word, TypeProperty+"=") {
+				name, ok = strings.TrimPrefix(word, TypeProperty+"="), true
+				break
+			}
+		}
+	}
+	if !ok {
+		return "", nil
+	}
+	switch typ := pdk.FieldType(name); typ {
+	case pdk.FieldTypeSet, pdk.FieldTypeMutex, pdk.FieldTypeBool, pdk.FieldTypeInt:
+		return typ, nil
+	}
+	return "", errors.Errorf("unknown %s '%s'", TypeProperty, name)
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package avro
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro"
+	"github.com/pilosa/pdk"
+)
+
+func TestParser(t *testing.T) {
+	schema, err := NewSchema(`{
+		"type": "record",
+		"name": "Order",
+		"fields": [
+			{"name": "id", "type": "string"},
+			{"name": "at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+			{"name": "open", "type": {"type": "int", "logicalType": "time-millis"}},
+			{"name": "price", "type": ["null", {"type": "bytes", "logicalType": "decimal", "precision": 9, "scale": 2}]},
+			{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "DONE"]}},
+			{"name": "region", "type": "string", "doc": "Where it ships. pilosa.type=mutex"},
+			{"name": "code", "type": "int", "pilosa.type": "set"},
+			{"name": "buyer", "type": ["null", {"type": "record", "name": "Buyer", "fields": [
+				{"name": "tier", "type": "Status"}
+			]}]},
+			{"name": "tags", "type": {"type": "array", "items": "string"}},
+			{"name": "note", "type": ["null", "string"]}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+	at := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	data, err := schema.codec.BinaryFromNative(nil, map[string]interface{}{
+		"id":     "o1",
+		"at":     at,
+		"open":   90 * time.Second,
+		"price":  goavro.Union("bytes.decimal", big.NewRat(1234, 100)),
+		"status": "DONE",
+		"region": "west",
+		"code":   int32(7),
+		"buyer":  goavro.Union("Buyer", map[string]interface{}{"tier": "NEW"}),
+		"tags":   []interface{}{"a", "b"},
+		"note":   nil,
+	})
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	datum, err := schema.Decode(data)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+
+	generic := pdk.NewDefaultGenericParser()
+	generic.EntitySubjecter = pdk.SubjectPath{"id"}
+	p := NewParser(generic)
+	e, err := p.Parse(&Record{Schema: schema, Datum: datum, Extra: map[string]interface{}{"meta": map[string]interface{}{"key": "k"}}})
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	exp := &pdk.Entity{Subject: "o1", Objects: map[pdk.Property]pdk.Object{
+		"at":     pdk.Time(at),
+		"open":   pdk.I64(90000),
+		"price":  pdk.F64(12.34),
+		"status": pdk.S("DONE"),
+		"region": pdk.S("west"),
+		"code":   pdk.I32(7),
+		"buyer":  &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"tier": pdk.S("NEW")}},
+		"tags":   pdk.Objects{pdk.S("a"), pdk.S("b")},
+		"meta":   &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"key": pdk.S("k")}},
+	}}
+	if !reflect.DeepEqual(e, exp) {
+		t.Fatalf("unexpected entity:\n%#v\nexp:\n%#v", e, exp)
+	}
+
+	for path, exp := range map[string]pdk.FieldType{
+		"status": pdk.FieldTypeMutex,
+		"region": pdk.FieldTypeMutex,
+		"code":   pdk.FieldTypeSet,
+	} {
+		if typ, _ := p.Hints.Type([]string{path}); typ != exp {
+			t.Errorf("expected %s to be hinted %s, got '%s'", path, exp, typ)
+		}
+	}
+	if typ, _ := p.Hints.Type([]string{"buyer", "tier"}); typ != pdk.FieldTypeMutex {
+		t.Errorf("expected nested enum to be hinted mutex, got '%s'", typ)
+	}
+	if places, ok := p.Hints.Decimals([]string{"price"}); !ok || places != 2 {
+		t.Errorf("expected price to be hinted 2 places, got %d, %v", places, ok)
+	}
+
+	e, err = p.Parse(map[string]interface{}{"id": "o2", "x": "y"})
+	if err != nil {
+		t.Fatalf("parsing non-record: %v", err)
+	}
+	if e.Subject != "o2" || e.Objects["x"] != pdk.S("y") {
+		t.Errorf("unexpected generic entity: %#v", e)
+	}
+
+	bad, err := NewSchema(`{"type": "record", "name": "Bad", "fields": [
+		{"name": "x", "type": "string", "pilosa.type": "ranked"}
+	]}`)
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+	if _, err := p.Parse(&Record{Schema: bad, Datum: map[string]interface{}{"x": "y"}}); err == nil {
+		t.Error("expected error for unknown field type")
+	}
+}
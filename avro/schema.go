@@ -0,0 +1,133 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package avro
+
+import (
+	"encoding/json"
+
+	"github.com/linkedin/goavro"
+	"github.com/pkg/errors"
+)
+
+// Schema is a parsed Avro schema. It decodes binary Avro values written with
+// the schema, and keeps the schema's definition so that a Parser can walk it
+// alongside them.
+type Schema struct {
+	codec *goavro.Codec
+	root  interface{}
+
+	// named holds the definitions of named types by full name.
+	named map[string]map[string]interface{}
+}
+
+// NewSchema parses the JSON Avro schema.
+func NewSchema(schema string) (*Schema, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, errors.Wrap(err, "compiling schema")
+	}
+	s := &Schema{codec: codec, named: make(map[string]map[string]interface{})}
+	if err := json.Unmarshal([]byte(schema), &s.root); err != nil {
+		return nil, errors.Wrap(err, "decoding schema")
+	}
+	s.define(s.root, "")
+	return s, nil
+}
+
+// Decode decodes a binary Avro value written with s into the form Record's
+// Datum holds.
+func (s *Schema) Decode(data []byte) (interface{}, error) {
+	datum, _, err := s.codec.NativeFromBinary(data)
+	return datum, errors.Wrap(err, "decoding value")
+}
+
+// define records the named types defined anywhere in schema.
+func (s *Schema) define(schema interface{}, ns string) {
+	switch def := schema.(type) {
+	case []interface{}:
+		for _, branch := range def {
+			s.define(branch, ns)
+		}
+	case map[string]interface{}:
+		if _, ok := def["name"].(string); ok {
+			s.named[fullName(def, ns)] = def
+			ns = namespace(def, ns)
+		}
+		for _, f := range fieldsOf(def) {
+			s.define(f["type"], ns)
+		}
+		s.define(def["items"], ns)
+		s.define(def["values"], ns)
+		if t, ok := def["type"].(map[string]interface{}); ok {
+			s.define(t, ns)
+		}
+	}
+}
+
+// resolve returns the definition of the named type schema refers to, or
+// schema itself if it isn't a reference to a named type.
+func (s *Schema) resolve(schema interface{}, ns string) interface{} {
+	if name, ok := schema.(string); ok {
+		if def, ok := s.named[qualify(name, ns)]; ok {
+			return def
+		}
+	}
+	return schema
+}
+
+// branch returns the branch of the union schema which v belongs to, and the
+// value itself. goavro decodes non-null union values to a single entry map
+// keyed by the name of their branch. If the name isn't one goavro would give
+// a branch, but the union has only one branch other than null, that branch is
+// assumed.
+func (s *Schema) branch(schema []interface{}, ns string, v interface{}) (interface{}, interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return nil, v, false
+	}
+	var name string
+	for name, v = range m {
+	}
+	var other interface{}
+	others := 0
+	for _, branch := range schema {
+		if branchName(branch, ns) == name {
+			return branch, v, true
+		}
+		if branch != "null" {
+			other = branch
+			others++
+		}
+	}
+	return other, v, others == 1
+}
@@ -0,0 +1,323 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+// Package avro provides a pdk.Source which reads Avro object container files.
+package avro
+
+import (
+	"bufio"
+	"math/big"
+	"strings"
+
+	"github.com/linkedin/goavro"
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+)
+
+// Source reads records from the Avro object container files which are the
+// readers of a RawSource. Each record is returned as a map[string]interface{}
+// keyed by field name. Unions are unwrapped to the value of their branch,
+// dates and timestamps are returned as time.Time, times of day as
+// time.Duration, and decimals as float64.
+type Source struct {
+	rs      pdk.RawSource
+	columns []string
+
+	cur  pdk.NamedReadCloser
+	ocf  *goavro.OCFReader
+	conv *converter
+}
+
+// Option is a functional option for Source.
+type Option func(s *Source)
+
+// OptColumns makes the Source return only the named top level fields of each
+// record. Avro is stored by row, so the other fields are still decoded, but
+// they are dropped before the record is returned.
+func OptColumns(columns ...string) Option {
+	return func(s *Source) {
+		s.columns = columns
+	}
+}
+
+// NewSourceFromRawSource gets a Source which reads the files of rs in turn.
+func NewSourceFromRawSource(rs pdk.RawSource, opts ...Option) *Source {
+	s := &Source{rs: rs}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Record implements pdk.Source.
+func (s *Source) Record() (interface{}, error) {
+	for {
+		if s.cur == nil {
+			r, err := s.rs.NextReader()
+			if err != nil {
+				return nil, err
+			}
+			if err := s.open(r); err != nil {
+				r.Close()
+				return nil, errors.Wrapf(err, "opening %s", r.Name())
+			}
+		}
+		if s.ocf.Scan() {
+			datum, err := s.ocf.Read()
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading %s", s.cur.Name())
+			}
+			return s.conv.record(datum), nil
+		}
+		err := s.ocf.Err()
+		name := s.cur.Name()
+		s.cur.Close()
+		s.cur, s.ocf, s.conv = nil, nil, nil
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", name)
+		}
+	}
+}
+
+func (s *Source) open(r pdk.NamedReadCloser) error {
+	ocf, err := goavro.NewOCFReader(bufio.NewReader(r))
+	if err != nil {
+		return errors.Wrap(err, "reading header")
+	}
+	schema, err := NewSchema(ocf.Codec().Schema())
+	if err != nil {
+		return err
+	}
+	conv, err := newConverter(schema, s.columns)
+	if err != nil {
+		return err
+	}
+	s.cur, s.ocf, s.conv = r, ocf, conv
+	return nil
+}
+
+// converter turns the values decoded by goavro into the ones returned by
+// Source, using the schema of the file to unwrap unions.
+type converter struct {
+	*Schema
+	fields []field
+}
+
+type field struct {
+	name   string
+	schema interface{}
+	ns     string
+}
+
+func newConverter(schema *Schema, columns []string) (*converter, error) {
+	c := &converter{Schema: schema}
+	def, ok := schema.root.(map[string]interface{})
+	if !ok || def["type"] != "record" {
+		return nil, errors.New("top level schema is not a record")
+	}
+	ns := namespace(def, "")
+	for _, f := range fieldsOf(def) {
+		c.fields = append(c.fields, field{name: f["name"].(string), schema: f["type"], ns: ns})
+	}
+	if len(columns) == 0 {
+		return c, nil
+	}
+	fields := make([]field, 0, len(columns))
+	for _, col := range columns {
+		found := false
+		for _, f := range c.fields {
+			if f.name == col {
+				fields = append(fields, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("column %s is not a field of the schema", col)
+		}
+	}
+	c.fields = fields
+	return c, nil
+}
+
+// record converts the top level record datum.
+func (c *converter) record(datum interface{}) map[string]interface{} {
+	m, _ := datum.(map[string]interface{})
+	rec := make(map[string]interface{}, len(c.fields))
+	for _, f := range c.fields {
+		if v, ok := m[f.name]; ok && v != nil {
+			rec[f.name] = c.convert(f.schema, f.ns, v)
+		}
+	}
+	return rec
+}
+
+// convert converts v, which was decoded with schema in namespace ns.
+func (c *converter) convert(schema interface{}, ns string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch s := schema.(type) {
+	case string:
+		if def, ok := c.named[qualify(s, ns)]; ok {
+			return c.convert(def, ns, v)
+		}
+		return primitive(v)
+	case []interface{}:
+		return c.union(s, ns, v)
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return v
+			}
+			ns = namespace(s, ns)
+			out := make(map[string]interface{}, len(m))
+			for _, f := range fieldsOf(s) {
+				name := f["name"].(string)
+				if fv, ok := m[name]; ok && fv != nil {
+					out[name] = c.convert(f["type"], ns, fv)
+				}
+			}
+			return out
+		case "array":
+			vs, ok := v.([]interface{})
+			if !ok {
+				return v
+			}
+			out := make([]interface{}, len(vs))
+			for i, item := range vs {
+				out[i] = c.convert(s["items"], ns, item)
+			}
+			return out
+		case "map":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return v
+			}
+			out := make(map[string]interface{}, len(m))
+			for k, item := range m {
+				out[k] = c.convert(s["values"], ns, item)
+			}
+			return out
+		default:
+			if t, ok := s["type"].(map[string]interface{}); ok {
+				return c.convert(t, ns, v)
+			}
+			return primitive(v)
+		}
+	}
+	return primitive(v)
+}
+
+// union converts v according to the branch of schema it belongs to.
+func (c *converter) union(schema []interface{}, ns string, v interface{}) interface{} {
+	branch, v, ok := c.branch(schema, ns, v)
+	if !ok {
+		return primitive(v)
+	}
+	return c.convert(branch, ns, v)
+}
+
+// primitive converts the values of logical types which aren't convenient to
+// index.
+func primitive(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case *big.Rat:
+		f, _ := tv.Float64()
+		return f
+	}
+	return v
+}
+
+// branchName returns the name goavro gives to values of a union branch.
+func branchName(branch interface{}, ns string) string {
+	switch b := branch.(type) {
+	case string:
+		return qualify(b, ns)
+	case map[string]interface{}:
+		if _, ok := b["name"].(string); ok {
+			return fullName(b, ns)
+		}
+		t, _ := b["type"].(string)
+		if lt, ok := b["logicalType"].(string); ok {
+			return t + "." + lt
+		}
+		return qualify(t, ns)
+	}
+	return ""
+}
+
+var primitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true,
+	"double": true, "bytes": true, "string": true,
+	"record": true, "enum": true, "array": true, "map": true, "fixed": true,
+}
+
+// qualify returns the full name of the type called name in namespace ns.
+func qualify(name, ns string) string {
+	if primitives[name] || ns == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return ns + "." + name
+}
+
+func fullName(def map[string]interface{}, ns string) string {
+	name, _ := def["name"].(string)
+	if dns, ok := def["namespace"].(string); ok && !strings.Contains(name, ".") {
+		ns = dns
+	}
+	return qualify(name, ns)
+}
+
+// namespace returns the namespace enclosed by the named type def.
+func namespace(def map[string]interface{}, ns string) string {
+	full := fullName(def, ns)
+	if i := strings.LastIndex(full, "."); i >= 0 {
+		return full[:i]
+	}
+	return ""
+}
+
+func fieldsOf(def map[string]interface{}) []map[string]interface{} {
+	fs, _ := def["fields"].([]interface{})
+	fields := make([]map[string]interface{}, 0, len(fs))
+	for _, f := range fs {
+		if fm, ok := f.(map[string]interface{}); ok {
+			if _, ok := fm["name"].(string); ok {
+				fields = append(fields, fm)
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package avro
+
+import (
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro"
+	"github.com/pilosa/pdk/file"
+)
+
+const testSchema = `{
+	"type": "record",
+	"name": "Event",
+	"namespace": "com.example",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "name", "type": ["null", "string"]},
+		{"name": "at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "day", "type": ["null", {"type": "int", "logicalType": "date"}]},
+		{"name": "price", "type": {"type": "bytes", "logicalType": "decimal", "precision": 9, "scale": 2}},
+		{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["A", "B"]}},
+		{"name": "where", "type": ["null", "string", {"type": "record", "name": "Place", "fields": [
+			{"name": "city", "type": "string"},
+			{"name": "zip", "type": ["null", "int"]}
+		]}]},
+		{"name": "tags", "type": {"type": "array", "items": ["null", "string"]}}
+	]
+}`
+
+func writeOCF(t *testing.T, name string, records []interface{}) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("creating file: %v", err)
+	}
+	defer f.Close()
+	w, err := goavro.NewOCFWriter(goavro.OCFConfig{W: f, Schema: testSchema})
+	if err != nil {
+		t.Fatalf("getting writer: %v", err)
+	}
+	if err := w.Append(records); err != nil {
+		t.Fatalf("appending: %v", err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	d, err := ioutil.TempDir("", "testavrosource")
+	if err != nil {
+		t.Fatalf("getting temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	at := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	day := time.Date(2018, 3, 4, 0, 0, 0, 0, time.UTC)
+	writeOCF(t, filepath.Join(d, "a.avro"), []interface{}{
+		map[string]interface{}{
+			"id":    int64(1),
+			"name":  goavro.Union("string", "first"),
+			"at":    at,
+			"day":   goavro.Union("int.date", day),
+			"price": big.NewRat(1234, 100),
+			"kind":  "B",
+			"where": goavro.Union("com.example.Place", map[string]interface{}{
+				"city": "Austin",
+				"zip":  goavro.Union("int", 78701),
+			}),
+			"tags": []interface{}{goavro.Union("string", "x"), nil},
+		},
+		map[string]interface{}{
+			"id":    int64(2),
+			"name":  nil,
+			"at":    at,
+			"day":   nil,
+			"price": big.NewRat(-5, 1),
+			"kind":  "A",
+			"where": goavro.Union("string", "nowhere"),
+			"tags":  []interface{}{},
+		},
+	})
+
+	rs, err := file.NewRawSource(d)
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	s := NewSourceFromRawSource(rs)
+	exp := []interface{}{
+		map[string]interface{}{
+			"id":    int64(1),
+			"name":  "first",
+			"at":    at,
+			"day":   day,
+			"price": 12.34,
+			"kind":  "B",
+			"where": map[string]interface{}{"city": "Austin", "zip": int32(78701)},
+			"tags":  []interface{}{"x", nil},
+		},
+		map[string]interface{}{
+			"id":    int64(2),
+			"at":    at,
+			"price": -5.0,
+			"kind":  "A",
+			"where": "nowhere",
+			"tags":  []interface{}{},
+		},
+	}
+	for i, e := range exp {
+		rec, err := s.Record()
+		if err != nil {
+			t.Fatalf("getting record %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(rec, e) {
+			t.Fatalf("unexpected record %d:\n%#v\nexp:\n%#v", i, rec, e)
+		}
+	}
+	if _, err := s.Record(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	rs, err = file.NewRawSource(d)
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	s = NewSourceFromRawSource(rs, OptColumns("id", "where"))
+	rec, err := s.Record()
+	if err != nil {
+		t.Fatalf("getting projected record: %v", err)
+	}
+	if exp := (map[string]interface{}{"id": int64(1), "where": exp[0].(map[string]interface{})["where"]}); !reflect.DeepEqual(rec, exp) {
+		t.Fatalf("unexpected projected record: %#v", rec)
+	}
+
+	rs, err = file.NewRawSource(d)
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	s = NewSourceFromRawSource(rs, OptColumns("id", "nope"))
+	if _, err := s.Record(); err == nil {
+		t.Fatal("expected error projecting unknown column")
+	}
+}
@@ -33,6 +33,7 @@
 package s3
 
 import (
+	"context"
 	"log"
 
 	"github.com/pilosa/pdk"
@@ -51,6 +52,9 @@ type Main struct {
 	SubjectAt   string   `help:"Tells the S3 source to add a unique 'subject' key to each record which is the s3 object key + record number."`
 	SubjectPath []string `help:"Path to value in each record that should be mapped to column ID. Blank gets a sequential ID."`
 	Proxy       string   `help:"Bind to this address to proxy and translate requests to Pilosa"`
+	Decimals    []string `help:"Comma separated field:places pairs. Numbers indexed into these int fields keep that many decimal places (they are stored multiplied by 10^places)."`
+	Time        pdk.TimeOptions
+	Types       pdk.FieldTypeOptions
 }
 
 // NewMain gets a new Main with the default configuration.
@@ -69,6 +73,12 @@ func NewMain() *Main {
 
 // Run runs the ingester.
 func (m *Main) Run() error {
+	return m.RunContext(context.Background())
+}
+
+// RunContext works like Run, but stops ingesting once ctx is done, after
+// flushing everything which has already been read.
+func (m *Main) RunContext(ctx context.Context) error {
 	src, err := NewSource(
 		OptSrcBucket(m.Bucket),
 		OptSrcPrefix(m.Prefix),
@@ -93,15 +103,26 @@ func (m *Main) Run() error {
 	mapper := pdk.NewCollapsingMapper()
 	mapper.Framer = &m.Framer
 
-	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, nil, m.BatchSize)
+	mapper.Decimals, err = pdk.ParseDecimals(m.Decimals)
+	if err != nil {
+		return errors.Wrap(err, "parsing decimals")
+	}
+	m.Types.Setup(mapper)
+	pilosaOpts, err := m.Time.Setup(parser, mapper)
+	if err != nil {
+		return errors.Wrap(err, "configuring timestamps")
+	}
+	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, nil, m.BatchSize, pilosaOpts...)
 	if err != nil {
 		return errors.Wrap(err, "setting up Pilosa")
 	}
 	ingester := pdk.NewIngester(src, parser, mapper, indexer)
 
+	fwd := pdk.NewPilosaForwarder(m.PilosaHosts[0], mapper.Translator)
+	fwd.SetDecimals(mapper.Decimals)
 	go func() {
-		err = pdk.StartMappingProxy(m.Proxy, pdk.NewPilosaForwarder(m.PilosaHosts[0], mapper.Translator))
+		err = pdk.StartMappingProxy(m.Proxy, fwd)
 		log.Fatal(errors.Wrap(err, "starting mapping proxy"))
 	}()
-	return errors.Wrap(ingester.Run(), "running ingester")
+	return errors.Wrap(ingester.RunContext(ctx), "running ingester")
 }
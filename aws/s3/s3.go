@@ -33,6 +33,7 @@
 package s3
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync/atomic"
@@ -42,6 +43,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pilosa/pdk"
 	"github.com/pilosa/pdk/json"
+	"github.com/pilosa/pdk/unpack"
 	"github.com/pkg/errors"
 )
 
@@ -71,7 +73,8 @@ func OptSrcBufSize(bufsize int) SrcOption {
 }
 
 // OptSrcSubjectAt tells the source to add a new key to each record whose value
-// will be <S3 bucket>.<S3 object key>#<record number>.
+// will be <S3 bucket>.<S3 object key>#<record number>. The key of a file in an
+// archive is <S3 object key>/<member name>.
 func OptSrcSubjectAt(key string) SrcOption {
 	return func(s *Source) {
 		s.subjectAt = key
@@ -86,13 +89,15 @@ func OptSrcPrefix(prefix string) SrcOption {
 	}
 }
 
-// Source is a pdk.Source which reads data from S3.
+// Source is a pdk.Source which reads data from S3. Objects compressed with
+// gzip, bzip2, zstd or xz are decompressed, and each file in a tar or zip
+// archive is read in turn.
 type Source struct {
 	bucket string
 	prefix string
 	region string
 
-	rs        *RawSource
+	rs        pdk.RawSource
 	subjectAt string
 
 	s3      *s3.S3
@@ -115,10 +120,11 @@ func NewSource(opts ...SrcOption) (s *Source, err error) {
 	for _, opt := range opts {
 		opt(s)
 	}
-	s.rs, err = NewRawSource(s.region, s.bucket, s.prefix)
+	rs, err := NewRawSource(s.region, s.bucket, s.prefix)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting raw s3 source")
 	}
+	s.rs = unpack.NewRawSource(rs)
 
 	go s.populateRecords()
 
@@ -146,6 +152,7 @@ func (s *Source) populateRecords() {
 			}
 			s.records <- res
 		}
+		reader.Close()
 	}
 	if err != io.EOF {
 		s.errors <- errors.Wrap(err, "getting next object")
@@ -158,8 +165,16 @@ func (s *Source) populateRecords() {
 // moves to the next file and parses and returns the first json object. A
 // map[string]interface{} will be returned unless there is an error.
 func (s *Source) Record() (rec interface{}, err error) {
+	return s.RecordContext(context.Background())
+}
+
+// RecordContext works like Record, but returns ctx.Err() if ctx is done before
+// a record is available.
+func (s *Source) RecordContext(ctx context.Context) (rec interface{}, err error) {
 	var ok bool
 	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case rec, ok = <-s.records:
 		if ok {
 			return rec, nil
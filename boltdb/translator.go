@@ -139,24 +139,131 @@ func (bt *Translator) Get(field string, id uint64) (val interface{}) {
 	return val
 }
 
-// GetID maps val (which must be a byte slice) to a monotonic id.
-func (bt *Translator) GetID(field string, val interface{}) (id uint64, err error) {
-	// ensure field existence
+// ensureField adds field if it doesn't exist yet.
+func (bt *Translator) ensureField(field string) error {
+	bt.fmu.RLock()
+	_, ok := bt.fields[field]
+	bt.fmu.RUnlock()
+	if ok {
+		return nil
+	}
+	return bt.Db.Update(func(tx *bolt.Tx) error {
+		ib := tx.Bucket(idBucket)
+		vb := tx.Bucket(valBucket)
+		_, _, err := bt.addField(ib, vb, field)
+		return err
+	})
+}
+
+// GetMany returns the values previously mapped to each of ids, reading them all
+// in one transaction. Unlike Get, it returns an error for an unknown field, and
+// for ids which aren't mapped.
+func (bt *Translator) GetMany(field string, ids []uint64) (vals []interface{}, err error) {
 	bt.fmu.RLock()
 	_, ok := bt.fields[field]
 	bt.fmu.RUnlock()
 	if !ok {
-		err = bt.Db.Update(func(tx *bolt.Tx) error {
-			ib := tx.Bucket(idBucket)
-			vb := tx.Bucket(valBucket)
-			_, _, err := bt.addField(ib, vb, field)
-			return err
-		})
-		if err != nil {
-			return 0, errors.Wrap(err, "adding fields in GetID")
+		return nil, errors.Errorf("can't GetMany() with unknown field '%v'", field)
+	}
+	vals = make([]interface{}, len(ids))
+	err = bt.Db.View(func(tx *bolt.Tx) error {
+		fib := tx.Bucket(idBucket).Bucket([]byte(field))
+		idBytes := make([]byte, 8)
+		for i, id := range ids {
+			binary.BigEndian.PutUint64(idBytes, id)
+			val := fib.Get(idBytes)
+			if val == nil {
+				return errors.Errorf("id %d not found in field '%v'", id, field)
+			}
+			// bolt's values are only valid for the life of the transaction
+			vals[i] = append([]byte(nil), val...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// GetIDs maps each of vals (which must be byte slices) to a monotonic id. The
+// existing mappings are read in one transaction, and the values which aren't
+// mapped yet are all allocated ids in one more.
+func (bt *Translator) GetIDs(field string, vals []interface{}) (ids []uint64, err error) {
+	if err = bt.ensureField(field); err != nil {
+		return nil, errors.Wrap(err, "adding fields in GetIDs")
+	}
+	bsvals := make([][]byte, len(vals))
+	for i, val := range vals {
+		var ok bool
+		if bsvals[i], ok = val.([]byte); !ok {
+			return nil, errors.Errorf("val %v of type %T for field %v not supported by BoltTranslator - must be a []byte. ", val, val, field)
 		}
 	}
 
+	// look up the vals which are already mapped to ids
+	ids = make([]uint64, len(vals))
+	missing := make([]int, 0)
+	err = bt.Db.View(func(tx *bolt.Tx) error {
+		fvb := tx.Bucket(valBucket).Bucket([]byte(field))
+		for i, bsval := range bsvals {
+			if ret := fvb.Get(bsval); len(ret) == 8 {
+				ids[i] = binary.BigEndian.Uint64(ret)
+			} else {
+				missing = append(missing, i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up ids")
+	}
+	if len(missing) == 0 {
+		return ids, nil
+	}
+
+	// get new ids, and map them in both directions. The vals are checked again
+	// since they may have been mapped concurrently, or earlier in the batch.
+	err = bt.Db.Batch(func(tx *bolt.Tx) error {
+		fib := tx.Bucket(idBucket).Bucket([]byte(field))
+		fvb := tx.Bucket(valBucket).Bucket([]byte(field))
+		for _, i := range missing {
+			if ret := fvb.Get(bsvals[i]); len(ret) == 8 {
+				ids[i] = binary.BigEndian.Uint64(ret)
+				continue
+			}
+			id, err := fib.NextSequence()
+			if err != nil {
+				return err
+			}
+			keybytes := make([]byte, 8)
+			binary.BigEndian.PutUint64(keybytes, id)
+			err = fib.Put(keybytes, bsvals[i])
+			if err != nil {
+				return errors.Wrap(err, "inserting into idKey bucket")
+			}
+			err = fvb.Put(bsvals[i], keybytes)
+			if err != nil {
+				return errors.Wrap(err, "inserting into valKey bucket")
+			}
+			ids[i] = id
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// GetID maps val (which must be a byte slice) to a monotonic id.
+func (bt *Translator) GetID(field string, val interface{}) (id uint64, err error) {
+	// ensure field existence
+	err = bt.ensureField(field)
+	if err != nil {
+		return 0, errors.Wrap(err, "adding fields in GetID")
+	}
+
 	// check that val is of a supported type
 	bsval, ok := val.([]byte)
 	if !ok {
@@ -105,6 +105,51 @@ func TestBoltTranslator(t *testing.T) {
 	}
 }
 
+func TestBoltTranslatorBatch(t *testing.T) {
+	bt, err := NewTranslator(tempFileName(t), "f1")
+	if err != nil {
+		t.Fatalf("couldn't get bolt db: %v", err)
+	}
+	defer bt.Close()
+	id, err := bt.GetID("f1", []byte("a"))
+	if err != nil {
+		t.Fatalf("couldn't get id for a: %v", err)
+	}
+
+	ids, err := bt.GetIDs("f1", []interface{}{[]byte("b"), []byte("a"), []byte("c"), []byte("b")})
+	if err != nil {
+		t.Fatalf("getting ids: %v", err)
+	}
+	if ids[1] != id || ids[0] != ids[3] || ids[0] == ids[2] || ids[0] == id || ids[2] == id {
+		t.Fatalf("unexpected ids for b, a, c, b: %v (a is %v)", ids, id)
+	}
+
+	vals, err := bt.GetMany("f1", []uint64{ids[2], ids[1], ids[0]})
+	if err != nil {
+		t.Fatalf("getting values: %v", err)
+	}
+	for i, exp := range []string{"c", "a", "b"} {
+		if !bytes.Equal(vals[i].([]byte), []byte(exp)) {
+			t.Fatalf("unexpected value %d: %s, expected %s", i, vals[i], exp)
+		}
+	}
+	if _, err = bt.GetMany("f1", []uint64{ids[2] + 1}); err == nil {
+		t.Fatal("expected error getting unknown id")
+	}
+	if _, err = bt.GetMany("f2", []uint64{0}); err == nil {
+		t.Fatal("expected error getting from unknown field")
+	}
+
+	ids, err = bt.GetIDs("f2", []interface{}{[]byte("new")})
+	if err != nil {
+		t.Fatalf("getting ids in new field: %v", err)
+	}
+	vals, err = bt.GetMany("f2", ids)
+	if err != nil || !bytes.Equal(vals[0].([]byte), []byte("new")) {
+		t.Fatalf("unexpected value in new field: %s, %v", vals, err)
+	}
+}
+
 func tempFileName(t *testing.T) string {
 	tf, err := ioutil.TempFile("", "")
 	if err != nil {
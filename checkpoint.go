@@ -0,0 +1,100 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk
+
+import (
+	"sync"
+)
+
+// OffsetTracker helps a CheckpointSource decide what position is safe to
+// persist. Records are returned from one or more ordered streams (files, Kafka
+// partitions, etc.), but may be committed in any order when the Ingester is
+// parsing concurrently. OffsetTracker remembers which offsets have been handed
+// out for each stream, and reports the highest offset below which every record
+// has been committed. It is safe for concurrent use.
+type OffsetTracker struct {
+	mu      sync.Mutex
+	streams map[interface{}]*offsetStream
+}
+
+type offsetStream struct {
+	pending []int64
+	done    map[int64]struct{}
+}
+
+// NewOffsetTracker gets a new OffsetTracker.
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{
+		streams: make(map[interface{}]*offsetStream),
+	}
+}
+
+// Add records that the record at offset in stream has been returned by the
+// source. Offsets must be added in ascending order for each stream, so callers
+// which return records from multiple goroutines must serialize Add with
+// retrieving the record.
+func (t *OffsetTracker) Add(stream interface{}, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.streams[stream]
+	if !ok {
+		s = &offsetStream{done: make(map[int64]struct{})}
+		t.streams[stream] = s
+	}
+	s.pending = append(s.pending, offset)
+}
+
+// Done marks the record at offset in stream as committed. If this allows the
+// stream's committed position to move forward, Done returns the new position
+// (the highest offset such that it and every offset added before it are
+// committed) and true. Otherwise it returns false.
+func (t *OffsetTracker) Done(stream interface{}, offset int64) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.streams[stream]
+	if !ok {
+		return 0, false
+	}
+	s.done[offset] = struct{}{}
+	var low int64
+	var advanced bool
+	for len(s.pending) > 0 {
+		if _, ok := s.done[s.pending[0]]; !ok {
+			break
+		}
+		low, advanced = s.pending[0], true
+		delete(s.done, s.pending[0])
+		s.pending = s.pending[1:]
+	}
+	return low, advanced
+}
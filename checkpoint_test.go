@@ -0,0 +1,67 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk_test
+
+import (
+	"testing"
+
+	"github.com/pilosa/pdk"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	tr := pdk.NewOffsetTracker()
+	for _, off := range []int64{3, 4, 7, 8} {
+		tr.Add("a", off)
+	}
+	tr.Add("b", 0)
+
+	tests := []struct {
+		stream  string
+		offset  int64
+		exp     int64
+		advance bool
+	}{
+		{stream: "a", offset: 4, advance: false},
+		{stream: "b", offset: 0, exp: 0, advance: true},
+		{stream: "a", offset: 3, exp: 4, advance: true},
+		{stream: "a", offset: 8, advance: false},
+		{stream: "a", offset: 7, exp: 8, advance: true},
+		{stream: "c", offset: 1, advance: false},
+	}
+	for i, test := range tests {
+		off, ok := tr.Done(test.stream, test.offset)
+		if ok != test.advance || off != test.exp {
+			t.Errorf("test %d: expected %d/%v, got %d/%v", i, test.exp, test.advance, off, ok)
+		}
+	}
+}
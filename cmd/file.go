@@ -21,13 +21,16 @@ func NewFileCommand(stdin io.Reader, stdout, stderr io.Writer) *cobra.Command {
 		Use:   "file",
 		Short: "Index line separated json from objects from a file or all files in a directory.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
 			start := time.Now()
-			err = FileMain.Run()
+			err = FileMain.RunContext(ctx)
 			if err != nil {
 				return err
 			}
 			log.Println("Done: ", time.Since(start))
-			select {}
+			<-ctx.Done()
+			return nil
 		},
 	}
 	flags := fileCommand.Flags()
@@ -21,13 +21,16 @@ func NewGenCommand(stdin io.Reader, stdout, stderr io.Writer) *cobra.Command {
 		Use:   "gen",
 		Short: "Generate and index fake event data.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
 			start := time.Now()
-			err = GenMain.Run()
+			err = GenMain.RunContext(ctx)
 			if err != nil {
 				return err
 			}
 			log.Println("Done: ", time.Since(start))
-			select {}
+			<-ctx.Done()
+			return nil
 		},
 	}
 	flags := genCommand.Flags()
@@ -42,10 +42,16 @@ import (
 
 // NewHTTPCommand returns a new cobra command which wraps http.Main
 func NewHTTPCommand(stdin io.Reader, stdout, stderr io.Writer) *cobra.Command {
-	com, err := cobrafy.Command(http.NewMain())
+	main := http.NewMain()
+	com, err := cobrafy.Command(main)
 	if err != nil {
 		panic(err)
 	}
+	com.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signalContext()
+		defer cancel()
+		return main.RunContext(ctx)
+	}
 	com.Use = `http`
 	com.Short = `listens for and indexes arbitrary JSON data in Pilosa`
 	com.Long = `
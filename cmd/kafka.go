@@ -54,13 +54,16 @@ func NewKafkaCommand(stdin io.Reader, stdout, stderr io.Writer) *cobra.Command {
 		Use:   "kafka",
 		Short: "Index data from kafka in Pilosa.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
 			start := time.Now()
-			err = KafkaMain.Run()
+			err = KafkaMain.RunContext(ctx)
 			if err != nil {
 				return err
 			}
 			log.Println("Done: ", time.Since(start))
-			select {}
+			<-ctx.Done()
+			return nil
 		},
 	}
 	flags := kafkaCommand.Flags()
@@ -35,8 +35,6 @@ package cmd
 import (
 	"fmt"
 	"io"
-	"os"
-	"os/signal"
 
 	"github.com/jaffee/commandeer"
 	"github.com/pilosa/pdk/kafka"
@@ -63,18 +61,20 @@ stdout.
 			if err != nil {
 				return err
 			}
-			signals := make(chan os.Signal, 1)
-			signal.Notify(signals, os.Interrupt)
-			go func() {
-				<-signals
+			defer func() {
 				err := KafkaSource.Close()
 				if err != nil {
 					fmt.Fprintf(stderr, "closing kafka source: %v", err)
 				}
 			}()
+			ctx, cancel := signalContext()
+			defer cancel()
 			for {
-				rec, err := KafkaSource.Record()
+				rec, err := KafkaSource.RecordContext(ctx)
 				if err != nil {
+					if ctx.Err() != nil {
+						return nil // interrupted
+					}
 					return err
 				}
 				fmt.Fprintf(stdout, "record: %v\n", rec)
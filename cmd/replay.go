@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/jaffee/commandeer"
+	"github.com/pilosa/pdk/file"
+	"github.com/spf13/cobra"
+)
+
+// ReplayMain is wrapped by NewReplayCommand and only exported for testing
+// purposes.
+var ReplayMain *file.ReplayMain
+
+// NewReplayCommand returns a new cobra command wrapping ReplayMain.
+func NewReplayCommand(stdin io.Reader, stdout, stderr io.Writer) *cobra.Command {
+	var err error
+	ReplayMain = file.NewReplayMain()
+	replayCommand := &cobra.Command{
+		Use:   "replay",
+		Short: "Index the records in a dead letter file written by a previous ingest.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+			start := time.Now()
+			err = ReplayMain.RunContext(ctx)
+			if err != nil {
+				return err
+			}
+			log.Println("Done: ", time.Since(start))
+			return nil
+		},
+	}
+	flags := replayCommand.Flags()
+	err = commandeer.Flags(flags, ReplayMain)
+	if err != nil {
+		panic(err)
+	}
+	return replayCommand
+}
+
+func init() {
+	subcommandFns["replay"] = NewReplayCommand
+}
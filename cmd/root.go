@@ -33,9 +33,14 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -85,6 +90,26 @@ Build Time: ` + BuildTime + "\n",
 	return rc
 }
 
+// signalContext returns a context which is cancelled when the process receives
+// SIGINT or SIGTERM, so that a subcommand can stop ingesting and flush what it
+// has already read before exiting. Once the context is cancelled the signal
+// handler is removed, so a second signal kills the process immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %v, shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
 // setAllConfig takes a FlagSet to be the definition of all configuration
 // options, as well as their defaults. It then reads from the command line, the
 // environment, and a config file (if specified), and applies the configuration
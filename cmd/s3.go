@@ -53,13 +53,16 @@ func NewS3Command(stdin io.Reader, stdout, stderr io.Writer) *cobra.Command {
 		Use:   "s3",
 		Short: "Index line separated json from objects in an S3 bucket.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
 			start := time.Now()
-			err = S3Main.Run()
+			err = S3Main.RunContext(ctx)
 			if err != nil {
 				return err
 			}
 			log.Println("Done: ", time.Since(start))
-			select {}
+			<-ctx.Done()
+			return nil
 		},
 	}
 	flags := s3Command.Flags()
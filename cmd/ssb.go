@@ -61,7 +61,10 @@ func NewSSBCommand(stdin io.Reader, stdout, stderr io.Writer) *cobra.Command {
 				return err
 			}
 			log.Println("Done: ", time.Since(start))
-			select {}
+			ctx, cancel := signalContext()
+			defer cancel()
+			<-ctx.Done()
+			return nil
 		},
 	}
 	if err != nil {
@@ -0,0 +1,477 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package csv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// NoQuote may be used as Format.Quote to read files whose fields are never
+// quoted.
+const NoQuote rune = -1
+
+// Format describes the dialect of a CSV file and how its values are decoded.
+// The zero value reads RFC 4180 files with a header line, and decodes every
+// value as a string.
+type Format struct {
+	// Delimiter separates fields. It defaults to ','.
+	Delimiter rune
+
+	// Quote encloses fields which contain the delimiter, the quote or a line
+	// break. A quote within a quoted field is written twice. It defaults to
+	// '"'.
+	Quote rune
+
+	// Comment, if set, marks lines which are skipped when it is their first
+	// character.
+	Comment rune
+
+	// Header names the columns of files which have no header line. If it is
+	// empty, the first record of each file is its header.
+	Header []string
+
+	// Types decodes the named columns as the given type. A value which can't be
+	// decoded fails its record.
+	Types map[string]Type
+
+	// Infer decodes each column not in Types as the type of its first
+	// non-empty value. A later value which isn't of the inferred type widens
+	// the column: an int column becomes a float column for a float, and any
+	// column becomes a string column otherwise. Values decoded before are
+	// left as they were. Leading zeros (as in zip codes) keep a number a
+	// string.
+	Infer bool
+
+	// TimeLayouts are tried in order to decode time columns. They default to
+	// RFC 3339 with or without a "T" and time zone, and bare dates.
+	TimeLayouts []string
+}
+
+// Type is the type a column's values are decoded as.
+type Type string
+
+// Types which a column may be decoded as. Values are decoded as string,
+// int64, float64, bool and time.Time respectively.
+const (
+	TypeString Type = "string"
+	TypeInt    Type = "int"
+	TypeFloat  Type = "float"
+	TypeBool   Type = "bool"
+	TypeTime   Type = "time"
+)
+
+var defaultTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func (f Format) delimiter() rune {
+	if f.Delimiter == 0 {
+		return ','
+	}
+	return f.Delimiter
+}
+
+func (f Format) quote() rune {
+	if f.Quote == 0 {
+		return '"'
+	}
+	return f.Quote
+}
+
+func (f Format) typed() bool {
+	return f.Infer || len(f.Types) > 0
+}
+
+func (f Format) validate() error {
+	d, q := f.delimiter(), f.quote()
+	if !validRune(d) {
+		return errors.Errorf("invalid delimiter %q", d)
+	}
+	if q != NoQuote && !validRune(q) {
+		return errors.Errorf("invalid quote %q", q)
+	}
+	if f.Comment != 0 && !validRune(f.Comment) {
+		return errors.Errorf("invalid comment %q", f.Comment)
+	}
+	if d == q || d == f.Comment || q == f.Comment {
+		return errors.Errorf("delimiter %q, quote %q and comment %q must differ", d, q, f.Comment)
+	}
+	for col, typ := range f.Types {
+		switch typ {
+		case TypeString, TypeInt, TypeFloat, TypeBool, TypeTime:
+		default:
+			return errors.Errorf("unknown type %q for column %s", typ, col)
+		}
+	}
+	return nil
+}
+
+func validRune(r rune) bool {
+	return r > 0 && r != '\r' && r != '\n' && utf8.ValidRune(r) && r != utf8.RuneError
+}
+
+// ParseError is returned for a record which can't be parsed or decoded.
+// Reading may continue with the next record.
+type ParseError struct {
+	Line int // line on which the record starts
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// HeaderError is returned for a file whose header is invalid. Nothing more can
+// be read from the file.
+type HeaderError struct {
+	Header []string
+	Err    error
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("invalid header %v: %v", e.Header, e.Err)
+}
+
+// Reader reads records from a CSV file. Unlike encoding/csv it allows any quote
+// character, and records may have differing numbers of fields. Blank lines are
+// skipped.
+type Reader struct {
+	f     Format
+	r     *bufio.Reader
+	line  int
+	start int
+}
+
+// NewReader returns a Reader which reads records in the Format f from r.
+func NewReader(r io.Reader, f Format) *Reader {
+	return &Reader{
+		f: f,
+		r: bufio.NewReader(r),
+	}
+}
+
+// Line returns the line on which the last record read started.
+func (r *Reader) Line() int {
+	return r.start
+}
+
+// Read returns the fields of the next record. It returns a *ParseError for a
+// malformed record, after which reading may continue, and io.EOF at the end of
+// the file.
+func (r *Reader) Read() ([]string, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		r.start = r.line
+		if r.f.Comment != 0 && strings.HasPrefix(line, string(r.f.Comment)) {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue // skip empty lines. TODO: add stats tracking
+		}
+		return r.parse(line)
+	}
+}
+
+// readLine returns the next line without its line ending. A final line with no
+// line ending is returned without error.
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	r.line++
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+func (r *Reader) parse(line string) ([]string, error) {
+	delim, quote := string(r.f.delimiter()), string(r.f.quote())
+	fields := make([]string, 0, 8)
+	for {
+		if r.f.quote() == NoQuote || !strings.HasPrefix(line, quote) {
+			i := strings.Index(line, delim)
+			if i < 0 {
+				return append(fields, line), nil
+			}
+			fields = append(fields, line[:i])
+			line = line[i+len(delim):]
+			continue
+		}
+
+		line = line[len(quote):]
+		var field strings.Builder
+		for {
+			i := strings.Index(line, quote)
+			if i < 0 {
+				// the field continues on the next line
+				field.WriteString(line)
+				field.WriteByte('\n')
+				next, err := r.readLine()
+				if err == io.EOF {
+					return nil, &ParseError{Line: r.start, Err: errors.New("quoted field is never closed")}
+				} else if err != nil {
+					return nil, err
+				}
+				line = next
+				continue
+			}
+			field.WriteString(line[:i])
+			line = line[i+len(quote):]
+			if !strings.HasPrefix(line, quote) {
+				break
+			}
+			field.WriteString(quote)
+			line = line[len(quote):]
+		}
+		fields = append(fields, field.String())
+		if line == "" {
+			return fields, nil
+		}
+		if !strings.HasPrefix(line, delim) {
+			return nil, &ParseError{Line: r.line, Err: errors.Errorf("unexpected %q after quoted field", line)}
+		}
+		line = line[len(delim):]
+	}
+}
+
+// Decoder reads the records of a CSV file as maps from column names to values.
+type Decoder struct {
+	f      Format
+	r      *Reader
+	header []string
+	types  []Type
+}
+
+// NewDecoder returns a Decoder which reads records in the Format f from r.
+func NewDecoder(r io.Reader, f Format) *Decoder {
+	return &Decoder{
+		f: f,
+		r: NewReader(r, f),
+	}
+}
+
+// Line returns the line on which the last record decoded started.
+func (d *Decoder) Line() int {
+	return d.r.Line()
+}
+
+// Header returns the names of the columns, reading them from the first record
+// if the Format has no Header. It returns a *HeaderError if they are invalid.
+func (d *Decoder) Header() ([]string, error) {
+	if d.header != nil {
+		return d.header, nil
+	}
+	if err := d.f.validate(); err != nil {
+		return nil, errors.Wrap(err, "validating format")
+	}
+	header := d.f.Header
+	if len(header) == 0 {
+		var err error
+		header, err = d.r.Read()
+		if perr, ok := err.(*ParseError); ok {
+			return nil, &HeaderError{Err: perr}
+		} else if err == io.EOF {
+			return nil, err
+		} else if err != nil {
+			return nil, errors.Wrap(err, "reading header")
+		}
+	}
+	if err := validateHeader(header); err != nil {
+		return nil, &HeaderError{Header: header, Err: err}
+	}
+	d.header = header
+	if d.f.typed() {
+		d.types = make([]Type, len(header))
+		for i, h := range header {
+			d.types[i] = d.f.Types[h]
+		}
+	}
+	return header, nil
+}
+
+// Decode returns the next record. It is a map[string]string if the Format
+// neither infers nor declares Types, and a map[string]interface{} otherwise.
+// Empty values are left out. Decode returns a *ParseError for a record which
+// can't be decoded, after which decoding may continue, and io.EOF at the end
+// of the file.
+func (d *Decoder) Decode() (interface{}, error) {
+	header, err := d.Header()
+	if err != nil {
+		return nil, err
+	}
+	row, err := d.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > len(row) {
+		return nil, &ParseError{Line: d.Line(), Err: errors.Errorf("header/row len mismatch: %dvs%d, %v and %v", len(header), len(row), header, row)}
+	}
+	for i := len(header); i < len(row); i++ {
+		if strings.TrimSpace(row[i]) != "" {
+			log.Printf("data in non headered field: %v, %d", row, i)
+		}
+	}
+	if !d.f.typed() {
+		ret := make(map[string]string, len(header))
+		for i, h := range header {
+			if row[i] == "" {
+				continue
+			}
+			ret[h] = row[i]
+		}
+		return ret, nil
+	}
+
+	ret := make(map[string]interface{}, len(header))
+	for i, h := range header {
+		if row[i] == "" {
+			continue
+		}
+		if d.types[i] == "" {
+			if !d.f.Infer {
+				ret[h] = row[i]
+				continue
+			}
+			d.types[i] = d.infer(row[i])
+		}
+		val, err := d.decode(d.types[i], row[i])
+		if err != nil {
+			if _, ok := d.f.Types[h]; ok {
+				return nil, &ParseError{Line: d.Line(), Err: errors.Wrapf(err, "decoding %s", h)}
+			}
+			d.types[i] = d.widen(d.types[i], row[i])
+			if val, err = d.decode(d.types[i], row[i]); err != nil {
+				val = row[i]
+			}
+		}
+		ret[h] = val
+	}
+	return ret, nil
+}
+
+// infer returns the narrowest type which v may be decoded as.
+func (d *Decoder) infer(v string) Type {
+	if isNumber(v) {
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return TypeInt
+		}
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return TypeFloat
+		}
+	}
+	if strings.EqualFold(v, "true") || strings.EqualFold(v, "false") {
+		return TypeBool
+	}
+	if _, err := d.decode(TypeTime, v); err == nil {
+		return TypeTime
+	}
+	return TypeString
+}
+
+// widen returns the type which a column inferred as typ becomes for v, which
+// typ can't decode.
+func (d *Decoder) widen(typ Type, v string) Type {
+	if typ == TypeInt && d.infer(v) == TypeFloat {
+		return TypeFloat
+	}
+	return TypeString
+}
+
+// isNumber reports whether v looks like a number which is safe to decode as
+// one. Words like "Inf" and "NaN", and numbers with leading zeros, are not.
+func isNumber(v string) bool {
+	digits := strings.TrimLeft(v, "+-")
+	if digits == "" || (digits[0] < '0' || digits[0] > '9') && digits[0] != '.' {
+		return false
+	}
+	return !(len(digits) > 1 && digits[0] == '0' && digits[1] != '.')
+}
+
+func (d *Decoder) decode(typ Type, v string) (interface{}, error) {
+	switch typ {
+	case TypeInt:
+		return strconv.ParseInt(v, 10, 64)
+	case TypeFloat:
+		return strconv.ParseFloat(v, 64)
+	case TypeBool:
+		return strconv.ParseBool(v)
+	case TypeTime:
+		layouts := d.f.TimeLayouts
+		if len(layouts) == 0 {
+			layouts = defaultTimeLayouts
+		}
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		return nil, errors.Errorf("time %q matches none of %v", v, layouts)
+	default:
+		return v, nil
+	}
+}
+
+func validateHeader(header []string) error {
+	fields := make(map[string]int)
+	for i, h := range header {
+		if h == "" {
+			return errors.Errorf("header contains empty string at %d: %v", i, header)
+		}
+		if h == "," {
+			return errors.Errorf("header contains reserved name \",\" at %d: %v", i, header)
+		}
+		if pos, exists := fields[h]; exists {
+			return errors.Errorf("%s appeared at both %d and %d in header", h, pos, i)
+		}
+		fields[h] = i
+	}
+	return nil
+}
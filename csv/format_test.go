@@ -0,0 +1,235 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package csv_test
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pilosa/pdk/csv"
+)
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		format csv.Format
+		input  string
+		exp    [][]string
+		lines  []int
+	}{
+		{
+			name:  "quoted",
+			input: "a,\"b,c\",\"say \"\"hi\"\"\"\r\n\"\",x,\n",
+			exp:   [][]string{{"a", "b,c", `say "hi"`}, {"", "x", ""}},
+			lines: []int{1, 2},
+		},
+		{
+			name:  "embedded newline",
+			input: "1,\"two\nlines\"\n\n3,4",
+			exp:   [][]string{{"1", "two\nlines"}, {"3", "4"}},
+			lines: []int{1, 4},
+		},
+		{
+			name:   "tsv",
+			format: csv.Format{Delimiter: '\t'},
+			input:  "a,b\tc\n",
+			exp:    [][]string{{"a,b", "c"}},
+			lines:  []int{1},
+		},
+		{
+			name:   "pipe and single quotes",
+			format: csv.Format{Delimiter: '|', Quote: '\''},
+			input:  "'a|b'|\"c\"\n",
+			exp:    [][]string{{"a|b", `"c"`}},
+			lines:  []int{1},
+		},
+		{
+			name:   "no quote",
+			format: csv.Format{Quote: csv.NoQuote},
+			input:  "\"a,b\"\n",
+			exp:    [][]string{{`"a`, `b"`}},
+			lines:  []int{1},
+		},
+		{
+			name:   "comments",
+			format: csv.Format{Comment: '#'},
+			input:  "# header comment\na,b\n#c,d\n",
+			exp:    [][]string{{"a", "b"}},
+			lines:  []int{2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := csv.NewReader(strings.NewReader(test.input), test.format)
+			var recs [][]string
+			var lines []int
+			for {
+				rec, err := r.Read()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("reading: %v", err)
+				}
+				recs = append(recs, rec)
+				lines = append(lines, r.Line())
+			}
+			if !reflect.DeepEqual(recs, test.exp) {
+				t.Errorf("unexpected records: %q", recs)
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("unexpected lines: %v", lines)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	r := csv.NewReader(strings.NewReader("\"a\"b,c\nd,e\n\"f\n"), csv.Format{})
+	if _, err := r.Read(); err == nil {
+		t.Fatalf("expected error for text after quoted field")
+	} else if perr, ok := err.(*csv.ParseError); !ok || perr.Line != 1 {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if rec, err := r.Read(); err != nil || !reflect.DeepEqual(rec, []string{"d", "e"}) {
+		t.Fatalf("reading after error: %v, %v", rec, err)
+	}
+	if _, err := r.Read(); err == nil {
+		t.Fatalf("expected error for unterminated quote")
+	} else if perr, ok := err.(*csv.ParseError); !ok || perr.Line != 3 {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	ts := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name   string
+		format csv.Format
+		input  string
+		exp    []interface{}
+		err    bool
+	}{
+		{
+			name:  "strings",
+			input: "a,b\n1,\n",
+			exp:   []interface{}{map[string]string{"a": "1"}},
+		},
+		{
+			name:   "no header line",
+			format: csv.Format{Header: []string{"x", "y"}},
+			input:  "1,2\n",
+			exp:    []interface{}{map[string]string{"x": "1", "y": "2"}},
+		},
+		{
+			name:   "infer",
+			format: csv.Format{Infer: true},
+			input: "i,f,b,t,s,zip,e\n" +
+				"-3,1.5,true,2019-03-04T05:06:07Z,hi,01234,\n" +
+				"4,2,False,2019-03-04 05:06:07,5,12345,7\n" +
+				"x,,,,,,8\n",
+			exp: []interface{}{
+				map[string]interface{}{"i": int64(-3), "f": 1.5, "b": true, "t": ts, "s": "hi", "zip": "01234"},
+				map[string]interface{}{"i": int64(4), "f": 2.0, "b": false, "t": ts, "s": "5", "zip": "12345", "e": int64(7)},
+				map[string]interface{}{"i": "x", "e": int64(8)},
+			},
+		},
+		{
+			name:   "infer mixed",
+			format: csv.Format{Infer: true},
+			input:  "n,b\n1,true\n2.5,yes\n3,false\nabc,\n4,\n",
+			exp: []interface{}{
+				map[string]interface{}{"n": int64(1), "b": true},
+				map[string]interface{}{"n": 2.5, "b": "yes"},
+				map[string]interface{}{"n": 3.0, "b": "false"},
+				map[string]interface{}{"n": "abc"},
+				map[string]interface{}{"n": "4"},
+			},
+		},
+		{
+			name:   "types",
+			format: csv.Format{Types: map[string]csv.Type{"a": csv.TypeFloat, "d": csv.TypeTime}, TimeLayouts: []string{"01/02/2006"}},
+			input:  "a,b,d\n1,2,03/04/2019\n",
+			exp:    []interface{}{map[string]interface{}{"a": 1.0, "b": "2", "d": time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC)}},
+		},
+		{
+			name:   "bad typed value",
+			format: csv.Format{Types: map[string]csv.Type{"a": csv.TypeInt}},
+			input:  "a\nx\n",
+			err:    true,
+		},
+		{
+			name:  "short row",
+			input: "a,b\n1\n",
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dec := csv.NewDecoder(strings.NewReader(test.input), test.format)
+			var recs []interface{}
+			for {
+				rec, err := dec.Decode()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					if _, ok := err.(*csv.ParseError); !test.err || !ok {
+						t.Fatalf("decoding: %v", err)
+					}
+					return
+				}
+				recs = append(recs, rec)
+			}
+			if test.err {
+				t.Fatalf("expected error, got %v", recs)
+			}
+			if !reflect.DeepEqual(recs, test.exp) {
+				t.Errorf("unexpected records:\n%#v\nexp:\n%#v", recs, test.exp)
+			}
+		})
+	}
+}
+
+func TestDecoderHeaderError(t *testing.T) {
+	dec := csv.NewDecoder(strings.NewReader("a,a\n1,2\n"), csv.Format{})
+	if _, err := dec.Decode(); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*csv.HeaderError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
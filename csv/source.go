@@ -33,10 +33,8 @@
 package csv
 
 import (
-	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -45,10 +43,10 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Source satisfies the PDK.Source interface for CSV data. Each line in a CSV
-// file will be returned by a call to record as a map[string]string where the
-// keys are taken from the first line of the CSV. Source is safe for concurrent
-// use.
+// Source satisfies the PDK.Source interface for CSV data. Each record in a CSV
+// file will be returned by a call to Record as a map[string]string where the
+// keys are taken from the first line of the CSV (see WithFormat for other
+// dialects and typed values). Source is safe for concurrent use.
 //
 // The Source takes care of retrying failed reads/downloads and making sure not
 // to return duplicate data. TODO: this functionality needs more testing.
@@ -56,6 +54,7 @@ type Source struct {
 	files       []*file
 	maxRetries  int
 	concurrency int
+	format      Format
 
 	records chan record
 }
@@ -125,10 +124,18 @@ func WithConcurrency(c int) Option {
 	}
 }
 
+// WithFormat returns an Option which sets the dialect of the CSV files a Source
+// reads, and how their values are decoded.
+func WithFormat(f Format) Option {
+	return func(s *Source) {
+		s.format = f
+	}
+}
+
 // file tracks the use of an OpenStringer.
 type file struct {
 	OpenStringer
-	line int // tracks how many lines of this file we've read.
+	records int // tracks how many records of this file we've read.
 }
 
 // Opener is an interface to a resource which can be repeatedly Opened (and the
@@ -173,8 +180,9 @@ func (u urlOpener) String() string {
 	return string(u)
 }
 
-// Record returns a map[string]string representing a single data line of a
-// CSV file. Each key is taken from the header, and each value is parsed from a
+// Record returns a map[string]string representing a single data record of a
+// CSV file, or a map[string]interface{} if the Source's Format decodes typed
+// values. Each key is taken from the header, and each value is parsed from a
 // row - empty fields are skipped.
 func (c *Source) Record() (interface{}, error) {
 	rec, ok := <-c.records
@@ -185,7 +193,7 @@ func (c *Source) Record() (interface{}, error) {
 }
 
 type record struct {
-	rec map[string]string
+	rec interface{}
 	err error
 }
 
@@ -225,86 +233,49 @@ func (c *Source) getRowTry(file *file) error {
 	if err != nil {
 		return errors.Wrap(err, "opening")
 	}
+	defer content.Close()
 
-	// scan header line
-	scan := bufio.NewScanner(content)
-	var header []string
-	if scan.Scan() && scan.Err() == nil {
-		header = strings.Split(scan.Text(), ",")
-		if err := validateHeader(header); err != nil {
+	dec := NewDecoder(content, c.format)
+	if _, err := dec.Header(); err != nil {
+		if err == io.EOF {
+			return nil // empty file
+		}
+		if _, ok := err.(*HeaderError); ok {
 			c.records <- record{err: errors.Wrapf(err, "validating header of %s", file)}
 			return nil // error is permanent so we don't return to getRows for retry
 		}
-		if file.line == 0 {
-			file.line++
-		}
+		return errors.Wrapf(err, "reading header of '%s'", file)
 	}
-	line := 1
 	// catch up to previous location
-	for line < file.line && scan.Scan() {
-		line++
-	}
-	for scan.Scan() && scan.Err() == nil {
-		txt := scan.Text()
-		if strings.TrimSpace(txt) == "" {
-			continue // skip empty lines. TODO: add stats tracking
-		}
-		row := strings.Split(txt, ",")
-		file.line++
-		recordMap, err := parseRecord(header, row)
-		if err != nil {
-			c.records <- record{
-				err: errors.Wrapf(err, "file %s: parsing line %d", file, file.line),
+	for n := 0; n < file.records; n++ {
+		if _, err := dec.Decode(); err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				return errors.Wrapf(err, "catching up '%s' to record %d", file, file.records)
 			}
-			continue
-		}
-		// add file and line number under the comma header since that can't
-		// be a header from the csv file.
-		recordMap[","] = fmt.Sprintf("%s:line%d", file, file.line)
-		c.records <- record{
-			rec: recordMap,
 		}
 	}
-	return errors.Wrapf(scan.Err(), "scanning '%s', line %d", file, min(line, file.line))
-}
-
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
-func parseRecord(header []string, row []string) (map[string]string, error) {
-	if len(header) > len(row) {
-		return nil, errors.Errorf("header/row len mismatch: %dvs%d, %v and %v", len(header), len(row), header, row)
-	} else if len(row) > len(header) {
-		for i := len(header); i < len(row); i++ {
-			if strings.TrimSpace(row[i]) != "" {
-				log.Printf("data in non headered field: %v, %d", row, i)
+	for {
+		rec, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				return errors.Wrapf(err, "reading '%s', record %d", file, file.records+1)
 			}
-		}
-	}
-	ret := make(map[string]string, len(header))
-	for i := 0; i < len(header); i++ {
-		if row[i] == "" {
+			file.records++
+			c.records <- record{err: errors.Wrapf(err, "file %s: parsing", file)}
 			continue
 		}
-		ret[header[i]] = row[i]
-	}
-	return ret, nil
-}
-
-func validateHeader(header []string) error {
-	fields := make(map[string]int)
-	for i, h := range header {
-		if h == "" {
-			return errors.Errorf("header contains empty string at %d: %v", i, header)
-		}
-		if pos, exists := fields[h]; exists {
-			return errors.Errorf("%s appeared at both %d and %d in header", h, pos, i)
+		file.records++
+		// add file and line number under the comma header since that can't
+		// be a header from the csv file.
+		pos := fmt.Sprintf("%s:line%d", file, dec.Line())
+		switch rec := rec.(type) {
+		case map[string]string:
+			rec[","] = pos
+		case map[string]interface{}:
+			rec[","] = pos
 		}
-		fields[h] = i
+		c.records <- record{rec: rec}
 	}
-	return nil
 }
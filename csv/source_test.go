@@ -346,3 +346,26 @@ func (e *erroringOpenStringer) Read(p []byte) (n int, err error) {
 }
 
 func (e *erroringOpenStringer) Close() error { return nil }
+
+func TestCSVSourceFormat(t *testing.T) {
+	f := MustGetTempFile(t, `id;note;score
+1;"multi
+line; note";2.5
+2;plain;3
+`)
+	src := csv.NewSource(csv.WithURLs([]string{f.Name()}), csv.WithFormat(csv.Format{Delimiter: ';', Infer: true}))
+	var recs []map[string]interface{}
+	for rec, err := src.Record(); err != io.EOF; rec, err = src.Record() {
+		if err != nil {
+			t.Fatalf("getting record: %v", err)
+		}
+		recs = append(recs, rec.(map[string]interface{}))
+	}
+	exp := []map[string]interface{}{
+		{"id": int64(1), "note": "multi\nline; note", "score": 2.5, ",": f.Name() + ":line2"},
+		{"id": int64(2), "note": "plain", "score": 3.0, ",": f.Name() + ":line4"},
+	}
+	if !reflect.DeepEqual(recs, exp) {
+		t.Fatalf("unexpected records:\n%#v\nexp:\n%#v", recs, exp)
+	}
+}
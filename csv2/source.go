@@ -1,22 +1,35 @@
 package csv2
 
 import (
-	"bufio"
 	"io"
-	"log"
-	"strings"
+	"os"
+	"sync"
 
 	"github.com/pilosa/pdk"
+	"github.com/pilosa/pdk/csv"
+	"github.com/pilosa/pdk/file"
 	"github.com/pkg/errors"
 )
 
+// Source reads CSV records from each reader of a RawSource in turn. Records
+// are returned as by csv.Decoder.
 type Source struct {
+	// Format is the dialect of the files, and how their values are decoded. It
+	// must be set before the first call to Record.
+	Format csv.Format
+
+	// Concurrency is the number of readers to read from at once. If it is more
+	// than one, reading a reader stops at its first error. It must be set
+	// before the first call to Record.
+	Concurrency int
+
 	rs pdk.RawSource
 
-	cur    pdk.NamedReadCloser
-	scan   *bufio.Scanner
-	header []string
-	line   int
+	cur pdk.NamedReadCloser
+	dec *csv.Decoder
+
+	once     sync.Once
+	parallel pdk.Source
 }
 
 func NewSourceFromRawSource(rs pdk.RawSource) *Source {
@@ -26,74 +39,71 @@ func NewSourceFromRawSource(rs pdk.RawSource) *Source {
 }
 
 func (s *Source) Record() (record interface{}, err error) {
-	if s.cur == nil {
-		s.cur, err = s.rs.NextReader()
-		if err != nil {
-			return nil, err
-		}
-		// scan header line
-		s.scan = bufio.NewScanner(s.cur)
-		if s.scan.Scan() && s.scan.Err() == nil {
-			s.header = strings.Split(s.scan.Text(), ",")
-			if err := validateHeader(s.header); err != nil {
-				s.cur = nil
-				s.scan = nil
-				s.line = 0
-				return nil, errors.Wrap(err, "validating header")
+	if s.Concurrency > 1 {
+		s.once.Do(func() {
+			s.parallel = pdk.NewParallelSource(s.rs, s.Concurrency, func(r pdk.NamedReadCloser) (pdk.Source, error) {
+				dec, err := s.decoder(r)
+				return decoderSource{dec}, err
+			})
+		})
+		return s.parallel.Record()
+	}
+	for {
+		if s.cur == nil {
+			s.cur, err = s.rs.NextReader()
+			if err != nil {
+				return nil, err
+			}
+			s.dec, err = s.decoder(s.cur)
+			if err != nil {
+				name := s.cur.Name()
+				s.cur.Close()
+				s.cur, s.dec = nil, nil
+				return nil, errors.Wrapf(err, "opening %s", name)
 			}
 		}
-	}
-	scan := s.scan
-	for scan.Scan() {
-		s.line++
-		if err := scan.Err(); err != nil {
-			return nil, err
+		record, err = s.dec.Decode()
+		if err == nil {
+			return record, nil
 		}
-		txt := scan.Text()
-		if strings.TrimSpace(txt) == "" {
-			continue // skip empty lines. TODO: add stats tracking
+		name := s.cur.Name()
+		if _, ok := err.(*csv.ParseError); ok {
+			return nil, errors.Wrapf(err, "parsing %s", name)
 		}
-		row := strings.Split(txt, ",")
-		recordMap, err := parseRecord(s.header, row)
-		if err != nil {
-			return nil, errors.Wrapf(err, "parsing")
+		// the rest of this reader can't be read, so move on to the next.
+		s.cur.Close()
+		s.cur, s.dec = nil, nil
+		if err != io.EOF {
+			return nil, errors.Wrapf(err, "reading %s", name)
 		}
-		return recordMap, nil
 	}
-	return nil, io.EOF
-
 }
 
-func validateHeader(header []string) error {
-	fields := make(map[string]int)
-	for i, h := range header {
-		if h == "" {
-			return errors.Errorf("header contains empty string at %d: %v", i, header)
+// decoder returns a Decoder for r. A fragment of a file after the first has no
+// header line, so it gets the file's header from the start of the file.
+func (s *Source) decoder(r pdk.NamedReadCloser) (*csv.Decoder, error) {
+	format := s.Format
+	meta := r.Meta()
+	if frag, _ := meta[file.MetaFragment].(int); frag > 0 && len(format.Header) == 0 {
+		path, _ := meta[file.MetaPath].(string)
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening file for header")
 		}
-		if pos, exists := fields[h]; exists {
-			return errors.Errorf("%s appeared at both %d and %d in header", h, pos, i)
+		defer f.Close()
+		format.Header, err = csv.NewDecoder(f, format).Header()
+		if err != nil {
+			return nil, errors.Wrap(err, "reading header from start of file")
 		}
-		fields[h] = i
 	}
-	return nil
+	return csv.NewDecoder(r, format), nil
 }
 
-func parseRecord(header []string, row []string) (map[string]string, error) {
-	if len(header) > len(row) {
-		return nil, errors.Errorf("header/row len mismatch: %dvs%d, %v and %v", len(header), len(row), header, row)
-	} else if len(row) > len(header) {
-		for i := len(header); i < len(row); i++ {
-			if strings.TrimSpace(row[i]) != "" {
-				log.Printf("data in non headered field: %v, %d", row, i)
-			}
-		}
-	}
-	ret := make(map[string]string, len(header))
-	for i := 0; i < len(header); i++ {
-		if row[i] == "" {
-			continue
-		}
-		ret[header[i]] = row[i]
-	}
-	return ret, nil
+// decoderSource is a pdk.Source for the records of a single reader.
+type decoderSource struct {
+	*csv.Decoder
+}
+
+func (d decoderSource) Record() (interface{}, error) {
+	return d.Decode()
 }
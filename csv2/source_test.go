@@ -1,10 +1,14 @@
 package csv2
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
+	"reflect"
 	"testing"
 
+	"github.com/pilosa/pdk"
+	"github.com/pilosa/pdk/csv"
 	"github.com/pilosa/pdk/file"
 )
 
@@ -59,3 +63,68 @@ func TestSource(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceFormat(t *testing.T) {
+	d := mustTempDir(t, "testcsvsourceformat")
+	mustFile(t, d, "# counts\nname\tcount\n\"a\tb\"\t3\n")
+	mustFile(t, d, "name\tcount\nc\t4\n")
+
+	rs, err := file.NewRawSource(d)
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	s := NewSourceFromRawSource(rs)
+	s.Format = csv.Format{Delimiter: '\t', Comment: '#', Infer: true}
+	parser := pdk.NewDefaultGenericParser()
+
+	counts := make(map[string]pdk.Object)
+	rec, err := s.Record()
+	for ; err != io.EOF; rec, err = s.Record() {
+		if err != nil {
+			t.Fatalf("getting record: %v", err)
+		}
+		ent, err := parser.Parse(rec)
+		if err != nil {
+			t.Fatalf("parsing %v: %v", rec, err)
+		}
+		counts[string(ent.Objects["name"].(pdk.S))] = ent.Objects["count"]
+	}
+	exp := map[string]pdk.Object{"a\tb": pdk.I64(3), "c": pdk.I64(4)}
+	if !reflect.DeepEqual(counts, exp) {
+		t.Fatalf("unexpected counts: %#v", counts)
+	}
+}
+
+func TestSourceFragments(t *testing.T) {
+	d := mustTempDir(t, "testcsvsourcefragments")
+	content := "# comment\nid,name\n"
+	for i := 0; i < 500; i++ {
+		content += fmt.Sprintf("%d,n%d\n", i, i)
+	}
+	mustFile(t, d, content)
+
+	rs, err := file.NewRawSource(d, file.OptRawFragments(4, 0))
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	s := NewSourceFromRawSource(rs)
+	s.Format = csv.Format{Comment: '#', Infer: true}
+	s.Concurrency = 4
+
+	ids := make(map[int64]bool)
+	rec, err := s.Record()
+	for ; err != io.EOF; rec, err = s.Record() {
+		if err != nil {
+			t.Fatalf("getting record: %v", err)
+		}
+		recm := rec.(map[string]interface{})
+		id := recm["id"].(int64)
+		if recm["name"] != fmt.Sprintf("n%d", id) {
+			t.Fatalf("unexpected record %v", recm)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 500 {
+		t.Fatalf("expected 500 records, got %d", len(ids))
+	}
+}
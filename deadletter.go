@@ -0,0 +1,179 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DeadLetter is the serializable form of a record which was sent to a
+// DeadLetterSink. Records which are []byte are stored in Raw, and everything
+// else in Record, so that a replayed record looks as much like the original as
+// JSON allows.
+type DeadLetter struct {
+	Stage  Stage       `json:"stage"`
+	Err    string      `json:"error"`
+	Time   time.Time   `json:"time"`
+	Record interface{} `json:"record,omitempty"`
+	Raw    []byte      `json:"raw,omitempty"`
+}
+
+// NewDeadLetter gets a DeadLetter for rec which failed at stage with err.
+func NewDeadLetter(rec interface{}, stage Stage, err error) *DeadLetter {
+	dl := &DeadLetter{
+		Stage: stage,
+		Time:  time.Now().UTC(),
+	}
+	if err != nil {
+		dl.Err = err.Error()
+	}
+	if raw, ok := rec.([]byte); ok {
+		dl.Raw = raw
+	} else {
+		dl.Record = rec
+	}
+	return dl
+}
+
+// Value returns the record that the DeadLetter holds.
+func (d *DeadLetter) Value() interface{} {
+	if d.Raw != nil {
+		return d.Raw
+	}
+	return d.Record
+}
+
+// Marshal encodes d as JSON. Records which can't be encoded are stored as
+// their fmt representation so that at least the failure is not lost.
+func (d *DeadLetter) Marshal() ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err == nil {
+		return data, nil
+	}
+	dd := *d
+	dd.Record = fmt.Sprintf("%v", d.Record)
+	data, err = json.Marshal(dd)
+	return data, errors.Wrap(err, "marshaling dead letter")
+}
+
+// FileDeadLetterSink is a DeadLetterSink which appends each record to a file
+// as a line of JSON. The file can be fed back through an ingest with
+// DeadLetterSource.
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterSink gets a FileDeadLetterSink which appends to filename,
+// creating it if necessary.
+func NewFileDeadLetterSink(filename string) (*FileDeadLetterSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening dead letter file")
+	}
+	return &FileDeadLetterSink{file: f}, nil
+}
+
+// DeadLetter implements DeadLetterSink.
+func (s *FileDeadLetterSink) DeadLetter(rec interface{}, stage Stage, err error) error {
+	data, merr := NewDeadLetter(rec, stage, err).Marshal()
+	if merr != nil {
+		return merr
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, werr := s.file.Write(data)
+	return errors.Wrap(werr, "writing dead letter")
+}
+
+// Close closes the underlying file.
+func (s *FileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// DeadLetterSource is a Source which returns the original records from a
+// stream of dead letters, as written by FileDeadLetterSink.
+type DeadLetterSource struct {
+	mu   sync.Mutex
+	scan *bufio.Scanner
+	line int
+}
+
+// NewDeadLetterSource gets a DeadLetterSource which reads dead letters from r.
+func NewDeadLetterSource(r io.Reader) *DeadLetterSource {
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return &DeadLetterSource{scan: scan}
+}
+
+// Record implements Source.
+func (s *DeadLetterSource) Record() (interface{}, error) {
+	dl, err := s.DeadLetter()
+	if err != nil {
+		return nil, err
+	}
+	return dl.Value(), nil
+}
+
+// DeadLetter returns the next dead letter, skipping blank lines.
+func (s *DeadLetterSource) DeadLetter() (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.scan.Scan() {
+		s.line++
+		line := s.scan.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		dl := &DeadLetter{}
+		if err := json.Unmarshal(line, dl); err != nil {
+			return nil, errors.Wrapf(err, "decoding dead letter on line %d", s.line)
+		}
+		return dl, nil
+	}
+	if err := s.scan.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading dead letters")
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pilosa/pdk"
+	ptest "github.com/pilosa/pilosa/test"
+	"github.com/pkg/errors"
+)
+
+func TestFileDeadLetterSink(t *testing.T) {
+	f, err := ioutil.TempFile("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	sink, err := pdk.NewFileDeadLetterSink(f.Name())
+	if err != nil {
+		t.Fatalf("getting sink: %v", err)
+	}
+	recs := []interface{}{
+		map[string]interface{}{"a": "b", "c": float64(2)},
+		[]byte("not,json"),
+		"just a string",
+	}
+	stages := []pdk.Stage{pdk.StageParse, pdk.StageMap, pdk.StageTransform}
+	for i, rec := range recs {
+		if err := sink.DeadLetter(rec, stages[i], errors.New("bad")); err != nil {
+			t.Fatalf("writing dead letter: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("closing sink: %v", err)
+	}
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	src := pdk.NewDeadLetterSource(r)
+	for i, exp := range recs {
+		dl, err := src.DeadLetter()
+		if err != nil {
+			t.Fatalf("reading dead letter %d: %v", i, err)
+		}
+		if dl.Stage != stages[i] || dl.Err != "bad" {
+			t.Errorf("unexpected dead letter %d: %#v", i, dl)
+		}
+		if !reflect.DeepEqual(dl.Value(), exp) {
+			t.Errorf("record %d: expected %#v, got %#v", i, exp, dl.Value())
+		}
+	}
+	if _, err := src.Record(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// recordingSink is a pdk.DeadLetterSink which remembers what it was sent.
+type recordingSink struct {
+	mu     sync.Mutex
+	stages map[pdk.Stage][]interface{}
+}
+
+func (s *recordingSink) DeadLetter(rec interface{}, stage pdk.Stage, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stages[stage] = append(s.stages[stage], rec)
+	return nil
+}
+
+// failingParser fails to parse records with a "bad" key.
+type failingParser struct {
+	pdk.RecordParser
+}
+
+func (p failingParser) Parse(data interface{}) (*pdk.Entity, error) {
+	if _, ok := data.(map[string]interface{})["bad"]; ok {
+		return nil, errors.New("bad record")
+	}
+	return p.RecordParser.Parse(data)
+}
+
+// failingTransformer fails to transform entities with an "ugly" property.
+type failingTransformer struct{}
+
+func (failingTransformer) Transform(e *pdk.Entity) error {
+	if _, ok := e.Objects["ugly"]; ok {
+		return errors.New("ugly record")
+	}
+	return nil
+}
+
+func TestIngesterDeadLetters(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	src := &sliceSource{recs: []map[string]interface{}{
+		{"color": "blue"},
+		{"color": "red", "bad": true},
+		{"color": "green", "ugly": "yes"},
+		{"color": "blue"},
+	}}
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "deadletters", nil, 3)
+	if err != nil {
+		t.Fatalf("setting up pilosa: %v", err)
+	}
+	sink := &recordingSink{stages: make(map[pdk.Stage][]interface{})}
+	ingester := pdk.NewIngester(src, failingParser{parser}, pdk.NewCollapsingMapper(), indexer)
+	ingester.Transformers = []pdk.Transformer{failingTransformer{}}
+	ingester.DeadLetters = sink
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+
+	if err := ingester.Run(); err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+	if len(sink.stages) != 2 {
+		t.Fatalf("unexpected dead letters: %v", sink.stages)
+	}
+	if recs := sink.stages[pdk.StageParse]; len(recs) != 1 || !reflect.DeepEqual(recs[0], src.recs[1]) {
+		t.Errorf("unexpected parse dead letters: %v", recs)
+	}
+	if recs := sink.stages[pdk.StageTransform]; len(recs) != 1 || !reflect.DeepEqual(recs[0], src.recs[2]) {
+		t.Errorf("unexpected transform dead letters: %v", recs)
+	}
+	// every record is committed, including the dead ones
+	if len(src.committed) != 4 {
+		t.Errorf("expected 4 committed records, got %v", src.committed)
+	}
+}
+
+func TestIngesterDeadLettersOutOfRange(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	schema := gopilosa.NewSchema()
+	schema.Index("outofrange").Field("age", gopilosa.OptFieldTypeInt(0, 150))
+	src := &sliceSource{recs: []map[string]interface{}{
+		{"age": 42},
+		{"age": 4200},
+		{"age": 7},
+	}}
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "outofrange", schema, 3)
+	if err != nil {
+		t.Fatalf("setting up pilosa: %v", err)
+	}
+	sink := &recordingSink{stages: make(map[pdk.Stage][]interface{})}
+	ingester := pdk.NewIngester(src, parser, pdk.NewCollapsingMapper(), indexer)
+	ingester.DeadLetters = sink
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+
+	if err := ingester.Run(); err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+	if recs := sink.stages[pdk.StageIndex]; len(sink.stages) != 1 || len(recs) != 1 || !reflect.DeepEqual(recs[0], src.recs[1]) {
+		t.Fatalf("unexpected dead letters: %v", sink.stages)
+	}
+	resp, err := indexer.Client().Query(schema.Index("outofrange").Field("age").Sum(nil))
+	if err != nil {
+		t.Fatalf("querying sum: %v", err)
+	}
+	if sum := resp.Result().Value(); sum != 49 {
+		t.Errorf("unexpected sum: %d", sum)
+	}
+}
@@ -99,6 +99,11 @@ func equal(o, o2 Object) error {
 				return errors.Wrapf(eqErr, "index %d", i)
 			}
 		}
+	case Time:
+		// compare instants, since the same time may have different locations
+		if t, t2 := time.Time(o.(Time)), time.Time(o2.(Time)); !t.Equal(t2) {
+			return errors.Errorf("'%v' and '%v' not equal", t, t2)
+		}
 	default:
 		_, ok := o.(Literal)
 		_, ok2 := o2.(Literal)
@@ -518,6 +523,7 @@ const (
 	u16ID
 	u32ID
 	u64ID
+	tID
 )
 
 // ToBytes converts a literal into a typed byte slice representation.
@@ -584,6 +590,11 @@ func ToBytes(l Literal) []byte {
 		ret[0] = u64ID
 		binary.BigEndian.PutUint64(ret[1:], uint64(l))
 		return ret
+	case Time:
+		ret := make([]byte, 9)
+		ret[0] = tID
+		binary.BigEndian.PutUint64(ret[1:], uint64(time.Time(l).UnixNano()))
+		return ret
 	default:
 		panic("should have covered all literal types in ToBytes switch")
 	}
@@ -634,6 +645,8 @@ func FromBytes(bs []byte) Literal {
 		return U32(binary.BigEndian.Uint32(bs[1:]))
 	case u64ID:
 		return U64(binary.BigEndian.Uint64(bs[1:]))
+	case tID:
+		return Time(time.Unix(0, int64(binary.BigEndian.Uint64(bs[1:]))).UTC())
 	default:
 		panic("should have covered all literal types in FromBytes switch")
 	}
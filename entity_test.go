@@ -40,6 +40,7 @@ import (
 	"github.com/pkg/errors"
 
 	"testing"
+	"time"
 )
 
 func TestToAndFromBytes(t *testing.T) {
@@ -87,6 +88,7 @@ func TestToAndFromBytes(t *testing.T) {
 		pdk.U64(0),
 		pdk.U64(1234567890),
 		pdk.U64(18446744000000000000),
+		pdk.Time(time.Date(2019, time.March, 4, 5, 6, 7, 8, time.UTC)),
 	}
 
 	for i, tst := range tests {
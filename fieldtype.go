@@ -0,0 +1,154 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk
+
+import (
+	"strings"
+	"sync"
+)
+
+// FieldType is a kind of Pilosa field.
+type FieldType string
+
+// Field types which a FieldSpec may declare. Rows can be hinted as set, mutex,
+// or bool (see Row.FieldType).
+const (
+	FieldTypeSet   FieldType = "set"
+	FieldTypeMutex FieldType = "mutex"
+	FieldTypeBool  FieldType = "bool"
+	FieldTypeInt   FieldType = "int"
+	FieldTypeTime  FieldType = "time"
+)
+
+// FieldTypeOptions configures which fields CollapsingMapper hints as mutex or
+// bool fields, and which it stores as column attributes. Like TimeOptions, it
+// is meant to be included in the Main of an ingest command.
+type FieldTypeOptions struct {
+	Mutex   []string `help:"Fields which hold a single value per record. Indexing a new value for a record replaces its old one."`
+	Bool    []string `help:"Fields which hold true or false. Boolean values at the path of such a field are indexed into it, rather than as a row of the field above them."`
+	ColAttr []string `help:"Fields whose values are stored as attributes of the record's column instead of being indexed. They are returned with query results, but can't be queried."`
+}
+
+// Setup configures mapper to hint the fields in o.
+func (o FieldTypeOptions) Setup(mapper *CollapsingMapper) {
+	if len(o.ColAttr) > 0 && mapper.ColAttrs == nil {
+		mapper.ColAttrs = make(map[string]bool)
+	}
+	for _, field := range o.ColAttr {
+		mapper.ColAttrs[field] = true
+	}
+	if len(o.Mutex) == 0 && len(o.Bool) == 0 {
+		return
+	}
+	if mapper.FieldTypes == nil {
+		mapper.FieldTypes = make(map[string]FieldType)
+	}
+	for _, field := range o.Mutex {
+		mapper.FieldTypes[field] = FieldTypeMutex
+	}
+	for _, field := range o.Bool {
+		mapper.FieldTypes[field] = FieldTypeBool
+	}
+}
+
+// FieldHints holds hints about the fields which values at particular paths are
+// indexed into, which a RecordParser learns from the schemas of the records it
+// parses (see avro.Parser) rather than being configured up front. A
+// CollapsingMapper with Hints uses them for fields which aren't in its
+// FieldTypes or Decimals. FieldHints is safe for concurrent use, so one parser
+// can share it with mappers running in other goroutines.
+type FieldHints struct {
+	mu       sync.RWMutex
+	types    map[string]FieldType
+	decimals map[string]int
+}
+
+// NewFieldHints returns an empty FieldHints.
+func NewFieldHints() *FieldHints {
+	return &FieldHints{
+		types:    make(map[string]FieldType),
+		decimals: make(map[string]int),
+	}
+}
+
+// hintKey joins path with a separator which doesn't appear in property names.
+func hintKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// SetType hints that values at path belong in a field of type typ.
+func (h *FieldHints) SetType(path []string, typ FieldType) {
+	key := hintKey(path)
+	h.mu.RLock()
+	old, ok := h.types[key]
+	h.mu.RUnlock()
+	if ok && old == typ {
+		return
+	}
+	h.mu.Lock()
+	h.types[key] = typ
+	h.mu.Unlock()
+}
+
+// Type returns the type hinted for the field of values at path.
+func (h *FieldHints) Type(path []string) (FieldType, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	typ, ok := h.types[hintKey(path)]
+	return typ, ok
+}
+
+// SetDecimals hints that numbers at path have places significant decimal
+// places, which are kept like those of CollapsingMapper.Decimals. Unlike
+// CollapsingMapper.Decimals, hinted places aren't known to a proxy, which
+// can't scale queries and results for them.
+func (h *FieldHints) SetDecimals(path []string, places int) {
+	key := hintKey(path)
+	h.mu.RLock()
+	old, ok := h.decimals[key]
+	h.mu.RUnlock()
+	if ok && old == places {
+		return
+	}
+	h.mu.Lock()
+	h.decimals[key] = places
+	h.mu.Unlock()
+}
+
+// Decimals returns the number of decimal places hinted for numbers at path.
+func (h *FieldHints) Decimals(path []string) (int, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	places, ok := h.decimals[hintKey(path)]
+	return places, ok
+}
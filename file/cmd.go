@@ -1,12 +1,20 @@
 package file
 
 import (
+	"context"
 	"log"
+	"time"
 
+	gopilosa "github.com/pilosa/go-pilosa"
 	"github.com/pilosa/pdk"
+	"github.com/pilosa/pdk/leveldb"
 	"github.com/pkg/errors"
 )
 
+// fragmentMinSize is the size of the smallest file which is split by the
+// Fragments option.
+const fragmentMinSize = 64 << 20
+
 // Main contains the configuration for an ingester with an S3 Source.
 type Main struct {
 	Path        string   `help:"File or directory path to read from."`
@@ -17,6 +25,15 @@ type Main struct {
 	SubjectAt   string   `help:"Tells the source to add a unique 'subject' key to each record which is the filename + record number."`
 	SubjectPath []string `help:"Path to value in each record that should be mapped to column ID. Blank gets a sequential ID."`
 	Proxy       string   `help:"Bind to this address to proxy and translate requests to Pilosa"`
+	Checkpoint  string   `help:"File in which to record ingest progress. A restarted ingest skips records which were already indexed. Rows and columns are translated with a leveldb store in <checkpoint>.translator so that a restarted ingest gives them the same ids."`
+	Follow      bool     `help:"Keep watching Path for new files and read files as they grow, like tail -F. Each line must be a JSON object. With --checkpoint, a restarted ingest carries on from the byte offset reached in each file."`
+	Fragments   int      `help:"Split files over 64MB into this many fragments (on line breaks) and read them concurrently. Subjects are numbered within each fragment."`
+	DeadLetter  string   `help:"File to which records which fail to parse or map are appended as JSON lines. See 'pdk replay'."`
+	Spec        string   `help:"YAML or JSON file declaring which paths to index into which fields (see pdk.Spec). Overrides the framer and subject path."`
+	Decimals    []string `help:"Comma separated field:places pairs. Numbers indexed into these int fields keep that many decimal places (they are stored multiplied by 10^places)."`
+	Time        pdk.TimeOptions
+	Types       pdk.FieldTypeOptions
+	Upsert      pdk.UpsertOptions
 }
 
 // NewMain gets a new Main with the default configuration.
@@ -33,14 +50,44 @@ func NewMain() *Main {
 
 // Run runs the ingester.
 func (m *Main) Run() error {
-	src, err := NewSource(
+	return m.RunContext(context.Background())
+}
+
+// RunContext works like Run, but stops ingesting once ctx is done, after
+// flushing everything which has already been read.
+func (m *Main) RunContext(ctx context.Context) error {
+	opts := []SrcOption{
 		OptSrcPath(m.Path),
 		OptSrcSubjectAt(m.SubjectAt),
-	)
+	}
+	if m.Checkpoint != "" {
+		opts = append(opts, OptSrcCheckpoint(m.Checkpoint))
+	}
+	if m.Follow {
+		opts = append(opts, OptSrcFollow(time.Second))
+	}
+	if m.Fragments > 1 {
+		opts = append(opts, OptSrcFragments(m.Fragments, fragmentMinSize))
+	}
+	src, err := NewSource(opts...)
 	if err != nil {
 		return errors.Wrap(err, "getting file source")
 	}
 
+	var spec *pdk.Spec
+	if m.Spec != "" {
+		spec, err = pdk.LoadSpec(m.Spec)
+		if err != nil {
+			return errors.Wrap(err, "loading spec")
+		}
+		if len(spec.Subject) > 0 {
+			m.SubjectPath = spec.Subject
+		}
+		if m.SubjectAt != "" {
+			spec.Ignore = append(spec.Ignore, []string{m.SubjectAt})
+		}
+	}
+
 	translateColumns := true
 	parser := pdk.NewDefaultGenericParser()
 	if len(m.SubjectPath) == 0 && m.SubjectAt == "" {
@@ -55,19 +102,89 @@ func (m *Main) Run() error {
 
 	mapper := pdk.NewCollapsingMapper()
 	mapper.Framer = &m.Framer
-	if translateColumns {
+	if m.Checkpoint != "" {
+		// a resumed ingest must give rows and columns the ids they got
+		// before, so they are translated with leveldb translators kept next
+		// to the checkpoint file.
+		if !translateColumns {
+			return errors.New("--checkpoint requires --subject-at or --subject-path, since sequential column ids would start over when the ingest is resumed")
+		}
+		dir := m.Checkpoint + ".translator"
+		translator, err := leveldb.NewTranslator(dir)
+		if err != nil {
+			return errors.Wrap(err, "creating translator")
+		}
+		defer translator.Close()
+		mapper.Translator = translator
+		colTranslator, err := leveldb.NewFieldTranslator(dir, "__columns")
+		if err != nil {
+			return errors.Wrap(err, "creating column translator")
+		}
+		defer colTranslator.Close()
+		mapper.ColTranslator = colTranslator
+	} else if translateColumns {
 		mapper.ColTranslator = pdk.NewMapFieldTranslator()
 	}
 
-	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, nil, m.BatchSize)
+	mapper.Decimals, err = pdk.ParseDecimals(m.Decimals)
+	if err != nil {
+		return errors.Wrap(err, "parsing decimals")
+	}
+	m.Types.Setup(mapper)
+	pilosaOpts, err := m.Time.Setup(parser, mapper)
+	if err != nil {
+		return errors.Wrap(err, "configuring timestamps")
+	}
+	if err := m.Upsert.Check(m.Time); err != nil {
+		return err
+	}
+	var recMapper pdk.RecordMapper = mapper
+	var schema *gopilosa.Schema
+	untranslated := mapper.Untranslated()
+	if spec != nil {
+		recMapper = spec.Mapper(mapper)
+		schema = spec.Schema(m.Index)
+		for field, places := range spec.Decimals() {
+			mapper.Decimals[field] = places
+		}
+		for field := range spec.Untranslated() {
+			untranslated[field] = true
+		}
+	}
+	if m.Upsert.Upserting() {
+		var store pdk.RecordStore
+		if m.Upsert.Dir != "" {
+			lstore, err := leveldb.NewRecordStore(m.Upsert.Dir)
+			if err != nil {
+				return errors.Wrap(err, "opening upsert record store")
+			}
+			defer lstore.Close()
+			store = lstore
+		} else {
+			log.Println("upserting with records remembered in memory; pass --upsert.dir to clear what was indexed before a restart")
+		}
+		recMapper = m.Upsert.Wrap(recMapper, store)
+	}
+	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, schema, m.BatchSize, pilosaOpts...)
 	if err != nil {
 		return errors.Wrap(err, "setting up Pilosa")
 	}
-	ingester := pdk.NewIngester(src, parser, mapper, indexer)
+	ingester := pdk.NewIngester(src, parser, recMapper, indexer)
+	if m.DeadLetter != "" {
+		sink, err := pdk.NewFileDeadLetterSink(m.DeadLetter)
+		if err != nil {
+			return errors.Wrap(err, "setting up dead letter sink")
+		}
+		defer sink.Close()
+		ingester.DeadLetters = sink
+	}
 
+	fwd := pdk.NewPilosaForwarder(m.PilosaHosts[0], mapper.Translator, mapper.ColTranslator)
+	fwd.SetDecimals(mapper.Decimals)
+	fwd.SetUntranslated(untranslated)
 	go func() {
-		err = pdk.StartMappingProxy(m.Proxy, pdk.NewPilosaForwarder(m.PilosaHosts[0], mapper.Translator, mapper.ColTranslator))
+		err = pdk.StartMappingProxy(m.Proxy, fwd)
 		log.Fatal(errors.Wrap(err, "starting mapping proxy"))
 	}()
-	return errors.Wrap(ingester.Run(), "running ingester")
+	return errors.Wrap(ingester.RunContext(ctx), "running ingester")
 }
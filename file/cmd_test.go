@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -89,3 +91,52 @@ func newFileWithData(t *testing.T, data string) string {
 
 	return tf.Name()
 }
+
+func TestFileIngestCheckpointResume(t *testing.T) {
+	pilosa := test.MustRunCluster(t, 1)
+	defer pilosa.Close()
+	pilosaHost := pilosa[0].API.Node().URI.HostPort()
+	d := mustTempDir(t, "testfileingestcheckpoint")
+	defer os.RemoveAll(d)
+	fname := filepath.Join(d, "data.json")
+	mustAppend(t, fname, "{\"id\": \"a\", \"stuff\": \"stuff1\"}\n{\"id\": \"b\", \"stuff\": \"stuff2\"}\n")
+
+	run := func(proxy string) {
+		t.Helper()
+		cmd := NewMain()
+		cmd.Path = fname
+		cmd.PilosaHosts = []string{pilosaHost}
+		cmd.SubjectPath = []string{"id"}
+		cmd.Checkpoint = filepath.Join(d, "checkpoint")
+		cmd.Proxy = proxy
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("running ingester: %v", err)
+		}
+	}
+	run("localhost:55347")
+	// the resumed ingest only reads the new records, which must get new
+	// columns, and rows with the ids they had before.
+	mustAppend(t, fname, "{\"id\": \"c\", \"stuff\": \"stuff3\"}\n{\"id\": \"d\", \"stuff\": \"stuff1\"}\n")
+	run("localhost:55348")
+
+	for q, exp := range map[string]string{
+		"Count(Union(Row(stuff=0), Row(stuff=1), Row(stuff=2)))": `{"results":[4]}`,
+		"Count(Row(stuff=0))": `{"results":[2]}`,
+	} {
+		if res := strings.TrimSpace(mustQueryHost(t, q, pilosaHost)); res != exp {
+			t.Errorf("%s: expected %s, got %s", q, exp, res)
+		}
+	}
+}
+
+func TestFileIngestCheckpointNoSubject(t *testing.T) {
+	d := mustTempDir(t, "testfileingestnosubject")
+	defer os.RemoveAll(d)
+	cmd := NewMain()
+	cmd.Path = newFileWithData(t, data)
+	cmd.SubjectAt = ""
+	cmd.Checkpoint = filepath.Join(d, "checkpoint")
+	if err := cmd.Run(); err == nil || !strings.Contains(err.Error(), "--checkpoint requires") {
+		t.Fatalf("expected checkpointing without subjects to fail, got %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package file
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID returns an ID for the file at path which stays the same when it is
+// renamed: its device and inode numbers.
+func fileID(path string, info os.FileInfo) string {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", uint64(st.Dev), uint64(st.Ino))
+	}
+	return path
+}
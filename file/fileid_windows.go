@@ -0,0 +1,11 @@
+package file
+
+import (
+	"os"
+)
+
+// fileID returns an ID for the file at path. Inode numbers aren't available on
+// Windows, so it is just the path, and renamed files are read again.
+func fileID(path string, info os.FileInfo) string {
+	return path
+}
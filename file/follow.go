@@ -0,0 +1,403 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	gojson "encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pilosa/pdk/unpack"
+	"github.com/pkg/errors"
+)
+
+// OptSrcFollow tells the source to keep watching its path for new files, and
+// to read files as they grow, like tail -F. Files are told apart by their
+// inode, so a file which is renamed (e.g. when a log is rotated) is read to
+// its end under its new name, while a new file at the old name is read from
+// its start, as is a file which is truncated. Files named like compressed
+// files or archives are skipped.
+//
+// Each line must hold one JSON object; lines which don't are logged and
+// skipped. The directory is watched with inotify (or its equivalent), and
+// polled every pollInterval in case that fails or misses changes. With
+// OptSrcSubjectAt, subjects are <filename>@<file ID>#<byte offset>, and with
+// OptSrcCheckpoint the byte offset reached in each file is recorded so that a
+// restarted source carries on from there. The offset is stored with a
+// fingerprint of the start of the file, and is ignored if the file found
+// under the same ID has a different start, since IDs are reused once files are
+// deleted. Files which leave the directory are dropped from the checkpoint
+// file. A following source never returns io.EOF unless it is closed.
+func OptSrcFollow(pollInterval time.Duration) SrcOption {
+	return func(s *Source) error {
+		s.follow = true
+		s.pollInterval = pollInterval
+		return nil
+	}
+}
+
+// Close stops a source which is following its path (see OptSrcFollow). Record
+// returns io.EOF once the records already read have been returned. It does
+// nothing for other sources.
+func (s *Source) Close() error {
+	if s.follow {
+		s.closeOnce.Do(func() { close(s.stop) })
+	}
+	return nil
+}
+
+// follower finds the files to tail, and starts a tailer for each.
+type follower struct {
+	s    *Source
+	dir  string
+	only string // base name of the file to follow if the path is a file
+
+	tailers map[string]*tailer // by file ID
+	ignored map[string]bool    // IDs of packed files
+	wg      sync.WaitGroup
+}
+
+func (s *Source) runFollow() {
+	f := &follower{
+		s:       s,
+		dir:     s.path,
+		tailers: make(map[string]*tailer),
+		ignored: make(map[string]bool),
+	}
+	if info, err := os.Stat(s.path); err == nil && !info.IsDir() {
+		f.dir, f.only = filepath.Split(s.path)
+	}
+	interval := s.pollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	var watchErrs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(f.dir)
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("watching %s: %v, polling every %v instead", f.dir, err, interval)
+	} else {
+		defer watcher.Close()
+		events, watchErrs = watcher.Events, watcher.Errors
+	}
+
+	for {
+		f.scan()
+		select {
+		case <-s.stop:
+			f.wg.Wait()
+			close(s.records)
+			return
+		case <-events:
+		case err := <-watchErrs:
+			log.Printf("watching %s: %v", f.dir, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan starts tailing any new files, lets the tailers of existing files know
+// that they may have grown, and tells the tailers of files which are gone to
+// finish.
+func (f *follower) scan() {
+	var names []string
+	if f.only != "" {
+		names = []string{f.only}
+	} else {
+		infos, err := ioutil.ReadDir(f.dir)
+		if err != nil {
+			log.Printf("reading directory %s: %v", f.dir, err)
+			return
+		}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		path := filepath.Join(f.dir, name)
+		if f.s.isCheckpointFile(path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		id := fileID(path, info)
+		seen[id] = true
+		if t, ok := f.tailers[id]; ok {
+			t.rename(name)
+			t.poke()
+			continue
+		}
+		if f.ignored[id] || f.packed(path) {
+			f.ignored[id] = true
+			continue
+		}
+		cp := f.s.committedProgress(id)
+		t := &tailer{
+			s:           f.s,
+			id:          id,
+			name:        name,
+			path:        path,
+			offset:      cp.idx,
+			fingerprint: cp.fingerprint,
+			pokes:       make(chan struct{}, 1),
+			done:        make(chan struct{}),
+		}
+		f.tailers[id] = t
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			t.run()
+		}()
+	}
+	for id, t := range f.tailers {
+		if !seen[id] {
+			close(t.done)
+			delete(f.tailers, id)
+		}
+	}
+	for id := range f.ignored {
+		if !seen[id] {
+			delete(f.ignored, id)
+		}
+	}
+	f.s.forget(seen)
+}
+
+// packed reports whether the file at path is compressed or an archive, which
+// can't be tailed.
+func (f *follower) packed(path string) bool {
+	if unpack.PackedName(path) {
+		return true
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return unpack.Packed(head[:n], path)
+}
+
+// tailer reads the lines of one file as they are written.
+type tailer struct {
+	s      *Source
+	id     string
+	path   string // path at which the file was found
+	offset int64  // offset of the next line
+
+	// fingerprint of the file (see fingerprint), or "" if its first line
+	// hasn't been written yet.
+	fingerprint string
+
+	mu   sync.Mutex
+	name string // current name of the file
+
+	pokes chan struct{} // the file may have grown
+	done  chan struct{} // closed when the file leaves the directory
+}
+
+func (t *tailer) rename(name string) {
+	t.mu.Lock()
+	t.name = name
+	t.mu.Unlock()
+}
+
+func (t *tailer) poke() {
+	select {
+	case t.pokes <- struct{}{}:
+	default:
+	}
+}
+
+func (t *tailer) run() {
+	f, err := os.Open(t.path)
+	if err != nil {
+		log.Printf("opening %s to follow: %v", t.path, err)
+		return
+	}
+	defer f.Close()
+	fp := fileFingerprint(f)
+	if t.offset > 0 && t.fingerprint != "" && fp != t.fingerprint {
+		log.Printf("%s doesn't start like the file in its checkpoint, reading from the start", t.path)
+		t.offset = 0
+	}
+	t.fingerprint = fp
+	if info, err := f.Stat(); err == nil && info.Size() < t.offset {
+		log.Printf("%s is shorter than its checkpoint, reading from the start", t.path)
+		t.offset = 0
+	}
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		log.Printf("seeking in %s: %v", t.path, err)
+		return
+	}
+
+	br := bufio.NewReader(f)
+	var line []byte
+	finishing := false
+	for {
+		chunk, err := br.ReadBytes('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			if !t.emit(line) {
+				return
+			}
+			line = nil
+			continue
+		} else if err != io.EOF {
+			log.Printf("reading %s: %v", t.path, err)
+			return
+		}
+
+		// the end of the file, for now.
+		if finishing {
+			if len(line) > 0 {
+				t.emit(line)
+			}
+			return
+		}
+		if info, err := f.Stat(); err == nil && info.Size() < t.offset+int64(len(line)) {
+			log.Printf("%s was truncated, reading from the start", t.path)
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				log.Printf("seeking in %s: %v", t.path, err)
+				return
+			}
+			br.Reset(f)
+			t.offset, t.fingerprint, line = 0, "", nil
+			continue
+		}
+		select {
+		case <-t.pokes:
+		case <-t.done:
+			finishing = true
+		case <-t.s.stop:
+			return
+		}
+	}
+}
+
+// emit sends the record on line, which starts at t.offset, and moves t.offset
+// past it. It returns false if the source has been closed.
+func (t *tailer) emit(line []byte) bool {
+	start := t.offset
+	t.offset += int64(len(line))
+	if start == 0 {
+		t.fingerprint = fingerprint(line)
+	}
+	var data map[string]interface{}
+	if err := gojson.Unmarshal(line, &data); err != nil {
+		if len(bytes.TrimSpace(line)) > 0 {
+			log.Printf("skipping line at %s:%d: %v", t.path, start, errors.Wrap(err, "decoding json"))
+		}
+		return true
+	}
+	if t.s.subjectAt != "" {
+		t.mu.Lock()
+		data[t.s.subjectAt] = fmt.Sprintf("%s@%s#%d", t.name, t.id, start)
+		t.mu.Unlock()
+	}
+	select {
+	case t.s.records <- record{data: data, file: t.id, idx: t.offset, fingerprint: t.fingerprint}:
+		return true
+	case <-t.s.stop:
+		return false
+	}
+}
+
+// fingerprintSize is the most of a file's first line which its fingerprint
+// covers.
+const fingerprintSize = 1024
+
+// fingerprint returns the fingerprint of a file whose first line is line: a
+// hash of the line, or of its first fingerprintSize bytes if it is longer.
+// Every checkpointed offset is at or past the end of the first line, so the
+// bytes it covers are there to check when a restarted source reads the file.
+func fingerprint(line []byte) string {
+	if len(line) > fingerprintSize {
+		line = line[:fingerprintSize]
+	}
+	h := fnv.New64a()
+	h.Write(line)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// fileFingerprint returns the fingerprint of f, or "" if its first line is
+// incomplete.
+func fileFingerprint(f *os.File) string {
+	head := make([]byte, fingerprintSize)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i+1]
+	} else if n < fingerprintSize {
+		return ""
+	}
+	return fingerprint(head)
+}
+
+// isCheckpointFile reports whether path is the source's checkpoint file, or
+// the temporary file it is written through.
+func (s *Source) isCheckpointFile(path string) bool {
+	if s.cpFile == "" {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	cp, err := filepath.Abs(s.cpFile)
+	return err == nil && (abs == cp || abs == cp+".tmp")
+}
+
+// committedProgress returns the byte offset to start following the file with
+// the given ID from, and the fingerprint the file had.
+func (s *Source) committedProgress(id string) progress {
+	s.cpLock.Lock()
+	defer s.cpLock.Unlock()
+	return s.committed[id]
+}
+
+// forget drops the progress of files whose IDs aren't in seen, so that the
+// checkpoint file doesn't grow with every rotated log. Records of a file which
+// are committed after it is gone put it back until the next scan.
+func (s *Source) forget(seen map[string]bool) {
+	if s.tracker == nil {
+		return
+	}
+	s.cpLock.Lock()
+	defer s.cpLock.Unlock()
+	dirty := false
+	for id := range s.committed {
+		if !seen[id] {
+			delete(s.committed, id)
+			dirty = true
+		}
+	}
+	if !dirty {
+		return
+	}
+	if err := s.writeCheckpoint(); err != nil {
+		log.Printf("forgetting files which are gone: %v", err)
+	}
+}
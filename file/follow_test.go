@@ -0,0 +1,193 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pilosa/pdk"
+)
+
+func mustAppend(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatalf("appending to %s: %v", path, err)
+	}
+}
+
+// nextFollowed returns the "hey" value and subject of the next record from s,
+// and its checkpoint.
+func nextFollowed(t *testing.T, s *Source) (float64, string, pdk.Checkpoint) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rec, cp, err := s.CheckpointRecord(ctx)
+	if err != nil {
+		t.Fatalf("getting record: %v", err)
+	}
+	recm := rec.(map[string]interface{})
+	return recm["hey"].(float64), recm["here"].(string), cp
+}
+
+// expectNothing checks that s has no record ready for a little while.
+func expectNothing(t *testing.T, s *Source) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	rec, _, err := s.CheckpointRecord(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected no record, got %v, %v", rec, err)
+	}
+}
+
+func TestSourceFollow(t *testing.T) {
+	d := mustTempDir(t, "testsourcefollow")
+	defer os.RemoveAll(d)
+	cpFile := filepath.Join(d, "checkpoint")
+	log := filepath.Join(d, "app.log")
+	mustAppend(t, log, "{\"hey\": 1}\n{\"hey\": 2}\nnot json\n{\"hey\":")
+	mustAppend(t, filepath.Join(d, "old.log.gz"), "\x1f\x8bnot really gzip\n")
+
+	opts := []SrcOption{OptSrcPath(d), OptSrcFollow(10 * time.Millisecond), OptSrcCheckpoint(cpFile), OptSrcSubjectAt("here")}
+	s, err := NewSource(opts...)
+	if err != nil {
+		t.Fatalf("getting source: %v", err)
+	}
+	var cps []pdk.Checkpoint
+	next := func(expVal float64, expSubject string) {
+		t.Helper()
+		val, subj, cp := nextFollowed(t, s)
+		if val != expVal || (expSubject != "" && !strings.HasPrefix(subj, expSubject)) {
+			t.Fatalf("expected %v from %s, got %v from %s", expVal, expSubject, val, subj)
+		}
+		cps = append(cps, cp)
+	}
+	next(1, "app.log@")
+	next(2, "app.log@")
+	expectNothing(t, s) // the partial line waits for the rest
+
+	mustAppend(t, log, " 3}\n")
+	next(3, "app.log@")
+
+	// a new file
+	other := filepath.Join(d, "other.log")
+	mustAppend(t, other, "{\"hey\": 4}\n")
+	next(4, "other.log@")
+
+	// rotation: the renamed file is read to its end, and the new one from its
+	// start.
+	if err := os.Rename(log, log+".1"); err != nil {
+		t.Fatalf("rotating: %v", err)
+	}
+	mustAppend(t, log+".1", "{\"hey\": 5}\n")
+	next(5, "")
+	mustAppend(t, log, "{\"hey\": 6}\n")
+	next(6, "app.log@")
+
+	// truncation
+	if err := os.Truncate(other, 0); err != nil {
+		t.Fatalf("truncating: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mustAppend(t, other, "{\"hey\": 7}\n")
+	next(7, "other.log@")
+	if err := s.Commit(cps); err != nil {
+		t.Fatalf("committing: %v", err)
+	}
+	s.Close()
+	for {
+		if _, err := s.Record(); err == io.EOF {
+			break
+		}
+	}
+
+	// a restarted source carries on where the last one stopped.
+	mustAppend(t, log, "{\"hey\": 8}\n")
+	s, err = NewSource(opts...)
+	if err != nil {
+		t.Fatalf("getting restarted source: %v", err)
+	}
+	defer s.Close()
+	next(8, "app.log@")
+	expectNothing(t, s)
+	mustAppend(t, log+".1", "{\"hey\": 9}\n")
+	next(9, "app.log.1@")
+}
+
+func TestSourceFollowFingerprint(t *testing.T) {
+	d := mustTempDir(t, "testsourcefollowfingerprint")
+	defer os.RemoveAll(d)
+	cpFile := filepath.Join(d, "checkpoint")
+	log := filepath.Join(d, "app.log")
+	mustAppend(t, log, "{\"hey\": 1}\n{\"hey\": 2}\n")
+	info, err := os.Stat(log)
+	if err != nil {
+		t.Fatalf("statting log: %v", err)
+	}
+	id := fileID(log, info)
+
+	// the checkpoint is for a different file which had the same ID, and for
+	// one which is gone.
+	cp := fmt.Sprintf(`{%q: {"offset": 11, "fingerprint": "0123456789abcdef"}, "gone": 5}`, id)
+	if err := ioutil.WriteFile(cpFile, []byte(cp), 0644); err != nil {
+		t.Fatalf("writing checkpoint: %v", err)
+	}
+	opts := []SrcOption{OptSrcPath(d), OptSrcFollow(10 * time.Millisecond), OptSrcCheckpoint(cpFile), OptSrcSubjectAt("here")}
+	s, err := NewSource(opts...)
+	if err != nil {
+		t.Fatalf("getting source: %v", err)
+	}
+	var cps []pdk.Checkpoint
+	for _, exp := range []float64{1, 2} {
+		val, _, cp := nextFollowed(t, s)
+		if val != exp {
+			t.Fatalf("expected %v, got %v", exp, val)
+		}
+		cps = append(cps, cp)
+	}
+	if err := s.Commit(cps); err != nil {
+		t.Fatalf("committing: %v", err)
+	}
+	s.Close()
+	for {
+		if _, err := s.Record(); err == io.EOF {
+			break
+		}
+	}
+	data, err := ioutil.ReadFile(cpFile)
+	if err != nil {
+		t.Fatalf("reading checkpoint: %v", err)
+	}
+	committed := make(map[string]progress)
+	if err := json.Unmarshal(data, &committed); err != nil {
+		t.Fatalf("decoding checkpoint: %v", err)
+	}
+	exp := map[string]progress{id: {idx: 22, fingerprint: fingerprint([]byte("{\"hey\": 1}\n"))}}
+	if !reflect.DeepEqual(committed, exp) {
+		t.Errorf("expected checkpoint %v, got %v", exp, committed)
+	}
+
+	// with a matching fingerprint, a restarted source carries on.
+	mustAppend(t, log, "{\"hey\": 3}\n")
+	s, err = NewSource(opts...)
+	if err != nil {
+		t.Fatalf("getting restarted source: %v", err)
+	}
+	defer s.Close()
+	if val, _, _ := nextFollowed(t, s); val != 3 {
+		t.Fatalf("expected 3 after restarting, got %v", val)
+	}
+}
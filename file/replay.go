@@ -0,0 +1,113 @@
+package file
+
+import (
+	"context"
+	"os"
+
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+)
+
+// ReplayMain contains the configuration for re-ingesting the records from a
+// dead letter file, such as one written by 'pdk file --dead-letter'.
+type ReplayMain struct {
+	Path        string   `help:"Dead letter file to replay."`
+	Stages      []string `help:"If any are passed, only records which failed at one of these stages (parse, transform, map, index) are replayed."`
+	PilosaHosts []string `help:"Comma separated list of Pilosa hosts and ports."`
+	Index       string   `help:"Pilosa index."`
+	BatchSize   uint     `help:"Batch size for Pilosa imports (latency/throughput tradeoff)."`
+	Framer      pdk.DashField
+	SubjectPath []string `help:"Path to value in each record that should be mapped to column ID. Blank gets a sequential ID."`
+	DeadLetter  string   `help:"File to which records which still fail are appended. Must not be the file being replayed."`
+	Decimals    []string `help:"Comma separated field:places pairs. Numbers indexed into these int fields keep that many decimal places (they are stored multiplied by 10^places)."`
+	Time        pdk.TimeOptions
+	Types       pdk.FieldTypeOptions
+}
+
+// NewReplayMain gets a new ReplayMain with the default configuration.
+func NewReplayMain() *ReplayMain {
+	return &ReplayMain{
+		PilosaHosts: []string{"localhost:10101"},
+		Index:       "pdk",
+		BatchSize:   1000,
+		SubjectPath: []string{},
+	}
+}
+
+// Run replays the dead letter file.
+func (m *ReplayMain) Run() error {
+	return m.RunContext(context.Background())
+}
+
+// RunContext works like Run, but stops ingesting once ctx is done, after
+// flushing everything which has already been read.
+func (m *ReplayMain) RunContext(ctx context.Context) error {
+	if m.DeadLetter != "" && m.DeadLetter == m.Path {
+		return errors.New("dead letter file must be different from the file being replayed")
+	}
+	f, err := os.Open(m.Path)
+	if err != nil {
+		return errors.Wrap(err, "opening dead letter file")
+	}
+	defer f.Close()
+	src := &stageSource{src: pdk.NewDeadLetterSource(f)}
+	if len(m.Stages) > 0 {
+		src.stages = make(map[pdk.Stage]bool)
+		for _, stage := range m.Stages {
+			src.stages[pdk.Stage(stage)] = true
+		}
+	}
+
+	parser := pdk.NewDefaultGenericParser()
+	mapper := pdk.NewCollapsingMapper()
+	mapper.Framer = &m.Framer
+	if len(m.SubjectPath) == 0 {
+		parser.Subjecter = pdk.BlankSubjecter{}
+	} else {
+		parser.EntitySubjecter = pdk.SubjectPath(m.SubjectPath)
+		mapper.ColTranslator = pdk.NewMapFieldTranslator()
+	}
+
+	mapper.Decimals, err = pdk.ParseDecimals(m.Decimals)
+	if err != nil {
+		return errors.Wrap(err, "parsing decimals")
+	}
+	m.Types.Setup(mapper)
+	pilosaOpts, err := m.Time.Setup(parser, mapper)
+	if err != nil {
+		return errors.Wrap(err, "configuring timestamps")
+	}
+	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, nil, m.BatchSize, pilosaOpts...)
+	if err != nil {
+		return errors.Wrap(err, "setting up Pilosa")
+	}
+	ingester := pdk.NewIngester(src, parser, mapper, indexer)
+	if m.DeadLetter != "" {
+		sink, err := pdk.NewFileDeadLetterSink(m.DeadLetter)
+		if err != nil {
+			return errors.Wrap(err, "setting up dead letter sink")
+		}
+		defer sink.Close()
+		ingester.DeadLetters = sink
+	}
+	return errors.Wrap(ingester.RunContext(ctx), "running ingester")
+}
+
+// stageSource returns the records from a DeadLetterSource, skipping those which
+// failed at a stage not in stages (if stages is set).
+type stageSource struct {
+	src    *pdk.DeadLetterSource
+	stages map[pdk.Stage]bool
+}
+
+func (s *stageSource) Record() (interface{}, error) {
+	for {
+		dl, err := s.src.DeadLetter()
+		if err != nil {
+			return nil, err
+		}
+		if s.stages == nil || s.stages[dl.Stage] {
+			return dl.Value(), nil
+		}
+	}
+}
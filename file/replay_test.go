@@ -0,0 +1,52 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pilosa/pdk"
+	"github.com/pilosa/pilosa/test"
+	"github.com/pkg/errors"
+)
+
+func TestReplay(t *testing.T) {
+	pilosa := test.MustRunCluster(t, 1)
+	defer pilosa.Close()
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "deadletters")
+	sink, err := pdk.NewFileDeadLetterSink(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, stage := range []pdk.Stage{pdk.StageParse, pdk.StageMap, pdk.StageParse} {
+		rec := map[string]interface{}{"id": float64(i), "stuff": "stuff1"}
+		if err := sink.DeadLetter(rec, stage, errors.New("oops")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := NewReplayMain()
+	cmd.Path = fname
+	cmd.Stages = []string{"parse"}
+	cmd.PilosaHosts = []string{pilosa[0].API.Node().URI.HostPort()}
+	cmd.SubjectPath = []string{"id"}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+
+	res := mustQueryHost(t, "Count(Row(stuff=0))", cmd.PilosaHosts[0])
+	if !strings.Contains(res, `"results":[2]`) {
+		t.Fatalf("expected 2 replayed records, got %s", res)
+	}
+}
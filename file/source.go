@@ -1,31 +1,55 @@
 package file
 
 import (
+	"context"
+	gojson "encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pilosa/pdk"
 	"github.com/pilosa/pdk/json"
+	"github.com/pilosa/pdk/unpack"
 	"github.com/pkg/errors"
 )
 
-// Source is a pdk.Source which reads json objects from files on disk.
+// Source is a pdk.Source which reads json objects from files on disk. Files
+// compressed with gzip, bzip2, zstd or xz are decompressed, and each file in a
+// tar or zip archive is read in turn.
 type Source struct {
-	rawSource *RawSource
+	path      string
+	rawSource pdk.RawSource
 	records   chan record
 	subjectAt string
+
+	fragments       int
+	minFragmentSize int64
+
+	follow       bool
+	pollInterval time.Duration
+	stop         chan struct{}
+	closeOnce    sync.Once
+
+	mu      sync.Mutex
+	tracker *pdk.OffsetTracker
+
+	cpLock    sync.Mutex
+	cpFile    string
+	committed map[string]progress
 }
 
 // SrcOption is a functional option for the file Source.
 type SrcOption func(s *Source) error
 
 // OptSrcSubjectAt tells the source to add a new key to each record whose value
-// will be <filename>#<record number>.
+// will be <filename>#<record number>. The filename of a file in an archive is
+// <archive filename>/<member name>.
 func OptSrcSubjectAt(key string) SrcOption {
 	return func(s *Source) error {
 		s.subjectAt = key
@@ -36,37 +60,87 @@ func OptSrcSubjectAt(key string) SrcOption {
 // OptSrcPath sets the path name for the file or directory to use for source
 // data.
 func OptSrcPath(pathname string) SrcOption {
-	return func(s *Source) (err error) {
-		s.rawSource, err = NewRawSource(pathname)
-		if err != nil {
-			return errors.Wrap(err, "getting raw source")
-		}
+	return func(s *Source) error {
+		s.path = pathname
 		return nil
 	}
 }
 
+// OptSrcFragments tells the source to split files of at least minSize bytes
+// into n fragments, and to read n files or fragments at once (see
+// OptRawFragments). Subjects are numbered from the start of each fragment.
+func OptSrcFragments(n int, minSize int64) SrcOption {
+	return func(s *Source) error {
+		s.fragments = n
+		s.minFragmentSize = minSize
+		return nil
+	}
+}
+
+// OptSrcCheckpoint tells the source to record the progress of each file in
+// filename as records are committed, and to skip records which were committed
+// by a previous run. Progress is stored as the number of leading records in
+// each file which have been durably indexed or, when following (see
+// OptSrcFollow), as the byte offset in each file up to which records have been.
+func OptSrcCheckpoint(filename string) SrcOption {
+	return func(s *Source) error {
+		s.cpFile = filename
+		s.committed = make(map[string]progress)
+		s.tracker = pdk.NewOffsetTracker()
+		data, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "reading checkpoint file")
+		}
+		return errors.Wrap(gojson.Unmarshal(data, &s.committed), "decoding checkpoint file")
+	}
+}
+
 func (s *Source) run() {
+	wg := sync.WaitGroup{}
+	for i := 0; i < s.fragments || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.read()
+		}()
+	}
+	wg.Wait()
+	close(s.records)
+}
+
+// read reads records from the source's readers until there are none left.
+func (s *Source) read() {
 	reader, err := s.rawSource.NextReader()
 	for ; err == nil; reader, err = s.rawSource.NextReader() {
 		src := json.NewSource(reader)
-		r := record{}
+		s.cpLock.Lock()
+		skip := s.committed[reader.Name()].idx
+		s.cpLock.Unlock()
 		for i := 0; true; i++ {
+			r := record{file: reader.Name(), idx: int64(i)}
 			r.data, r.err = src.Record()
 			if r.err == io.EOF {
-				reader.Close()
 				break
+			} else if r.err != nil {
+				r.err = errors.Wrapf(r.err, "decoding json from %s", reader.Name())
+				s.records <- r
+				break
+			}
+			if r.idx < skip {
+				continue // indexed by a previous run
 			}
 			if s.subjectAt != "" {
 				r.data.(map[string]interface{})[s.subjectAt] = fmt.Sprintf("%s#%d", reader.Name(), i)
 			}
 			s.records <- r
 		}
+		reader.Close()
 	}
-	if err != nil {
+	if err != io.EOF {
 		s.records <- record{err: errors.Wrap(err, "getting next reader")}
 	}
-
-	close(s.records)
 }
 
 // NewSource gets a new file source which will index json data from a file or
@@ -81,6 +155,22 @@ func NewSource(opts ...SrcOption) (*Source, error) {
 			return nil, err
 		}
 	}
+	if s.follow {
+		if s.fragments > 1 {
+			return nil, errors.New("can't split files which are being followed")
+		}
+		if _, err := os.Stat(s.path); err != nil {
+			return nil, errors.Wrap(err, "statting path")
+		}
+		s.stop = make(chan struct{})
+		go s.runFollow()
+		return s, nil
+	}
+	rs, err := NewRawSource(s.path, OptRawFragments(s.fragments, s.minFragmentSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "getting raw source")
+	}
+	s.rawSource = unpack.NewRawSource(rs)
 	go s.run()
 	return s, nil
 }
@@ -88,28 +178,190 @@ func NewSource(opts ...SrcOption) (*Source, error) {
 // Record implements pdk.Record returning a map[string]interface{} for each json
 // object in the source files.
 func (s *Source) Record() (interface{}, error) {
-	rec, ok := <-s.records
+	return s.RecordContext(context.Background())
+}
+
+// RecordContext works like Record, but returns ctx.Err() if ctx is done before
+// a record is read.
+func (s *Source) RecordContext(ctx context.Context) (interface{}, error) {
+	select {
+	case rec, ok := <-s.records:
+		if !ok {
+			return nil, io.EOF
+		}
+		return rec.data, rec.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CheckpointRecord works like Record, but also returns a checkpoint for the
+// record which can be passed to Commit.
+func (s *Source) CheckpointRecord(ctx context.Context) (interface{}, pdk.Checkpoint, error) {
+	s.mu.Lock()
+	var rec record
+	var ok bool
+	select {
+	case rec, ok = <-s.records:
+	case <-ctx.Done():
+		s.mu.Unlock()
+		return nil, nil, ctx.Err()
+	}
+	if ok && rec.err == nil && s.tracker != nil {
+		s.tracker.Add(rec.file, rec.idx)
+	}
+	s.mu.Unlock()
 	if !ok {
-		return nil, io.EOF
+		return nil, nil, io.EOF
 	}
-	return rec.data, rec.err
+	return rec.data, checkpoint{file: rec.file, idx: rec.idx, fingerprint: rec.fingerprint}, rec.err
+}
+
+// Commit records that the records identified by cps have been indexed. If the
+// source has a checkpoint file, it is rewritten whenever a file's progress
+// moves forward. Without one, Commit does nothing.
+func (s *Source) Commit(cps []pdk.Checkpoint) error {
+	if s.tracker == nil {
+		return nil
+	}
+	s.cpLock.Lock()
+	defer s.cpLock.Unlock()
+	dirty := false
+	for _, icp := range cps {
+		cp, ok := icp.(checkpoint)
+		if !ok {
+			return errors.Errorf("unexpected checkpoint type %T for file source", icp)
+		}
+		if idx, ok := s.tracker.Done(cp.file, cp.idx); ok {
+			if s.follow {
+				// the offset of the end of the record
+				s.committed[cp.file] = progress{idx: idx, fingerprint: cp.fingerprint}
+			} else {
+				s.committed[cp.file] = progress{idx: idx + 1}
+			}
+			dirty = true
+		}
+	}
+	if !dirty {
+		return nil
+	}
+	return s.writeCheckpoint()
+}
+
+// writeCheckpoint rewrites the checkpoint file with the progress in
+// s.committed. s.cpLock must be held.
+func (s *Source) writeCheckpoint() error {
+	data, err := gojson.Marshal(s.committed)
+	if err != nil {
+		return errors.Wrap(err, "encoding checkpoints")
+	}
+	// write and rename so that a crash can't leave a partial checkpoint file.
+	tmp := s.cpFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "writing checkpoint file")
+	}
+	return errors.Wrap(os.Rename(tmp, s.cpFile), "replacing checkpoint file")
 }
 
 type record struct {
-	data interface{}
-	err  error
+	data        interface{}
+	err         error
+	file        string
+	idx         int64
+	fingerprint string // of the file, when following
+}
+
+// checkpoint is the pdk.Checkpoint for a record in a file.
+type checkpoint struct {
+	file        string
+	idx         int64
+	fingerprint string
+}
+
+// progress is how far the records of a file have been committed: the number
+// of leading records, or when following, the byte offset up to which records
+// have been along with the fingerprint of the file (see fingerprint).
+type progress struct {
+	idx         int64
+	fingerprint string
+}
+
+// MarshalJSON encodes p as a bare number if it has no fingerprint, and
+// otherwise as an object.
+func (p progress) MarshalJSON() ([]byte, error) {
+	if p.fingerprint == "" {
+		return gojson.Marshal(p.idx)
+	}
+	return gojson.Marshal(progressJSON{Offset: p.idx, Fingerprint: p.fingerprint})
+}
+
+// UnmarshalJSON decodes either form written by MarshalJSON.
+func (p *progress) UnmarshalJSON(data []byte) error {
+	if err := gojson.Unmarshal(data, &p.idx); err == nil {
+		p.fingerprint = ""
+		return nil
+	}
+	var pj progressJSON
+	if err := gojson.Unmarshal(data, &pj); err != nil {
+		return err
+	}
+	p.idx, p.fingerprint = pj.Offset, pj.Fingerprint
+	return nil
+}
+
+type progressJSON struct {
+	Offset      int64  `json:"offset"`
+	Fingerprint string `json:"fingerprint"`
 }
 
+// Keys which RawSource sets in the Meta of the readers it returns.
+const (
+	// MetaPath is the path of the file a reader reads.
+	MetaPath = "path"
+	// MetaFragment is the index of the fragment of its file which a reader
+	// reads, if the file was split (see OptRawFragments).
+	MetaFragment = "fragment"
+)
+
+// RawSource is a pdk.RawSource which returns a reader for each file in a
+// directory, or for a single file.
 type RawSource struct {
 	files   []string
 	fileIdx *uint64
+
+	fragments       int
+	minFragmentSize int64
+
+	mu      sync.Mutex
+	pending []pdk.NamedReadCloser
 }
 
-func NewRawSource(pathname string) (*RawSource, error) {
+// RawOption is a functional option for RawSource.
+type RawOption func(s *RawSource)
+
+// OptRawFragments tells the RawSource to split each file of at least minSize
+// bytes into n fragments which end on line breaks, and return a reader for
+// each so that they may be read concurrently. A fragment is named
+// <filename>@<offset of its first byte>. Compressed files and archives aren't
+// split, and neither should files whose records may span lines (such as CSV
+// with quoted line breaks) be.
+func OptRawFragments(n int, minSize int64) RawOption {
+	return func(s *RawSource) {
+		s.fragments = n
+		s.minFragmentSize = minSize
+	}
+}
+
+// NewRawSource returns a RawSource which reads the file at pathname or, if it
+// is a directory, each file in it.
+func NewRawSource(pathname string, opts ...RawOption) (*RawSource, error) {
 	fileIdx := uint64(0)
 	s := &RawSource{
 		fileIdx: &fileIdx,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
 	info, err := os.Stat(pathname)
 	if err != nil {
 		return nil, errors.Wrap(err, "statting path")
@@ -137,9 +389,32 @@ func (m *metaFile) Name() string {
 	return filepath.Base(m.File.Name())
 }
 
-func (m *metaFile) Meta() map[string]interface{} { return nil }
+func (m *metaFile) Meta() map[string]interface{} {
+	return map[string]interface{}{MetaPath: m.File.Name()}
+}
+
+// fragment is the pdk.NamedReadCloser for part of a file.
+type fragment struct {
+	*pdk.FileFragment
+	name string
+	meta map[string]interface{}
+}
+
+func (f *fragment) Name() string                 { return f.name }
+func (f *fragment) Meta() map[string]interface{} { return f.meta }
 
+// NextReader implements pdk.RawSource.
 func (s *RawSource) NextReader() (pdk.NamedReadCloser, error) {
+	if s.fragments > 1 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.pending) > 0 {
+			r := s.pending[0]
+			s.pending = s.pending[1:]
+			return r, nil
+		}
+	}
+
 	idx := atomic.AddUint64(s.fileIdx, 1) - 1
 	if int(idx) >= len(s.files) {
 		return nil, io.EOF
@@ -150,6 +425,61 @@ func (s *RawSource) NextReader() (pdk.NamedReadCloser, error) {
 		return nil, errors.Wrapf(err, "opening %s", s.files[idx])
 	}
 
+	if s.fragments > 1 {
+		frags, err := s.split(file)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "splitting %s", s.files[idx])
+		}
+		if len(frags) > 0 {
+			file.Close() // each fragment has its own handle
+			s.pending = frags[1:]
+			return frags[0], nil
+		}
+	}
+
 	mf := metaFile{file}
 	return &mf, nil
 }
+
+// split returns the fragments of f, or nothing if f shouldn't be split. It
+// leaves f at its start.
+func (s *RawSource) split(f *os.File) ([]pdk.NamedReadCloser, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "statting")
+	}
+	if info.Size() < s.minFragmentSize || info.Size() == 0 {
+		return nil, nil
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrap(err, "reading head")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seeking to start")
+	}
+	if unpack.Packed(head[:n], f.Name()) {
+		return nil, nil
+	}
+	ffs, err := pdk.SplitFileLines(f, int64(s.fragments))
+	if _, serr := f.Seek(0, io.SeekStart); err == nil && serr != nil {
+		err = errors.Wrap(serr, "seeking to start")
+	}
+	if err != nil {
+		for _, ff := range ffs {
+			ff.Close()
+		}
+		return nil, err
+	}
+	frags := make([]pdk.NamedReadCloser, len(ffs))
+	for i, ff := range ffs {
+		frags[i] = &fragment{
+			FileFragment: ff,
+			name:         fmt.Sprintf("%s@%d", filepath.Base(f.Name()), ff.Start()),
+			meta:         map[string]interface{}{MetaPath: f.Name(), MetaFragment: i},
+		}
+	}
+	return frags, nil
+}
@@ -1,11 +1,17 @@
 package file
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/pilosa/pdk"
@@ -125,3 +131,203 @@ func TestSource(t *testing.T) {
 	}
 
 }
+
+func TestSourceCheckpoint(t *testing.T) {
+	d := mustTempDir(t, "testsourcecheckpoint")
+	defer func() {
+		os.RemoveAll(d)
+	}()
+	data := mustTempDir(t, "testsourcecheckpointdata")
+	defer func() {
+		os.RemoveAll(data)
+	}()
+	mustFile(t, data, `{"hey": 0}
+{"hey": 1}
+{"hey": 2}
+{"hey": 3}
+`)
+	cpFile := filepath.Join(d, "checkpoint")
+
+	s, err := NewSource(OptSrcPath(data), OptSrcCheckpoint(cpFile))
+	if err != nil {
+		t.Fatalf("getting source: %v", err)
+	}
+	cps := make([]pdk.Checkpoint, 0)
+	for i := 0; i < 3; i++ {
+		_, cp, err := s.CheckpointRecord(context.Background())
+		if err != nil {
+			t.Fatalf("getting record %d: %v", i, err)
+		}
+		cps = append(cps, cp)
+	}
+	// commit out of order, and leave a gap so that only the first record is
+	// durable.
+	err = s.Commit([]pdk.Checkpoint{cps[2], cps[0]})
+	if err != nil {
+		t.Fatalf("committing: %v", err)
+	}
+
+	s, err = NewSource(OptSrcPath(data), OptSrcCheckpoint(cpFile))
+	if err != nil {
+		t.Fatalf("getting resumed source: %v", err)
+	}
+	got := make([]float64, 0)
+	var rec interface{}
+	for rec, err = s.Record(); err == nil; rec, err = s.Record() {
+		got = append(got, rec.(map[string]interface{})["hey"].(float64))
+	}
+	if err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, []float64{1, 2, 3}) {
+		t.Fatalf("unexpected records after resume: %v", got)
+	}
+}
+
+func TestSourceArchive(t *testing.T) {
+	d := mustTempDir(t, "testsourcearchive")
+	defer func() {
+		os.RemoveAll(d)
+	}()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"a.json", "b.json"} {
+		content := `{"hey": 1}` + "\n" + `{"hey": 2}` + "\n"
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("writing header: %v", err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatalf("writing content: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("closing gzip: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "dump.tar.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("writing archive: %v", err)
+	}
+
+	s, err := NewSource(OptSrcSubjectAt("here"), OptSrcPath(d))
+	if err != nil {
+		t.Fatalf("getting source: %v", err)
+	}
+	subjects := make([]string, 0)
+	var rec interface{}
+	for rec, err = s.Record(); err == nil; rec, err = s.Record() {
+		subjects = append(subjects, rec.(map[string]interface{})["here"].(string))
+	}
+	if err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []string{"dump.tar.gz/a.json#0", "dump.tar.gz/a.json#1", "dump.tar.gz/b.json#0", "dump.tar.gz/b.json#1"}
+	if !reflect.DeepEqual(subjects, exp) {
+		t.Fatalf("unexpected subjects: %v", subjects)
+	}
+}
+
+func TestRawSourceFragments(t *testing.T) {
+	d := mustTempDir(t, "testrawsourcefragments")
+	defer func() {
+		os.RemoveAll(d)
+	}()
+	lines := ""
+	for i := 0; i < 100; i++ {
+		lines += fmt.Sprintf("line %d\n", i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "a"), []byte(lines), 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "b"), []byte("small\n"), 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	io.WriteString(gz, lines)
+	gz.Close()
+	if err := ioutil.WriteFile(filepath.Join(d, "c.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	rs, err := NewRawSource(d, OptRawFragments(4, 100))
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	var joined string
+	var names []string
+	for {
+		r, err := rs.NextReader()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("getting reader: %v", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading %s: %v", r.Name(), err)
+		}
+		r.Close()
+		names = append(names, r.Name())
+		if strings.HasPrefix(r.Name(), "a@") {
+			if frag := r.Meta()[MetaFragment].(int); frag != len(names)-1 {
+				t.Errorf("fragment %s has index %d", r.Name(), frag)
+			}
+			if !strings.HasSuffix(string(data), "\n") {
+				t.Errorf("fragment %s doesn't end on a line break: %q", r.Name(), data)
+			}
+			joined += string(data)
+		}
+	}
+	if joined != lines {
+		t.Fatalf("fragments don't make up the file: %q", joined)
+	}
+	exp := []string{"a@0", "a@198", "a@398", "a@598", "b", "c.gz"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected readers: %v", names)
+	}
+}
+
+func TestSourceFragments(t *testing.T) {
+	d := mustTempDir(t, "testsourcefragments")
+	defer func() {
+		os.RemoveAll(d)
+	}()
+	lines := ""
+	for i := 0; i < 1000; i++ {
+		lines += fmt.Sprintf(`{"hey": %d}`+"\n", i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "a.json"), []byte(lines), 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	s, err := NewSource(OptSrcSubjectAt("here"), OptSrcPath(d), OptSrcFragments(4, 0))
+	if err != nil {
+		t.Fatalf("getting source: %v", err)
+	}
+	vals := make(map[float64]bool)
+	subjects := make(map[string]bool)
+	fragments := make(map[string]bool)
+	var rec interface{}
+	for rec, err = s.Record(); err == nil; rec, err = s.Record() {
+		recm := rec.(map[string]interface{})
+		vals[recm["hey"].(float64)] = true
+		subj := recm["here"].(string)
+		if subjects[subj] {
+			t.Fatalf("duplicate subject %s", subj)
+		}
+		subjects[subj] = true
+		fragments[strings.Split(subj, "#")[0]] = true
+	}
+	if err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vals) != 1000 {
+		t.Fatalf("expected 1000 records, got %d", len(vals))
+	}
+	if len(fragments) != 4 || !subjects["a.json@0#0"] {
+		t.Fatalf("unexpected fragments %v", fragments)
+	}
+}
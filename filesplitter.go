@@ -81,9 +81,14 @@ func (ff *FileFragment) Read(b []byte) (n int, err error) {
 	return ff.file.Read(b)
 }
 
+// Start returns the location in the file at which ff starts.
+func (ff *FileFragment) Start() int64 {
+	return ff.startLoc
+}
+
 // Close implements io.Closer for a FileFragment.
 func (ff *FileFragment) Close() error {
-	return nil // TODO
+	return ff.file.Close()
 }
 
 // SplitFileLines returns a slice of file fragments which is numParts in length.
@@ -1,38 +1,43 @@
 module github.com/pilosa/pdk
 
 require (
-	github.com/Shopify/sarama v1.19.0
+	github.com/Shopify/sarama v1.23.1
 	github.com/Shopify/toxiproxy v2.1.4+incompatible // indirect
-	github.com/aws/aws-sdk-go v1.15.88
+	github.com/aws/aws-sdk-go v1.30.19
 	github.com/boltdb/bolt v1.3.1
 	github.com/bsm/sarama-cluster v2.1.15+incompatible
 	github.com/eapache/go-resiliency v1.1.0 // indirect
 	github.com/eapache/go-xerial-snappy v0.0.0-20180814174437-776d5712da21 // indirect
 	github.com/eapache/queue v1.1.0 // indirect
 	github.com/elodina/go-avro v0.0.0-20160406082632-0c8185d9a3ba
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gogo/protobuf v1.3.1 // indirect
-	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.3.3
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/hashicorp/go-uuid v1.0.1 // indirect
 	github.com/jaffee/commandeer v0.1.0
+	github.com/jhump/protoreflect v1.6.1
+	github.com/klauspost/compress v1.10.5
 	github.com/linkedin/goavro v0.0.0-20181018120728-1beee2a74088
 	github.com/lotreal/pdk v0.8.0 // indirect
 	github.com/miekg/dns v1.1.1 // indirect
 	github.com/mmcloughlin/geohash v0.0.0-20181009053802-f7f2bcae3294
 	github.com/onsi/ginkgo v1.7.0 // indirect
 	github.com/onsi/gomega v1.4.3 // indirect
-	github.com/pierrec/lz4 v0.0.0-20181005164709-635575b42742 // indirect
 	github.com/pilosa/go-pilosa v1.3.1-0.20190612142550-e616c1393660
 	github.com/pilosa/pilosa v1.4.0
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
 	github.com/rcrowley/go-metrics v0.0.0-20181016184325-3113b8401b8a // indirect
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.3.1
-	github.com/stretchr/testify v1.3.0 // indirect
 	github.com/syndtr/goleveldb v0.0.0-20181128100959-b001fa50d6b2
+	github.com/ulikunitz/xz v0.5.15
+	github.com/xdg/scram v1.0.5
+	github.com/xitongsys/parquet-go v1.5.4
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
 	gopkg.in/linkedin/goavro.v1 v1.0.5 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 go 1.13
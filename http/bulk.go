@@ -0,0 +1,271 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package http
+
+import (
+	gojson "encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Properties which BulkHandler adds to each record.
+const (
+	BulkIndex   = "_index"
+	BulkID      = "_id"
+	BulkDeleted = "_deleted"
+)
+
+// BulkHandler accepts documents in the format of the Elasticsearch bulk API,
+// so that shippers which write to Elasticsearch can write to a JSONSource
+// instead. The document of each index or create action is posted to the
+// source with the action's index and id as the BulkIndex and BulkID
+// properties. A delete action posts a record holding just those, and
+// BulkDeleted set to true, which an UpsertMapper treats as a tombstone if its
+// DeletePath is BulkDeleted (and the subject path is BulkID). Update actions
+// aren't supported, and fail.
+//
+// Each action gets an item in the response, which reports the outcome of its
+// record if the source acknowledges records (see WithAck), and success
+// otherwise. Records which failed because Pilosa couldn't be reached get
+// status 429, so that clients retry them, and those which couldn't be parsed,
+// mapped or indexed get 400. GET / is answered with version information as
+// some clients check it before writing.
+type BulkHandler struct {
+	src *JSONSource
+}
+
+// NewBulkHandler returns a BulkHandler which posts records to src.
+func NewBulkHandler(src *JSONSource) *BulkHandler {
+	return &BulkHandler{src: src}
+}
+
+// handles reports whether r is for one of the handler's paths.
+func (h *BulkHandler) handles(r *http.Request) bool {
+	switch path := r.URL.Path; {
+	case path == "/_bulk" || strings.HasSuffix(path, "/_bulk") && strings.Count(path, "/") == 2:
+		return true
+	case path == "/" || path == "/_cluster/health":
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	return false
+}
+
+// bulkItem is an action from a bulk request, and its outcome. rec is nil if
+// the action failed without being posted.
+type bulkItem struct {
+	action string
+	index  string
+	id     string
+	rec    map[string]interface{}
+	err    error
+}
+
+// ServeHTTP implements http.Handler.
+func (h *BulkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	switch {
+	case r.URL.Path == "/":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":         "pdk",
+			"cluster_name": "pdk",
+			"version":      map[string]interface{}{"number": "7.10.2"},
+			"tagline":      "You Know, for Search",
+		})
+		return
+	case r.URL.Path == "/_cluster/health":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"cluster_name": "pdk", "status": "green"})
+		return
+	case r.Method != http.MethodPost && r.Method != http.MethodPut:
+		bulkError(w, http.StatusMethodNotAllowed, "illegal_argument_exception", "unsupported method: "+r.Method)
+		return
+	}
+	if !h.src.authorized(token(r)) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="security" charset="UTF-8"`)
+		bulkError(w, http.StatusUnauthorized, "security_exception", "missing or invalid credentials")
+		return
+	}
+	body, status, err := h.src.body(r)
+	if err != nil {
+		bulkError(w, status, "parse_exception", err.Error())
+		return
+	}
+	defer body.Close()
+	index := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "_bulk")
+	items, err := readBulk(body, strings.TrimSuffix(index, "/"))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Cause(err) == errTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		bulkError(w, status, "parse_exception", err.Error())
+		return
+	}
+
+	recs := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if item.rec != nil {
+			recs = append(recs, item.rec)
+		}
+	}
+	errs, err := h.src.submit(r.Context(), recs)
+	if err != nil {
+		bulkError(w, http.StatusServiceUnavailable, "unavailable_shards_exception", err.Error())
+		return
+	}
+	resp := bulkResponse{Items: make([]map[string]bulkResult, len(items))}
+	i := 0
+	for n, item := range items {
+		if item.rec != nil {
+			if errs != nil {
+				item.err = errs[i]
+			}
+			i++
+		}
+		res := bulkResult{Index: item.index, ID: item.id}
+		switch {
+		case item.err != nil && temporary(item.err):
+			// like a full Elasticsearch queue, which clients retry.
+			resp.Errors = true
+			res.Status = http.StatusTooManyRequests
+			res.Error = &bulkErrorCause{Type: "es_rejected_execution_exception", Reason: item.err.Error()}
+		case item.err != nil:
+			resp.Errors = true
+			res.Status = http.StatusBadRequest
+			res.Error = &bulkErrorCause{Type: "mapper_parsing_exception", Reason: item.err.Error()}
+		case item.action == "delete":
+			res.Status, res.Result = http.StatusOK, "deleted"
+		default:
+			res.Status, res.Result = http.StatusCreated, "created"
+		}
+		resp.Items[n] = map[string]bulkResult{item.action: res}
+	}
+	resp.Took = int64(time.Since(start) / time.Millisecond)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readBulk reads the actions in the body of a bulk request, and the records
+// they post. Actions which can't be posted get an error. It returns an error
+// if the body is malformed.
+func readBulk(body io.Reader, defaultIndex string) ([]bulkItem, error) {
+	dec := gojson.NewDecoder(body)
+	var items []bulkItem
+	for {
+		var action map[string]map[string]interface{}
+		err := dec.Decode(&action)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding action")
+		}
+		if len(action) != 1 {
+			return nil, errors.Errorf("malformed action/metadata line [%d], expected a single action", len(items)+1)
+		}
+		var item bulkItem
+		var meta map[string]interface{}
+		for item.action, meta = range action {
+		}
+		item.index = defaultIndex
+		if index, ok := meta["_index"]; ok {
+			item.index = fmt.Sprint(index)
+		}
+		if id, ok := meta["_id"]; ok && id != nil {
+			item.id = fmt.Sprint(id)
+		}
+		switch item.action {
+		case "index", "create":
+			var doc map[string]interface{}
+			if err := dec.Decode(&doc); err != nil {
+				return nil, errors.Wrapf(err, "decoding document of action [%d]", len(items)+1)
+			}
+			if doc == nil {
+				return nil, errors.Errorf("document of action [%d] is not an object", len(items)+1)
+			}
+			doc[BulkIndex] = item.index
+			if item.id != "" {
+				doc[BulkID] = item.id
+			}
+			item.rec = doc
+		case "delete":
+			if item.id == "" {
+				item.err = errors.New("delete requires an _id")
+				break
+			}
+			item.rec = map[string]interface{}{BulkIndex: item.index, BulkID: item.id, BulkDeleted: true}
+		case "update":
+			var doc gojson.RawMessage
+			if err := dec.Decode(&doc); err != nil {
+				return nil, errors.Wrapf(err, "decoding document of action [%d]", len(items)+1)
+			}
+			item.err = errors.New("update actions are not supported")
+		default:
+			return nil, errors.Errorf("malformed action/metadata line [%d], unknown action [%s]", len(items)+1, item.action)
+		}
+		items = append(items, item)
+	}
+}
+
+// bulkResponse is the response to a bulk request.
+type bulkResponse struct {
+	Took   int64                   `json:"took"`
+	Errors bool                    `json:"errors"`
+	Items  []map[string]bulkResult `json:"items"`
+}
+
+// bulkResult is the outcome of one action of a bulk request.
+type bulkResult struct {
+	Index  string          `json:"_index"`
+	ID     string          `json:"_id,omitempty"`
+	Status int             `json:"status"`
+	Result string          `json:"result,omitempty"`
+	Error  *bulkErrorCause `json:"error,omitempty"`
+}
+
+type bulkErrorCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// bulkError responds to a request which failed as a whole the way
+// Elasticsearch does.
+func bulkError(w http.ResponseWriter, status int, typ, reason string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error":  bulkErrorCause{Type: typ, Reason: reason},
+		"status": status,
+	})
+}
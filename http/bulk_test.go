@@ -0,0 +1,135 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package http_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pilosa/pdk/http"
+)
+
+func TestBulkHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	j, err := http.NewJSONSource(http.WithListener(ln), http.WithAck(), http.WithTokens("secret"), http.WithProtocols(http.ProtocolElasticsearch))
+	if err != nil {
+		t.Fatalf("getting json source: %v", err)
+	}
+	ingested, stop := ingest(j)
+	defer stop()
+
+	body := `{"index": {"_id": "1"}}
+{"msg": "hi"}
+{"create": {"_index": "other"}}
+{"bad": true}
+{"update": {"_id": "1"}}
+{"doc": {"msg": "bye"}}
+{"delete": {"_id": 2}}
+{"index": {"_id": "3"}}
+{"busy": true}
+`
+	req := httptest.NewRequest("POST", "/logs/_bulk", strings.NewReader(body))
+	req.SetBasicAuth("elastic", "secret")
+	w := httptest.NewRecorder()
+	j.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Errors bool
+		Items  []map[string]struct {
+			Index  string `json:"_index"`
+			ID     string `json:"_id"`
+			Status int
+			Error  *struct{ Type, Reason string }
+		}
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if !resp.Errors || len(resp.Items) != 5 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	for i, exp := range []struct {
+		action, index, id string
+		status            int
+		failed            bool
+	}{
+		{"index", "logs", "1", 201, false},
+		{"create", "other", "", 400, true},
+		{"update", "logs", "1", 400, true},
+		{"delete", "logs", "2", 200, false},
+		{"index", "logs", "3", 429, true},
+	} {
+		item, ok := resp.Items[i][exp.action]
+		if !ok || item.Index != exp.index || item.ID != exp.id || item.Status != exp.status || (item.Error != nil) != exp.failed {
+			t.Errorf("unexpected item %d: %+v", i, resp.Items[i])
+		}
+	}
+	exp := []interface{}{
+		map[string]interface{}{"msg": "hi", http.BulkIndex: "logs", http.BulkID: "1"},
+		map[string]interface{}{http.BulkIndex: "logs", http.BulkID: "2", http.BulkDeleted: true},
+	}
+	if !reflect.DeepEqual(ingested(), exp) {
+		t.Fatalf("unexpected records: %#v", ingested())
+	}
+
+	for _, test := range []struct {
+		method, path, auth, body string
+		status                   int
+	}{
+		{"GET", "/", "", "", 200},
+		{"POST", "/_bulk", "", `{"index": {}}` + "\n" + `{"a": 1}`, 401},
+		{"POST", "/_bulk", "ApiKey secret", `{"index": {}}` + "\n" + `{"a": 1}`, 200},
+		{"POST", "/_bulk", "ApiKey secret", `{"index": {}, "create": {}}`, 400},
+		{"POST", "/_bulk", "ApiKey secret", `{"index": {}}` + "\n" + `{"a": `, 400},
+		{"POST", "/other", "ApiKey secret", `{"a": 1}`, 404},
+	} {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		j.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s %s %q: expected %d, got %d: %s", test.method, test.path, test.body, test.status, w.Code, w.Body)
+		}
+	}
+}
@@ -33,10 +33,13 @@
 package http
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 
+	gopilosa "github.com/pilosa/go-pilosa"
 	"github.com/pilosa/pdk"
 	"github.com/pilosa/pdk/leveldb"
 	"github.com/pkg/errors"
@@ -58,6 +61,15 @@ type Main struct {
 	Proxy         string   `help:"Bind to this address to proxy and translate requests to Pilosa"`
 	AllowedFields []string `help:"If any are passed, only frame names in this comma separated list will be indexed."`
 	TranslatorDir string   `help:"Directory for key/id mapping storage."`
+	Spec          string   `help:"YAML or JSON file declaring which paths to index into which fields (see pdk.Spec). Overrides the framer and subject path."`
+	Decimals      []string `help:"Comma separated field:places pairs. Numbers indexed into these int fields keep that many decimal places (they are stored multiplied by 10^places)."`
+	Ack           bool     `help:"Respond to each request only once its records have been mapped and handed to the indexer, with a JSON body reporting any records which failed."`
+	MaxBodySize   int64    `help:"Reject request bodies bigger than this many bytes (after decompression). 0 means no limit."`
+	Tokens        []string `help:"Comma separated tokens, one of which each request must carry as a Bearer, ApiKey or Splunk token, the password of basic credentials, or an X-API-Key header. Empty means no authentication."`
+	Protocols     []string `help:"Comma separated protocols to accept: json (documents posted to any other path), elasticsearch (the bulk API at /_bulk) and splunk (the HTTP Event Collector at /services/collector)."`
+	Time          pdk.TimeOptions
+	Types         pdk.FieldTypeOptions
+	Upsert        pdk.UpsertOptions
 
 	proxy http.Server
 }
@@ -71,12 +83,24 @@ func NewMain() *Main {
 		BatchSize:   10,
 		Framer:      pdk.DashField{},
 		Proxy:       ":13131",
+		MaxBodySize: 64 << 20,
+		Protocols:   []string{ProtocolJSON},
 	}
 }
 
 // Run runs the http command.
 func (m *Main) Run() error {
-	src, err := NewJSONSource(WithAddr(m.Bind))
+	return m.RunContext(context.Background())
+}
+
+// RunContext works like Run, but stops ingesting once ctx is done, after
+// flushing everything which has already been read.
+func (m *Main) RunContext(ctx context.Context) error {
+	opts := []JSONSourceOption{WithAddr(m.Bind), WithMaxBodySize(m.MaxBodySize), WithTokens(m.Tokens...), WithProtocols(m.Protocols...)}
+	if m.Ack {
+		opts = append(opts, WithAck())
+	}
+	src, err := NewJSONSource(opts...)
 	if err != nil {
 		return errors.Wrap(err, "getting json source")
 	}
@@ -90,6 +114,17 @@ func (m *Main) Run() error {
 
 	log.Println("listening on", src.Addr())
 
+	var spec *pdk.Spec
+	if m.Spec != "" {
+		spec, err = pdk.LoadSpec(m.Spec)
+		if err != nil {
+			return errors.Wrap(err, "loading spec")
+		}
+		if len(spec.Subject) > 0 {
+			m.SubjectPath = spec.Subject
+		}
+	}
+
 	translateColumns := true
 	parser := pdk.NewDefaultGenericParser()
 	if len(m.SubjectPath) == 0 {
@@ -115,21 +150,65 @@ func (m *Main) Run() error {
 		log.Println("not translating columns")
 	}
 
-	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, nil, m.BatchSize)
+	mapper.Decimals, err = pdk.ParseDecimals(m.Decimals)
+	if err != nil {
+		return errors.Wrap(err, "parsing decimals")
+	}
+	m.Types.Setup(mapper)
+	pilosaOpts, err := m.Time.Setup(parser, mapper)
+	if err != nil {
+		return errors.Wrap(err, "configuring timestamps")
+	}
+	if err := m.Upsert.Check(m.Time); err != nil {
+		return err
+	}
+	var recMapper pdk.RecordMapper = mapper
+	var schema *gopilosa.Schema
+	untranslated := mapper.Untranslated()
+	if spec != nil {
+		recMapper = spec.Mapper(mapper)
+		schema = spec.Schema(m.Index)
+		for field, places := range spec.Decimals() {
+			mapper.Decimals[field] = places
+		}
+		for field := range spec.Untranslated() {
+			untranslated[field] = true
+		}
+	}
+	if m.Upsert.Upserting() {
+		dir := m.Upsert.Dir
+		if dir == "" {
+			dir = filepath.Join(m.TranslatorDir, "upsert")
+		}
+		store, err := leveldb.NewRecordStore(dir)
+		if err != nil {
+			return errors.Wrap(err, "opening upsert record store")
+		}
+		defer store.Close()
+		recMapper = m.Upsert.Wrap(recMapper, store)
+	}
+	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, schema, m.BatchSize, pilosaOpts...)
 	if err != nil {
 		return errors.Wrap(err, "setting up Pilosa")
 	}
 
-	ingester := pdk.NewIngester(src, parser, mapper, indexer)
+	var source pdk.Source = src
+	if m.Ack {
+		source = AckJSONSource{src}
+	}
+	ingester := pdk.NewIngester(source, parser, recMapper, indexer)
 	if len(m.AllowedFields) > 0 {
 		ingester.AllowedFields = make(map[string]bool)
 		for _, fram := range m.AllowedFields {
 			ingester.AllowedFields[fram] = true
 		}
 	}
+	fwd := pdk.NewPilosaForwarder(m.PilosaHosts[0], mapper.Translator, mapper.ColTranslator)
+	fwd.SetDecimals(mapper.Decimals)
+	fwd.SetUntranslated(untranslated)
 	m.proxy = http.Server{
 		Addr:    m.Proxy,
-		Handler: pdk.NewPilosaForwarder(m.PilosaHosts[0], mapper.Translator, mapper.ColTranslator),
+		Handler: fwd,
 	}
 	go func() {
 		err := m.proxy.ListenAndServe()
@@ -137,5 +216,5 @@ func (m *Main) Run() error {
 			log.Printf("proxy closed: %v", err)
 		}
 	}()
-	return errors.Wrap(ingester.Run(), "running ingester")
+	return errors.Wrap(ingester.RunContext(ctx), "running ingester")
 }
@@ -0,0 +1,274 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package http
+
+import (
+	"bufio"
+	gojson "encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// hecMetadata are the HEC event properties which HECHandler copies into each
+// record.
+var hecMetadata = []string{"time", "host", "source", "sourcetype", "index"}
+
+// HECHandler accepts events in the format of the Splunk HTTP Event Collector,
+// so that shippers which write to Splunk can write to a JSONSource instead.
+// Events are posted to /services/collector/event (or /services/collector) as
+// a sequence of JSON objects, or to /services/collector/raw as lines of text,
+// in which case their metadata comes from the query string.
+//
+// The record posted for each event is the event itself if it is an object,
+// or an object holding it as "event" otherwise. The event's indexed "fields"
+// are added to it, as are its time, host, source, sourcetype and index, which
+// replace any properties of the event with the same names. The source's
+// tokens are checked against the "Authorization: Splunk <token>" header.
+//
+// Responses use HEC's codes. If the source acknowledges records (see
+// WithAck) and some of them fail, the response has a result for each event,
+// which is "Server is busy" if Pilosa couldn't be reached and "Invalid data
+// format" if the event itself couldn't be indexed. The response is "Invalid
+// data format" with the number of the first invalid event if there is one,
+// and "Server is busy" otherwise, so that the client retries. The other
+// events are still indexed.
+type HECHandler struct {
+	src *JSONSource
+}
+
+// NewHECHandler returns an HECHandler which posts records to src.
+func NewHECHandler(src *JSONSource) *HECHandler {
+	return &HECHandler{src: src}
+}
+
+// handles reports whether r is for one of the handler's paths.
+func (h *HECHandler) handles(r *http.Request) bool {
+	return r.URL.Path == "/services/collector" || strings.HasPrefix(r.URL.Path, "/services/collector/")
+}
+
+// hecResponse is the body of every HEC response.
+type hecResponse struct {
+	Text               string `json:"text"`
+	Code               int    `json:"code"`
+	InvalidEventNumber *int   `json:"invalid-event-number,omitempty"`
+
+	// Results has the outcome of each event, if any failed.
+	Results []hecResponse `json:"results,omitempty"`
+}
+
+// HEC response codes.
+const (
+	hecSuccess       = 0
+	hecTokenRequired = 2
+	hecInvalidToken  = 4
+	hecNoData        = 5
+	hecInvalidFormat = 6
+	hecServerBusy    = 9
+	hecEventRequired = 12
+	hecHealthy       = 17
+	hecNotFound      = 404
+)
+
+// ServeHTTP implements http.Handler.
+func (h *HECHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/1.0"), "/")
+	switch path {
+	case "/services/collector/health":
+		writeJSON(w, http.StatusOK, hecResponse{Text: "HEC is healthy", Code: hecHealthy})
+		return
+	case "/services/collector", "/services/collector/event", "/services/collector/raw":
+		if r.Method == http.MethodPost {
+			break
+		}
+		fallthrough
+	default:
+		// like Splunk, which answers other methods as if the path didn't exist.
+		writeJSON(w, http.StatusNotFound, hecResponse{Text: "The requested URL was not found on this server.", Code: hecNotFound})
+		return
+	}
+	if tok := token(r); !h.src.authorized(tok) {
+		if tok == "" {
+			writeJSON(w, http.StatusUnauthorized, hecResponse{Text: "Token is required", Code: hecTokenRequired})
+		} else {
+			writeJSON(w, http.StatusForbidden, hecResponse{Text: "Invalid token", Code: hecInvalidToken})
+		}
+		return
+	}
+	body, status, err := h.src.body(r)
+	if err != nil {
+		writeJSON(w, status, hecResponse{Text: err.Error(), Code: hecInvalidFormat})
+		return
+	}
+	defer body.Close()
+	var recs []interface{}
+	if path == "/services/collector/raw" {
+		recs, err = readHECRaw(body, r)
+	} else {
+		recs, err = readHECEvents(body)
+	}
+	if err != nil {
+		if errors.Cause(err) == errTooLarge {
+			writeJSON(w, http.StatusRequestEntityTooLarge, hecResponse{Text: err.Error(), Code: hecInvalidFormat})
+		} else if herr, ok := err.(hecError); ok {
+			writeJSON(w, http.StatusBadRequest, herr.hecResponse)
+		} else {
+			writeJSON(w, http.StatusBadRequest, hecResponse{Text: err.Error(), Code: hecInvalidFormat})
+		}
+		return
+	}
+	if len(recs) == 0 {
+		writeJSON(w, http.StatusBadRequest, hecResponse{Text: "No data", Code: hecNoData})
+		return
+	}
+	errs, err := h.src.submit(r.Context(), recs)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, hecResponse{Text: "Server is busy", Code: hecServerBusy})
+		return
+	}
+	writeHECResults(w, errs)
+}
+
+// writeHECResults writes the response for a request whose events were
+// acknowledged with errs.
+func writeHECResults(w http.ResponseWriter, errs []error) {
+	results := make([]hecResponse, len(errs))
+	invalid, failed := -1, false
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			results[i] = hecResponse{Text: "Success", Code: hecSuccess}
+		case temporary(err):
+			results[i] = hecResponse{Text: "Server is busy", Code: hecServerBusy}
+			failed = true
+		default:
+			results[i] = hecResponse{Text: "Invalid data format", Code: hecInvalidFormat}
+			failed = true
+			if invalid < 0 {
+				invalid = i
+			}
+		}
+	}
+	switch {
+	case invalid >= 0:
+		writeJSON(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: hecInvalidFormat, InvalidEventNumber: &invalid, Results: results})
+	case failed:
+		writeJSON(w, http.StatusServiceUnavailable, hecResponse{Text: "Server is busy", Code: hecServerBusy, Results: results})
+	default:
+		writeJSON(w, http.StatusOK, hecResponse{Text: "Success", Code: hecSuccess})
+	}
+}
+
+// hecError is an error which is reported with its own HEC response.
+type hecError struct {
+	hecResponse
+}
+
+func (e hecError) Error() string {
+	return e.Text
+}
+
+// readHECEvents reads a sequence of HEC event objects, and returns the record
+// for each.
+func readHECEvents(body io.Reader) ([]interface{}, error) {
+	dec := gojson.NewDecoder(body)
+	var recs []interface{}
+	for n := 0; ; n++ {
+		var ev map[string]interface{}
+		err := dec.Decode(&ev)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if errors.Cause(err) == errTooLarge {
+			return nil, err
+		}
+		if err != nil || ev == nil {
+			return nil, hecError{hecResponse{Text: "Invalid data format", Code: hecInvalidFormat, InvalidEventNumber: &n}}
+		}
+		if event, ok := ev["event"]; !ok || event == nil || event == "" {
+			return nil, hecError{hecResponse{Text: "Event field is required", Code: hecEventRequired, InvalidEventNumber: &n}}
+		}
+		recs = append(recs, hecRecord(ev))
+	}
+}
+
+// readHECRaw reads an event from each non-empty line of body, with the
+// metadata from the query string of r.
+func readHECRaw(body io.Reader, r *http.Request) ([]interface{}, error) {
+	query := r.URL.Query()
+	br := bufio.NewReader(body)
+	var recs []interface{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			ev := map[string]interface{}{"event": line}
+			for _, key := range hecMetadata {
+				if val := query.Get(key); val != "" {
+					ev[key] = val
+				}
+			}
+			recs = append(recs, hecRecord(ev))
+		}
+		if err == io.EOF {
+			return recs, nil
+		}
+	}
+}
+
+// hecRecord returns the record for the HEC event ev.
+func hecRecord(ev map[string]interface{}) map[string]interface{} {
+	rec := make(map[string]interface{})
+	if obj, ok := ev["event"].(map[string]interface{}); ok {
+		for k, v := range obj {
+			rec[k] = v
+		}
+	} else {
+		rec["event"] = ev["event"]
+	}
+	if fields, ok := ev["fields"].(map[string]interface{}); ok {
+		for k, v := range fields {
+			rec[k] = v
+		}
+	}
+	for _, key := range hecMetadata {
+		if val, ok := ev[key]; ok && val != nil {
+			rec[key] = val
+		}
+	}
+	return rec
+}
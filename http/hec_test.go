@@ -0,0 +1,100 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package http_test
+
+import (
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pilosa/pdk/http"
+)
+
+func TestHECHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	j, err := http.NewJSONSource(http.WithListener(ln), http.WithAck(), http.WithTokens("secret"), http.WithProtocols(http.ProtocolJSON, http.ProtocolSplunk))
+	if err != nil {
+		t.Fatalf("getting json source: %v", err)
+	}
+	ingested, stop := ingest(j)
+	defer stop()
+
+	for _, test := range []struct {
+		method, path, auth, body string
+		status                   int
+		resp                     string
+	}{
+		{"GET", "/services/collector/health", "", "", 200, `{"text":"HEC is healthy","code":17}`},
+		{"POST", "/services/collector/event", "", `{"event": "x"}`, 401, `{"text":"Token is required","code":2}`},
+		{"POST", "/services/collector/event", "Splunk nope", `{"event": "x"}`, 403, `{"text":"Invalid token","code":4}`},
+		{"POST", "/services/collector/event", "Splunk secret", ``, 400, `{"text":"No data","code":5}`},
+		{"POST", "/services/collector/event", "Splunk secret", `{"event": "x"}{"time": 1}`, 400, `{"text":"Event field is required","code":12,"invalid-event-number":1}`},
+		{"POST", "/services/collector/event", "Splunk secret", `{"event": "x"}{"event": `, 400, `{"text":"Invalid data format","code":6,"invalid-event-number":1}`},
+		{"GET", "/services/collector/event", "Splunk secret", ``, 404, `{"text":"The requested URL was not found on this server.","code":404}`},
+		{"POST", "/services/collector/event", "Splunk secret", `{"event": {"msg": "hi", "host": "mine"}, "host": "web1", "sourcetype": "access", "time": 1500000000.5, "fields": {"region": "us"}}
+{"event": "plain", "index": "main"}`, 200, `{"text":"Success","code":0}`},
+		{"POST", "/services/collector", "Splunk secret", `{"event": {"bad": 1}}{"event": "fine"}`, 400, `{"text":"Invalid data format","code":6,"invalid-event-number":0,"results":[{"text":"Invalid data format","code":6},{"text":"Success","code":0}]}`},
+		{"POST", "/services/collector", "Splunk secret", `{"event": {"bad": 1}}{"event": {"busy": 1}}`, 400, `{"text":"Invalid data format","code":6,"invalid-event-number":0,"results":[{"text":"Invalid data format","code":6},{"text":"Server is busy","code":9}]}`},
+		{"POST", "/services/collector", "Splunk secret", `{"event": "fine"}{"event": {"busy": 1}}`, 503, `{"text":"Server is busy","code":9,"results":[{"text":"Success","code":0},{"text":"Server is busy","code":9}]}`},
+		{"POST", "/services/collector/raw?sourcetype=syslog", "Splunk secret", "line one\r\n\nline two", 200, `{"text":"Success","code":0}`},
+		{"POST", "/", "Bearer secret", `{"plain": "json"}`, 200, `{"records":1,"failed":0}`},
+	} {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		j.ServeHTTP(w, req)
+		if w.Code != test.status || strings.TrimSpace(w.Body.String()) != test.resp {
+			t.Errorf("%s %s %q: expected %d %s, got %d %s", test.method, test.path, test.body, test.status, test.resp, w.Code, w.Body)
+		}
+	}
+
+	exp := []interface{}{
+		map[string]interface{}{"msg": "hi", "host": "web1", "sourcetype": "access", "time": 1500000000.5, "region": "us"},
+		map[string]interface{}{"event": "plain", "index": "main"},
+		map[string]interface{}{"event": "fine"},
+		map[string]interface{}{"event": "fine"},
+		map[string]interface{}{"event": "line one", "sourcetype": "syslog"},
+		map[string]interface{}{"event": "line two", "sourcetype": "syslog"},
+		map[string]interface{}{"plain": "json"},
+	}
+	if !reflect.DeepEqual(ingested(), exp) {
+		t.Fatalf("unexpected records: %#v", ingested())
+	}
+}
@@ -33,25 +33,61 @@
 package http
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	gojson "encoding/json"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/pilosa/pdk"
 	"github.com/pilosa/pdk/json"
 	"github.com/pkg/errors"
 )
 
 // JSONSource implements the pdk.Source interface by listening for HTTP post
-// requests and decoding json from their bodies.
+// requests and decoding json from their bodies. A body may hold a sequence of
+// objects (e.g. newline delimited json) or arrays of objects, and may be
+// gzipped. Nothing from a body is ingested unless all of it decodes. GET
+// requests to /health are answered with 200 OK so that load balancers can
+// check that the source is up.
+//
+// With WithAck, each response waits until the Ingester has mapped the records
+// in the request and handed them to the Indexer, and reports any which failed
+// (see Response). The Ingester must then read from an AckJSONSource wrapping
+// the JSONSource.
+//
+// With WithProtocols, JSONSource can also accept the Elasticsearch bulk API
+// and the Splunk HTTP Event Collector protocol (see BulkHandler and
+// HECHandler).
 type JSONSource struct {
 	addr     string
 	listener net.Listener
 	server   *http.Server
 	records  chan record
+
+	ack       bool
+	maxBody   int64
+	tokens    []string
+	protocols []string
+
+	json bool
+	bulk *BulkHandler
+	hec  *HECHandler
 }
 
+// Protocols which a JSONSource can accept (see WithProtocols).
+const (
+	ProtocolJSON          = "json"
+	ProtocolElasticsearch = "elasticsearch"
+	ProtocolSplunk        = "splunk"
+)
+
 // WithAddr is an option for the JSONSource which causes it to bind to the given
 // address.
 func WithAddr(addr string) JSONSourceOption {
@@ -80,6 +116,48 @@ func WithBuffer(n int) JSONSourceOption {
 	}
 }
 
+// WithAck is an option for JSONSource which makes it respond to each request
+// only once the records in it have been mapped and handed to the Indexer (or
+// have failed), with a Response in the body. Records must be read through an
+// AckJSONSource, by an Ingester or with CheckpointRecord and Ack, or requests
+// will never be answered.
+func WithAck() JSONSourceOption {
+	return func(j *JSONSource) {
+		j.ack = true
+	}
+}
+
+// WithMaxBodySize is an option for JSONSource which rejects requests whose
+// bodies are bigger than n bytes (after decompression) with 413 Request Entity
+// Too Large. Bodies are read completely before they're ingested, so this
+// bounds the memory each request can use.
+func WithMaxBodySize(n int64) JSONSourceOption {
+	return func(j *JSONSource) {
+		j.maxBody = n
+	}
+}
+
+// WithTokens is an option for JSONSource which requires each request (except
+// health checks) to carry one of tokens, either in the Authorization header
+// (as a Bearer, ApiKey or Splunk token, or the password of Basic credentials)
+// or in an X-API-Key header. Other requests get 401 Unauthorized.
+func WithTokens(tokens ...string) JSONSourceOption {
+	return func(j *JSONSource) {
+		j.tokens = tokens
+	}
+}
+
+// WithProtocols is an option for JSONSource which sets the protocols it
+// accepts. The default is just ProtocolJSON, which accepts JSON posted to any
+// path not claimed by another protocol. ProtocolElasticsearch serves a
+// BulkHandler at /_bulk and /{index}/_bulk (and / for version checks), and
+// ProtocolSplunk serves an HECHandler under /services/collector.
+func WithProtocols(protocols ...string) JSONSourceOption {
+	return func(j *JSONSource) {
+		j.protocols = protocols
+	}
+}
+
 // JSONSourceOption is a functional option type for JSONSource.
 type JSONSourceOption func(j *JSONSource)
 
@@ -92,6 +170,21 @@ func NewJSONSource(opts ...JSONSourceOption) (*JSONSource, error) {
 	for _, opt := range opts {
 		opt(j)
 	}
+	if len(j.protocols) == 0 {
+		j.protocols = []string{ProtocolJSON}
+	}
+	for _, protocol := range j.protocols {
+		switch protocol {
+		case ProtocolJSON:
+			j.json = true
+		case ProtocolElasticsearch:
+			j.bulk = NewBulkHandler(j)
+		case ProtocolSplunk:
+			j.hec = NewHECHandler(j)
+		default:
+			return nil, errors.Errorf("unknown protocol '%s'", protocol)
+		}
+	}
 
 	if j.listener == nil {
 		var err error
@@ -127,39 +220,320 @@ func (j *JSONSource) Addr() string {
 type record struct {
 	data interface{}
 	err  error
+
+	// cp identifies the request the record came from, if it is being
+	// acknowledged.
+	cp checkpoint
+}
+
+// batch collects the outcomes of the records from one request.
+type batch struct {
+	wg   sync.WaitGroup
+	errs []error
+}
+
+// checkpoint is the pdk.Checkpoint of a record, which is its position in the
+// batch it was posted in.
+type checkpoint struct {
+	b *batch
+	i int
 }
 
 // Record returns an unmarshaled json document as a map[string]interface. That
 // is, the resulting interface{} can be cast to a map[string]interface{}.
 func (j *JSONSource) Record() (interface{}, error) {
-	rec, ok := <-j.records
-	if !ok {
-		return nil, io.EOF
+	return j.RecordContext(context.Background())
+}
+
+// RecordContext works like Record, but returns ctx.Err() if ctx is done before
+// a record is posted.
+func (j *JSONSource) RecordContext(ctx context.Context) (interface{}, error) {
+	select {
+	case rec, ok := <-j.records:
+		if !ok {
+			return nil, io.EOF
+		}
+		return rec.data, rec.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return rec.data, rec.err
+}
+
+// AckJSONSource wraps a JSONSource created with WithAck, implementing
+// pdk.AckSource so that the Ingester reports the outcome of each record. A
+// JSONSource without WithAck has nothing to acknowledge, and is read directly.
+type AckJSONSource struct {
+	*JSONSource
+}
+
+// CheckpointRecord implements pdk.CheckpointSource. It works like
+// RecordContext, but also returns a Checkpoint for Ack.
+func (j AckJSONSource) CheckpointRecord(ctx context.Context) (interface{}, pdk.Checkpoint, error) {
+	select {
+	case rec, ok := <-j.records:
+		if !ok {
+			return nil, nil, io.EOF
+		}
+		return rec.data, rec.cp, rec.err
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// Commit implements pdk.CheckpointSource. Records which have been posted
+// can't be posted again, so there is nothing to do.
+func (j AckJSONSource) Commit(cps []pdk.Checkpoint) error {
+	return nil
+}
+
+// Ack implements pdk.AckSource by recording the outcome of a record for the
+// response to the request it came from.
+func (j AckJSONSource) Ack(cp pdk.Checkpoint, err error) {
+	c, ok := cp.(checkpoint)
+	if !ok || c.b == nil {
+		return
+	}
+	c.b.errs[c.i] = err
+	c.b.wg.Done()
+}
+
+// submit queues recs to be read from the source. If the source acknowledges
+// requests, it waits until every record has been acked, and returns their
+// errors. It gives up if ctx is done first.
+func (j *JSONSource) submit(ctx context.Context, recs []interface{}) ([]error, error) {
+	var b *batch
+	if j.ack {
+		b = &batch{errs: make([]error, len(recs))}
+		b.wg.Add(len(recs))
+	}
+	for i, data := range recs {
+		select {
+		case j.records <- record{data: data, cp: checkpoint{b: b, i: i}}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if b == nil {
+		return nil, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return b.errs, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Response is the body of the response to each request when records are
+// acknowledged (see WithAck). The request succeeded if Failed is 0.
+type Response struct {
+	Records int           `json:"records"`
+	Failed  int           `json:"failed"`
+	Errors  []RecordError `json:"errors,omitempty"`
+}
+
+// RecordError reports why the record at Index (counting from 0) in a request
+// wasn't ingested.
+type RecordError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// newResponse summarizes the outcomes of the records in a request.
+func newResponse(errs []error) Response {
+	resp := Response{Records: len(errs)}
+	for i, err := range errs {
+		if err != nil {
+			resp.Failed++
+			resp.Errors = append(resp.Errors, RecordError{Index: i, Error: err.Error()})
+		}
+	}
+	return resp
+}
+
+// temporary reports whether err, the error a record was acknowledged with,
+// came from failing to reach Pilosa (see pdk.PilosaError) rather than from the
+// record, so that sending the record again may succeed.
+func temporary(err error) bool {
+	for err != nil {
+		if _, ok := err.(*pdk.PilosaError); ok {
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
 }
 
 // ServeHTTP implements http.Handler for JSONSource
 func (j *JSONSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/health":
+		serveHealth(w, r)
+		return
+	case j.bulk != nil && j.bulk.handles(r):
+		j.bulk.ServeHTTP(w, r)
+		return
+	case j.hec != nil && j.hec.handles(r):
+		j.hec.ServeHTTP(w, r)
+		return
+	case !j.json:
+		http.NotFound(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		err := errors.Errorf("unsupported method: %v, request: %#v", r.Method, r)
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
 		return
 	}
-	jsource := json.NewSource(r.Body)
+	if !j.authorized(token(r)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+	body, status, err := j.body(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer body.Close()
+	var recs []interface{}
+	jsource := json.NewSource(body)
 	for {
 		stuff, err := jsource.Record()
 		if err == io.EOF {
-			return
+			break
 		}
 		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Cause(err) == errTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
 			err := errors.Wrap(err, "decoding json")
 			log.Println(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), status)
 			return
 		}
-		j.records <- record{data: stuff}
+		recs = append(recs, stuff)
+	}
+	errs, err := j.submit(r.Context(), recs)
+	if err != nil {
+		log.Println(errors.Wrap(err, "submitting records"))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if j.ack {
+		writeJSON(w, http.StatusOK, newResponse(errs))
+	}
+}
+
+// serveHealth reports that the source is up.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "unsupported method: "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// token returns the token r carries in its Authorization header (as a Bearer,
+// ApiKey or Splunk token, or the password of Basic credentials), or in its
+// X-API-Key header.
+func token(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if i := strings.IndexByte(auth, ' '); i > 0 {
+		switch scheme, cred := auth[:i], strings.TrimSpace(auth[i+1:]); strings.ToLower(scheme) {
+		case "bearer", "apikey", "splunk":
+			return cred
+		case "basic":
+			if _, password, ok := r.BasicAuth(); ok {
+				return password
+			}
+		}
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authorized reports whether token is one of the source's tokens, if it has
+// any.
+func (j *JSONSource) authorized(token string) bool {
+	if len(j.tokens) == 0 {
+		return true
+	}
+	if token == "" {
+		return false
+	}
+	ok := false
+	for _, t := range j.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// body returns the decompressed body of r, limited to the source's maximum
+// body size. If the body can't be read, it returns the status to respond with.
+func (j *JSONSource) body(r *http.Request) (io.ReadCloser, int, error) {
+	var body io.ReadCloser = r.Body
+	switch enc := strings.ToLower(r.Header.Get("Content-Encoding")); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.Wrap(err, "reading gzipped body")
+		}
+		body = gz
+	default:
+		return nil, http.StatusUnsupportedMediaType, errors.Errorf("unsupported content encoding '%s'", enc)
+	}
+	if j.maxBody > 0 {
+		body = &limitedBody{ReadCloser: body, n: j.maxBody}
+	}
+	return body, 0, nil
+}
+
+// errTooLarge is returned by a limitedBody which has more than its limit.
+var errTooLarge = errors.New("request body too large")
+
+// limitedBody returns errTooLarge rather than reading more than n bytes.
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errTooLarge
+	}
+	// read one byte more than allowed to find out whether there is one.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+// writeJSON responds with status and v encoded as json.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := gojson.NewEncoder(w).Encode(v); err != nil {
+		log.Println(errors.Wrap(err, "writing response"))
 	}
 }
 
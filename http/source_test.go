@@ -33,14 +33,22 @@
 package http_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	gohttp "net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/pilosa/pdk"
 	"github.com/pilosa/pdk/http"
+	"github.com/pkg/errors"
 )
 
 func TestJSONSource(t *testing.T) {
@@ -53,6 +61,10 @@ func TestJSONSource(t *testing.T) {
 	if err != nil {
 		t.Fatalf("getting json source: %v", err)
 	}
+	// without WithAck, the Ingester shouldn't checkpoint it.
+	if _, ok := interface{}(j).(pdk.CheckpointSource); ok {
+		t.Fatalf("JSONSource shouldn't be a CheckpointSource")
+	}
 
 	tests := []struct {
 		method string
@@ -132,3 +144,112 @@ func TestJSONSource(t *testing.T) {
 	}
 
 }
+
+// ingest stands in for an Ingester reading from j. It fails records with a
+// "bad" property as the Indexer would fail an invalid record, and those with a
+// "busy" property as it would if Pilosa were down, and returns a func which gets the others, and one which
+// stops it.
+func ingest(j *http.JSONSource) (func() []interface{}, func()) {
+	src := http.AckJSONSource{JSONSource: j}
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var ingested []interface{}
+	go func() {
+		for {
+			rec, cp, err := src.CheckpointRecord(ctx)
+			if err != nil {
+				return
+			}
+			if _, ok := rec.(map[string]interface{})["bad"]; ok {
+				src.Ack(cp, &pdk.StageError{Stage: pdk.StageIndex, Err: errors.New("bad record")})
+				continue
+			}
+			if _, ok := rec.(map[string]interface{})["busy"]; ok {
+				src.Ack(cp, &pdk.StageError{Stage: pdk.StageIndex, Err: &pdk.PilosaError{Err: errors.New("pilosa is down")}})
+				continue
+			}
+			mu.Lock()
+			ingested = append(ingested, rec)
+			mu.Unlock()
+			src.Ack(cp, nil)
+		}
+	}()
+	return func() []interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return ingested
+	}, cancel
+}
+
+func TestJSONSourceAck(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	j, err := http.NewJSONSource(http.WithListener(ln), http.WithAck(), http.WithMaxBodySize(64), http.WithTokens("secret"))
+	if err != nil {
+		t.Fatalf("getting json source: %v", err)
+	}
+
+	ingested, stop := ingest(j)
+	defer stop()
+
+	post := func(body []byte, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		j.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post([]byte(`[{"a": 1}, {"bad": 2}]
+{"c": 3}`), nil)
+	var resp http.Response
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected response %d: %v", w.Code, err)
+	}
+	exp := http.Response{Records: 3, Failed: 1, Errors: []http.RecordError{{Index: 1, Error: "bad record"}}}
+	if !reflect.DeepEqual(resp, exp) {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+	if exp := []interface{}{map[string]interface{}{"a": 1.0}, map[string]interface{}{"c": 3.0}}; !reflect.DeepEqual(ingested(), exp) {
+		t.Fatalf("unexpected records: %#v", ingested())
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`{"d": 4}`))
+	gz.Close()
+	if w := post(buf.Bytes(), map[string]string{"Content-Encoding": "gzip", "Authorization": "", "X-API-Key": "secret"}); w.Code != 200 || !strings.Contains(w.Body.String(), `"records":1`) {
+		t.Fatalf("unexpected response to gzipped body %d: %s", w.Code, w.Body)
+	}
+
+	for name, test := range map[string]struct {
+		body   string
+		header map[string]string
+		status int
+	}{
+		"bad json":     {body: `{"e": 5} {"f": `, status: gohttp.StatusBadRequest},
+		"not objects":  {body: `[1, 2]`, status: gohttp.StatusBadRequest},
+		"too large":    {body: `{"g": "` + strings.Repeat("x", 64) + `"}`, status: gohttp.StatusRequestEntityTooLarge},
+		"no token":     {body: `{"h": 6}`, header: map[string]string{"Authorization": ""}, status: gohttp.StatusUnauthorized},
+		"wrong token":  {body: `{"h": 6}`, header: map[string]string{"Authorization": "Bearer nope"}, status: gohttp.StatusUnauthorized},
+		"bad encoding": {body: `{"h": 6}`, header: map[string]string{"Content-Encoding": "br"}, status: gohttp.StatusUnsupportedMediaType},
+	} {
+		if w := post([]byte(test.body), test.header); w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d: %s", name, test.status, w.Code, w.Body)
+		}
+	}
+	if len(ingested()) != 3 {
+		t.Fatalf("rejected requests were partially ingested: %#v", ingested())
+	}
+
+	w = httptest.NewRecorder()
+	j.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected health status %d", w.Code)
+	}
+}
@@ -33,12 +33,15 @@
 package pdk
 
 import (
+	"context"
 	"io"
 	"log"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/pilosa/pdk/termstat"
+	"github.com/pkg/errors"
 )
 
 // Ingester combines a Source, Parser, Mapper, and Indexer, and uses them to
@@ -46,9 +49,18 @@ import (
 // never ends, and calling it just waits for more data to be available, or a
 // batch situation where the Source eventually returns io.EOF (or some other
 // error), and the Ingester completes (after the other components are done).
+//
+// If the Source implements CheckpointSource, the Ingester periodically flushes
+// the Indexer and commits the checkpoints of every record which has been
+// processed so that a restarted ingest can pick up where this one left off.
 type Ingester struct {
 	ParseConcurrency int
 
+	// CheckpointInterval is how often the Indexer is flushed and progress is
+	// committed to a CheckpointSource. If it is 0, progress is only committed
+	// when the ingest finishes.
+	CheckpointInterval time.Duration
+
 	src     Source
 	parser  RecordParser
 	mapper  RecordMapper
@@ -57,14 +69,39 @@ type Ingester struct {
 	Transformers  []Transformer
 	AllowedFields map[string]bool
 
+	// ErrorHandler is called with each error reported by the Indexer while
+	// the ingest is running - both from adding data and from asynchronous
+	// imports. If it returns a non-nil error, the ingest stops, and Run
+	// returns that error. If ErrorHandler is nil, errors are logged and the
+	// ingest continues. Either way, Run returns the Indexer's import errors
+	// once it has been closed.
+	ErrorHandler func(err error) error
+
+	// DeadLetters, if set, receives every record which fails to parse,
+	// transform, or map. Records which fail a Transformer are normally still
+	// indexed, but when there is a DeadLetterSink they are skipped instead so
+	// that replaying them doesn't index a record twice. Records with a value
+	// the Indexer rejects as out of range (see RangeError) are sent here at
+	// StageIndex rather than being treated as indexing errors.
+	DeadLetters DeadLetterSink
+
 	Stats Statter
 	Log   Logger
+
+	cpLock   sync.Mutex
+	pending  []Checkpoint
+	flushErr error
+
+	quit      chan struct{}
+	abortOnce sync.Once
+	abortErr  error
 }
 
 // NewIngester gets a new Ingester.
 func NewIngester(source Source, parser RecordParser, mapper RecordMapper, indexer Indexer) *Ingester {
 	return &Ingester{
-		ParseConcurrency: 1,
+		ParseConcurrency:   1,
+		CheckpointInterval: time.Second * 10,
 
 		src:     source,
 		parser:  parser,
@@ -79,6 +116,40 @@ func NewIngester(source Source, parser RecordParser, mapper RecordMapper, indexe
 
 // Run runs the ingest.
 func (n *Ingester) Run() error {
+	return n.RunContext(context.Background())
+}
+
+// RunContext runs the ingest until the Source is exhausted or ctx is done.
+// Once ctx is done, no more records are read from the Source (a Source which
+// implements ContextSource or CheckpointSource stops waiting immediately), but
+// the records already read are parsed, mapped, and flushed to Pilosa, and
+// their checkpoints committed, before RunContext returns. Stopping because ctx
+// is done is not an error - RunContext returns nil if the shutdown was clean.
+func (n *Ingester) RunContext(ctx context.Context) error {
+	n.quit = make(chan struct{})
+	ewg := sync.WaitGroup{}
+	ewg.Add(1)
+	go func() {
+		defer ewg.Done()
+		for err := range n.indexer.Errors() {
+			n.Stats.Count("ingest.ImportError", 1, 1)
+			n.handleError(err)
+		}
+	}()
+
+	cs, checkpointing := n.src.(CheckpointSource)
+	as, acking := n.src.(AckSource)
+	ctxSrc, hasCtx := n.src.(ContextSource)
+	stop := make(chan struct{})
+	cwg := sync.WaitGroup{}
+	if checkpointing && n.CheckpointInterval > 0 {
+		cwg.Add(1)
+		go func() {
+			defer cwg.Done()
+			n.runCheckpoints(cs, stop)
+		}()
+	}
+
 	pwg := sync.WaitGroup{}
 	for i := 0; i < n.ParseConcurrency; i++ {
 		pwg.Add(1)
@@ -86,61 +157,301 @@ func (n *Ingester) Run() error {
 			defer pwg.Done()
 			var recordErr error
 			for {
+				select {
+				case <-n.quit:
+					return
+				case <-ctx.Done():
+					return
+				default:
+				}
 				// Source
 				var rec interface{}
-				rec, recordErr = n.src.Record()
+				var cp Checkpoint
+				if checkpointing {
+					rec, cp, recordErr = cs.CheckpointRecord(ctx)
+				} else if hasCtx {
+					rec, recordErr = ctxSrc.RecordContext(ctx)
+				} else {
+					rec, recordErr = n.src.Record()
+				}
 				if recordErr != nil {
 					break
 				}
 				n.Stats.Count("ingest.Record", 1, 1)
-
-				// Parse
-				val, err := n.parser.Parse(rec)
-				if err != nil {
-					n.Log.Printf("couldn't parse record %s, err: %v", rec, err)
-					n.Stats.Count("ingest.ParseError", 1, 1)
-					continue
-				}
-				n.Stats.Count("ingest.Parse", 1, 1)
-
-				// Transform
-				for _, tr := range n.Transformers {
-					err := tr.Transform(val)
-					if err != nil {
-						n.Log.Printf("Problem with transformer %#v: %v", tr, err)
-						n.Stats.Count("ingest.TransformError", 1, 1)
-					}
-				}
-				n.Stats.Count("ingest.Transform", 1, 1)
-
-				// Map
-				pr, err := n.mapper.Map(val)
-				if err != nil {
-					n.Log.Printf("couldn't map val: %s, err: %v", val, err)
-					n.Stats.Count("ingest.MapError", 1, 1)
-					continue
+				err := n.ingestRecord(rec)
+				if acking {
+					as.Ack(cp, err)
 				}
-
-				// Index
-				n.Stats.Count("ingest.Map", 1, 1)
-				for _, row := range pr.Rows {
-					if n.AllowedFields == nil || n.AllowedFields[row.Field] {
-						n.indexer.AddColumn(row.Field, pr.Col, row.ID)
-						n.Stats.Count("ingest.AddBit", 1, 1)
-					}
-				}
-				for _, val := range pr.Vals {
-					if n.AllowedFields == nil || n.AllowedFields[val.Field] {
-						n.indexer.AddValue(val.Field, pr.Col, val.Value)
-						n.Stats.Count("ingest.AddValue", 1, 1)
-					}
+				if checkpointing {
+					n.cpLock.Lock()
+					n.pending = append(n.pending, cp)
+					n.cpLock.Unlock()
 				}
 			}
-			if recordErr != io.EOF && recordErr != nil {
+			if recordErr != io.EOF && recordErr != nil && ctx.Err() == nil {
 				n.Log.Printf("error in ingest run loop: %v", recordErr)
 			}
 		}()
 	}
 	pwg.Wait()
-	return n.indexer.Close()
+	close(stop)
+	cwg.Wait()
+	err := n.indexer.Close()
+	ewg.Wait()
+	if n.abortErr != nil {
+		return n.abortErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "closing indexer")
+	}
+	if n.flushErr != nil {
+		return errors.Wrap(n.flushErr, "flushing indexer")
+	}
+	if checkpointing {
+		return errors.Wrap(cs.Commit(n.takePending()), "committing checkpoints")
+	}
+	return nil
+}
+
+// handleError passes err to the ErrorHandler (or logs it if there is none),
+// and stops the ingest if the handler returns an error.
+func (n *Ingester) handleError(err error) {
+	if n.ErrorHandler == nil {
+		n.Log.Printf("indexing: %v", err)
+		return
+	}
+	if herr := n.ErrorHandler(err); herr != nil {
+		n.abortOnce.Do(func() {
+			n.abortErr = herr
+			close(n.quit)
+		})
+	}
+}
+
+// ingestRecord parses, transforms, and maps a single record from the Source
+// and hands the results to the Indexer. Records which fail along the way are
+// logged, sent to the DeadLetterSink if there is one, and skipped. It returns
+// a *StageError for the error which stopped the record, or the first one the
+// Indexer returned for it.
+func (n *Ingester) ingestRecord(rec interface{}) (rerr error) {
+	// Parse
+	val, err := n.parser.Parse(rec)
+	if err != nil {
+		n.Log.Printf("couldn't parse record %s, err: %v", rec, err)
+		n.Stats.Count("ingest.ParseError", 1, 1)
+		n.deadLetter(rec, StageParse, err)
+		return &StageError{Stage: StageParse, Err: errors.Wrap(err, "parsing")}
+	}
+	n.Stats.Count("ingest.Parse", 1, 1)
+
+	// Transform
+	for _, tr := range n.Transformers {
+		err := tr.Transform(val)
+		if err != nil {
+			n.Log.Printf("Problem with transformer %#v: %v", tr, err)
+			n.Stats.Count("ingest.TransformError", 1, 1)
+			if n.DeadLetters != nil {
+				n.deadLetter(rec, StageTransform, err)
+				return &StageError{Stage: StageTransform, Err: errors.Wrap(err, "transforming")}
+			}
+		}
+	}
+	n.Stats.Count("ingest.Transform", 1, 1)
+
+	// Map
+	pr, err := n.mapper.Map(val)
+	if err != nil {
+		n.Log.Printf("couldn't map val: %s, err: %v", val, err)
+		n.Stats.Count("ingest.MapError", 1, 1)
+		n.deadLetter(rec, StageMap, err)
+		return &StageError{Stage: StageMap, Err: errors.Wrap(err, "mapping")}
+	}
+
+	// Index
+	n.Stats.Count("ingest.Map", 1, 1)
+	rerr = n.indexRecord(rec, pr)
+	if am, ok := n.mapper.(AckMapper); ok {
+		if err := am.Ack(val, pr, rerr); err != nil {
+			n.Log.Printf("couldn't acknowledge record: %v", err)
+			rerr = firstErr(rerr, err)
+		}
+	}
+	if rerr != nil {
+		return &StageError{Stage: StageIndex, Err: rerr}
+	}
+	return rerr
+}
+
+// indexRecord hands pr, which was mapped from rec, to the Indexer. It returns
+// the first error the Indexer returned.
+func (n *Ingester) indexRecord(rec interface{}, pr PilosaRecord) (rerr error) {
+	if pr.Delete {
+		if err := n.indexer.DeleteColumn(pr.Col); err != nil {
+			n.Stats.Count("ingest.DeleteColumnError", 1, 1)
+			rerr = firstErr(rerr, err)
+			n.handleError(err)
+		} else {
+			n.Stats.Count("ingest.DeleteColumn", 1, 1)
+		}
+	}
+	for _, row := range pr.ClearRows {
+		if n.AllowedFields == nil || n.AllowedFields[row.Field] {
+			if err := n.indexer.ClearColumn(row.Field, pr.Col, row.ID); err != nil {
+				n.Stats.Count("ingest.ClearBitError", 1, 1)
+				rerr = firstErr(rerr, err)
+				n.handleError(err)
+				continue
+			}
+			n.Stats.Count("ingest.ClearBit", 1, 1)
+		}
+	}
+	for _, field := range pr.ClearVals {
+		if n.AllowedFields == nil || n.AllowedFields[field] {
+			if err := n.indexer.ClearValue(field, pr.Col); err != nil {
+				n.Stats.Count("ingest.ClearValueError", 1, 1)
+				rerr = firstErr(rerr, err)
+				n.handleError(err)
+				continue
+			}
+			n.Stats.Count("ingest.ClearValue", 1, 1)
+		}
+	}
+	for _, row := range pr.Rows {
+		if n.AllowedFields == nil || n.AllowedFields[row.Field] {
+			var err error
+			switch {
+			case !row.Time.IsZero():
+				err = n.indexer.AddColumnTimestamp(row.Field, pr.Col, row.ID, row.Time)
+			case row.FieldType != "" && row.FieldType != FieldTypeSet:
+				err = n.indexer.AddColumnType(row.Field, row.FieldType, pr.Col, row.ID)
+			default:
+				err = n.indexer.AddColumn(row.Field, pr.Col, row.ID)
+			}
+			if err != nil {
+				n.Stats.Count("ingest.AddBitError", 1, 1)
+				rerr = firstErr(rerr, err)
+				n.handleError(err)
+				continue
+			}
+			n.Stats.Count("ingest.AddBit", 1, 1)
+		}
+	}
+	deadLettered := false
+	for _, val := range pr.Vals {
+		if n.AllowedFields == nil || n.AllowedFields[val.Field] {
+			if err := n.indexer.AddValue(val.Field, pr.Col, val.Value); err != nil {
+				n.Stats.Count("ingest.AddValueError", 1, 1)
+				if _, ok := errors.Cause(err).(*RangeError); ok {
+					n.Stats.Count("ingest.OutOfRange", 1, 1)
+					if n.DeadLetters != nil {
+						// The rest of the record is indexed, which is
+						// harmless if it is replayed.
+						if !deadLettered {
+							n.Log.Printf("dead lettering record: %v", err)
+							n.deadLetter(rec, StageIndex, err)
+							deadLettered = true
+						}
+						rerr = firstErr(rerr, err)
+						continue
+					}
+				}
+				rerr = firstErr(rerr, err)
+				n.handleError(err)
+				continue
+			}
+			n.Stats.Count("ingest.AddValue", 1, 1)
+		}
+	}
+	for key, value := range pr.ColAttrs {
+		if err := n.indexer.AddColAttr(pr.Col, key, value); err != nil {
+			n.Stats.Count("ingest.AddColAttrError", 1, 1)
+			rerr = firstErr(rerr, err)
+			n.handleError(err)
+			continue
+		}
+		n.Stats.Count("ingest.AddColAttr", 1, 1)
+	}
+	for _, attr := range pr.RowAttrs {
+		if n.AllowedFields == nil || n.AllowedFields[attr.Field] {
+			if err := n.indexer.AddRowAttr(attr.Field, attr.ID, attr.Key, attr.Value); err != nil {
+				n.Stats.Count("ingest.AddRowAttrError", 1, 1)
+				rerr = firstErr(rerr, err)
+				n.handleError(err)
+				continue
+			}
+			n.Stats.Count("ingest.AddRowAttr", 1, 1)
+		}
+	}
+	return errors.Wrap(rerr, "indexing")
+}
+
+// firstErr returns err if it is the first error, otherwise first.
+func firstErr(first, err error) error {
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+// deadLetter sends rec to the DeadLetterSink, if there is one. Failing to do
+// so means the record is lost, so it is treated like an indexing error.
+func (n *Ingester) deadLetter(rec interface{}, stage Stage, err error) {
+	if n.DeadLetters == nil {
+		return
+	}
+	if err := n.DeadLetters.DeadLetter(rec, stage, err); err != nil {
+		n.Stats.Count("ingest.DeadLetterError", 1, 1)
+		n.handleError(errors.Wrap(err, "sending record to dead letter sink"))
+		return
+	}
+	n.Stats.Count("ingest.DeadLetter", 1, 1)
+}
+
+// runCheckpoints commits progress to cs every CheckpointInterval until stop is
+// closed.
+func (n *Ingester) runCheckpoints(cs CheckpointSource, stop <-chan struct{}) {
+	ticker := time.NewTicker(n.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := n.checkpoint(cs); err != nil {
+				n.Log.Printf("checkpointing: %v", err)
+				n.Stats.Count("ingest.CheckpointError", 1, 1)
+			}
+		}
+	}
+}
+
+// checkpoint flushes the Indexer, and then commits the checkpoints of every
+// record which was fully processed before the flush began. If the flush fails,
+// those checkpoints are dropped, so the source's committed position can't move
+// past them and they will be re-ingested after a restart.
+func (n *Ingester) checkpoint(cs CheckpointSource) error {
+	cps := n.takePending()
+	if len(cps) == 0 {
+		return nil
+	}
+	if err := n.indexer.Flush(); err != nil {
+		// Remember the failure so that Run still reports it even though
+		// Close won't return these errors again.
+		n.cpLock.Lock()
+		if n.flushErr == nil {
+			n.flushErr = err
+		}
+		n.cpLock.Unlock()
+		return errors.Wrap(err, "flushing indexer")
+	}
+	n.Stats.Count("ingest.Checkpoint", 1, 1)
+	return errors.Wrap(cs.Commit(cps), "committing checkpoints")
+}
+
+func (n *Ingester) takePending() []Checkpoint {
+	n.cpLock.Lock()
+	defer n.cpLock.Unlock()
+	cps := n.pending
+	n.pending = nil
+	return cps
 }
@@ -0,0 +1,306 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk_test
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pilosa/pdk"
+	ptest "github.com/pilosa/pilosa/test"
+	"github.com/pkg/errors"
+)
+
+// sliceSource is a pdk.CheckpointSource which returns each of its records in
+// turn, and remembers which ones have been committed.
+type sliceSource struct {
+	mu        sync.Mutex
+	recs      []map[string]interface{}
+	next      int
+	committed []int
+}
+
+func (s *sliceSource) Record() (interface{}, error) {
+	rec, _, err := s.CheckpointRecord(context.Background())
+	return rec, err
+}
+
+func (s *sliceSource) CheckpointRecord(ctx context.Context) (interface{}, pdk.Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= len(s.recs) {
+		return nil, nil, io.EOF
+	}
+	s.next++
+	return s.recs[s.next-1], s.next - 1, nil
+}
+
+func (s *sliceSource) Commit(cps []pdk.Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cp := range cps {
+		s.committed = append(s.committed, cp.(int))
+	}
+	return nil
+}
+
+func TestIngesterCheckpoints(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	src := &sliceSource{}
+	for i := 0; i < 10; i++ {
+		src.recs = append(src.recs, map[string]interface{}{"color": "blue", "size": i})
+	}
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "checkpoints", nil, 3)
+	if err != nil {
+		t.Fatalf("setting up pilosa: %v", err)
+	}
+	ingester := pdk.NewIngester(src, parser, pdk.NewCollapsingMapper(), indexer)
+	ingester.ParseConcurrency = 3
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+
+	err = ingester.Run()
+	if err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+	sort.Ints(src.committed)
+	if len(src.committed) != 10 {
+		t.Fatalf("expected all 10 records to be committed, got: %v", src.committed)
+	}
+	for i, cp := range src.committed {
+		if cp != i {
+			t.Fatalf("unexpected committed checkpoints: %v", src.committed)
+		}
+	}
+}
+
+// ackSource is a sliceSource which also remembers the outcome of each record.
+type ackSource struct {
+	sliceSource
+	acks map[int]error
+}
+
+func (s *ackSource) Ack(cp pdk.Checkpoint, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks[cp.(int)] = err
+}
+
+// failMapper fails to map entities with a "fail" property.
+type failMapper struct {
+	pdk.RecordMapper
+}
+
+func (m failMapper) Map(e *pdk.Entity) (pdk.PilosaRecord, error) {
+	if _, ok := e.Objects["fail"]; ok {
+		return pdk.PilosaRecord{}, errors.New("failing")
+	}
+	return m.RecordMapper.Map(e)
+}
+
+func TestIngesterAcks(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	src := &ackSource{acks: make(map[int]error)}
+	for i := 0; i < 6; i++ {
+		rec := map[string]interface{}{"color": "blue"}
+		if i%3 == 1 {
+			rec["fail"] = true
+		}
+		src.recs = append(src.recs, rec)
+	}
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "acks", nil, 3)
+	if err != nil {
+		t.Fatalf("setting up pilosa: %v", err)
+	}
+	ingester := pdk.NewIngester(src, parser, failMapper{pdk.NewCollapsingMapper()}, indexer)
+	ingester.ParseConcurrency = 2
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+
+	if err := ingester.Run(); err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+	if len(src.acks) != 6 {
+		t.Fatalf("expected 6 acks, got %v", src.acks)
+	}
+	for i, err := range src.acks {
+		if failed := i%3 == 1; failed != (err != nil) {
+			t.Errorf("unexpected ack for record %d: %v", i, err)
+		} else if serr, ok := err.(*pdk.StageError); failed && (!ok || serr.Stage != pdk.StageMap) {
+			t.Errorf("expected record %d to fail mapping, got %#v", i, err)
+		}
+	}
+}
+
+// chanSource is a pdk.ContextSource which returns records sent on its channel,
+// blocking until one is available.
+type chanSource chan interface{}
+
+func (s chanSource) Record() (interface{}, error) {
+	return s.RecordContext(context.Background())
+}
+
+func (s chanSource) RecordContext(ctx context.Context) (interface{}, error) {
+	select {
+	case rec := <-s:
+		return rec, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestIngesterRunContext(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	src := make(chanSource)
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	parser.Subjecter = pdk.BlankSubjecter{}
+	// a large batch size means nothing is imported until the ingest is
+	// shut down.
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "runcontext", nil, 1000)
+	if err != nil {
+		t.Fatalf("setting up pilosa: %v", err)
+	}
+	ingester := pdk.NewIngester(src, parser, pdk.NewCollapsingMapper(), indexer)
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ingester.RunContext(ctx)
+	}()
+	for i := 0; i < 10; i++ {
+		src <- map[string]interface{}{"color": "blue"}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+
+	client := indexer.Client()
+	schema, err := client.Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	index := schema.Index("runcontext")
+	resp, err := client.Query(index.Count(index.Field("color").Row(0)))
+	if err != nil {
+		t.Fatalf("querying: %v", err)
+	}
+	if n := resp.Result().Count(); n != 10 {
+		t.Fatalf("expected all 10 records to be flushed, got %d", n)
+	}
+}
+
+func TestIngesterMutexAndBoolFields(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	parser.EntitySubjecter = pdk.SubjectPath([]string{"id"})
+	mapper := pdk.NewCollapsingMapper()
+	mapper.ColTranslator = pdk.NewMapFieldTranslator()
+	pdk.FieldTypeOptions{Mutex: []string{"status"}, Bool: []string{"active"}}.Setup(mapper)
+
+	// re-ingesting an updated entity replaces its status and active flag
+	for _, rec := range []map[string]interface{}{
+		{"id": "a", "status": "open", "active": true},
+		{"id": "a", "status": "closed", "active": false},
+	} {
+		indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "mutex", nil, 10)
+		if err != nil {
+			t.Fatalf("setting up pilosa: %v", err)
+		}
+		ingester := pdk.NewIngester(&sliceSource{recs: []map[string]interface{}{rec}}, parser, mapper, indexer)
+		ingester.Stats = pdk.NopStatter{}
+		ingester.Log = pdk.NopLogger{}
+		if err := ingester.Run(); err != nil {
+			t.Fatalf("running ingester: %v", err)
+		}
+	}
+
+	client, err := gopilosa.NewClient([]string{cluster[0].URL()})
+	if err != nil {
+		t.Fatalf("getting client: %v", err)
+	}
+	schema, err := client.Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	index := schema.Index("mutex")
+	status, active := index.Field("status"), index.Field("active")
+	if typ := status.Options().Type(); typ != gopilosa.FieldTypeMutex {
+		t.Errorf("expected mutex status field, got %s", typ)
+	}
+	if typ := active.Options().Type(); typ != gopilosa.FieldTypeBool {
+		t.Errorf("expected bool active field, got %s", typ)
+	}
+	open, err := mapper.Translator.GetID("status", pdk.S("open"))
+	if err != nil {
+		t.Fatalf("getting id: %v", err)
+	}
+	closed, err := mapper.Translator.GetID("status", pdk.S("closed"))
+	if err != nil {
+		t.Fatalf("getting id: %v", err)
+	}
+	for query, exp := range map[*gopilosa.PQLRowQuery]int{
+		status.Row(open):   0,
+		status.Row(closed): 1,
+		active.Row(true):   0,
+		active.Row(false):  1,
+	} {
+		resp, err := client.Query(query)
+		if err != nil {
+			t.Fatalf("querying %s: %v", query.Serialize(), err)
+		}
+		if cols := resp.Result().Row().Columns; len(cols) != exp {
+			t.Errorf("%s: expected %d columns, got %v", query.Serialize(), exp, cols)
+		}
+	}
+}
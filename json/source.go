@@ -11,6 +11,9 @@ import (
 // Source is a pdk.Source for reading json data.
 type Source struct {
 	dec *json.Decoder
+
+	// pending holds the rest of the objects from a top level array.
+	pending []map[string]interface{}
 }
 
 // NewSource gets a new json source which will decode from the given reader.
@@ -21,21 +24,41 @@ func NewSource(r io.Reader) *Source {
 }
 
 // Record implements pdk.Source. It returns the next json object that can be
-// decoded from the reader. It is guaranteed to return a map[string]interface{}
-// if there is no error.
+// decoded from the reader. The reader may hold a sequence of objects (e.g.
+// newline delimited json), arrays of objects, or a mixture, and each object is
+// returned in turn. It is guaranteed to return a map[string]interface{} if
+// there is no error.
 func (s *Source) Record() (rec interface{}, err error) {
-	var res map[string]interface{}
-	err = s.dec.Decode(&res)
-	if err != nil {
-		return nil, err
+	for len(s.pending) == 0 {
+		var val interface{}
+		err = s.dec.Decode(&val)
+		if err != nil {
+			return nil, err
+		}
+		switch tval := val.(type) {
+		case map[string]interface{}:
+			return tval, nil
+		case []interface{}:
+			for i, elem := range tval {
+				obj, ok := elem.(map[string]interface{})
+				if !ok {
+					return nil, errors.Errorf("element %d of array is a %T, not an object", i, elem)
+				}
+				s.pending = append(s.pending, obj)
+			}
+		default:
+			return nil, errors.Errorf("expected an object or an array of objects, but got a %T", val)
+		}
 	}
-	return res, nil
+	rec, s.pending = s.pending[0], s.pending[1:]
+	return rec, nil
 }
 
 type rawSourceSource struct {
 	rs pdk.RawSource
 
-	s *Source
+	cur pdk.NamedReadCloser
+	s   *Source
 }
 
 func NewSourceFromRawSource(rs pdk.RawSource) pdk.Source {
@@ -50,14 +73,24 @@ func (r *rawSourceSource) Record() (rec interface{}, err error) {
 		} else if err == io.EOF {
 			return nil, err
 		}
-		r.s = NewSource(reader)
+		r.cur, r.s = reader, NewSource(reader)
 	}
 	rec, err = r.s.Record()
 	if err == io.EOF {
-		r.s = nil
+		r.cur.Close()
+		r.cur, r.s = nil, nil
 		return r.Record()
 	} else if err != nil {
 		return rec, err
 	}
 	return rec, err
 }
+
+// NewParallelSourceFromRawSource gets a source which decodes json objects from
+// up to concurrency of rs's readers at once. Use it with file.OptRawFragments
+// to read a large file on several cores.
+func NewParallelSourceFromRawSource(rs pdk.RawSource, concurrency int) pdk.Source {
+	return pdk.NewParallelSource(rs, concurrency, func(r pdk.NamedReadCloser) (pdk.Source, error) {
+		return NewSource(r), nil
+	})
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package kafka
+
+import (
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/xdg/scram"
+)
+
+// ClientOptions holds the settings for connecting to Kafka which are shared by
+// Source and DeadLetterSink. The zero value connects in plain text, speaking
+// version 0.10.0.0 of the protocol.
+type ClientOptions struct {
+	Version      string `help:"Kafka protocol version to use, e.g. 2.1.0. Defaults to 0.10.0.0, or 0.11.0.0 if --metadata is set."`
+	ClientID     string `help:"Client ID to send to the brokers."`
+	Offset       string `help:"Where to start reading partitions which the group has no committed offset for: oldest, newest, or an RFC 3339 timestamp."`
+	FetchMin     int32  `help:"Minimum number of bytes for a fetch request to return."`
+	FetchDefault int32  `help:"Number of bytes to fetch from each partition per request."`
+	FetchMax     int32  `help:"Maximum number of bytes to fetch from each partition per request. 0 is unlimited."`
+	TLS          TLSOptions
+	SASL         SASLOptions
+}
+
+// TLSOptions configures TLS for connections to Kafka brokers or the schema
+// registry.
+type TLSOptions struct {
+	Enable     bool   `help:"Connect with TLS. Implied by the other TLS options."`
+	CA         string `help:"PEM file of certificate authorities to verify the server with, instead of the system's."`
+	Cert       string `help:"PEM file of a certificate to authenticate to the server with."`
+	Key        string `help:"PEM file of the key for the certificate."`
+	SkipVerify bool   `help:"Don't verify the server's certificate."`
+}
+
+// SASLOptions configures SASL authentication with Kafka brokers.
+type SASLOptions struct {
+	Mechanism string `help:"SASL mechanism: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512. Blank disables SASL."`
+	User      string `help:"SASL user name."`
+	Password  string `help:"SASL password."`
+}
+
+// GoString keeps the password out of logged options.
+func (o SASLOptions) GoString() string {
+	return fmt.Sprintf("kafka.SASLOptions{Mechanism:%q, User:%q, Password:%q}", o.Mechanism, o.User, redact(o.Password))
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// enabled returns whether any of the TLS options are set.
+func (o TLSOptions) enabled() bool {
+	return o.Enable || o.CA != "" || o.Cert != "" || o.Key != "" || o.SkipVerify
+}
+
+// Config returns the tls.Config described by o, or nil if TLS isn't enabled.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if !o.enabled() {
+		return nil, nil
+	}
+	conf := &tls.Config{InsecureSkipVerify: o.SkipVerify}
+	if o.CA != "" {
+		pem, err := ioutil.ReadFile(o.CA)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading CA file")
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", o.CA)
+		}
+	}
+	if o.Cert != "" || o.Key != "" {
+		if o.Cert == "" || o.Key == "" {
+			return nil, errors.New("a TLS certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading certificate")
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// apply sets the options in conf, which should have come from
+// sarama.NewConfig.
+func (o ClientOptions) apply(conf *sarama.Config) error {
+	if o.Version != "" {
+		v, err := sarama.ParseKafkaVersion(o.Version)
+		if err != nil {
+			return errors.Wrap(err, "parsing version")
+		}
+		conf.Version = v
+	}
+	if o.ClientID != "" {
+		conf.ClientID = o.ClientID
+	}
+	switch strings.ToLower(o.Offset) {
+	case "", "oldest":
+		conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case "newest":
+		conf.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		// the starting offsets are looked up by Source.Open, and the
+		// consumer starts from them.
+		if _, err := o.offsetTime(); err != nil {
+			return err
+		}
+		conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	if o.FetchMin > 0 {
+		conf.Consumer.Fetch.Min = o.FetchMin
+	}
+	if o.FetchDefault > 0 {
+		conf.Consumer.Fetch.Default = o.FetchDefault
+	}
+	if o.FetchMax > 0 {
+		conf.Consumer.Fetch.Max = o.FetchMax
+	}
+
+	tlsConf, err := o.TLS.Config()
+	if err != nil {
+		return errors.Wrap(err, "configuring TLS")
+	}
+	if tlsConf != nil {
+		conf.Net.TLS.Enable = true
+		conf.Net.TLS.Config = tlsConf
+	}
+
+	switch strings.ToUpper(o.SASL.Mechanism) {
+	case "":
+		return nil
+	case sarama.SASLTypePlaintext:
+		conf.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: sha512.New}
+		}
+	default:
+		return errors.Errorf("unsupported SASL mechanism '%s'", o.SASL.Mechanism)
+	}
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.User = o.SASL.User
+	conf.Net.SASL.Password = o.SASL.Password
+	return nil
+}
+
+// offsetTime returns the time given as the initial offset, or the zero time if
+// the offset is oldest or newest.
+func (o ClientOptions) offsetTime() (time.Time, error) {
+	switch strings.ToLower(o.Offset) {
+	case "", "oldest", "newest":
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, o.Offset)
+	if err != nil {
+		return time.Time{}, errors.Errorf("initial offset '%s' is not oldest, newest, or an RFC 3339 timestamp", o.Offset)
+	}
+	return t, nil
+}
+
+// seekTime commits, for each partition of topics which group has no committed
+// offset for, the offset of the first message at or after t. The consumer
+// then starts from there rather than the initial offset of conf.
+func seekTime(hosts []string, group string, topics []string, conf *sarama.Config, t time.Time) error {
+	client, err := sarama.NewClient(hosts, conf)
+	if err != nil {
+		return errors.Wrap(err, "getting client")
+	}
+	defer client.Close()
+	om, err := sarama.NewOffsetManagerFromClient(group, client)
+	if err != nil {
+		return errors.Wrap(err, "getting offset manager")
+	}
+	// closing flushes the marked offsets.
+	defer om.Close()
+	millis := t.UnixNano() / int64(time.Millisecond)
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return errors.Wrapf(err, "getting partitions of %s", topic)
+		}
+		for _, partition := range partitions {
+			pom, err := om.ManagePartition(topic, partition)
+			if err != nil {
+				return errors.Wrapf(err, "managing %s/%d", topic, partition)
+			}
+			if next, _ := pom.NextOffset(); next >= 0 {
+				pom.AsyncClose()
+				continue
+			}
+			offset, err := client.GetOffset(topic, partition, millis)
+			if err == nil && offset < 0 {
+				// no messages at or after t.
+				offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest)
+			}
+			if err != nil {
+				pom.AsyncClose()
+				return errors.Wrapf(err, "getting offset of %s/%d at %s", topic, partition, t)
+			}
+			pom.MarkOffset(offset, "")
+			pom.AsyncClose()
+		}
+	}
+	return nil
+}
+
+// scramClient implements sarama.SCRAMClient.
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
+
+// RegistryOptions configures the client for the Confluent schema registry.
+type RegistryOptions struct {
+	User     string `help:"User name for HTTP basic authentication with the schema registry."`
+	Password string `help:"Password for HTTP basic authentication with the schema registry."`
+	TLS      TLSOptions
+}
+
+// GoString keeps the password out of logged options.
+func (o RegistryOptions) GoString() string {
+	return fmt.Sprintf("kafka.RegistryOptions{User:%q, Password:%q, TLS:%#v}", o.User, redact(o.Password), o.TLS)
+}
+
+// client returns an HTTP client for the registry, and the scheme which
+// registry URLs without one should use.
+func (o RegistryOptions) client() (*http.Client, string, error) {
+	tlsConf, err := o.TLS.Config()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "configuring TLS")
+	}
+	if tlsConf == nil {
+		return &http.Client{}, "http", nil
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConf,
+	}}, "https", nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package kafka
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestClientOptions(t *testing.T) {
+	conf := sarama.NewConfig()
+	opts := ClientOptions{
+		Version:      "2.1.0",
+		ClientID:     "pdk-test",
+		Offset:       "newest",
+		FetchDefault: 1 << 20,
+		SASL:         SASLOptions{Mechanism: "scram-sha-512", User: "u", Password: "p"},
+	}
+	if err := opts.apply(conf); err != nil {
+		t.Fatalf("applying options: %v", err)
+	}
+	if conf.Version != sarama.V2_1_0_0 || conf.ClientID != "pdk-test" {
+		t.Fatalf("unexpected version %v or client ID %s", conf.Version, conf.ClientID)
+	}
+	if conf.Consumer.Offsets.Initial != sarama.OffsetNewest {
+		t.Fatalf("unexpected initial offset %d", conf.Consumer.Offsets.Initial)
+	}
+	if conf.Consumer.Fetch.Default != 1<<20 || conf.Consumer.Fetch.Min != 1 {
+		t.Fatalf("unexpected fetch sizes %+v", conf.Consumer.Fetch)
+	}
+	if !conf.Net.SASL.Enable || conf.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || conf.Net.SASL.User != "u" {
+		t.Fatalf("unexpected SASL config %+v", conf.Net.SASL)
+	}
+	if err := conf.Net.SASL.SCRAMClientGeneratorFunc().Begin("u", "p", ""); err != nil {
+		t.Fatalf("beginning SCRAM conversation: %v", err)
+	}
+	if conf.Net.TLS.Enable {
+		t.Fatal("TLS enabled without being asked for")
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	opts = ClientOptions{Offset: "2019-01-02T03:04:05Z"}
+	if at, err := opts.offsetTime(); err != nil || at.Unix() != 1546398245 {
+		t.Fatalf("unexpected offset time %v, err: %v", at, err)
+	}
+	for _, bad := range []ClientOptions{
+		{Version: "nope"},
+		{Offset: "yesterday"},
+		{SASL: SASLOptions{Mechanism: "GSSAPI"}},
+		{TLS: TLSOptions{Cert: "cert.pem"}},
+		{TLS: TLSOptions{CA: "/does/not/exist"}},
+	} {
+		if err := bad.apply(sarama.NewConfig()); err == nil {
+			t.Errorf("expected error applying %#v", bad)
+		}
+	}
+
+	m := NewMain()
+	m.Client.SASL.Password = "hunter2"
+	m.Registry.Password = "hunter3"
+	logged := fmt.Sprintf("%#v", m)
+	if strings.Contains(logged, "hunter") {
+		t.Fatalf("password logged: %s", logged)
+	}
+}
+
+func TestConfluentSourceRegistryAuth(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "reader" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		RegistryHandler(w, r)
+	}))
+	defer ts.Close()
+	ca, err := ioutil.TempFile("", "testregistryca")
+	if err != nil {
+		t.Fatalf("getting temp file: %v", err)
+	}
+	defer os.Remove(ca.Name())
+	if err := pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}); err != nil {
+		t.Fatalf("writing CA: %v", err)
+	}
+	ca.Close()
+	val := append([]byte{0, 0, 0, 0, 1}, GetAvroEncodedValue(t)...)
+
+	source := NewConfluentSource()
+	source.RegistryURL = ts.Listener.Addr().String()
+	source.Registry = RegistryOptions{User: "reader", Password: "wrong", TLS: TLSOptions{CA: ca.Name()}}
+	if _, err := source.decodeValueWithSchemaRegistry(val); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+
+	source = NewConfluentSource()
+	source.RegistryURL = ts.URL
+	source.Registry = RegistryOptions{User: "reader", Password: "secret", TLS: TLSOptions{CA: ca.Name()}}
+	rec, err := source.decodeValueWithSchemaRegistry(val)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if rec.(map[string]interface{})["thing_string"] != "blah" {
+		t.Fatalf("unexpected record %v", rec)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+)
+
+// DeadLetterSink is a pdk.DeadLetterSink which publishes each record to a
+// Kafka topic as a JSON encoded pdk.DeadLetter. The key of each message is the
+// stage at which the record failed.
+type DeadLetterSink struct {
+	Topic string
+
+	producer sarama.SyncProducer
+}
+
+// NewDeadLetterSink gets a DeadLetterSink which publishes to topic on the
+// Kafka cluster at hosts, connecting as described by client.
+func NewDeadLetterSink(hosts []string, topic string, client ClientOptions) (*DeadLetterSink, error) {
+	conf := sarama.NewConfig()
+	conf.Version = sarama.V0_10_0_0
+	if err := client.apply(conf); err != nil {
+		return nil, errors.Wrap(err, "configuring client")
+	}
+	conf.Producer.Return.Successes = true
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+	producer, err := sarama.NewSyncProducer(hosts, conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting producer")
+	}
+	return &DeadLetterSink{
+		Topic:    topic,
+		producer: producer,
+	}, nil
+}
+
+// DeadLetter implements pdk.DeadLetterSink. Raw messages from a Source are
+// stored by value so that they can be decoded again when replayed.
+func (s *DeadLetterSink) DeadLetter(rec interface{}, stage pdk.Stage, err error) error {
+	if msg, ok := rec.(*sarama.ConsumerMessage); ok {
+		rec = msg.Value
+	}
+	data, merr := pdk.NewDeadLetter(rec, stage, err).Marshal()
+	if merr != nil {
+		return merr
+	}
+	_, _, perr := s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.Topic,
+		Key:   sarama.StringEncoder(stage),
+		Value: sarama.ByteEncoder(data),
+	})
+	return errors.Wrap(perr, "publishing dead letter")
+}
+
+// Close closes the underlying producer.
+func (s *DeadLetterSink) Close() error {
+	return errors.Wrap(s.producer.Close(), "closing producer")
+}
@@ -33,11 +33,16 @@
 package kafka
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 
+	gopilosa "github.com/pilosa/go-pilosa"
 	"github.com/pilosa/pdk"
+	pdkavro "github.com/pilosa/pdk/avro"
+	"github.com/pilosa/pdk/leveldb"
 	"github.com/pkg/errors"
 )
 
@@ -47,6 +52,8 @@ type Main struct {
 	Topics        []string `help:"Comma separated list of Kafka topics"`
 	Group         string   `help:"Kafka group"`
 	RegistryURL   string   `help:"URL of the confluent schema registry. Pass an empty string to use JSON instead of Avro."`
+	Registry      RegistryOptions
+	Client        ClientOptions
 	Framer        pdk.DashField
 	PilosaHosts   []string `help:"Comma separated list of Pilosa hosts and ports."`
 	Index         string   `help:"Pilosa index."`
@@ -54,7 +61,15 @@ type Main struct {
 	SubjectPath   []string `help:"Comma separated path to value in each record that should be mapped to column ID. Blank gets a sequential ID"`
 	AllowedFields []string `help:"If any are passed, only frame names in this comma separated list will be indexed."`
 	MaxRecords    int      `help:"Maximum number of records to ingest from kafka before stopping."`
+	Metadata      string   `help:"If set, each record gets the Kafka message's key, timestamp, headers, topic, partition and offset as properties of an object under this name, e.g. for use in the subject path or the time path."`
+	AvroSchemas   bool     `help:"Parse Avro values by walking their schemas, so that timestamps, decimals and enums are indexed by their logical types, and schemas can declare field types with the pilosa.type property. Decimals are stored in int fields multiplied by 10^scale, and no proxy is started to scale them back, so queries made against Pilosa must scale constants and results themselves."`
 	TranslatorDir string   `help:"Directory for key/id mapping storage."`
+	DeadLetter    string   `help:"Kafka topic to which records which fail to parse or map are published."`
+	Spec          string   `help:"YAML or JSON file declaring which paths to index into which fields (see pdk.Spec). Overrides the framer and subject path."`
+	Decimals      []string `help:"Comma separated field:places pairs. Numbers indexed into these int fields keep that many decimal places (they are stored multiplied by 10^places)."`
+	Time          pdk.TimeOptions
+	Types         pdk.FieldTypeOptions
+	Upsert        pdk.UpsertOptions
 
 	proxy http.Server
 }
@@ -73,7 +88,13 @@ func NewMain() *Main {
 }
 
 // Run begins indexing data from Kafka into Pilosa.
-func (m *Main) Run() (err error) {
+func (m *Main) Run() error {
+	return m.RunContext(context.Background())
+}
+
+// RunContext works like Run, but stops ingesting once ctx is done, after
+// flushing everything which has already been read.
+func (m *Main) RunContext(ctx context.Context) (err error) {
 	log.Printf("Running Main: %#v", m)
 	var src pdk.Source
 	if m.RegistryURL == "" {
@@ -82,6 +103,8 @@ func (m *Main) Run() (err error) {
 		isrc.Topics = m.Topics
 		isrc.Group = m.Group
 		isrc.MaxMsgs = m.MaxRecords
+		isrc.Metadata = m.Metadata
+		isrc.Client = m.Client
 		src = isrc
 		if err := isrc.Open(); err != nil {
 			return errors.Wrap(err, "opening kafka source")
@@ -92,7 +115,11 @@ func (m *Main) Run() (err error) {
 		isrc.Topics = m.Topics
 		isrc.Group = m.Group
 		isrc.RegistryURL = m.RegistryURL
+		isrc.Registry = m.Registry
+		isrc.AvroRecords = m.AvroSchemas
 		isrc.MaxMsgs = m.MaxRecords
+		isrc.Metadata = m.Metadata
+		isrc.Client = m.Client
 		src = isrc
 		if err := isrc.Open(); err != nil {
 			return errors.Wrap(err, "opening kafka source")
@@ -106,6 +133,17 @@ func (m *Main) Run() (err error) {
 		}
 	}
 
+	var spec *pdk.Spec
+	if m.Spec != "" {
+		spec, err = pdk.LoadSpec(m.Spec)
+		if err != nil {
+			return errors.Wrap(err, "loading spec")
+		}
+		if len(spec.Subject) > 0 {
+			m.SubjectPath = spec.Subject
+		}
+	}
+
 	parser := pdk.NewDefaultGenericParser()
 	if len(m.SubjectPath) == 0 {
 		parser.Subjecter = pdk.BlankSubjecter{}
@@ -118,12 +156,65 @@ func (m *Main) Run() (err error) {
 	mapper.ColTranslator = nil
 	mapper.Nexter = nil
 
-	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, nil, m.BatchSize)
+	mapper.Decimals, err = pdk.ParseDecimals(m.Decimals)
+	if err != nil {
+		return errors.Wrap(err, "parsing decimals")
+	}
+	m.Types.Setup(mapper)
+	pilosaOpts, err := m.Time.Setup(parser, mapper)
+	if err != nil {
+		return errors.Wrap(err, "configuring timestamps")
+	}
+	if err := m.Upsert.Check(m.Time); err != nil {
+		return err
+	}
+	var recParser pdk.RecordParser = parser
+	if m.AvroSchemas {
+		aparser := pdkavro.NewParser(parser)
+		mapper.Hints = aparser.Hints
+		recParser = aparser
+	}
+	var recMapper pdk.RecordMapper = mapper
+	var schema *gopilosa.Schema
+	if spec != nil {
+		smapper := spec.Mapper(mapper)
+		// fields declared without keys need their values translated to ids.
+		smapper.Translator, err = leveldb.NewTranslator(m.TranslatorDir)
+		if err != nil {
+			return errors.Wrap(err, "creating translator")
+		}
+		recMapper = smapper
+		schema = spec.Schema(m.Index)
+		for field, places := range spec.Decimals() {
+			mapper.Decimals[field] = places
+		}
+	}
+	if m.Upsert.Upserting() {
+		dir := m.Upsert.Dir
+		if dir == "" {
+			dir = filepath.Join(m.TranslatorDir, "upsert")
+		}
+		store, err := leveldb.NewRecordStore(dir)
+		if err != nil {
+			return errors.Wrap(err, "opening upsert record store")
+		}
+		defer store.Close()
+		recMapper = m.Upsert.Wrap(recMapper, store)
+	}
+	indexer, err := pdk.SetupPilosa(m.PilosaHosts, m.Index, schema, m.BatchSize, pilosaOpts...)
 	if err != nil {
 		return errors.Wrap(err, "setting up Pilosa")
 	}
 
-	ingester := pdk.NewIngester(src, parser, mapper, indexer)
+	ingester := pdk.NewIngester(src, recParser, recMapper, indexer)
+	if m.DeadLetter != "" {
+		sink, err := NewDeadLetterSink(m.Hosts, m.DeadLetter, m.Client)
+		if err != nil {
+			return errors.Wrap(err, "setting up dead letter sink")
+		}
+		defer sink.Close()
+		ingester.DeadLetters = sink
+	}
 	if len(m.AllowedFields) > 0 {
 		ingester.AllowedFields = make(map[string]bool)
 		for _, fram := range m.AllowedFields {
@@ -131,7 +222,7 @@ func (m *Main) Run() (err error) {
 		}
 	}
 
-	return errors.Wrap(ingester.Run(), "running ingester")
+	return errors.Wrap(ingester.RunContext(ctx), "running ingester")
 }
 
 func (m *Main) Close() error {
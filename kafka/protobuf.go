@@ -0,0 +1,180 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/pkg/errors"
+)
+
+// protobufCodec decodes values written with a Protobuf schema from the
+// registry.
+type protobufCodec struct {
+	file *desc.FileDescriptor
+}
+
+// newProtobufCodec parses the schema named name from files, which holds it and
+// the schemas it references by their import names.
+func newProtobufCodec(name string, files map[string]string) (*protobufCodec, error) {
+	p := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(files)}
+	fds, err := p.ParseFiles(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing protobuf schema")
+	}
+	return &protobufCodec{file: fds[0]}, nil
+}
+
+// decode decodes data, which starts with the indexes of its message type in
+// the schema, to a map from field names to values. Fields which aren't set
+// (including proto3 scalars with their zero value) are left out.
+func (c *protobufCodec) decode(data []byte) (interface{}, error) {
+	md, data, err := c.messageType(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading message indexes")
+	}
+	msg := dynamic.NewMessage(md)
+	if err := msg.Unmarshal(data); err != nil {
+		return nil, errors.Wrapf(err, "unmarshaling %s", md.GetFullyQualifiedName())
+	}
+	return protobufMap(msg), nil
+}
+
+// messageType reads the message indexes from the start of data, which are the
+// path through the messages of the schema (and then their nested messages) to
+// the type of the value. It returns the type and the rest of data.
+func (c *protobufCodec) messageType(data []byte) (*desc.MessageDescriptor, []byte, error) {
+	n, data, err := readVarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n < 0 {
+		return nil, nil, errors.Errorf("invalid number of indexes %d", n)
+	}
+	indexes := []int64{0} // the common case of the first message is encoded as no indexes.
+	if n > 0 {
+		indexes = make([]int64, n)
+		for i := range indexes {
+			indexes[i], data, err = readVarint(data)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	types := c.file.GetMessageTypes()
+	var md *desc.MessageDescriptor
+	for _, idx := range indexes {
+		if idx < 0 || idx >= int64(len(types)) {
+			return nil, nil, errors.Errorf("message index %v out of range", indexes)
+		}
+		md = types[idx]
+		types = md.GetNestedMessageTypes()
+	}
+	return md, data, nil
+}
+
+// readVarint reads a zig-zag encoded varint from the start of data.
+func readVarint(data []byte) (int64, []byte, error) {
+	v, n := binary.Varint(data)
+	if n <= 0 {
+		return 0, nil, errors.New("invalid varint")
+	}
+	return v, data[n:], nil
+}
+
+// protobufMap converts msg to a map keyed by field name.
+func protobufMap(msg *dynamic.Message) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for _, fd := range msg.GetMessageDescriptor().GetFields() {
+		if !msg.HasField(fd) {
+			continue
+		}
+		ret[fd.GetName()] = protobufField(fd, msg.GetField(fd))
+	}
+	return ret
+}
+
+func protobufField(fd *desc.FieldDescriptor, v interface{}) interface{} {
+	switch {
+	case fd.IsMap():
+		m, _ := v.(map[interface{}]interface{})
+		ret := make(map[string]interface{}, len(m))
+		for k, mv := range m {
+			ret[fmt.Sprint(k)] = protobufValue(fd.GetMapValueType(), mv)
+		}
+		return ret
+	case fd.IsRepeated():
+		vs, _ := v.([]interface{})
+		ret := make([]interface{}, len(vs))
+		for i, item := range vs {
+			ret[i] = protobufValue(fd, item)
+		}
+		return ret
+	}
+	return protobufValue(fd, v)
+}
+
+// protobufValue converts a single value of the field fd. Enums become the
+// name of their value, and google.protobuf.Timestamps become time.Time.
+func protobufValue(fd *desc.FieldDescriptor, v interface{}) interface{} {
+	if et := fd.GetEnumType(); et != nil {
+		n, ok := v.(int32)
+		if !ok {
+			return v
+		}
+		if ev := et.FindValueByNumber(n); ev != nil {
+			return ev.GetName()
+		}
+		return n
+	}
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return v
+	}
+	msg, err := dynamic.AsDynamicMessage(pm)
+	if err != nil {
+		return v
+	}
+	if msg.GetMessageDescriptor().GetFullyQualifiedName() == "google.protobuf.Timestamp" {
+		secs, _ := msg.GetFieldByName("seconds").(int64)
+		nanos, _ := msg.GetFieldByName("nanos").(int32)
+		return time.Unix(secs, int64(nanos)).UTC()
+	}
+	return protobufMap(msg)
+}
@@ -33,6 +33,7 @@
 package kafka
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -40,11 +41,16 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/bsm/sarama-cluster"
 	"github.com/elodina/go-avro"
+	"github.com/pilosa/pdk"
+	pdkavro "github.com/pilosa/pdk/avro"
 	"github.com/pkg/errors"
 )
 
@@ -57,8 +63,29 @@ type Source struct {
 	MaxMsgs int
 	numMsgs int
 
+	// Metadata, if set, is the property under which each decoded record gets
+	// an object holding the message's key, timestamp, headers, topic,
+	// partition and offset (see MetaKey etc.), replacing any property of the
+	// value with the same name. The key can then be used as the subject with
+	// pdk.SubjectPath, and the timestamp as the time of the record's rows.
+	// Metadata is not added to "raw" records.
+	Metadata string
+
+	// Client holds the version, security and fetch settings used by Open.
+	Client ClientOptions
+
 	consumer *cluster.Consumer
 	messages <-chan *sarama.ConsumerMessage
+	marker   offsetMarker
+
+	mu      sync.Mutex
+	tracker *pdk.OffsetTracker
+}
+
+// offsetMarker marks the offsets of processed messages, as cluster.Consumer
+// does.
+type offsetMarker interface {
+	MarkPartitionOffset(topic string, partition int32, offset int64, metadata string)
 }
 
 // NewSource gets a new Source
@@ -71,34 +98,151 @@ func NewSource() *Source {
 	}
 }
 
-// Record returns the value of the next kafka message.
+// The properties of the object which Source adds to records when Metadata is
+// set. Properties which a message doesn't have (a nil key, or the timestamp of
+// a message from before Kafka 0.10) are left out.
+const (
+	MetaKey       = "key"
+	MetaTimestamp = "timestamp"
+	MetaHeaders   = "headers"
+	MetaTopic     = "topic"
+	MetaPartition = "partition"
+	MetaOffset    = "offset"
+)
+
+// topicPartition identifies a stream of messages for the OffsetTracker.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// checkpoint is the pdk.Checkpoint for a single kafka message.
+type checkpoint struct {
+	topicPartition
+	offset int64
+}
+
+// Record returns the value of the next kafka message. The message is marked as
+// processed as soon as it is returned - use CheckpointRecord and Commit (as
+// pdk.Ingester does) to mark messages only once they've been indexed.
 func (s *Source) Record() (interface{}, error) {
-	if s.MaxMsgs > 0 {
-		s.numMsgs++
-		if s.numMsgs > s.MaxMsgs {
-			return nil, io.EOF
-		}
-	}
-	msg, ok := <-s.consumer.Messages()
-	if ok {
-		var ret interface{}
-		switch s.Type {
-		case "json":
-			parsed := make(map[string]interface{})
-			err := json.Unmarshal(msg.Value, &parsed)
-			if err != nil {
-				return nil, errors.Wrap(err, "unmarshaling json")
-			}
-			ret = parsed
-		case "raw":
-			ret = msg
-		default:
-			return nil, errors.Errorf("unsupported kafka message type: '%v'", s.Type)
+	return s.RecordContext(context.Background())
+}
+
+// RecordContext works like Record, but returns ctx.Err() if ctx is done before
+// a message arrives.
+func (s *Source) RecordContext(ctx context.Context) (interface{}, error) {
+	rec, cp, err := s.CheckpointRecord(ctx)
+	if err != nil {
+		return rec, err
+	}
+	return rec, s.Commit([]pdk.Checkpoint{cp})
+}
+
+// CheckpointRecord returns the value of the next kafka message along with a
+// checkpoint for it. The message's offset is not marked until its checkpoint
+// (and those of all earlier messages in the same partition) are passed to
+// Commit.
+func (s *Source) CheckpointRecord(ctx context.Context) (interface{}, pdk.Checkpoint, error) {
+	msg, cp, err := s.nextMessage(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ret interface{}
+	switch s.Type {
+	case "json":
+		parsed := make(map[string]interface{})
+		err := json.Unmarshal(msg.Value, &parsed)
+		if err != nil {
+			return nil, nil, s.skip(cp, errors.Wrap(err, "unmarshaling json"))
+		}
+		s.addMetadata(parsed, msg)
+		ret = parsed
+	case "raw":
+		ret = msg
+	default:
+		return nil, nil, s.skip(cp, errors.Errorf("unsupported kafka message type: '%v'", s.Type))
+	}
+	return ret, cp, nil
+}
+
+// addMetadata adds msg's metadata to rec if s.Metadata is set.
+func (s *Source) addMetadata(rec map[string]interface{}, msg *sarama.ConsumerMessage) {
+	if s.Metadata == "" {
+		return
+	}
+	meta := map[string]interface{}{
+		MetaTopic:     msg.Topic,
+		MetaPartition: msg.Partition,
+		MetaOffset:    msg.Offset,
+	}
+	if msg.Key != nil {
+		meta[MetaKey] = string(msg.Key)
+	}
+	if !msg.Timestamp.IsZero() {
+		meta[MetaTimestamp] = msg.Timestamp
+	}
+	if len(msg.Headers) > 0 {
+		headers := make(map[string]interface{}, len(msg.Headers))
+		for _, h := range msg.Headers {
+			headers[string(h.Key)] = string(h.Value)
 		}
-		s.consumer.MarkOffset(msg, "") // mark message as processed
-		return ret, nil
+		meta[MetaHeaders] = headers
 	}
-	return nil, errors.New("messages channel closed")
+	rec[s.Metadata] = meta
+}
+
+// nextMessage gets the next message from the consumer and starts tracking its
+// offset. Receiving and tracking are done under a lock so that offsets are
+// tracked in the order they were consumed.
+func (s *Source) nextMessage(ctx context.Context) (*sarama.ConsumerMessage, checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxMsgs > 0 && s.numMsgs >= s.MaxMsgs {
+		return nil, checkpoint{}, io.EOF
+	}
+	var msg *sarama.ConsumerMessage
+	var ok bool
+	select {
+	case msg, ok = <-s.messages:
+	case <-ctx.Done():
+		return nil, checkpoint{}, ctx.Err()
+	}
+	if !ok {
+		return nil, checkpoint{}, errors.New("messages channel closed")
+	}
+	s.numMsgs++
+	cp := checkpoint{
+		topicPartition: topicPartition{topic: msg.Topic, partition: msg.Partition},
+		offset:         msg.Offset,
+	}
+	s.tracker.Add(cp.topicPartition, cp.offset)
+	return msg, cp, nil
+}
+
+// skip commits a message which can't be decoded - re-reading it after a
+// restart wouldn't help - and returns err.
+func (s *Source) skip(cp checkpoint, err error) error {
+	if cerr := s.Commit([]pdk.Checkpoint{cp}); cerr != nil {
+		log.Printf("committing undecodable message: %v", cerr)
+	}
+	return err
+}
+
+// Commit marks the offsets of the messages identified by cps as processed. A
+// partition's offset only moves forward once every message consumed before it
+// has been committed too.
+func (s *Source) Commit(cps []pdk.Checkpoint) error {
+	for _, icp := range cps {
+		cp, ok := icp.(checkpoint)
+		if !ok {
+			return errors.Errorf("unexpected checkpoint type %T for kafka source", icp)
+		}
+		if offset, ok := s.tracker.Done(cp.topicPartition, cp.offset); ok {
+			s.marker.MarkPartitionOffset(cp.topic, cp.partition, offset, "")
+		}
+	}
+	return nil
 }
 
 // Open initializes the kafka source.
@@ -107,16 +251,33 @@ func (s *Source) Open() error {
 	sarama.Logger = log.New(ioutil.Discard, "", 0)
 	config := cluster.NewConfig()
 	config.Config.Version = sarama.V0_10_0_0
+	if s.Metadata != "" {
+		// headers were added to messages in 0.11.
+		config.Config.Version = sarama.V0_11_0_0
+	}
+	if err := s.Client.apply(&config.Config); err != nil {
+		return errors.Wrap(err, "configuring client")
+	}
 	config.Consumer.Return.Errors = true
-	config.Consumer.Offsets.Initial = sarama.OffsetOldest
 	config.Group.Return.Notifications = true
 
-	var err error
+	start, err := s.Client.offsetTime()
+	if err != nil {
+		return err
+	}
+	if !start.IsZero() {
+		if err := seekTime(s.Hosts, s.Group, s.Topics, &config.Config, start); err != nil {
+			return errors.Wrap(err, "seeking to initial offset")
+		}
+	}
+
 	s.consumer, err = cluster.NewConsumer(s.Hosts, s.Group, s.Topics, config)
 	if err != nil {
 		return errors.Wrap(err, "getting new consumer")
 	}
 	s.messages = s.consumer.Messages()
+	s.marker = s.consumer
+	s.tracker = pdk.NewOffsetTracker()
 
 	// consume errors
 	go func() {
@@ -141,18 +302,30 @@ func (s *Source) Close() error {
 }
 
 // ConfluentSource implements pdk.Source using Kafka and the Confluent schema
-// registry.
+// registry. Values may be encoded with Avro, Protobuf or JSON Schema schemas,
+// and are all returned as map[string]interface{} unless AvroRecords is set.
 type ConfluentSource struct {
 	Source
+	// RegistryURL is the address of the schema registry. If it has no
+	// scheme, http is used, or https if Registry.TLS is enabled.
 	RegistryURL string
-	lock        sync.RWMutex
-	cache       map[int32]avro.Schema
+	Registry    RegistryOptions
+
+	// AvroRecords causes Avro values to be returned as *avro.Record (from
+	// github.com/pilosa/pdk/avro) along with their schemas, for an
+	// avro.Parser to parse. Message metadata goes in the Record's Extra.
+	AvroRecords bool
+
+	lock   sync.RWMutex
+	cache  map[int32]valueCodec
+	client *http.Client
+	scheme string
 }
 
 // NewConfluentSource returns a new ConfluentSource.
 func NewConfluentSource() *ConfluentSource {
 	src := &ConfluentSource{
-		cache: make(map[int32]avro.Schema),
+		cache: make(map[int32]valueCodec),
 	}
 	src.Type = "raw"
 	return src
@@ -160,40 +333,154 @@ func NewConfluentSource() *ConfluentSource {
 
 // Record returns the next value from kafka.
 func (s *ConfluentSource) Record() (interface{}, error) {
-	rec, err := s.Source.Record()
+	return s.RecordContext(context.Background())
+}
+
+// RecordContext works like Record, but returns ctx.Err() if ctx is done before
+// a message arrives.
+func (s *ConfluentSource) RecordContext(ctx context.Context) (interface{}, error) {
+	rec, cp, err := s.CheckpointRecord(ctx)
 	if err != nil {
 		return rec, err
 	}
+	return rec, s.Commit([]pdk.Checkpoint{cp})
+}
+
+// CheckpointRecord returns the next value from kafka along with a checkpoint
+// which should be passed to Commit once the value has been indexed. While the
+// schema registry fails, it keeps trying to fetch the value's schema, waiting
+// longer each time, until ctx is done.
+func (s *ConfluentSource) CheckpointRecord(ctx context.Context) (interface{}, pdk.Checkpoint, error) {
+	rec, cp, err := s.Source.CheckpointRecord(ctx)
+	if err != nil {
+		return rec, cp, err
+	}
 	msg, ok := rec.(*sarama.ConsumerMessage)
 	if !ok {
-		return rec, errors.Errorf("record is not a raw kafka record, but a %T", rec)
+		return nil, nil, s.skip(cp.(checkpoint), errors.Errorf("record is not a raw kafka record, but a %T", rec))
 	}
-	val := msg.Value
-	return s.decodeAvroValueWithSchemaRegistry(val)
+	val, err := s.decodeValueWithSchemaRegistry(msg.Value)
+	// Messages which can't be decoded are skipped. If the schema couldn't
+	// be fetched, rather than drop the message (or leave it uncommitted,
+	// which would hold back its partition), it is decoded again until the
+	// registry answers.
+	for delay := registryRetryDelay; err != nil; delay *= 2 {
+		if _, ok := err.(undecodableError); ok {
+			return nil, nil, s.skip(cp.(checkpoint), err)
+		}
+		if delay > maxRegistryRetryDelay {
+			delay = maxRegistryRetryDelay
+		}
+		log.Printf("decoding message at offset %d of %s/%d: %v, retrying in %v", msg.Offset, msg.Topic, msg.Partition, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		val, err = s.decodeValueWithSchemaRegistry(msg.Value)
+	}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		s.addMetadata(v, msg)
+	case *pdkavro.Record:
+		if s.Metadata != "" {
+			v.Extra = make(map[string]interface{}, 1)
+			s.addMetadata(v.Extra, msg)
+		}
+	}
+	return val, cp, nil
 }
 
-func (s *ConfluentSource) decodeAvroValueWithSchemaRegistry(val []byte) (interface{}, error) {
-	if len(val) <= 6 || val[0] != 0 {
-		return nil, errors.Errorf("unexpected magic byte or length in avro kafka value, should be 0x00, but got 0x%.8s", val)
+// registryRetryDelay is how long ConfluentSource first waits to fetch a schema
+// again when the registry fails. The wait doubles with each failure, up to
+// maxRegistryRetryDelay.
+var (
+	registryRetryDelay    = time.Second
+	maxRegistryRetryDelay = time.Minute
+)
+
+// decodeValueWithSchemaRegistry decodes a value in the Confluent wire format:
+// a zero byte, the big endian ID of the value's schema in the registry, and
+// the value encoded as described by the schema.
+// Values which are malformed, or don't match the schema they name, return an
+// undecodableError. Other errors, like failing to fetch the schema, are
+// temporary.
+func (s *ConfluentSource) decodeValueWithSchemaRegistry(val []byte) (interface{}, error) {
+	if len(val) < 5 || val[0] != 0 {
+		return nil, undecodableError{errors.Errorf("unexpected magic byte or length in kafka value, should be 0x00, but got 0x%.8s", val)}
 	}
 	id := int32(binary.BigEndian.Uint32(val[1:]))
 	codec, err := s.getCodec(id)
 	if err != nil {
-		return nil, errors.Wrap(err, "getting avro codec")
+		return nil, errors.Wrap(err, "getting codec")
+	}
+	ret, err := codec.decode(val[5:])
+	if err != nil {
+		return nil, undecodableError{errors.Wrapf(err, "decoding value with schema %d", id)}
 	}
-	ret, err := avroDecode(codec, val[5:])
-	return ret, errors.Wrap(err, "decoding avro record")
+	return ret, nil
+}
+
+// undecodableError is an error decoding a value which would happen again every
+// time the value was read.
+type undecodableError struct {
+	error
 }
 
 // The Schema type is an object produced by the schema registry.
 type Schema struct {
-	Schema  string `json:"schema"`  // The actual AVRO schema
-	Subject string `json:"subject"` // Subject where the schema is registered for
-	Version int    `json:"version"` // Version within this subject
-	ID      int    `json:"id"`      // Registry's unique id
+	Schema     string      `json:"schema"`     // The actual schema
+	SchemaType string      `json:"schemaType"` // AVRO (if blank), PROTOBUF or JSON
+	References []Reference `json:"references"` // Other schemas which Schema imports
+	Subject    string      `json:"subject"`    // Subject where the schema is registered for
+	Version    int         `json:"version"`    // Version within this subject
+	ID         int         `json:"id"`         // Registry's unique id
+}
+
+// A Reference is a schema which another schema imports by Name.
+type Reference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// valueCodec decodes values which were encoded with a registered schema.
+type valueCodec interface {
+	decode(data []byte) (interface{}, error)
+}
+
+type avroCodec struct {
+	schema avro.Schema
+}
+
+func (c avroCodec) decode(data []byte) (interface{}, error) {
+	return avroDecode(c.schema, data)
+}
+
+// avroRecordCodec decodes Avro values into Records which keep their schema.
+type avroRecordCodec struct {
+	schema *pdkavro.Schema
+}
+
+func (c avroRecordCodec) decode(data []byte) (interface{}, error) {
+	datum, err := c.schema.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return &pdkavro.Record{Schema: c.schema, Datum: datum}, nil
+}
+
+// jsonCodec decodes values written with a JSON Schema. The values are plain
+// JSON, and aren't validated against the schema.
+type jsonCodec struct{}
+
+func (jsonCodec) decode(data []byte) (interface{}, error) {
+	parsed := make(map[string]interface{})
+	err := json.Unmarshal(data, &parsed)
+	return parsed, errors.Wrap(err, "unmarshaling json")
 }
 
-func (s *ConfluentSource) getCodec(id int32) (rschema avro.Schema, rerr error) {
+func (s *ConfluentSource) getCodec(id int32) (valueCodec, error) {
 	s.lock.RLock()
 	if codec, ok := s.cache[id]; ok {
 		s.lock.RUnlock()
@@ -202,33 +489,110 @@ func (s *ConfluentSource) getCodec(id int32) (rschema avro.Schema, rerr error) {
 	s.lock.RUnlock()
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	r, err := http.Get(fmt.Sprintf("http://%s/schemas/ids/%d", s.RegistryURL, id))
+	if codec, ok := s.cache[id]; ok {
+		return codec, nil
+	}
+	schema := &Schema{}
+	if err := s.registryGet(fmt.Sprintf("/schemas/ids/%d", id), schema); err != nil {
+		return nil, err
+	}
+	var codec valueCodec
+	switch schema.SchemaType {
+	case "", "AVRO":
+		if s.AvroRecords {
+			parsed, err := pdkavro.NewSchema(schema.Schema)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing schema")
+			}
+			codec = avroRecordCodec{schema: parsed}
+			break
+		}
+		parsed, err := avro.ParseSchema(schema.Schema)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing schema")
+		}
+		codec = avroCodec{schema: parsed}
+	case "PROTOBUF":
+		// the schema itself has no name, so it gets one which can't clash
+		// with those it imports.
+		name := fmt.Sprintf("schema %d", id)
+		files := map[string]string{name: schema.Schema}
+		if err := s.getReferences(schema.References, files); err != nil {
+			return nil, err
+		}
+		pcodec, err := newProtobufCodec(name, files)
+		if err != nil {
+			return nil, err
+		}
+		codec = pcodec
+	case "JSON":
+		codec = jsonCodec{}
+	default:
+		return nil, errors.Errorf("unsupported schema type '%s'", schema.SchemaType)
+	}
+	s.cache[id] = codec
+	return codec, nil
+}
+
+// getReferences adds the schemas in refs, and those they reference, to files
+// by the names they're imported with.
+func (s *ConfluentSource) getReferences(refs []Reference, files map[string]string) error {
+	for _, ref := range refs {
+		if _, ok := files[ref.Name]; ok {
+			continue
+		}
+		schema := &Schema{}
+		if err := s.registryGet(fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(ref.Subject), ref.Version), schema); err != nil {
+			return errors.Wrapf(err, "getting reference %s", ref.Name)
+		}
+		files[ref.Name] = schema.Schema
+		if err := s.getReferences(schema.References, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registryGet gets path from the schema registry and decodes the JSON response
+// into v. s.lock must be held.
+func (s *ConfluentSource) registryGet(path string, v interface{}) (rerr error) {
+	if s.client == nil {
+		client, scheme, err := s.Registry.client()
+		if err != nil {
+			return errors.Wrap(err, "getting registry client")
+		}
+		s.client, s.scheme = client, scheme
+	}
+	base := strings.TrimSuffix(s.RegistryURL, "/")
+	if !strings.Contains(base, "://") {
+		base = s.scheme + "://" + base
+	}
+	req, err := http.NewRequest(http.MethodGet, base+path, nil)
+	if err != nil {
+		return errors.Wrap(err, "creating registry request")
+	}
+	if s.Registry.User != "" || s.Registry.Password != "" {
+		req.SetBasicAuth(s.Registry.User, s.Registry.Password)
+	}
+	r, err := s.client.Do(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "getting schema from registry")
+		return errors.Wrap(err, "getting schema from registry")
 	}
 	defer func() {
-		// hahahahahaha
-		rerr = r.Body.Close()
+		// don't let a successful close hide an earlier error.
+		if err := r.Body.Close(); rerr == nil {
+			rerr = err
+		}
 	}()
 	if r.StatusCode >= 300 {
 		bod, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to get schema, code: %d, no body", r.StatusCode)
+			return errors.Wrapf(err, "Failed to get schema, code: %d, no body", r.StatusCode)
 		}
-		return nil, errors.Errorf("Failed to get schema, code: %d, resp: %s", r.StatusCode, bod)
-	}
-	dec := json.NewDecoder(r.Body)
-	schema := &Schema{}
-	err = dec.Decode(schema)
-	if err != nil {
-		return nil, errors.Wrap(err, "decoding schema from registry")
-	}
-	codec, err := avro.ParseSchema(schema.Schema)
-	if err != nil {
-		return nil, errors.Wrap(err, "parsing schema")
+		return errors.Errorf("Failed to get schema, code: %d, resp: %s", r.StatusCode, bod)
 	}
-	s.cache[id] = codec
-	return codec, rerr
+	err = json.NewDecoder(r.Body).Decode(v)
+	return errors.Wrap(err, "decoding schema from registry")
 }
 
 func avroDecode(codec avro.Schema, data []byte) (map[string]interface{}, error) {
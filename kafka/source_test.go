@@ -33,15 +33,28 @@
 package kafka
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/elodina/go-avro"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
 	"github.com/linkedin/goavro"
+	"github.com/pilosa/pdk"
+	pdkavro "github.com/pilosa/pdk/avro"
+	ptest "github.com/pilosa/pilosa/test"
 	"github.com/pkg/errors"
 )
 
@@ -52,7 +65,7 @@ func TestConfluentSource(t *testing.T) {
 	data := GetAvroEncodedValue(t)
 	val := append([]byte{0, 0, 0, 0, 1}, data...)
 
-	parsedRec, err := source.decodeAvroValueWithSchemaRegistry(val)
+	parsedRec, err := source.decodeValueWithSchemaRegistry(val)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,6 +76,181 @@ func TestConfluentSource(t *testing.T) {
 
 }
 
+func TestConfluentSourceAvroRecords(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- &sarama.ConsumerMessage{
+		Key:       []byte("thing-1"),
+		Value:     append([]byte{0, 0, 0, 0, 1}, GetAvroEncodedValue(t)...),
+		Topic:     "things",
+		Partition: 1,
+		Offset:    7,
+	}
+	src := NewConfluentSource()
+	src.RegistryURL = StartFakeRegistry(t)
+	src.AvroRecords = true
+	src.Metadata = "meta"
+	src.messages = messages
+	src.tracker = pdk.NewOffsetTracker()
+
+	rec, _, err := src.CheckpointRecord(context.Background())
+	if err != nil {
+		t.Fatalf("getting record: %v", err)
+	}
+	if _, ok := rec.(*pdkavro.Record); !ok {
+		t.Fatalf("expected an avro record, got %T", rec)
+	}
+	generic := pdk.NewDefaultGenericParser()
+	generic.EntitySubjecter = pdk.SubjectPath{"meta", MetaKey}
+	ent, err := pdkavro.NewParser(generic).Parse(rec)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	exp := &pdk.Entity{Subject: "thing-1", Objects: map[pdk.Property]pdk.Object{
+		"thing_string": pdk.S("blah"),
+		"thing_int":    pdk.I32(34),
+		"mysubthing": &pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+			"substring": pdk.S("blahsub"),
+			"subdub":    pdk.F64(3.14),
+		}},
+		"meta": &pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+			MetaTopic:     pdk.S("things"),
+			MetaPartition: pdk.I32(1),
+			MetaOffset:    pdk.I64(7),
+		}},
+	}}
+	if !reflect.DeepEqual(ent, exp) {
+		t.Fatalf("unexpected entity:\n%#v\nexp:\n%#v", ent, exp)
+	}
+}
+
+// markRecorder is an offsetMarker which remembers the last offset marked in
+// each partition.
+type markRecorder struct {
+	mu     sync.Mutex
+	marked map[topicPartition]int64
+}
+
+func (m *markRecorder) MarkPartitionOffset(topic string, partition int32, offset int64, metadata string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.marked[topicPartition{topic: topic, partition: partition}] = offset
+}
+
+func TestConfluentSourceRegistryDown(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+	defer func(delay time.Duration) { registryRetryDelay = delay }(registryRetryDelay)
+	registryRetryDelay = time.Millisecond
+
+	var failures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, 1) <= 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		RegistryHandler(w, r)
+	}))
+	defer ts.Close()
+	messages := make(chan *sarama.ConsumerMessage, 2)
+	for offset := 0; offset < 2; offset++ {
+		messages <- &sarama.ConsumerMessage{Value: append([]byte{0, 0, 0, 0, 1}, GetAvroEncodedValue(t)...), Topic: "things", Offset: int64(offset)}
+	}
+	src := NewConfluentSource()
+	src.RegistryURL = ts.URL
+	src.MaxMsgs = 2
+	src.messages = messages
+	src.tracker = pdk.NewOffsetTracker()
+	marker := &markRecorder{marked: make(map[topicPartition]int64)}
+	src.marker = marker
+
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "registrydown", nil, 10)
+	if err != nil {
+		t.Fatalf("setting up pilosa: %v", err)
+	}
+	ingester := pdk.NewIngester(src, parser, pdk.NewCollapsingMapper(), indexer)
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+	if err := ingester.Run(); err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+
+	// both messages were decoded once the registry answered, and committed.
+	if offset, ok := marker.marked[topicPartition{topic: "things"}]; !ok || offset != 1 {
+		t.Fatalf("expected offset 1 to be marked, got %d, %v", offset, ok)
+	}
+	if src.numMsgs != 2 {
+		t.Fatalf("expected 2 messages to be read, got %d", src.numMsgs)
+	}
+}
+
+func TestSourceMetadata(t *testing.T) {
+	at := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	messages := make(chan *sarama.ConsumerMessage, 2)
+	messages <- &sarama.ConsumerMessage{
+		Key:       []byte("user-1"),
+		Value:     []byte(`{"name": "bob", "meta": "overwritten"}`),
+		Topic:     "users",
+		Partition: 3,
+		Offset:    42,
+		Timestamp: at,
+		Headers:   []*sarama.RecordHeader{{Key: []byte("origin"), Value: []byte("web")}},
+	}
+	messages <- &sarama.ConsumerMessage{
+		Value:     []byte(`{"name": "alice"}`),
+		Topic:     "users",
+		Partition: 3,
+		Offset:    43,
+	}
+	src := NewSource()
+	src.Metadata = "meta"
+	src.messages = messages
+	src.tracker = pdk.NewOffsetTracker()
+
+	exp := []map[string]interface{}{
+		{
+			"name": "bob",
+			"meta": map[string]interface{}{
+				MetaKey:       "user-1",
+				MetaTimestamp: at,
+				MetaHeaders:   map[string]interface{}{"origin": "web"},
+				MetaTopic:     "users",
+				MetaPartition: int32(3),
+				MetaOffset:    int64(42),
+			},
+		},
+		{
+			"name": "alice",
+			"meta": map[string]interface{}{
+				MetaTopic:     "users",
+				MetaPartition: int32(3),
+				MetaOffset:    int64(43),
+			},
+		},
+	}
+	for i, e := range exp {
+		rec, _, err := src.CheckpointRecord(context.Background())
+		if err != nil {
+			t.Fatalf("getting record %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(rec, e) {
+			t.Fatalf("unexpected record %d: %#v", i, rec)
+		}
+	}
+
+	// the key can be the subject, and is then not indexed.
+	parser := pdk.NewDefaultGenericParser()
+	parser.EntitySubjecter = pdk.SubjectPath{"meta", MetaKey}
+	ent, err := parser.Parse(exp[0])
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	if ent.Subject != "user-1" {
+		t.Fatalf("unexpected subject %s", ent.Subject)
+	}
+}
+
 var value = map[string]interface{}{
 	"thing_string": "blah",
 	"thing_int":    34,
@@ -189,3 +377,145 @@ func RegistryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+const commonProto = `syntax = "proto3";
+package common;
+message Location {
+	string city = 1;
+	double lat = 2;
+}`
+
+const eventProto = `syntax = "proto3";
+package events;
+import "common.proto";
+import "google/protobuf/timestamp.proto";
+message Other {
+	int32 x = 1;
+}
+message Event {
+	enum Kind {
+		UNKNOWN = 0;
+		CLICK = 1;
+	}
+	message Inner {
+		bool ok = 1;
+	}
+	string id = 1;
+	Kind kind = 2;
+	google.protobuf.Timestamp at = 3;
+	common.Location where = 4;
+	repeated string tags = 5;
+	map<string, int64> counts = 6;
+	int64 zero = 7;
+	Inner inner = 8;
+}`
+
+func TestConfluentSourceSchemaTypes(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var schema Schema
+		switch r.URL.Path {
+		case "/schemas/ids/2":
+			schema = Schema{Schema: eventProto, SchemaType: "PROTOBUF", References: []Reference{
+				{Name: "common.proto", Subject: "common", Version: 1},
+			}}
+		case "/subjects/common/versions/1":
+			schema = Schema{Schema: commonProto, SchemaType: "PROTOBUF", Subject: "common", Version: 1}
+		case "/schemas/ids/3":
+			schema = Schema{Schema: `{"type": "object"}`, SchemaType: "JSON"}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(schema); err != nil {
+			t.Errorf("encoding schema: %v", err)
+		}
+	}))
+	defer ts.Close()
+	source := NewConfluentSource()
+	source.RegistryURL = ts.URL
+
+	// encode an Event with a dynamic message for the same schema.
+	p := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(map[string]string{
+		"event.proto":  eventProto,
+		"common.proto": commonProto,
+	})}
+	fds, err := p.ParseFiles("event.proto")
+	if err != nil {
+		t.Fatalf("parsing proto: %v", err)
+	}
+	eventType := fds[0].FindMessage("events.Event")
+	event := dynamic.NewMessage(eventType)
+	where := dynamic.NewMessage(fds[0].GetDependencies()[0].FindMessage("common.Location"))
+	where.SetFieldByName("city", "Austin")
+	at, err := ptypes.TimestampProto(time.Date(2019, 1, 2, 3, 4, 5, 6, time.UTC))
+	if err != nil {
+		t.Fatalf("getting timestamp: %v", err)
+	}
+	event.SetFieldByName("id", "e1")
+	event.SetFieldByName("kind", int32(1))
+	event.SetFieldByName("at", at)
+	event.SetFieldByName("where", where)
+	event.SetFieldByName("tags", []string{"a", "b"})
+	event.SetFieldByName("counts", map[string]int64{"x": 3})
+	data, err := event.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling event: %v", err)
+	}
+	// the message indexes [1] select the second message, Event.
+	val := append([]byte{0, 0, 0, 0, 2, 2, 2}, data...)
+	rec, err := source.decodeValueWithSchemaRegistry(val)
+	if err != nil {
+		t.Fatalf("decoding protobuf: %v", err)
+	}
+	exp := map[string]interface{}{
+		"id":     "e1",
+		"kind":   "CLICK",
+		"at":     time.Date(2019, 1, 2, 3, 4, 5, 6, time.UTC),
+		"where":  map[string]interface{}{"city": "Austin"},
+		"tags":   []interface{}{"a", "b"},
+		"counts": map[string]interface{}{"x": int64(3)},
+	}
+	if !reflect.DeepEqual(rec, exp) {
+		t.Fatalf("unexpected protobuf record: %#v", rec)
+	}
+
+	// [1, 0] selects Event.Inner, and a single zero byte the first message.
+	inner := dynamic.NewMessage(eventType.GetNestedMessageTypes()[0])
+	inner.SetFieldByName("ok", true)
+	data, err = inner.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling inner: %v", err)
+	}
+	rec, err = source.decodeValueWithSchemaRegistry(append([]byte{0, 0, 0, 0, 2, 4, 2, 0}, data...))
+	if err != nil {
+		t.Fatalf("decoding nested message: %v", err)
+	}
+	if !reflect.DeepEqual(rec, map[string]interface{}{"ok": true}) {
+		t.Fatalf("unexpected nested record: %#v", rec)
+	}
+	rec, err = source.decodeValueWithSchemaRegistry([]byte{0, 0, 0, 0, 2, 0, 8, 7})
+	if err != nil {
+		t.Fatalf("decoding first message: %v", err)
+	}
+	if !reflect.DeepEqual(rec, map[string]interface{}{"x": int32(7)}) {
+		t.Fatalf("unexpected first record: %#v", rec)
+	}
+	if _, err := source.decodeValueWithSchemaRegistry([]byte{0, 0, 0, 0, 2, 2, 10}); err == nil {
+		t.Fatal("expected error for out of range message index")
+	}
+
+	rec, err = source.decodeValueWithSchemaRegistry(append([]byte{0, 0, 0, 0, 3}, `{"a": 1, "b": "two"}`...))
+	if err != nil {
+		t.Fatalf("decoding json: %v", err)
+	}
+	if !reflect.DeepEqual(rec, map[string]interface{}{"a": 1.0, "b": "two"}) {
+		t.Fatalf("unexpected json record: %#v", rec)
+	}
+
+	// schemas and their references are fetched once.
+	if requests != 3 {
+		t.Fatalf("expected 3 registry requests, got %d", requests)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package leveldb
+
+import (
+	"encoding/json"
+
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var _ pdk.RecordStore = &RecordStore{}
+
+// RecordStore is a pdk.RecordStore which keeps records in leveldb, so that an
+// UpsertMapper can clear what was indexed for a subject before a restart. Like
+// pdk.MapRecordStore, it only keeps the column, rows and values of each
+// record.
+type RecordStore struct {
+	db *leveldb.DB
+}
+
+// NewRecordStore opens (or creates) a RecordStore in the directory dirname.
+func NewRecordStore(dirname string) (*RecordStore, error) {
+	db, err := leveldb.OpenFile(dirname, &opt.Options{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening leveldb at %v", dirname)
+	}
+	return &RecordStore{db: db}, nil
+}
+
+// Close closes the underlying leveldb.
+func (s *RecordStore) Close() error {
+	return s.db.Close()
+}
+
+// Get implements pdk.RecordStore.
+func (s *RecordStore) Get(subject string) (pdk.PilosaRecord, bool, error) {
+	data, err := s.db.Get([]byte(subject), nil)
+	if err == leveldb.ErrNotFound {
+		return pdk.PilosaRecord{}, false, nil
+	} else if err != nil {
+		return pdk.PilosaRecord{}, false, errors.Wrap(err, "reading record")
+	}
+	var sr storedRecord
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return pdk.PilosaRecord{}, false, errors.Wrapf(err, "decoding record for %s", subject)
+	}
+	pr := pdk.PilosaRecord{Col: sr.Col.value(), Vals: sr.Vals}
+	for _, row := range sr.Rows {
+		pr.Rows = append(pr.Rows, pdk.Row{Field: row.Field, ID: row.ID.value()})
+	}
+	return pr, true, nil
+}
+
+// Put implements pdk.RecordStore.
+func (s *RecordStore) Put(subject string, pr pdk.PilosaRecord) error {
+	sr := storedRecord{Col: newStoredID(pr.Col), Vals: pr.Vals}
+	for _, row := range pr.Rows {
+		sr.Rows = append(sr.Rows, storedRow{Field: row.Field, ID: newStoredID(row.ID)})
+	}
+	data, err := json.Marshal(sr)
+	if err != nil {
+		return errors.Wrap(err, "encoding record")
+	}
+	return errors.Wrap(s.db.Put([]byte(subject), data, nil), "writing record")
+}
+
+// Delete implements pdk.RecordStore.
+func (s *RecordStore) Delete(subject string) error {
+	return errors.Wrap(s.db.Delete([]byte(subject), nil), "deleting record")
+}
+
+// storedRecord is the part of a PilosaRecord which is stored.
+type storedRecord struct {
+	Col  storedID    `json:"col"`
+	Rows []storedRow `json:"rows,omitempty"`
+	Vals []pdk.Val   `json:"vals,omitempty"`
+}
+
+type storedRow struct {
+	Field string   `json:"field"`
+	ID    storedID `json:"id"`
+}
+
+// storedID holds a column or row, which is either a uint64 id or a string
+// key.
+type storedID struct {
+	ID    uint64 `json:"id,omitempty"`
+	Key   string `json:"key,omitempty"`
+	IsKey bool   `json:"isKey,omitempty"`
+}
+
+func newStoredID(idOrKey interface{}) storedID {
+	if key, ok := idOrKey.(string); ok {
+		return storedID{Key: key, IsKey: true}
+	}
+	id, _ := idOrKey.(uint64)
+	return storedID{ID: id}
+}
+
+func (id storedID) value() interface{} {
+	if id.IsKey {
+		return id.Key
+	}
+	return id.ID
+}
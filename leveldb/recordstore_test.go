@@ -0,0 +1,68 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package leveldb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pilosa/pdk"
+	"github.com/pilosa/pdk/test"
+)
+
+func TestRecordStore(t *testing.T) {
+	dir := tempDirName(t)
+	rs, err := NewRecordStore(dir)
+	test.ErrNil(t, err, "NewRecordStore")
+	pr := pdk.PilosaRecord{
+		Col:  uint64(7),
+		Rows: []pdk.Row{{Field: "color", ID: "red"}, {Field: "size", ID: uint64(1) << 60}},
+		Vals: []pdk.Val{{Field: "age", Value: -3}},
+	}
+	test.ErrNil(t, rs.Put("a", pr), "Put a")
+	test.ErrNil(t, rs.Put("b", pdk.PilosaRecord{Col: "b"}), "Put b")
+	test.ErrNil(t, rs.Delete("b"), "Delete b")
+	test.ErrNil(t, rs.Close(), "Close")
+
+	rs, err = NewRecordStore(dir)
+	test.ErrNil(t, err, "reopening")
+	defer rs.Close()
+	got, ok, err := rs.Get("a")
+	test.ErrNil(t, err, "Get a")
+	if !ok || !reflect.DeepEqual(got, pr) {
+		t.Fatalf("unexpected record after reopening: %v, %#v", ok, got)
+	}
+	if _, ok, err = rs.Get("b"); err != nil || ok {
+		t.Fatalf("deleted record is still stored: %v, %v", ok, err)
+	}
+}
@@ -35,6 +35,7 @@ package leveldb
 import (
 	"encoding/binary"
 	"hash/fnv"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -203,9 +204,112 @@ func (lt *Translator) GetID(field string, val interface{}) (id uint64, err error
 	return lft.GetID(val)
 }
 
-// GetID returns the integer id associated with the given value. It allocates a
-// new ID if the value is not found.
-func (lft *FieldTranslator) GetID(val interface{}) (id uint64, err error) {
+// GetMany returns the values mapped to each of the given ids in the given
+// field.
+func (lt *Translator) GetMany(field string, ids []uint64) (vals []interface{}, err error) {
+	lft, err := lt.getFieldTranslator(field)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting field translator")
+	}
+	return lft.GetMany(ids)
+}
+
+// GetMany returns the values mapped to each of the given ids. They are all read
+// from the same snapshot of the id map.
+func (lft *FieldTranslator) GetMany(ids []uint64) (vals []interface{}, err error) {
+	snap, err := lft.idMap.GetSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting idMap snapshot")
+	}
+	defer snap.Release()
+	vals = make([]interface{}, len(ids))
+	idBytes := make([]byte, 8)
+	for i, id := range ids {
+		binary.BigEndian.PutUint64(idBytes, id)
+		data, err := snap.Get(idBytes, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching %d from idMap", id)
+		}
+		vals[i] = pdk.FromBytes(data)
+	}
+	return vals, nil
+}
+
+// GetIDs returns the integer ids associated with each of the given values in
+// the given field. It allocates new IDs for values which are not found.
+func (lt *Translator) GetIDs(field string, vals []interface{}) (ids []uint64, err error) {
+	lft, err := lt.getFieldTranslator(field)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting field translator")
+	}
+	return lft.GetIDs(vals)
+}
+
+// GetIDs returns the integer ids associated with each of the given values. The
+// values which are not found are locked together and allocated new IDs, which
+// are written to each map in a single batch.
+func (lft *FieldTranslator) GetIDs(vals []interface{}) (ids []uint64, err error) {
+	ids = make([]uint64, len(vals))
+	valBytes := make([][]byte, len(vals))
+	missing := make([][]byte, 0)
+	for i, val := range vals {
+		if valBytes[i], err = toBytes(val); err != nil {
+			return nil, err
+		}
+		data, err := lft.valMap.Get(valBytes[i], &opt.ReadOptions{})
+		if err == leveldb.ErrNotFound {
+			missing = append(missing, valBytes[i])
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "trying to read value map")
+		}
+		ids[i] = binary.BigEndian.Uint64(data)
+	}
+	if len(missing) == 0 {
+		return ids, nil
+	}
+
+	// else, some vals not found
+	lft.lock.LockMany(missing)
+	defer lft.lock.UnlockMany(missing)
+	// re-read after locking, and allocate ids for the values which are still
+	// missing. A value may appear more than once in vals, so allocated ids are
+	// remembered until the batches are written.
+	allocated := make(map[string]uint64)
+	idBatch, valBatch := new(leveldb.Batch), new(leveldb.Batch)
+	for i := range vals {
+		if id, ok := allocated[string(valBytes[i])]; ok {
+			ids[i] = id
+			continue
+		}
+		data, err := lft.valMap.Get(valBytes[i], &opt.ReadOptions{})
+		if err == nil {
+			ids[i] = binary.BigEndian.Uint64(data)
+			continue
+		} else if err != leveldb.ErrNotFound {
+			return nil, errors.Wrap(err, "trying to read value map")
+		}
+		idBytes := make([]byte, 8)
+		new := atomic.AddUint64(lft.curID, 1)
+		binary.BigEndian.PutUint64(idBytes, new-1)
+		idBatch.Put(idBytes, valBytes[i])
+		valBatch.Put(valBytes[i], idBytes)
+		allocated[string(valBytes[i])] = new - 1
+		ids[i] = new - 1
+	}
+	err = lft.idMap.Write(idBatch, &opt.WriteOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "writing new ids into idmap")
+	}
+	err = lft.valMap.Write(valBatch, &opt.WriteOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "writing new ids into valmap")
+	}
+	return ids, nil
+}
+
+// toBytes returns the key under which val is stored in the value map.
+func toBytes(val interface{}) ([]byte, error) {
 	var vall pdk.Literal
 	switch valt := val.(type) {
 	case []byte:
@@ -215,10 +319,19 @@ func (lft *FieldTranslator) GetID(val interface{}) (id uint64, err error) {
 	default:
 		var ok bool
 		if vall, ok = val.(pdk.Literal); !ok {
-			return 0, errors.Errorf("val needs to be string, byte slice, or Literal, but is type: %T, val: '%v'", val, val)
+			return nil, errors.Errorf("val needs to be string, byte slice, or Literal, but is type: %T, val: '%v'", val, val)
 		}
 	}
-	valBytes := pdk.ToBytes(vall)
+	return pdk.ToBytes(vall), nil
+}
+
+// GetID returns the integer id associated with the given value. It allocates a
+// new ID if the value is not found.
+func (lft *FieldTranslator) GetID(val interface{}) (id uint64, err error) {
+	valBytes, err := toBytes(val)
+	if err != nil {
+		return 0, err
+	}
 	var data []byte
 
 	// if you're expecting most of the mapping to already be done, this would be faster
@@ -257,6 +370,8 @@ func (lft *FieldTranslator) GetID(val interface{}) (id uint64, err error) {
 type valueLocker interface {
 	Lock(val []byte)
 	Unlock(val []byte)
+	LockMany(vals [][]byte)
+	UnlockMany(vals [][]byte)
 }
 
 type bucketVLock struct {
@@ -270,13 +385,45 @@ func newBucketVLock() bucketVLock {
 }
 
 func (b bucketVLock) Lock(val []byte) {
-	hsh := fnv.New32a()
-	hsh.Write(val) // never returns error for hash
-	b.ms[hsh.Sum32()%1000].Lock()
+	b.ms[bucket(val)].Lock()
 }
 
 func (b bucketVLock) Unlock(val []byte) {
+	b.ms[bucket(val)].Unlock()
+}
+
+// LockMany locks the buckets of all of vals. Each bucket is locked once, in
+// ascending order, so that concurrent calls can't deadlock.
+func (b bucketVLock) LockMany(vals [][]byte) {
+	for _, i := range buckets(vals) {
+		b.ms[i].Lock()
+	}
+}
+
+// UnlockMany unlocks the buckets locked by LockMany(vals).
+func (b bucketVLock) UnlockMany(vals [][]byte) {
+	for _, i := range buckets(vals) {
+		b.ms[i].Unlock()
+	}
+}
+
+func bucket(val []byte) uint32 {
 	hsh := fnv.New32a()
 	hsh.Write(val) // never returns error for hash
-	b.ms[hsh.Sum32()%1000].Unlock()
+	return hsh.Sum32() % 1000
+}
+
+// buckets returns the distinct buckets of vals in ascending order.
+func buckets(vals [][]byte) []uint32 {
+	seen := make(map[uint32]struct{}, len(vals))
+	bs := make([]uint32, 0, len(vals))
+	for _, val := range vals {
+		i := bucket(val)
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			bs = append(bs, i)
+		}
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i] < bs[j] })
+	return bs
 }
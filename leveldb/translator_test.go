@@ -184,6 +184,93 @@ func TestConcTranslator(t *testing.T) {
 	}
 }
 
+func TestTranslatorBatch(t *testing.T) {
+	levelDir := tempDirName(t)
+	bt, err := NewTranslator(levelDir, "f1")
+	if err != nil {
+		t.Fatalf("couldn't get level translator: %v", err)
+	}
+	_, err = bt.GetID("f1", "a")
+	test.ErrNil(t, err, "GetID")
+
+	ids, err := bt.GetIDs("f1", []interface{}{[]byte("b"), "a", pdk.S("c"), "b"})
+	test.ErrNil(t, err, "GetIDs")
+	test.MustBe(t, []uint64{1, 0, 2, 1}, ids, "GetIDs")
+	vals, err := bt.GetMany("f1", []uint64{2, 0, 1})
+	test.ErrNil(t, err, "GetMany")
+	test.MustBe(t, []interface{}{pdk.S("c"), pdk.S("a"), pdk.S("b")}, vals, "GetMany")
+	if _, err = bt.GetMany("f1", []uint64{3}); err == nil {
+		t.Fatal("expected error getting unknown id")
+	}
+	if _, err = bt.GetIDs("f1", []interface{}{"d", 1}); err == nil {
+		t.Fatal("expected error getting id of unsupported value")
+	}
+
+	err = bt.Close()
+	if err != nil {
+		t.Fatalf("closing level translator: %v", err)
+	}
+	bt, err = NewTranslator(levelDir, "f1")
+	if err != nil {
+		t.Fatalf("couldn't get level translator after closing: %v", err)
+	}
+	ids, err = bt.GetIDs("f1", []interface{}{"c", "d"})
+	test.ErrNil(t, err, "GetIDs after reopen")
+	test.MustBe(t, []uint64{2, 3}, ids, "GetIDs after reopen")
+}
+
+func TestConcTranslatorBatch(t *testing.T) {
+	levelDir := tempDirName(t)
+	bt, err := NewTranslator(levelDir, "f1")
+	if err != nil {
+		t.Fatalf("couldn't get level translator: %v", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	rets := make([][]uint64, 8)
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// each goroutine asks for the values in batches of a different
+			// size, so that they overlap differently.
+			size := 10 * (i + 1)
+			for j := 0; j < 1000; j += size {
+				vals := make([]interface{}, 0, size)
+				for k := j; k < j+size && k < 1000; k++ {
+					vals = append(vals, []byte(strconv.Itoa(k)))
+				}
+				ids, err := bt.GetIDs("f1", vals)
+				if err != nil {
+					errs <- errors.Wrap(err, "error getting ids")
+					return
+				}
+				rets[i] = append(rets[i], ids...)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for i, ret := range rets {
+		if i != 0 {
+			if !reflect.DeepEqual(ret, rets[i-1]) {
+				t.Fatalf("returned ids different in different goroutines: %v, %v", ret, rets[i-1])
+			}
+		}
+	}
+	sort.Sort(test.Uint64Slice(rets[0]))
+	for j := 0; j < 1000; j++ {
+		if rets[0][j] != uint64(j) {
+			t.Fatalf("returned ids are not monotonic, pos: %v, val: %v, arr: %v", j, rets[0][j], rets[0])
+		}
+	}
+}
+
 func BenchmarkTranslatorGetID(b *testing.B) {
 	levelDir := tempDirName(b)
 	bt, err := NewTranslator(levelDir, "f1", "f2")
@@ -34,6 +34,9 @@ package pdk
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -47,6 +50,51 @@ type CollapsingMapper struct {
 	ColTranslator FieldTranslator
 	Framer        Framer
 	Nexter        INexter
+
+	// TimestampPath, if set, is the path to a Time in each Entity which is
+	// used as the timestamp of every row the Entity sets, so that they are
+	// imported into Pilosa time fields. Like SubjectPath, the timestamp is
+	// removed from the Entity rather than being indexed itself. Entities
+	// which have nothing at TimestampPath are mapped without timestamps.
+	TimestampPath []string
+
+	// Decimals maps field names to a number of decimal places which are kept
+	// when numeric values are imported into those int fields - each value is
+	// multiplied by 10^n and rounded. Numbers in other fields are truncated
+	// to integers. Pass the same map to the proxy (see
+	// PilosaKeyMapper.Decimals) so that query results are scaled back.
+	Decimals map[string]int
+
+	// FieldTypes hints the type of the Pilosa field which each field name
+	// should be created as. Rows in mutex fields replace any value a column
+	// already has. Values in set, mutex, and bool fields are indexed as rows
+	// even if they are numbers, and values in bool fields are converted to
+	// true or false.
+	FieldTypes map[string]FieldType
+
+	// BoolFields causes every boolean value to be indexed into a bool field
+	// named for its whole path. Otherwise, booleans are only indexed if they
+	// are true, as a row named for the last element of their path in the
+	// field named for the rest of it (unless FieldTypes says that the field
+	// for the whole path is a bool field).
+	BoolFields bool
+
+	// Buckets maps field names to Mappers which turn numeric values in those
+	// fields into set rows instead of int values. The Mapper is passed the
+	// value as a float64, so LinearFloatMapper and FloatMapper are suitable.
+	Buckets map[string]Mapper
+
+	// ColAttrs lists field names whose values are set as attributes of the
+	// record's column rather than indexed, for things like display names
+	// which are returned with query results but never queried. The attribute
+	// has the same name as the field. If there are several values for one,
+	// the last wins.
+	ColAttrs map[string]bool
+
+	// Hints, if set, supplies field types and decimal places for paths which
+	// FieldTypes and Decimals don't mention, as learned from schemas by the
+	// RecordParser which shares it.
+	Hints *FieldHints
 }
 
 // NewCollapsingMapper returns a CollapsingMapper with basic implementations of
@@ -65,18 +113,86 @@ func NewCollapsingMapper() *CollapsingMapper {
 // Map implements the RecordMapper interface.
 func (m *CollapsingMapper) Map(e *Entity) (PilosaRecord, error) {
 	pr := PilosaRecord{}
-	if m.ColTranslator != nil {
-		col, err := m.ColTranslator.GetID(string(e.Subject))
+	var err error
+	pr.Col, err = mapCol(e, m.ColTranslator, m.Nexter)
+	if err != nil {
+		return pr, err
+	}
+	ts, err := m.timestamp(e)
+	if err != nil {
+		return pr, errors.Wrap(err, "getting timestamp")
+	}
+	err = m.mapObj(e, &pr, []string{})
+	if err == nil {
+		err = m.translateRows(&pr)
+	}
+	if !ts.IsZero() {
+		for i := range pr.Rows {
+			pr.Rows[i].Time = ts
+		}
+	}
+	return pr, err
+}
+
+// mapCol gets the column for e. The subject is translated to an id if there
+// is a colTranslator. Otherwise, the column is the next id from nexter, or if
+// there is no nexter, the subject itself (as a Pilosa column key).
+func mapCol(e *Entity, colTranslator FieldTranslator, nexter INexter) (uint64OrString, error) {
+	if colTranslator != nil {
+		col, err := colTranslator.GetID(string(e.Subject))
 		if err != nil {
-			return pr, errors.Wrap(err, "getting column id from subject")
+			return nil, errors.Wrap(err, "getting column id from subject")
 		}
-		pr.Col = col
-	} else if m.Nexter != nil {
-		pr.Col = m.Nexter.Next()
-	} else {
-		pr.Col = string(e.Subject)
+		return col, nil
+	} else if nexter != nil {
+		return nexter.Next(), nil
+	}
+	return string(e.Subject), nil
+}
+
+// timestamp removes the Time at TimestampPath from e and returns it. It
+// returns the zero Time if there is no TimestampPath or e has no value there.
+func (m *CollapsingMapper) timestamp(e *Entity) (time.Time, error) {
+	return popTime(e, m.TimestampPath)
+}
+
+// popTime removes the Time at path from e and returns it. It returns the zero
+// Time if path is empty or e has no value there, and an error if the value
+// isn't a Time.
+func popTime(e *Entity, path []string) (time.Time, error) {
+	obj, ok := popObject(e, path)
+	if !ok {
+		return time.Time{}, nil
 	}
-	return pr, m.mapObj(e, &pr, []string{})
+	ts, ok := obj.(Time)
+	if !ok {
+		return time.Time{}, errors.Errorf("value at %v is a %T, not a Time", path, obj)
+	}
+	return time.Time(ts), nil
+}
+
+// popObject removes the Object at path from e and returns it. It returns
+// false if path is empty or e has nothing there.
+func popObject(e *Entity, path []string) (Object, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	ent := e
+	last := len(path) - 1
+	for _, item := range path[:last] {
+		next, ok := ent.Objects[Property(item)].(*Entity)
+		if !ok {
+			return nil, false
+		}
+		ent = next
+	}
+	prop := Property(path[last])
+	obj, ok := ent.Objects[prop]
+	if !ok {
+		return nil, false
+	}
+	delete(ent.Objects, prop)
+	return obj, true
 }
 
 func (m *CollapsingMapper) mapObj(val Object, pr *PilosaRecord, path []string) error {
@@ -111,62 +227,275 @@ func (m *CollapsingMapper) mapObj(val Object, pr *PilosaRecord, path []string) e
 }
 
 func (m *CollapsingMapper) mapLit(val Literal, pr *PilosaRecord, path []string) error {
-	switch tval := val.(type) {
-	case F32, F64, I, I8, I16, I32, I64, U, U8, U16, U32, U64:
-		field, err := m.Framer.Field(path)
+	if len(m.ColAttrs) > 0 {
+		if field, err := m.Framer.Field(path); err == nil && m.ColAttrs[field] {
+			attr, err := attrLiteral(val)
+			if err != nil {
+				return errors.Wrapf(err, "attribute %s", field)
+			}
+			pr.AddColAttr(field, attr)
+			return nil
+		}
+	}
+	if b, ok := val.(B); ok && !m.boolField(path) {
+		return m.mapBoolRow(b, pr, path)
+	}
+	field, err := m.Framer.Field(path)
+	if err != nil {
+		return errors.Wrapf(err, "getting field from %v", path)
+	}
+	typ := m.fieldType(field, path)
+	if _, ok := val.(B); ok {
+		typ = FieldTypeBool
+	}
+	switch typ {
+	case FieldTypeBool:
+		b, err := boolValue(val)
 		if err != nil {
-			return errors.Wrapf(err, "getting field from %v", path)
+			return err
 		}
 		if field == "" {
 			field = "default"
 		}
-		pr.AddVal(field, Int64ize(tval))
-	case S:
-		field, err := m.Framer.Field(path)
-		if err != nil {
-			return errors.Wrapf(err, "gettting field from %v", path)
+		if b {
+			pr.AddRowType(field, typ, uint64(1))
+		} else {
+			pr.AddRowType(field, typ, uint64(0))
 		}
+		return nil
+	case FieldTypeSet, FieldTypeMutex:
 		if field == "" {
 			return nil
 		}
-		if m.Translator != nil {
-			id, err := m.Translator.GetID(field, tval)
-			if err != nil {
-				return errors.Wrapf(err, "getting id from %v", val)
-			}
-			pr.AddRow(field, id)
-		} else {
-			pr.AddRow(field, string(tval))
+		if _, ok := val.(S); !ok {
+			val = S(literalString(val))
 		}
-	case B:
-		// for bools, use the last path element as the row name - only set if val is true
-		if !tval {
-			return nil
+		return m.mapRow(val.(S), pr, field, typ)
+	}
+
+	switch tval := val.(type) {
+	case F32, F64, I, I8, I16, I32, I64, U, U8, U16, U32, U64:
+		if field == "" {
+			field = "default"
 		}
-		var field string
-		var err error
-		if len(path) == 1 {
+		return m.mapNum(tval, pr, field, path)
+	case Time:
+		// Times which aren't the record's timestamp are indexed as Unix
+		// seconds so that they can be range queried.
+		if field == "" {
 			field = "default"
-		} else {
-			field, err = m.Framer.Field(path[:len(path)-1])
-			if err != nil {
-				return errors.Wrapf(err, "getting field from %v", path)
-			}
 		}
-		rowname := path[len(path)-1]
-		if m.Translator != nil {
-			id, err := m.Translator.GetID(field, rowname)
-			if err != nil {
-				return errors.Wrapf(err, "getting bool id from %v", field)
+		pr.AddVal(field, time.Time(tval).Unix())
+	case S:
+		if field == "" {
+			return nil
+		}
+		return m.mapRow(tval, pr, field, "")
+	}
+	return nil
+}
+
+// attrLiteral converts val to one of the types Pilosa stores for attributes.
+// Times are stored as RFC 3339 strings.
+func attrLiteral(val Literal) (interface{}, error) {
+	switch tval := val.(type) {
+	case S:
+		return string(tval), nil
+	case B:
+		return bool(tval), nil
+	case F32:
+		return float64(tval), nil
+	case F64:
+		return float64(tval), nil
+	case Time:
+		return time.Time(tval).Format(time.RFC3339Nano), nil
+	case I, I8, I16, I32, I64, U, U8, U16, U32, U64:
+		return Int64izeScaled(tval, 0)
+	}
+	return nil, errors.Errorf("can't store a %T as an attribute", val)
+}
+
+// boolField reports whether booleans at path are indexed into a bool field
+// rather than as rows of their parent's field.
+func (m *CollapsingMapper) boolField(path []string) bool {
+	if m.BoolFields {
+		return true
+	}
+	if len(m.FieldTypes) == 0 && m.Hints == nil {
+		return false
+	}
+	field, err := m.Framer.Field(path)
+	return err == nil && m.fieldType(field, path) == FieldTypeBool
+}
+
+// fieldType returns the type FieldTypes gives field, or failing that, the type
+// Hints gives path.
+func (m *CollapsingMapper) fieldType(field string, path []string) FieldType {
+	if typ, ok := m.FieldTypes[field]; ok || m.Hints == nil {
+		return typ
+	}
+	typ, _ := m.Hints.Type(path)
+	return typ
+}
+
+// mapRow adds the row for val to pr in field. If there is a Translator, the
+// row is translated to an id by translateRows once the whole record has been
+// mapped.
+func (m *CollapsingMapper) mapRow(val S, pr *PilosaRecord, field string, typ FieldType) error {
+	pr.AddRowType(field, typ, string(val))
+	return nil
+}
+
+// mapBoolRow sets the row named for the last element of path in the field for
+// the rest of it if b is true.
+func (m *CollapsingMapper) mapBoolRow(b B, pr *PilosaRecord, path []string) error {
+	if !b {
+		return nil
+	}
+	var field string
+	var err error
+	if len(path) == 1 {
+		field = "default"
+	} else {
+		field, err = m.Framer.Field(path[:len(path)-1])
+		if err != nil {
+			return errors.Wrapf(err, "getting field from %v", path)
+		}
+	}
+	pr.AddRow(field, path[len(path)-1])
+	return nil
+}
+
+// translateRows replaces the values of pr's rows with the ids the Translator
+// maps them to, if there is a Translator. Rows which already have ids are
+// left alone. The values of each field are translated with a single call to
+// GetIDs.
+func (m *CollapsingMapper) translateRows(pr *PilosaRecord) error {
+	if m.Translator == nil {
+		return nil
+	}
+	fields := make([]string, 0)
+	rows := make(map[string][]int)
+	for i, row := range pr.Rows {
+		if _, ok := row.ID.(string); !ok {
+			continue
+		}
+		if _, ok := rows[row.Field]; !ok {
+			fields = append(fields, row.Field)
+		}
+		rows[row.Field] = append(rows[row.Field], i)
+	}
+	for _, field := range fields {
+		vals := make([]interface{}, len(rows[field]))
+		for j, i := range rows[field] {
+			vals[j] = S(pr.Rows[i].ID.(string))
+		}
+		ids, err := m.Translator.GetIDs(field, vals)
+		if err != nil {
+			return errors.Wrapf(err, "getting ids for %s", field)
+		}
+		for j, i := range rows[field] {
+			pr.Rows[i].ID = ids[j]
+		}
+	}
+	return nil
+}
+
+// mapNum adds the numeric val to pr in field, scaling or bucketing it if the
+// field is configured for that.
+func (m *CollapsingMapper) mapNum(val Literal, pr *PilosaRecord, field string, path []string) error {
+	if bucketer, ok := m.Buckets[field]; ok {
+		ids, err := bucketer.ID(Float64ize(val))
+		if err != nil {
+			return errors.Wrapf(err, "bucketing value for %s", field)
+		}
+		for _, id := range ids {
+			if id < 0 {
+				return errors.Errorf("bucket mapper for %s returned negative row %d", field, id)
 			}
-			pr.AddRow(field, id)
-		} else {
-			pr.AddRow(field, rowname)
+			pr.AddRow(field, uint64(id))
 		}
+		return nil
+	}
+	decimals, ok := m.Decimals[field]
+	if !ok && m.Hints != nil {
+		decimals, ok = m.Hints.Decimals(path)
 	}
+	if ok {
+		ival, err := Int64izeScaled(val, decimals)
+		if err != nil {
+			return errors.Wrapf(err, "scaling value for %s", field)
+		}
+		pr.AddVal(field, ival)
+		return nil
+	}
+	pr.AddVal(field, Int64ize(val))
 	return nil
 }
 
+// Untranslated returns the fields in Buckets, whose rows are bucket ids
+// rather than translated values, for use with PilosaKeyMapper.Untranslated.
+func (m *CollapsingMapper) Untranslated() map[string]bool {
+	fields := make(map[string]bool)
+	for field := range m.Buckets {
+		fields[field] = true
+	}
+	return fields
+}
+
+// ParseDecimals parses a list of "field:places" pairs (as accepted by the
+// ingest subcommands' --decimals flag) into a map suitable for
+// CollapsingMapper.Decimals.
+func ParseDecimals(pairs []string) (map[string]int, error) {
+	decimals := make(map[string]int)
+	for _, pair := range pairs {
+		idx := strings.LastIndex(pair, ":")
+		if idx < 1 {
+			return nil, errors.Errorf("'%s' should be field:places", pair)
+		}
+		places, err := strconv.Atoi(pair[idx+1:])
+		if err != nil || places < 0 || places > 18 {
+			return nil, errors.Errorf("invalid number of decimal places in '%s'", pair)
+		}
+		decimals[pair[:idx]] = places
+	}
+	return decimals, nil
+}
+
+// Int64izeScaled converts a numeric Literal to an int64 which keeps decimals
+// decimal places of it, i.e. it is multiplied by 10^decimals and rounded to
+// the nearest integer. It returns an error if the result doesn't fit in an
+// int64.
+func Int64izeScaled(val Literal, decimals int) (int64, error) {
+	if decimals < 0 {
+		return 0, errors.Errorf("negative decimals %d", decimals)
+	}
+	switch tval := val.(type) {
+	case F32, F64:
+		f := math.Round(Float64ize(val) * math.Pow10(decimals))
+		if f >= math.MaxInt64 || f < math.MinInt64 || math.IsNaN(f) {
+			return 0, errors.Errorf("%v with %d decimals is out of range", val, decimals)
+		}
+		return int64(f), nil
+	case U:
+		if uint64(tval) > math.MaxInt64 {
+			return 0, errors.Errorf("%v is out of range", val)
+		}
+	case U64:
+		if uint64(tval) > math.MaxInt64 {
+			return 0, errors.Errorf("%v is out of range", val)
+		}
+	}
+	i := Int64ize(val)
+	for ; decimals > 0; decimals-- {
+		if i > math.MaxInt64/10 || i < math.MinInt64/10 {
+			return 0, errors.Errorf("%v is out of range", val)
+		}
+		i *= 10
+	}
+	return i, nil
+}
+
 func Int64ize(val Literal) int64 {
 	switch tval := val.(type) {
 	case F32:
@@ -199,12 +528,60 @@ func Int64ize(val Literal) int64 {
 
 }
 
+// Float64ize converts a numeric Literal to a float64.
+func Float64ize(val Literal) float64 {
+	switch tval := val.(type) {
+	case F32:
+		return float64(tval)
+	case F64:
+		return float64(tval)
+	default:
+		return float64(Int64ize(val))
+	}
+}
+
 // PilosaRecord represents a number of set columns and values in a single Column
 // in Pilosa.
 type PilosaRecord struct {
 	Col  uint64OrString
 	Rows []Row
 	Vals []Val
+
+	// Delete clears the column in every field of the index before anything
+	// else is done.
+	Delete bool
+	// ClearRows are columns to clear, which are cleared before Rows and Vals
+	// are set. Only Field and ID are used.
+	ClearRows []Row
+	// ClearVals are the int fields in which the column's value is cleared.
+	ClearVals []string
+
+	// ColAttrs are attributes to set on the column, and RowAttrs attributes
+	// to set on rows.
+	ColAttrs map[string]interface{}
+	RowAttrs []RowAttr
+}
+
+// AddColAttr adds an attribute to set on the PilosaRecord's column.
+func (pr *PilosaRecord) AddColAttr(key string, value interface{}) {
+	if pr.ColAttrs == nil {
+		pr.ColAttrs = make(map[string]interface{})
+	}
+	pr.ColAttrs[key] = value
+}
+
+// AddRowAttr adds an attribute to set on a row of field.
+func (pr *PilosaRecord) AddRowAttr(field string, idOrKey uint64OrString, key string, value interface{}) {
+	pr.RowAttrs = append(pr.RowAttrs, RowAttr{Field: field, ID: idOrKey, Key: key, Value: value})
+}
+
+// RowAttr is an attribute of a row in a field. Value is a string, bool,
+// int64, or float64.
+type RowAttr struct {
+	Field string
+	ID    uint64OrString
+	Key   string
+	Value interface{}
 }
 
 // AddVal adds a new value to be range encoded into the given field to the
@@ -218,9 +595,16 @@ func (pr *PilosaRecord) AddRow(field string, idOrKey uint64OrString) {
 	pr.Rows = append(pr.Rows, Row{Field: field, ID: idOrKey})
 }
 
+// AddRowType adds a new column to be set to the PilosaRecord, hinting that
+// field should be created as a field of type typ (set, mutex, or bool). An
+// empty typ means set.
+func (pr *PilosaRecord) AddRowType(field string, typ FieldType, idOrKey uint64OrString) {
+	pr.Rows = append(pr.Rows, Row{Field: field, ID: idOrKey, FieldType: typ})
+}
+
 // AddRowTime adds a new column to be set with a timestamp to the PilosaRecord.
-func (pr *PilosaRecord) AddRowTime(field string, id uint64, ts time.Time) {
-	pr.Rows = append(pr.Rows, Row{Field: field, ID: id, Time: ts})
+func (pr *PilosaRecord) AddRowTime(field string, idOrKey uint64OrString, ts time.Time) {
+	pr.Rows = append(pr.Rows, Row{Field: field, ID: idOrKey, Time: ts})
 }
 
 // Row represents a column to set in Pilosa sans column id (which is held by the
@@ -232,6 +616,10 @@ type Row struct {
 	// Time is the timestamp for the column in Pilosa which is the intersection of
 	// this row and the Column in the PilosaRecord which holds this row.
 	Time time.Time
+
+	// FieldType hints the type of field (set, mutex, or bool) which the
+	// Indexer should create if the field doesn't exist. Empty means set.
+	FieldType FieldType
 }
 
 // Val represents a BSI value to set in a Pilosa field sans column id (which is
@@ -34,7 +34,9 @@ package pdk_test
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pilosa/pdk"
 )
@@ -150,3 +152,211 @@ func TestCollapsingMapper(t *testing.T) {
 		})
 	}
 }
+
+func TestCollapsingMapperTimestamp(t *testing.T) {
+	ts := time.Date(2018, time.February, 22, 9, 0, 0, 0, time.UTC)
+	cm := pdk.NewCollapsingMapper()
+	cm.TimestampPath = []string{"meta", "ts"}
+	e := &pdk.Entity{
+		Objects: map[pdk.Property]pdk.Object{
+			"aa":      pdk.S("hello"),
+			"created": pdk.Time(ts),
+			"meta": &pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+				"ts": pdk.Time(ts),
+			}},
+		},
+	}
+	pr, err := cm.Map(e)
+	if err != nil {
+		t.Fatalf("mapping entity: %v", err)
+	}
+	if len(pr.Rows) != 1 || pr.Rows[0].Field != "aa" || !pr.Rows[0].Time.Equal(ts) {
+		t.Fatalf("unexpected rows: %v", pr.Rows)
+	}
+	// the timestamp itself isn't indexed, but other times are indexed as
+	// unix seconds.
+	if len(pr.Vals) != 1 || pr.Vals[0].Field != "created" || pr.Vals[0].Value != ts.Unix() {
+		t.Fatalf("unexpected vals: %v", pr.Vals)
+	}
+
+	// records without a timestamp are mapped without one
+	pr, err = cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"aa": pdk.S("hello")}})
+	if err != nil {
+		t.Fatalf("mapping entity without timestamp: %v", err)
+	}
+	if len(pr.Rows) != 1 || !pr.Rows[0].Time.IsZero() {
+		t.Fatalf("unexpected rows: %v", pr.Rows)
+	}
+
+	_, err = cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+		"meta": &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"ts": pdk.S("yesterday")}},
+	}})
+	if err == nil {
+		t.Fatalf("expected error mapping non-time timestamp")
+	}
+}
+
+func TestCollapsingMapperDecimals(t *testing.T) {
+	cm := pdk.NewCollapsingMapper()
+	cm.Decimals = map[string]int{"price": 2, "qty": 1}
+	cm.Buckets = map[string]pdk.Mapper{"temp": pdk.LinearFloatMapper{Min: 0, Max: 100, Res: 10}}
+	pr, err := cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+		"price":  pdk.F64(19.99),
+		"qty":    pdk.I(3),
+		"weight": pdk.F64(2.7),
+		"temp":   pdk.F32(72.5),
+	}})
+	if err != nil {
+		t.Fatalf("mapping entity: %v", err)
+	}
+	vals := make(map[string]int64)
+	for _, val := range pr.Vals {
+		vals[val.Field] = val.Value
+	}
+	if len(vals) != 3 || vals["price"] != 1999 || vals["qty"] != 30 || vals["weight"] != 2 {
+		t.Errorf("unexpected vals: %v", pr.Vals)
+	}
+	if len(pr.Rows) != 1 || pr.Rows[0].Field != "temp" || pr.Rows[0].ID != uint64(7) {
+		t.Errorf("unexpected rows: %v", pr.Rows)
+	}
+
+	for _, rec := range []map[pdk.Property]pdk.Object{
+		{"temp": pdk.F64(150)},
+		{"price": pdk.F64(1e18)},
+		{"price": pdk.U64(1 << 63)},
+	} {
+		if _, err := cm.Map(&pdk.Entity{Objects: rec}); err == nil {
+			t.Errorf("expected error mapping %v", rec)
+		}
+	}
+}
+
+func TestParseDecimals(t *testing.T) {
+	decimals, err := pdk.ParseDecimals([]string{"price:2", "a:b:0"})
+	if err != nil {
+		t.Fatalf("parsing decimals: %v", err)
+	}
+	if len(decimals) != 2 || decimals["price"] != 2 || decimals["a:b"] != 0 {
+		t.Errorf("unexpected decimals: %v", decimals)
+	}
+	for _, bad := range []string{"price", ":2", "price:x", "price:-1", "price:19"} {
+		if _, err := pdk.ParseDecimals([]string{bad}); err == nil {
+			t.Errorf("expected error parsing %s", bad)
+		}
+	}
+}
+
+func TestCollapsingMapperFieldTypes(t *testing.T) {
+	cm := pdk.NewCollapsingMapper()
+	cm.Translator = nil
+	cm.FieldTypes = map[string]pdk.FieldType{"status": pdk.FieldTypeMutex, "code": pdk.FieldTypeSet, "done": pdk.FieldTypeBool}
+	e := &pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+		"status": pdk.S("open"),
+		"code":   pdk.I(404),
+		"done":   pdk.S("false"),
+		"flags":  &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"new": pdk.B(true), "old": pdk.B(false)}},
+	}}
+	pr, err := cm.Map(e)
+	if err != nil {
+		t.Fatalf("mapping entity: %v", err)
+	}
+	rows := make(map[string]pdk.Row)
+	for _, row := range pr.Rows {
+		rows[row.Field] = row
+	}
+	for field, exp := range map[string]pdk.Row{
+		"status": {Field: "status", ID: "open", FieldType: pdk.FieldTypeMutex},
+		"code":   {Field: "code", ID: "404", FieldType: pdk.FieldTypeSet},
+		"done":   {Field: "done", ID: uint64(0), FieldType: pdk.FieldTypeBool},
+		"flags":  {Field: "flags", ID: "new"},
+	} {
+		if row := rows[field]; row != exp {
+			t.Errorf("field %s: expected %#v, got %#v", field, exp, row)
+		}
+	}
+	if len(pr.Rows) != 4 || len(pr.Vals) != 0 {
+		t.Errorf("unexpected record: %#v", pr)
+	}
+
+	cm.BoolFields = true
+	pr, err = cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+		"flags": &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"old": pdk.B(false)}},
+	}})
+	if err != nil {
+		t.Fatalf("mapping entity: %v", err)
+	}
+	if exp := (pdk.Row{Field: "flags-old", ID: uint64(0), FieldType: pdk.FieldTypeBool}); len(pr.Rows) != 1 || pr.Rows[0] != exp {
+		t.Errorf("unexpected rows with BoolFields: %#v", pr.Rows)
+	}
+
+	if _, err := cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"done": pdk.S("maybe")}}); err == nil {
+		t.Errorf("expected error mapping non-boolean to bool field")
+	}
+}
+
+func TestCollapsingMapperHints(t *testing.T) {
+	cm := pdk.NewCollapsingMapper()
+	cm.Translator = nil
+	cm.FieldTypes = map[string]pdk.FieldType{"kind": pdk.FieldTypeSet}
+	cm.Hints = pdk.NewFieldHints()
+	cm.Hints.SetType([]string{"kind"}, pdk.FieldTypeMutex)
+	cm.Hints.SetType([]string{"item", "state"}, pdk.FieldTypeMutex)
+	cm.Hints.SetType([]string{"ok"}, pdk.FieldTypeBool)
+	cm.Hints.SetDecimals([]string{"price"}, 2)
+	pr, err := cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+		"kind":  pdk.S("a"),
+		"item":  &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"state": pdk.S("new")}},
+		"ok":    pdk.B(false),
+		"price": pdk.F64(12.34),
+	}})
+	if err != nil {
+		t.Fatalf("mapping entity: %v", err)
+	}
+	rows := make(map[string]pdk.Row)
+	for _, row := range pr.Rows {
+		rows[row.Field] = row
+	}
+	for field, exp := range map[string]pdk.Row{
+		"kind":       {Field: "kind", ID: "a", FieldType: pdk.FieldTypeSet},
+		"item-state": {Field: "item-state", ID: "new", FieldType: pdk.FieldTypeMutex},
+		"ok":         {Field: "ok", ID: uint64(0), FieldType: pdk.FieldTypeBool},
+	} {
+		if row := rows[field]; row != exp {
+			t.Errorf("field %s: expected %#v, got %#v", field, exp, row)
+		}
+	}
+	if exp := []pdk.Val{{Field: "price", Value: 1234}}; !reflect.DeepEqual(pr.Vals, exp) {
+		t.Errorf("unexpected vals: %#v", pr.Vals)
+	}
+}
+
+func TestCollapsingMapperColAttrs(t *testing.T) {
+	ts := time.Date(2018, time.February, 22, 9, 0, 0, 0, time.UTC)
+	cm := pdk.NewCollapsingMapper()
+	cm.Translator = nil
+	cm.ColAttrs = map[string]bool{"user-name": true, "joined": true, "score": true, "admin": true}
+	pr, err := cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+		"user": &pdk.Entity{Objects: map[pdk.Property]pdk.Object{
+			"name": pdk.S("Alice"),
+			"id":   pdk.S("a1"),
+		}},
+		"joined": pdk.Time(ts),
+		"score":  pdk.F32(2.5),
+		"admin":  pdk.B(false),
+		"age":    pdk.U8(31),
+	}})
+	if err != nil {
+		t.Fatalf("mapping entity: %v", err)
+	}
+	exp := map[string]interface{}{"user-name": "Alice", "joined": "2018-02-22T09:00:00Z", "score": 2.5, "admin": false}
+	if !reflect.DeepEqual(pr.ColAttrs, exp) {
+		t.Errorf("unexpected column attributes: %#v", pr.ColAttrs)
+	}
+	if len(pr.Rows) != 1 || pr.Rows[0].Field != "user-id" || len(pr.Vals) != 1 || pr.Vals[0].Field != "age" {
+		t.Errorf("unexpected record: %#v", pr)
+	}
+
+	if _, err := cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"score": pdk.U64(1 << 63)}}); err == nil {
+		t.Errorf("expected error mapping out of range attribute")
+	}
+}
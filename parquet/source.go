@@ -0,0 +1,504 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+// Package parquet provides a pdk.Source which reads Parquet files.
+package parquet
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+	pq "github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/types"
+)
+
+// batchSize is the number of rows read from each column at a time.
+const batchSize = 1024
+
+// Source reads rows from the Parquet files which are the readers of a
+// RawSource. Each row is returned as a map[string]interface{} keyed by column
+// name, with the columns of nested groups in nested maps. Null values are left
+// out, and the values of repeated columns are returned as []interface{}.
+// Dates and timestamps are returned as time.Time, times of day as
+// time.Duration, and decimals as float64.
+//
+// Parquet files are read from the end, so readers which aren't files are
+// copied to a temporary file first.
+type Source struct {
+	rs      pdk.RawSource
+	columns []string
+
+	cur *parquetFile
+}
+
+// Option is a functional option for Source.
+type Option func(s *Source)
+
+// OptColumns makes the Source read only the named columns. A column name is a
+// dotted path through nested groups, such as "address.city", and selecting a
+// group selects all of the columns in it. Columns which aren't selected are
+// never read from the file.
+func OptColumns(columns ...string) Option {
+	return func(s *Source) {
+		s.columns = columns
+	}
+}
+
+// NewSourceFromRawSource gets a Source which reads the files of rs in turn.
+func NewSourceFromRawSource(rs pdk.RawSource, opts ...Option) *Source {
+	s := &Source{rs: rs}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Record implements pdk.Source.
+func (s *Source) Record() (interface{}, error) {
+	for {
+		if s.cur == nil {
+			r, err := s.rs.NextReader()
+			if err != nil {
+				return nil, err
+			}
+			s.cur, err = openFile(r, s.columns)
+			if err != nil {
+				r.Close()
+				return nil, errors.Wrapf(err, "opening %s", r.Name())
+			}
+		}
+		if len(s.cur.rows) == 0 && s.cur.remaining > 0 {
+			if err := s.cur.readBatch(); err != nil {
+				return nil, errors.Wrapf(err, "reading %s", s.cur.r.Name())
+			}
+		}
+		if len(s.cur.rows) > 0 {
+			row := s.cur.rows[0]
+			s.cur.rows[0] = nil
+			s.cur.rows = s.cur.rows[1:]
+			return row, nil
+		}
+		err := s.cur.Close()
+		name := s.cur.r.Name()
+		s.cur = nil
+		if err != nil {
+			return nil, errors.Wrapf(err, "closing %s", name)
+		}
+	}
+}
+
+// parquetFile is a Parquet file which is being read.
+type parquetFile struct {
+	r       pdk.NamedReadCloser
+	pr      *reader.ParquetReader
+	leaves  []*leaf
+	cleanup func() error
+
+	remaining int64
+	rows      []map[string]interface{}
+}
+
+// leaf is a column of values in a Parquet file.
+type leaf struct {
+	path  string
+	key   []string
+	elem  *pq.SchemaElement
+	maxDL int32
+	maxRL int32
+}
+
+func openFile(r pdk.NamedReadCloser, columns []string) (*parquetFile, error) {
+	f := &parquetFile{r: r}
+	pf, cleanup, err := newParquetFile(r)
+	if err != nil {
+		return nil, err
+	}
+	f.cleanup = cleanup
+	f.pr, err = reader.NewParquetColumnReader(pf, 1)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "reading footer")
+	}
+	f.leaves = leaves(f.pr)
+	if len(columns) > 0 {
+		f.leaves, err = project(f.leaves, columns)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	f.remaining = f.pr.GetNumRows()
+	return f, nil
+}
+
+// Close closes the file and the reader it's read from.
+func (f *parquetFile) Close() error {
+	if f.pr != nil {
+		f.pr.ReadStop()
+	}
+	var err error
+	if f.cleanup != nil {
+		err = f.cleanup()
+	}
+	if cerr := f.r.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// leaves finds the value columns of the file read by pr, in schema order.
+func leaves(pr *reader.ParquetReader) []*leaf {
+	sh := pr.SchemaHandler
+	elems := sh.SchemaElements
+	var ls []*leaf
+	// walk the schema depth first, keeping the path to the current element.
+	type frame struct {
+		index     int
+		remaining int32
+	}
+	var stack []frame
+	for i := 0; i < len(elems); i++ {
+		for len(stack) > 0 && stack[len(stack)-1].remaining == 0 {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 {
+			stack[len(stack)-1].remaining--
+		}
+		stack = append(stack, frame{index: i, remaining: elems[i].GetNumChildren()})
+		if elems[i].GetNumChildren() > 0 {
+			continue
+		}
+		l := &leaf{elem: elems[i]}
+		inPath := make([]string, 0, len(stack))
+		skip := 0
+		for depth, fr := range stack {
+			elem := elems[fr.index]
+			inPath = append(inPath, sh.Infos[fr.index].InName)
+			if depth == 0 {
+				continue
+			}
+			switch elem.GetRepetitionType() {
+			case pq.FieldRepetitionType_OPTIONAL:
+				l.maxDL++
+			case pq.FieldRepetitionType_REPEATED:
+				l.maxDL++
+				l.maxRL++
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			l.key = append(l.key, sh.Infos[fr.index].ExName)
+			// a list's values are kept at the key of the list, rather than
+			// under the repeated group and element which hold them.
+			if isList(elem) && depth+1 < len(stack) {
+				skip = 1
+				if elems[stack[depth+1].index].GetNumChildren() == 1 {
+					skip = 2
+				}
+			}
+		}
+		l.path = strings.Join(inPath, ".")
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+func isList(elem *pq.SchemaElement) bool {
+	if elem.ConvertedType != nil && *elem.ConvertedType == pq.ConvertedType_LIST {
+		return true
+	}
+	return elem.LogicalType != nil && elem.LogicalType.LIST != nil
+}
+
+// project returns the leaves which are in or under the named columns.
+func project(ls []*leaf, columns []string) ([]*leaf, error) {
+	selected := make([]*leaf, 0, len(ls))
+	chosen := make(map[*leaf]bool)
+	for _, col := range columns {
+		found := false
+		for _, l := range ls {
+			key := strings.Join(l.key, ".")
+			if key != col && !strings.HasPrefix(key, col+".") {
+				continue
+			}
+			found = true
+			if !chosen[l] {
+				chosen[l] = true
+				selected = append(selected, l)
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("column %s is not in the schema", col)
+		}
+	}
+	return selected, nil
+}
+
+// readBatch reads the next batch of rows from every selected column, and
+// assembles them into f.rows.
+func (f *parquetFile) readBatch() error {
+	n := f.remaining
+	if n > batchSize {
+		n = batchSize
+	}
+	rows := make([]map[string]interface{}, n)
+	for i := range rows {
+		rows[i] = make(map[string]interface{}, len(f.leaves))
+	}
+	for _, l := range f.leaves {
+		values, rls, dls, err := f.pr.ReadColumnByPath(l.path, n)
+		if err != nil {
+			return errors.Wrapf(err, "reading column %s", strings.Join(l.key, "."))
+		}
+		row := -1
+		var list []interface{}
+		flush := func() {
+			if row >= 0 && len(list) > 0 {
+				set(rows[row], l.key, list)
+			}
+			list = nil
+		}
+		for i, v := range values {
+			if rls[i] == 0 {
+				flush()
+				row++
+				if row >= len(rows) {
+					return errors.Errorf("column %s has more rows than expected", strings.Join(l.key, "."))
+				}
+			}
+			if dls[i] < l.maxDL || v == nil {
+				continue
+			}
+			v, err := convert(l.elem, v)
+			if err != nil {
+				return errors.Wrapf(err, "converting column %s", strings.Join(l.key, "."))
+			}
+			if l.maxRL == 0 {
+				set(rows[row], l.key, v)
+			} else {
+				list = append(list, v)
+			}
+		}
+		flush()
+	}
+	f.remaining -= n
+	f.rows = rows
+	return nil
+}
+
+// set sets the value at key in row, making the nested maps on the way.
+func set(row map[string]interface{}, key []string, v interface{}) {
+	for _, k := range key[:len(key)-1] {
+		next, ok := row[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			row[k] = next
+		}
+		row = next
+	}
+	row[key[len(key)-1]] = v
+}
+
+// julianUnixEpoch is the Julian day number of 1970-01-01.
+const julianUnixEpoch = 2440588
+
+// convert converts a value of the physical type of elem to the Go type for
+// its logical type.
+func convert(elem *pq.SchemaElement, v interface{}) (interface{}, error) {
+	lt := elem.LogicalType
+	ct := elem.ConvertedType
+	is := func(c pq.ConvertedType) bool { return ct != nil && *ct == c }
+
+	switch {
+	case lt != nil && lt.DECIMAL != nil:
+		return decimal(v, lt.DECIMAL.Scale)
+	case is(pq.ConvertedType_DECIMAL):
+		return decimal(v, elem.GetScale())
+	case lt != nil && lt.DATE != nil, is(pq.ConvertedType_DATE):
+		days, ok := v.(int32)
+		if !ok {
+			return nil, errors.Errorf("unexpected %T for date", v)
+		}
+		return time.Unix(int64(days)*24*60*60, 0).UTC(), nil
+	case lt != nil && lt.TIMESTAMP != nil:
+		return timestamp(v, timeUnit(lt.TIMESTAMP.Unit))
+	case is(pq.ConvertedType_TIMESTAMP_MILLIS):
+		return timestamp(v, time.Millisecond)
+	case is(pq.ConvertedType_TIMESTAMP_MICROS):
+		return timestamp(v, time.Microsecond)
+	case lt != nil && lt.TIME != nil:
+		return duration(v, timeUnit(lt.TIME.Unit))
+	case is(pq.ConvertedType_TIME_MILLIS):
+		return duration(v, time.Millisecond)
+	case is(pq.ConvertedType_TIME_MICROS):
+		return duration(v, time.Microsecond)
+	case elem.GetType() == pq.Type_INT96:
+		b, ok := v.(string)
+		if !ok || len(b) != 12 {
+			return nil, errors.Errorf("unexpected %T for int96 timestamp", v)
+		}
+		nanos := int64(binary.LittleEndian.Uint64([]byte(b[:8])))
+		days := int64(binary.LittleEndian.Uint32([]byte(b[8:]))) - julianUnixEpoch
+		return time.Unix(days*24*60*60, nanos).UTC(), nil
+	}
+	return types.ParquetTypeToGoType(v, elem.Type, ct), nil
+}
+
+func timeUnit(u *pq.TimeUnit) time.Duration {
+	switch {
+	case u == nil:
+		return time.Millisecond
+	case u.MICROS != nil:
+		return time.Microsecond
+	case u.NANOS != nil:
+		return time.Nanosecond
+	}
+	return time.Millisecond
+}
+
+func integer(v interface{}) (int64, error) {
+	switch tv := v.(type) {
+	case int32:
+		return int64(tv), nil
+	case int64:
+		return tv, nil
+	}
+	return 0, errors.Errorf("unexpected %T for integer", v)
+}
+
+func timestamp(v interface{}, unit time.Duration) (interface{}, error) {
+	i, err := integer(v)
+	if err != nil {
+		return nil, err
+	}
+	per := int64(time.Second / unit)
+	return time.Unix(i/per, i%per*int64(unit)).UTC(), nil
+}
+
+func duration(v interface{}, unit time.Duration) (interface{}, error) {
+	i, err := integer(v)
+	if err != nil {
+		return nil, err
+	}
+	return time.Duration(i) * unit, nil
+}
+
+// decimal converts an unscaled decimal value, stored either as an integer or
+// as big endian two's complement bytes, to float64.
+func decimal(v interface{}, scale int32) (interface{}, error) {
+	unscaled := new(big.Int)
+	switch tv := v.(type) {
+	case string:
+		unscaled.SetBytes([]byte(tv))
+		if len(tv) > 0 && tv[0]&0x80 != 0 {
+			unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(len(tv)*8)))
+		}
+	default:
+		i, err := integer(v)
+		if err != nil {
+			return nil, err
+		}
+		unscaled.SetInt64(i)
+	}
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	f, _ := new(big.Rat).SetFrac(unscaled, denom).Float64()
+	return f, nil
+}
+
+// fileReaderAt is satisfied by *os.File, and the file.RawSource readers which
+// embed one.
+type fileReaderAt interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// newParquetFile gets a source.ParquetFile for r. It reads r directly if r is
+// a file, and otherwise copies r to a temporary file, which cleanup removes.
+func newParquetFile(r pdk.NamedReadCloser) (pf source.ParquetFile, cleanup func() error, err error) {
+	if f, ok := r.(fileReaderAt); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "statting")
+		}
+		return newSectionFile(f, info.Size()), nil, nil
+	}
+	tmp, err := ioutil.TempFile("", "pdk-parquet-")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "creating temp file")
+	}
+	cleanup = func() error {
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, nil, errors.Wrap(err, "copying to temp file")
+	}
+	return newSectionFile(tmp, size), cleanup, nil
+}
+
+// sectionFile is a read only source.ParquetFile over an io.ReaderAt. Each
+// call to Open returns an independent handle on the same data.
+type sectionFile struct {
+	*io.SectionReader
+	ra   io.ReaderAt
+	size int64
+}
+
+func newSectionFile(ra io.ReaderAt, size int64) *sectionFile {
+	return &sectionFile{SectionReader: io.NewSectionReader(ra, 0, size), ra: ra, size: size}
+}
+
+func (f *sectionFile) Open(name string) (source.ParquetFile, error) {
+	return newSectionFile(f.ra, f.size), nil
+}
+
+func (f *sectionFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("parquet files are read only")
+}
+
+func (f *sectionFile) Write(p []byte) (int, error) {
+	return 0, errors.New("parquet files are read only")
+}
+
+func (f *sectionFile) Close() error { return nil }
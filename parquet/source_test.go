@@ -0,0 +1,198 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package parquet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pilosa/pdk"
+	"github.com/pilosa/pdk/file"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+type testRow struct {
+	Name  string    `parquet:"name=name, type=UTF8"`
+	ID    int64     `parquet:"name=id, type=INT64"`
+	Nick  *string   `parquet:"name=nick, type=UTF8"`
+	Price int64     `parquet:"name=price, type=DECIMAL, basetype=INT64, scale=2, precision=10"`
+	Day   int32     `parquet:"name=day, type=DATE"`
+	At    int64     `parquet:"name=at, type=TIMESTAMP_MILLIS"`
+	Tags  []string  `parquet:"name=tags, type=LIST, valuetype=UTF8"`
+	Place testPlace `parquet:"name=place"`
+}
+
+type testPlace struct {
+	City string `parquet:"name=city, type=UTF8"`
+	Zip  *int32 `parquet:"name=zip, type=INT32"`
+}
+
+var (
+	testAt  = time.Date(2018, 3, 4, 5, 6, 7, 8000000, time.UTC)
+	testDay = time.Date(2018, 3, 4, 0, 0, 0, 0, time.UTC)
+)
+
+const testRows = 1500
+
+func writeParquet(t *testing.T) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := writer.NewParquetWriterFromWriter(buf, new(testRow), 1)
+	if err != nil {
+		t.Fatalf("getting writer: %v", err)
+	}
+	for i := 0; i < testRows; i++ {
+		row := testRow{
+			Name:  fmt.Sprintf("row%d", i),
+			ID:    int64(i),
+			Price: int64(i*100 + 25),
+			Day:   int32(testDay.Unix() / (24 * 60 * 60)),
+			At:    testAt.UnixNano() / int64(time.Millisecond),
+			Place: testPlace{City: "Austin"},
+		}
+		if i%2 == 0 {
+			nick := fmt.Sprintf("nick%d", i)
+			zip := int32(i)
+			row.Nick, row.Place.Zip = &nick, &zip
+			row.Tags = []string{"a", "b"}
+		}
+		if err := w.Write(row); err != nil {
+			t.Fatalf("writing row %d: %v", i, err)
+		}
+	}
+	if err := w.WriteStop(); err != nil {
+		t.Fatalf("finishing file: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func expRow(i int) map[string]interface{} {
+	exp := map[string]interface{}{
+		"name":  fmt.Sprintf("row%d", i),
+		"id":    int64(i),
+		"price": float64(i) + 0.25,
+		"day":   testDay,
+		"at":    testAt,
+		"place": map[string]interface{}{"city": "Austin"},
+	}
+	if i%2 == 0 {
+		exp["nick"] = fmt.Sprintf("nick%d", i)
+		exp["place"].(map[string]interface{})["zip"] = int32(i)
+		exp["tags"] = []interface{}{"a", "b"}
+	}
+	return exp
+}
+
+func TestSource(t *testing.T) {
+	d, err := ioutil.TempDir("", "testparquetsource")
+	if err != nil {
+		t.Fatalf("getting temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "a.parquet"), writeParquet(t), 0644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	rs, err := file.NewRawSource(d)
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	s := NewSourceFromRawSource(rs)
+	for i := 0; i < testRows; i++ {
+		rec, err := s.Record()
+		if err != nil {
+			t.Fatalf("getting record %d: %v", i, err)
+		}
+		if exp := expRow(i); !reflect.DeepEqual(rec, exp) {
+			t.Fatalf("unexpected record %d:\n%#v\nexp:\n%#v", i, rec, exp)
+		}
+	}
+	if _, err := s.Record(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// bytesRawSource is a RawSource whose readers aren't files.
+type bytesRawSource [][]byte
+
+type bytesReader struct {
+	io.Reader
+}
+
+func (bytesReader) Name() string                 { return "bytes" }
+func (bytesReader) Meta() map[string]interface{} { return nil }
+func (bytesReader) Close() error                 { return nil }
+
+func (b *bytesRawSource) NextReader() (pdk.NamedReadCloser, error) {
+	if len(*b) == 0 {
+		return nil, io.EOF
+	}
+	r := bytesReader{bytes.NewReader((*b)[0])}
+	*b = (*b)[1:]
+	return r, nil
+}
+
+func TestSourceColumns(t *testing.T) {
+	data := writeParquet(t)
+	s := NewSourceFromRawSource(&bytesRawSource{data, data}, OptColumns("id", "place.zip", "tags"))
+	for i := 0; i < 2*testRows; i++ {
+		rec, err := s.Record()
+		if err != nil {
+			t.Fatalf("getting record %d: %v", i, err)
+		}
+		full := expRow(i % testRows)
+		exp := map[string]interface{}{"id": full["id"]}
+		if zip, ok := full["place"].(map[string]interface{})["zip"]; ok {
+			exp["place"] = map[string]interface{}{"zip": zip}
+			exp["tags"] = full["tags"]
+		}
+		if !reflect.DeepEqual(rec, exp) {
+			t.Fatalf("unexpected record %d:\n%#v\nexp:\n%#v", i, rec, exp)
+		}
+	}
+	if _, err := s.Record(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	s = NewSourceFromRawSource(&bytesRawSource{data}, OptColumns("nope"))
+	if _, err := s.Record(); err == nil {
+		t.Fatal("expected error projecting unknown column")
+	}
+}
@@ -37,6 +37,8 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/pilosa/pdk/termstat"
 	"github.com/pkg/errors"
@@ -55,6 +57,15 @@ type GenericParser struct {
 	// the entire record to fail.
 	Strict bool
 
+	// TimeLayouts are tried, in order, against every string value. A value
+	// which can be parsed with one of them becomes a Time rather than an S.
+	TimeLayouts []string
+
+	// EpochProperties maps the names of properties which hold Unix timestamps
+	// to the unit of those timestamps (e.g. time.Second or time.Millisecond).
+	// Numeric values (or numeric strings) of these properties become Times.
+	EpochProperties map[string]time.Duration
+
 	Stats Statter
 	Log   Logger
 }
@@ -194,7 +205,7 @@ func (m *GenericParser) parseMap(val reflect.Value) (*Entity, error) {
 		if _, ok := ent.Objects[prop]; ok {
 			return nil, errors.Errorf("property collision in objects at '%v', val '%v'", kval, vval)
 		}
-		obj, err := m.parseValue(vval)
+		obj, err := m.parseProp(prop, vval)
 		if err != nil {
 			if m.Strict {
 				return ent, errors.Wrapf(err, "parsing value '%v' at '%v':", vval, kval)
@@ -221,7 +232,7 @@ func (m *GenericParser) parseStruct(val reflect.Value) (*Entity, error) {
 		}
 		fieldv := val.Field(i)
 		fieldv = deref(fieldv)
-		obj, err := m.parseValue(fieldv)
+		obj, err := m.parseProp(Property(field.Name), fieldv)
 		if err != nil {
 			if m.Strict {
 				return nil, errors.Wrapf(err, "parsing field:%v value:%v", field, fieldv)
@@ -236,7 +247,40 @@ func (m *GenericParser) parseStruct(val reflect.Value) (*Entity, error) {
 	return ent, nil
 }
 
+// parseProp parses the value of a property, turning it into a Time if the
+// property is one of EpochProperties.
+func (m *GenericParser) parseProp(prop Property, val reflect.Value) (Object, error) {
+	obj, err := m.parseValue(val)
+	if err != nil {
+		return nil, err
+	}
+	unit, ok := m.EpochProperties[string(prop)]
+	if !ok {
+		return obj, nil
+	}
+	var epoch float64
+	switch tobj := obj.(type) {
+	case F32, F64, I, I8, I16, I32, I64, U, U8, U16, U32, U64:
+		epoch = Float64ize(obj.(Literal))
+	case S:
+		epoch, err = strconv.ParseFloat(string(tobj), 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing epoch timestamp '%s'", tobj)
+		}
+	case Time:
+		return obj, nil
+	default:
+		return nil, errors.Errorf("can't parse %v of type %T as an epoch timestamp", obj, obj)
+	}
+	return Time(time.Unix(0, int64(epoch*float64(unit))).UTC()), nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
 func (m *GenericParser) parseValue(val reflect.Value) (Object, error) {
+	if val.IsValid() && val.Type() == timeType {
+		return Time(val.Interface().(time.Time)), nil
+	}
 	switch k := val.Kind(); k {
 	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.String:
 		lit, err := m.parseLit(val)
@@ -328,6 +372,11 @@ func (m *GenericParser) parseLit(val reflect.Value) (Object, error) {
 		m.Stats.Count("parser.parseLit."+k.String(), 1, 1)
 		return nil, errors.New("nested slices/arrays of literals are not supported - parseLit should not be called with these kinds of values")
 	case reflect.String:
+		for _, layout := range m.TimeLayouts {
+			if t, err := time.Parse(layout, val.String()); err == nil {
+				return Time(t), nil
+			}
+		}
 		return S(val.String()), nil
 	default:
 		m.Stats.Count("parser.parseLit."+k.String(), 1, 1)
@@ -37,6 +37,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pilosa/pdk/fake"
 	"github.com/pilosa/pdk/mock"
@@ -318,3 +319,52 @@ func TestGenericParserWithStruct(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGenericParserTimes(t *testing.T) {
+	gp := NewDefaultGenericParser()
+	gp.TimeLayouts = []string{time.RFC3339, "2006-01-02"}
+	gp.EpochProperties = map[string]time.Duration{
+		"secs":   time.Second,
+		"millis": time.Millisecond,
+		"strsec": time.Second,
+	}
+	ts := time.Date(2018, time.February, 22, 9, 0, 0, 0, time.UTC)
+	testRec := map[string]interface{}{
+		"rfc":    "2018-02-22T10:00:00+01:00",
+		"date":   "2018-02-22",
+		"notime": "2018-02-22 is a date",
+		"secs":   float64(ts.Unix()),
+		"millis": ts.Unix() * 1000,
+		"strsec": fmt.Sprintf("%d", ts.Unix()),
+		"gotime": ts,
+		"inner":  map[string]interface{}{"secs": ts.Unix()},
+		"other":  ts.Unix(),
+	}
+
+	actual, err := gp.Parse(testRec)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	expected := &Entity{
+		Objects: map[Property]Object{
+			"rfc":    Time(ts),
+			"date":   Time(ts.Truncate(time.Hour * 24)),
+			"notime": S("2018-02-22 is a date"),
+			"secs":   Time(ts),
+			"millis": Time(ts),
+			"strsec": Time(ts),
+			"gotime": Time(ts),
+			"inner":  &Entity{Objects: map[Property]Object{"secs": Time(ts)}},
+			"other":  I64(ts.Unix()),
+		},
+	}
+	if err := expected.Equal(actual); err != nil {
+		t.Fatal(err)
+	}
+
+	gp.Strict = true
+	_, err = gp.Parse(map[string]interface{}{"secs": "yesterday"})
+	if err == nil {
+		t.Fatalf("expected error parsing non-numeric epoch")
+	}
+}
@@ -35,7 +35,10 @@ package pdk
 import (
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"math/bits"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -51,29 +54,292 @@ type Index struct {
 	lock        sync.RWMutex
 	index       *gopilosa.Index
 	importWG    sync.WaitGroup
+	fields      map[string]*gopilosa.Field
 	recordChans map[string]chanRecordIterator
+
+	// pending holds the values of new int fields whose bounds are still
+	// being discovered. They are charged to the memory budget like queued
+	// records.
+	pending map[string][]gopilosa.FieldValue
+
+	rangeLock sync.Mutex
+	observed  map[string]IntRange
+
+	// attrLock protects the attributes waiting to be sent. Column attributes
+	// are keyed by column, and row attributes by field and then row.
+	attrLock sync.Mutex
+	colAttrs map[uint64OrString]map[string]interface{}
+	rowAttrs map[string]map[uint64OrString]map[string]interface{}
+	numAttrs int
+
+	// budget bounds the memory used by records queued for import across
+	// all fields.
+	budget *memBudget
+	stats  Statter
+
+	errLock    sync.Mutex
+	importErrs ImportErrors
+	errs       chan error
 }
 
 func newIndex(options *pilosaOptions) *Index {
+	limit := int64(defaultMemoryLimit)
+	if options.memoryLimit != nil {
+		limit = int64(*options.memoryLimit)
+	}
+	var stats Statter = NopStatter{}
+	if options.stats != nil {
+		stats = options.stats
+	}
 	return &Index{
+		budget:      newMemBudget(limit, stats),
+		stats:       stats,
 		options:     options,
+		fields:      make(map[string]*gopilosa.Field),
 		recordChans: make(map[string]chanRecordIterator),
+		pending:     make(map[string][]gopilosa.FieldValue),
+		observed:    make(map[string]IntRange),
+		colAttrs:    make(map[uint64OrString]map[string]interface{}),
+		rowAttrs:    make(map[string]map[uint64OrString]map[string]interface{}),
+		errs:        make(chan error, 100),
 	}
 }
 
+// IntRange is an inclusive range of integer values.
+type IntRange struct {
+	Min int64
+	Max int64
+}
+
+// String implements the fmt.Stringer interface.
+func (r IntRange) String() string {
+	return fmt.Sprintf("[%d, %d]", r.Min, r.Max)
+}
+
+// RangeError is returned by AddValue for a value which lies outside the
+// bounds of an existing int field. Pilosa can't change the bounds of a field
+// once it is created, so such values can't be imported.
+type RangeError struct {
+	Field  string
+	Value  int64
+	Bounds IntRange
+	// Observed is the range of the values given to AddValue for the field so
+	// far, including this one.
+	Observed IntRange
+}
+
+// Error implements the error interface.
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("value %d is outside the bounds %v of int field '%s' (values seen so far span %v)", e.Value, e.Bounds, e.Field, e.Observed)
+}
+
+// PilosaError is returned by the Index when Pilosa couldn't be reached or
+// failed a request, such as creating a field, rather than because of what it
+// was given. Giving the same data again may succeed.
+type PilosaError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *PilosaError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error for use with errors.Cause.
+func (e *PilosaError) Cause() error {
+	return e.Err
+}
+
+// ImportError describes a failure to import data into a particular field.
+// Field is empty if column attributes couldn't be set.
+type ImportError struct {
+	Field string
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *ImportError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("setting column attributes: %v", e.Err)
+	}
+	return fmt.Sprintf("importing field '%s': %v", e.Field, e.Err)
+}
+
+// Cause returns the underlying error for use with errors.Cause.
+func (e *ImportError) Cause() error {
+	return e.Err
+}
+
+// ImportErrors is a list of import failures collected by an Index.
+type ImportErrors []*ImportError
+
+// Error implements the error interface.
+func (errs ImportErrors) Error() string {
+	errstrings := make([]string, len(errs))
+	for i, err := range errs {
+		errstrings[i] = err.Error()
+	}
+	return strings.Join(errstrings, "; ")
+}
+
 // Client returns a Pilosa client.
 func (i *Index) Client() *gopilosa.Client {
 	return i.client
 }
 
 // AddColumnTimestamp adds a column to be imported to Pilosa with a timestamp.
-func (i *Index) AddColumnTimestamp(field string, row, col uint64OrString, ts time.Time) {
-	i.addColumn(field, row, col, ts.UnixNano())
+// If the field doesn't exist, it is created as a time field with the quantum
+// given by OptPilosaTimeQuantum or OptPilosaFieldTimeQuantum. It returns an
+// error if the field does not exist and could not be created.
+func (i *Index) AddColumnTimestamp(field string, col, row uint64OrString, ts time.Time) error {
+	return i.addColumn(field, FieldTypeTime, col, row, ts.UnixNano())
+}
+
+// AddColumn adds a column to be imported to Pilosa. It returns an error if the
+// field does not exist and could not be created.
+func (i *Index) AddColumn(field string, col, row uint64OrString) error {
+	return i.addColumn(field, FieldTypeSet, col, row, 0)
+}
+
+// AddColumnType works like AddColumn, but if the field doesn't exist, it is
+// created as a field of type typ, which must be set, mutex, or bool. Setting a
+// column in a mutex field clears whichever row was set for it before, as does
+// setting a column in a bool field, whose rows are 0 (false) and 1 (true). If
+// the field already exists, it keeps its type.
+func (i *Index) AddColumnType(field string, typ FieldType, col, row uint64OrString) error {
+	switch typ {
+	case "":
+		typ = FieldTypeSet
+	case FieldTypeSet, FieldTypeMutex:
+	case FieldTypeBool:
+		if id, ok := row.(uint64); !ok || id > 1 {
+			return errors.Errorf("row for bool field '%s' must be 0 or 1, not %v", field, row)
+		}
+	default:
+		return errors.Errorf("can't add a column to a field of type '%s'", typ)
+	}
+	return i.addColumn(field, typ, col, row, 0)
+}
+
+// ClearColumn clears a column which was set with AddColumn (or one of its
+// variants). Sets and clears for a field are imported in the order they were
+// added. Columns in time fields are only cleared from the standard view.
+// Nothing is done if the field doesn't exist.
+func (i *Index) ClearColumn(field string, col, row uint64OrString) error {
+	if !validUint64OrString(col) || !validUint64OrString(row) {
+		panic(fmt.Sprintf("a %T and a %T were passed, both must be either uint64 or string", col, row))
+	}
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	c, ok := i.recordChans[field]
+	if !ok {
+		return nil
+	}
+	i.send(c, clearRecord{gopilosa.Column{
+		RowID: uint64Cast(row), ColumnID: uint64Cast(col),
+		RowKey: stringCast(row), ColumnKey: stringCast(col)}})
+	return nil
 }
 
-// AddColumn adds a column to be imported to Pilosa.
-func (i *Index) AddColumn(field string, col, row uint64OrString) {
-	i.addColumn(field, col, row, 0)
+// ClearValue clears the value of col in the int field, so that it has no
+// value at all. Nothing is done if the field doesn't exist.
+func (i *Index) ClearValue(fieldName string, col uint64OrString) error {
+	if !validUint64OrString(col) {
+		panic(fmt.Sprintf("a %T was passed, must be either uint64 or string", col))
+	}
+	i.lock.RLock()
+	c, ok := i.recordChans[fieldName]
+	if !ok {
+		i.lock.RUnlock()
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		// drop any values for col which are waiting for the field to be
+		// created
+		vals := i.pending[fieldName][:0]
+		for _, fv := range i.pending[fieldName] {
+			if fv.ColumnID != uint64Cast(col) || fv.ColumnKey != stringCast(col) {
+				vals = append(vals, fv)
+			} else {
+				i.budget.release(recordSize(fv))
+			}
+		}
+		if len(vals) > 0 {
+			i.pending[fieldName] = vals
+		} else {
+			delete(i.pending, fieldName)
+		}
+		return nil
+	}
+	defer i.lock.RUnlock()
+	// Clearing ignores the value, but it still has to be within the
+	// field's bounds.
+	opts := i.fields[fieldName].Options()
+	val := int64(0)
+	if val < opts.Min() {
+		val = opts.Min()
+	} else if val > opts.Max() {
+		val = opts.Max()
+	}
+	i.send(c, clearRecord{gopilosa.FieldValue{ColumnID: uint64Cast(col), ColumnKey: stringCast(col), Value: val}})
+	return nil
+}
+
+// DeleteColumn clears col in every field of the index: its value in each int
+// field, and each of its rows in the other fields. The rows are looked up in
+// Pilosa, so rows which have been added but not imported yet must be cleared
+// with ClearColumn. As with ClearColumn, time fields are only cleared from the
+// standard view.
+func (i *Index) DeleteColumn(col uint64OrString) error {
+	if !validUint64OrString(col) {
+		panic(fmt.Sprintf("a %T was passed, must be either uint64 or string", col))
+	}
+	i.lock.RLock()
+	names := make([]string, 0, len(i.fields)+len(i.pending))
+	rowFields := make([]*gopilosa.Field, 0, len(i.fields))
+	for name, field := range i.fields {
+		if field.Options().Type() == gopilosa.FieldTypeInt {
+			names = append(names, name)
+		} else {
+			rowFields = append(rowFields, field)
+		}
+	}
+	for name := range i.pending {
+		names = append(names, name)
+	}
+	i.lock.RUnlock()
+	for _, name := range names {
+		if err := i.ClearValue(name, col); err != nil {
+			return errors.Wrapf(err, "clearing value of '%s'", name)
+		}
+	}
+	if len(rowFields) == 0 {
+		return nil
+	}
+	queries := make([]gopilosa.PQLQuery, len(rowFields))
+	for j, field := range rowFields {
+		queries[j] = field.RowsColumn(col)
+	}
+	resp, err := i.client.Query(i.index.BatchQuery(queries...))
+	if err != nil {
+		return &PilosaError{Err: errors.Wrapf(err, "getting rows of column %v", col)}
+	}
+	for j, res := range resp.Results() {
+		rows := res.RowIdentifiers()
+		for _, key := range rows.Keys {
+			if err := i.ClearColumn(rowFields[j].Name(), col, key); err != nil {
+				return err
+			}
+		}
+		if len(rows.Keys) > 0 {
+			continue
+		}
+		for _, id := range rows.IDs {
+			if err := i.ClearColumn(rowFields[j].Name(), col, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 type uint64OrString interface{}
@@ -97,77 +363,472 @@ func validUint64OrString(u uint64OrString) bool {
 	return true
 }
 
-func (i *Index) addColumn(fieldName string, col uint64OrString, row uint64OrString, ts int64) {
+// addColumn adds a column to the field fieldName, creating it as a field of
+// type typ if it doesn't exist.
+func (i *Index) addColumn(fieldName string, typ FieldType, col uint64OrString, row uint64OrString, ts int64) error {
 	if !validUint64OrString(col) || !validUint64OrString(row) {
 		panic(fmt.Sprintf("a %T and a %T were passed, both must be either uint64 or string", col, row))
 	}
 	var c chanRecordIterator
 	var ok bool
+	// The lock is held while sending so that Flush can't close the channel out
+	// from under us.
 	i.lock.RLock()
 	if c, ok = i.recordChans[fieldName]; !ok {
 		i.lock.RUnlock()
 		i.lock.Lock()
 		defer i.lock.Unlock()
-		fieldType := gopilosa.OptFieldTypeSet(gopilosa.CacheTypeRanked, 100000)
-		if ts != 0 {
-			fieldType = gopilosa.OptFieldTypeTime(gopilosa.TimeQuantumYearMonthDayHour)
-		}
-		fieldOpts := []gopilosa.FieldOption{fieldType}
-		// If row value is a string then configure the field to use row keys.
-		if _, ok := row.(string); ok {
-			fieldOpts = append(fieldOpts, gopilosa.OptFieldKeys(true))
-		}
-		field := i.index.Field(fieldName, fieldOpts...)
-		err := i.setupField(field)
+		err := i.setupField(i.newField(fieldName, typ, row))
 		if err != nil {
-			log.Println(errors.Wrapf(err, "setting up field '%s'", fieldName)) // TODO make AddBit/AddValue return err?
-			return
+			return errors.Wrapf(err, "setting up field '%s'", fieldName)
 		}
 		c = i.recordChans[fieldName]
 	} else {
-		i.lock.RUnlock()
+		defer i.lock.RUnlock()
 	}
-	c <- gopilosa.Column{
+	i.send(c, gopilosa.Column{
 		RowID: uint64Cast(row), ColumnID: uint64Cast(col),
 		RowKey: stringCast(row), ColumnKey: stringCast(col),
-		Timestamp: ts}
+		Timestamp: ts})
+	return nil
 }
 
-// AddValue adds a value to be imported to Pilosa.
-func (i *Index) AddValue(fieldName string, col uint64OrString, val int64) {
-	var c chanRecordIterator
-	var ok bool
+// send queues rec to be imported from c, first waiting until the Index's
+// memory budget has room for it.
+func (i *Index) send(c chanRecordIterator, rec gopilosa.Record) {
+	i.budget.acquire(recordSize(rec))
+	c <- rec
+}
 
+// newField returns a field named fieldName of type typ, which uses row keys
+// if row is a string.
+func (i *Index) newField(fieldName string, typ FieldType, row uint64OrString) *gopilosa.Field {
+	var fieldType gopilosa.FieldOption
+	switch typ {
+	case FieldTypeTime:
+		fieldType = gopilosa.OptFieldTypeTime(i.timeQuantum(fieldName))
+	case FieldTypeMutex:
+		fieldType = gopilosa.OptFieldTypeMutex(gopilosa.CacheTypeRanked, 100000)
+	case FieldTypeBool:
+		fieldType = gopilosa.OptFieldTypeBool()
+	default:
+		fieldType = gopilosa.OptFieldTypeSet(gopilosa.CacheTypeRanked, 100000)
+	}
+	fieldOpts := []gopilosa.FieldOption{fieldType}
+	// If row value is a string then configure the field to use row keys.
+	if _, ok := row.(string); ok && typ != FieldTypeBool {
+		fieldOpts = append(fieldOpts, gopilosa.OptFieldKeys(true))
+	}
+	return i.index.Field(fieldName, fieldOpts...)
+}
+
+// AddColAttr sets the attribute key of col to value, which must be a string,
+// bool, integer, or float64. Attributes are sent to Pilosa in batches. A full
+// batch is sent as soon as it fills up, whether or not the columns and values
+// added before it have been imported yet; what remains is sent by Flush and
+// Close once the imports have finished.
+func (i *Index) AddColAttr(col uint64OrString, key string, value interface{}) error {
 	if !validUint64OrString(col) {
-		panic(fmt.Sprintf("a %T was passed, must be eithe uint64 or string", col))
+		panic(fmt.Sprintf("a %T was passed, must be either uint64 or string", col))
 	}
+	value, err := attrValue(key, value)
+	if err != nil {
+		return errors.Wrapf(err, "column %v", col)
+	}
+	i.attrLock.Lock()
+	defer i.attrLock.Unlock()
+	attrs, ok := i.colAttrs[col]
+	if !ok {
+		attrs = make(map[string]interface{})
+		i.colAttrs[col] = attrs
+	}
+	return i.addAttr(attrs, key, value)
+}
 
+// AddRowAttr sets the attribute key of row in field to value, which must be a
+// string, bool, integer, or float64. If the field doesn't exist, it is created
+// as a set field. Like column attributes, row attributes are sent in batches.
+func (i *Index) AddRowAttr(field string, row uint64OrString, key string, value interface{}) error {
+	if !validUint64OrString(row) {
+		panic(fmt.Sprintf("a %T was passed, must be either uint64 or string", row))
+	}
+	value, err := attrValue(key, value)
+	if err != nil {
+		return errors.Wrapf(err, "row %v of field '%s'", row, field)
+	}
 	i.lock.RLock()
-	if c, ok = i.recordChans[fieldName]; !ok {
-		i.lock.RUnlock()
+	_, ok := i.fields[field]
+	i.lock.RUnlock()
+	if !ok {
 		i.lock.Lock()
-		defer i.lock.Unlock()
-		field := i.index.Field(fieldName, gopilosa.OptFieldTypeInt())
-		err := i.setupField(field)
+		err := i.setupField(i.newField(field, FieldTypeSet, row))
+		i.lock.Unlock()
 		if err != nil {
-			log.Println(errors.Wrap(err, "setting up field"))
-			return
+			return errors.Wrapf(err, "setting up field '%s'", field)
 		}
-		c = i.recordChans[fieldName]
-	} else {
-		i.lock.RUnlock()
 	}
-	c <- gopilosa.FieldValue{ColumnID: uint64Cast(col), ColumnKey: stringCast(col), Value: val}
+	i.attrLock.Lock()
+	defer i.attrLock.Unlock()
+	rows, ok := i.rowAttrs[field]
+	if !ok {
+		rows = make(map[uint64OrString]map[string]interface{})
+		i.rowAttrs[field] = rows
+	}
+	attrs, ok := rows[row]
+	if !ok {
+		attrs = make(map[string]interface{})
+		rows[row] = attrs
+	}
+	return i.addAttr(attrs, key, value)
+}
+
+// addAttr sets key to value in attrs, and sends the pending attributes once
+// there are a batch of them. The pending imports aren't flushed first. Callers
+// must hold i.attrLock.
+func (i *Index) addAttr(attrs map[string]interface{}, key string, value interface{}) error {
+	if _, ok := attrs[key]; !ok {
+		i.numAttrs++
+	}
+	attrs[key] = value
+	if i.numAttrs < int(i.batchSize) {
+		return nil
+	}
+	if err := i.sendAttrs(); err != nil {
+		return &PilosaError{Err: err}
+	}
+	return nil
+}
+
+// sendAttrs sends the pending attributes to Pilosa, with one query for the
+// column attributes and one for the row attributes of each field. Callers
+// must hold i.attrLock.
+func (i *Index) sendAttrs() error {
+	var errs ImportErrors
+	if len(i.colAttrs) > 0 {
+		queries := make([]gopilosa.PQLQuery, 0, len(i.colAttrs))
+		for col, attrs := range i.colAttrs {
+			queries = append(queries, i.index.SetColumnAttrs(col, attrs))
+		}
+		if _, err := i.client.Query(i.index.BatchQuery(queries...)); err != nil {
+			errs = append(errs, &ImportError{Err: err})
+		}
+	}
+	i.lock.RLock()
+	for fieldName, rows := range i.rowAttrs {
+		field := i.fields[fieldName]
+		queries := make([]gopilosa.PQLQuery, 0, len(rows))
+		for row, attrs := range rows {
+			queries = append(queries, field.SetRowAttrs(row, attrs))
+		}
+		if _, err := i.client.Query(i.index.BatchQuery(queries...)); err != nil {
+			errs = append(errs, &ImportError{Field: fieldName, Err: errors.Wrap(err, "setting row attributes")})
+		}
+	}
+	i.lock.RUnlock()
+	i.colAttrs = make(map[uint64OrString]map[string]interface{})
+	i.rowAttrs = make(map[string]map[uint64OrString]map[string]interface{})
+	i.numAttrs = 0
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// flushAttrs sends the pending attributes to Pilosa, reporting any failures
+// as import errors. Callers must not hold i.lock.
+func (i *Index) flushAttrs() {
+	i.attrLock.Lock()
+	defer i.attrLock.Unlock()
+	if err := i.sendAttrs(); err != nil {
+		for _, ierr := range err.(ImportErrors) {
+			i.reportImportErr(ierr.Field, ierr.Err)
+		}
+	}
+}
+
+var attrNameRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// attrValue checks that key is a valid attribute name, and returns value as
+// one of the types Pilosa stores for attributes.
+func attrValue(key string, value interface{}) (interface{}, error) {
+	if len(key) > 64 || !attrNameRegexp.MatchString(key) {
+		return nil, errors.Errorf("invalid attribute name '%s'", key)
+	}
+	switch v := value.(type) {
+	case string, bool, int64, float64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, errors.Errorf("attribute '%s': %d is too large", key, v)
+		}
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	}
+	return nil, errors.Errorf("attribute '%s' can't be a %T", key, value)
+}
+
+// timeQuantum returns the quantum to use when creating the time field named
+// field.
+func (i *Index) timeQuantum(field string) gopilosa.TimeQuantum {
+	if i.options != nil {
+		if q, ok := i.options.fieldTimeQuantums[field]; ok {
+			return q
+		}
+		if i.options.timeQuantum != gopilosa.TimeQuantumNone {
+			return i.options.timeQuantum
+		}
+	}
+	return gopilosa.TimeQuantumYearMonthDayHour
+}
+
+// AddValue adds a value to be imported to Pilosa. If the field doesn't exist,
+// it is created as an int field. Unless bounds were given with
+// OptPilosaIntRange, the first values for a new field are held back (see
+// OptPilosaIntDiscovery) so that the field can be created with bounds which
+// fit them. Held back values count against the memory budget, and if there
+// isn't room for another, every field still being discovered is created with
+// the values it has so far. It returns a *RangeError if val is outside the bounds of an
+// existing int field, or another error if the field could not be created.
+func (i *Index) AddValue(fieldName string, col uint64OrString, val int64) error {
+	if !validUint64OrString(col) {
+		panic(fmt.Sprintf("a %T was passed, must be eithe uint64 or string", col))
+	}
+	observed := i.observe(fieldName, val)
+	fv := gopilosa.FieldValue{ColumnID: uint64Cast(col), ColumnKey: stringCast(col), Value: val}
+
+	i.lock.RLock()
+	if c, ok := i.recordChans[fieldName]; ok {
+		defer i.lock.RUnlock()
+		return i.sendValue(c, i.fields[fieldName], fv, observed)
+	}
+	i.lock.RUnlock()
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if c, ok := i.recordChans[fieldName]; ok {
+		// created while we waited for the lock
+		return i.sendValue(c, i.fields[fieldName], fv, observed)
+	}
+
+	bounds, ok := i.options.intRanges[fieldName]
+	if !ok && i.intDiscovery() > 0 {
+		if size := recordSize(fv); !i.budget.tryAcquire(size) {
+			// Pending values are only freed by importing them, so rather
+			// than wait for memory while holding them, the fields still
+			// being discovered are created with what they have so far.
+			i.createAllDiscovered()
+			i.budget.acquire(size)
+		}
+		i.pending[fieldName] = append(i.pending[fieldName], fv)
+		if len(i.pending[fieldName]) < i.intDiscovery() {
+			return nil
+		}
+		return i.createDiscovered(fieldName)
+	}
+	if !ok {
+		bounds = IntRange{Min: math.MinInt64, Max: math.MaxInt64}
+	}
+	field := i.index.Field(fieldName, gopilosa.OptFieldTypeInt(bounds.Min, bounds.Max))
+	err := i.setupField(field)
+	if err != nil {
+		return errors.Wrapf(err, "setting up field '%s'", fieldName)
+	}
+	return i.sendValue(i.recordChans[fieldName], field, fv, observed)
+}
+
+// sendValue checks that fv is within the bounds of field, and sends it to be
+// imported. Callers must hold i.lock.
+func (i *Index) sendValue(c chanRecordIterator, field *gopilosa.Field, fv gopilosa.FieldValue, observed IntRange) error {
+	if opts := field.Options(); opts.Type() == gopilosa.FieldTypeInt {
+		if fv.Value < opts.Min() || fv.Value > opts.Max() {
+			return &RangeError{
+				Field:    field.Name(),
+				Value:    fv.Value,
+				Bounds:   IntRange{Min: opts.Min(), Max: opts.Max()},
+				Observed: observed,
+			}
+		}
+	}
+	i.send(c, fv)
+	return nil
+}
+
+// observe records that val was added to field, and returns the range of all
+// the values added to field.
+func (i *Index) observe(field string, val int64) IntRange {
+	i.rangeLock.Lock()
+	defer i.rangeLock.Unlock()
+	r, ok := i.observed[field]
+	if !ok || val < r.Min {
+		r.Min = val
+	}
+	if !ok || val > r.Max {
+		r.Max = val
+	}
+	i.observed[field] = r
+	return r
+}
+
+// IntRanges returns the range of the values which have been added to each int
+// field with AddValue.
+func (i *Index) IntRanges() map[string]IntRange {
+	i.rangeLock.Lock()
+	defer i.rangeLock.Unlock()
+	ranges := make(map[string]IntRange, len(i.observed))
+	for field, r := range i.observed {
+		ranges[field] = r
+	}
+	return ranges
+}
+
+// intDiscovery returns the number of values to hold back while discovering
+// the bounds of a new int field.
+func (i *Index) intDiscovery() int {
+	if i.options.intDiscovery != nil {
+		return int(*i.options.intDiscovery)
+	}
+	return int(i.batchSize)
+}
+
+// createDiscovered creates the int field fieldName with bounds which leave
+// plenty of room around the pending values, and sends them to be imported.
+// Callers must hold i.lock.Lock().
+func (i *Index) createDiscovered(fieldName string) error {
+	vals := i.pending[fieldName]
+	delete(i.pending, fieldName)
+	r := IntRange{Min: vals[0].Value, Max: vals[0].Value}
+	for _, fv := range vals[1:] {
+		if fv.Value < r.Min {
+			r.Min = fv.Value
+		}
+		if fv.Value > r.Max {
+			r.Max = fv.Value
+		}
+	}
+	bounds := discoveredBounds(r)
+	field := i.index.Field(fieldName, gopilosa.OptFieldTypeInt(bounds.Min, bounds.Max))
+	if err := i.setupField(field); err != nil {
+		for _, fv := range vals {
+			i.budget.release(recordSize(fv))
+		}
+		return errors.Wrapf(err, "setting up field '%s' with bounds %v", fieldName, bounds)
+	}
+	// the values' memory was acquired when they were held back.
+	c := i.recordChans[fieldName]
+	for _, fv := range vals {
+		c <- fv
+	}
+	return nil
+}
+
+// createAllDiscovered creates every int field which is still being
+// discovered. Failures are reported as import errors. Callers must hold
+// i.lock.Lock().
+func (i *Index) createAllDiscovered() {
+	for fieldName := range i.pending {
+		if err := i.createDiscovered(fieldName); err != nil {
+			i.reportImportErr(fieldName, err)
+		}
+	}
+}
+
+// discoveredBounds returns bounds for an int field whose values so far lie
+// within r. Each bound is pushed out to 1024 times the next power of two, so
+// that later values have room to grow at the cost of about ten bits per
+// value in Pilosa. Non-negative values get a lower bound of 0.
+func discoveredBounds(r IntRange) IntRange {
+	widen := func(v uint64) int64 {
+		n := bits.Len64(v) + 10
+		if n >= 63 {
+			return math.MaxInt64
+		}
+		return 1<<uint(n) - 1
+	}
+	var bounds IntRange
+	if r.Max > 0 {
+		bounds.Max = widen(uint64(r.Max))
+	}
+	if r.Min < 0 {
+		bounds.Min = -widen(uint64(-(r.Min + 1)))
+		if bounds.Min == -math.MaxInt64 {
+			bounds.Min = math.MinInt64
+		}
+	}
+	return bounds
+}
+
+// Flush closes the channels feeding every field's importer, waits for the
+// imports to finish, and then starts fresh importers so that the Index can
+// continue to be used. It returns an ImportErrors if any import since the last
+// Flush failed.
+func (i *Index) Flush() error {
+	i.lock.Lock()
+	i.createAllDiscovered()
+	for _, cbi := range i.recordChans {
+		close(cbi)
+	}
+	i.importWG.Wait()
+	for _, field := range i.fields {
+		i.startImport(field)
+	}
+	i.lock.Unlock()
+	// Attributes are set once the data added before them is in, so that
+	// Pilosa has already seen any keys they use.
+	i.flushAttrs()
+	return i.takeImportErrs()
+}
+
+// Errors returns a channel on which import failures are sent as they occur. If
+// nothing is receiving, errors are not sent, but they are still returned by
+// the next call to Flush or Close. The channel is closed by Close.
+func (i *Index) Errors() <-chan error {
+	return i.errs
+}
+
+// reportImportErr records that importing into field failed.
+func (i *Index) reportImportErr(field string, err error) {
+	ierr := &ImportError{Field: field, Err: err}
+	i.errLock.Lock()
+	i.importErrs = append(i.importErrs, ierr)
+	i.errLock.Unlock()
+	select {
+	case i.errs <- ierr:
+	default:
+	}
+}
+
+// takeImportErrs returns and clears the errors collected since it was last
+// called.
+func (i *Index) takeImportErrs() error {
+	i.errLock.Lock()
+	defer i.errLock.Unlock()
+	errs := i.importErrs
+	i.importErrs = nil
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
 }
 
 // Close ensures that all ongoing imports have finished and cleans up internal
-// state.
+// state. It returns an ImportErrors if any import failed since the last Flush.
 func (i *Index) Close() error {
+	i.lock.Lock()
+	i.createAllDiscovered()
 	for _, cbi := range i.recordChans {
 		close(cbi)
 	}
 	i.importWG.Wait()
-	return nil
+	i.lock.Unlock()
+	i.flushAttrs()
+	close(i.errs)
+	return i.takeImportErrs()
 }
 
 func NewRankedField(index *gopilosa.Index, name string, size int) *gopilosa.Field {
@@ -187,33 +848,71 @@ func (i *Index) setupField(field *gopilosa.Field) error {
 	if _, ok := i.recordChans[fieldName]; !ok {
 		err := i.client.EnsureField(field)
 		if err != nil {
-			return errors.Wrapf(err, "creating field '%v'", field)
-		}
-		i.recordChans[fieldName] = newChanRecordIterator()
-		i.importWG.Add(1)
-		var importOptions []gopilosa.ImportOption
-		if i.options != nil {
-			importOptions = i.options.importOptions
-		}
-		if importOptions == nil {
-			// We don't mutate pilosaOptions.importOptions since the default
-			// may be different elsewhere.
-			importOptions = []gopilosa.ImportOption{
-				gopilosa.OptImportBatchSize(int(i.batchSize)),
-				gopilosa.OptImportRoaring(true),
-			}
+			return &PilosaError{Err: errors.Wrapf(err, "creating field '%v'", field)}
 		}
-		go func(fram *gopilosa.Field, cbi chanRecordIterator) {
-			defer i.importWG.Done()
-			err := i.client.ImportField(fram, cbi, importOptions...)
-			if err != nil {
-				log.Println(errors.Wrapf(err, "starting field import for %v", fieldName))
-			}
-		}(field, i.recordChans[fieldName])
+		i.fields[fieldName] = field
+		i.startImport(field)
 	}
 	return nil
 }
 
+// startImport creates a new record channel for field and starts importing
+// from it. Callers must hold i.lock.Lock() or otherwise have exclusive access.
+func (i *Index) startImport(field *gopilosa.Field) {
+	fieldName := field.Name()
+	i.recordChans[fieldName] = newChanRecordIterator(i.batchSize)
+	i.importWG.Add(1)
+	var importOptions []gopilosa.ImportOption
+	if i.options != nil {
+		importOptions = i.options.importOptions
+	}
+	if importOptions == nil {
+		// We don't mutate pilosaOptions.importOptions since the default
+		// may be different elsewhere.
+		importOptions = []gopilosa.ImportOption{
+			gopilosa.OptImportBatchSize(int(i.batchSize)),
+			gopilosa.OptImportRoaring(true),
+		}
+	}
+	if typ := field.Options().Type(); typ == gopilosa.FieldTypeMutex || typ == gopilosa.FieldTypeBool {
+		// Pilosa only accepts roaring imports into set and time fields.
+		importOptions = append(importOptions[:len(importOptions):len(importOptions)], gopilosa.OptImportRoaring(false))
+	}
+	go func(fram *gopilosa.Field, cbi chanRecordIterator) {
+		defer i.importWG.Done()
+		// Sets and clears are imported separately, in the order they were
+		// added, so runs of each are imported in turn.
+		runs := &runIterator{
+			c:        cbi,
+			max:      int(i.batchSize),
+			interval: i.options.flushInterval,
+			budget:   i.budget,
+		}
+		tries := 0
+		for runs.next() {
+			// If an import fails, the records in the failed batch are lost,
+			// but we keep importing the rest of the channel so that later
+			// data still makes it in.
+			opts := append(importOptions[:len(importOptions):len(importOptions)], gopilosa.OptImportClear(runs.clear))
+			err := i.client.ImportField(fram, runs, opts...)
+			runs.done()
+			i.stats.Gauge("index.QueueDepth", float64(len(cbi)), 1, "field:"+fieldName)
+			if err == nil {
+				continue
+			}
+			i.reportImportErr(fieldName, err)
+			tries++
+			if tries >= maxImportTries {
+				// Don't leave callers blocked on a channel nobody is reading.
+				n := runs.drain()
+				i.reportImportErr(fieldName, errors.Errorf("giving up after %d failed imports, dropped %d records", tries, n))
+				return
+			}
+			time.Sleep(importRetryDelay)
+		}
+	}(field, i.recordChans[fieldName])
+}
+
 // SetupPilosa returns a new Indexer after creating the given fields and starting importers.
 // You can pass options to the underlying go-pilosa client using the following functions:
 // - pdk.OptPilosaImportOptions: Pass import options. See: https://github.com/pilosa/go-pilosa/blob/master/docs/server-interaction.md#pilosa-client for the list of options you can pass.
@@ -253,13 +952,21 @@ func SetupPilosa(hosts []string, indexName string, schema *gopilosa.Schema, batc
 		return nil, errors.Wrap(err, "creating pilosa cluster client")
 	}
 	indexer.client = client
-	indexer.index = schema.Index(indexName)
+	index := schema.Index(indexName)
 	err = client.SyncSchema(schema)
 	if err != nil {
 		return nil, errors.Wrap(err, "synchronizing schema")
 	}
-	for _, field := range indexer.index.Fields() {
-		err := indexer.setupField(field)
+	// Pilosa's copy of the index knows its shard width. Otherwise, every
+	// import would look it up and copy the index, racing with fields being
+	// added to it.
+	serverSchema, err := client.Schema()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting schema")
+	}
+	indexer.index = serverSchema.Index(indexName)
+	for _, field := range index.Fields() {
+		err := indexer.setupField(indexer.index.Field(field.Name()))
 		if err != nil {
 			return nil, errors.Wrapf(err, "setting up field '%s'", field.Name())
 		}
@@ -267,10 +974,23 @@ func SetupPilosa(hosts []string, indexName string, schema *gopilosa.Schema, batc
 	return indexer, nil
 }
 
+// maxImportTries is the number of times a field's importer is restarted after
+// failing before it gives up and discards records until the next Flush.
+const maxImportTries = 3
+
+var importRetryDelay = time.Second
+
 type chanRecordIterator chan gopilosa.Record
 
-func newChanRecordIterator() chanRecordIterator {
-	return make(chan gopilosa.Record, 200000)
+// newChanRecordIterator returns a channel with room for two batches, so that
+// the next batch can be queued while one is imported. The memory budget
+// bounds how much is queued across all fields.
+func newChanRecordIterator(batchSize uint) chanRecordIterator {
+	size := 2 * batchSize
+	if size == 0 || size > 200000 {
+		size = 200000
+	}
+	return make(chan gopilosa.Record, size)
 }
 
 func (c chanRecordIterator) NextRecord() (gopilosa.Record, error) {
@@ -281,9 +1001,240 @@ func (c chanRecordIterator) NextRecord() (gopilosa.Record, error) {
 	return b, nil
 }
 
+// clearRecord wraps a record which should be cleared rather than set.
+type clearRecord struct {
+	gopilosa.Record
+}
+
+// runIterator reads records from a channel in runs, each of which is imported
+// by a separate call to ImportField. It returns io.EOF at the end of each run.
+// A run holds either records to set or records to clear, and ends early once
+// it has max records, once it has been going for interval, or when the memory
+// budget is exhausted and there is nothing more to read. The memory used by a
+// run's records is released once it has been imported.
+type runIterator struct {
+	c        chanRecordIterator
+	max      int
+	interval time.Duration
+	budget   *memBudget
+
+	// pending is a record which has been read from c but not returned.
+	pending gopilosa.Record
+	clear   bool
+	n       int
+	size    int64
+	timer   *time.Timer
+}
+
+// next starts the next run, and returns false if there are no more records.
+func (r *runIterator) next() bool {
+	if r.pending == nil {
+		rec, ok := <-r.c
+		if !ok {
+			return false
+		}
+		r.pending = rec
+	}
+	_, r.clear = r.pending.(clearRecord)
+	r.n = 0
+	if r.interval > 0 {
+		r.timer = time.NewTimer(r.interval)
+	}
+	return true
+}
+
+// done releases the memory used by the records of the run, which must have
+// been imported (or failed to import).
+func (r *runIterator) done() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.budget.release(r.size)
+	r.size = 0
+}
+
+// NextRecord implements gopilosa.RecordIterator.
+func (r *runIterator) NextRecord() (gopilosa.Record, error) {
+	if r.max > 0 && r.n >= r.max {
+		return nil, io.EOF
+	}
+	rec := r.pending
+	r.pending = nil
+	if rec == nil {
+		var ok bool
+		select {
+		case rec, ok = <-r.c:
+		default:
+			// Nothing is queued, so this is a good time to end the run if
+			// it has gone on long enough or others are waiting for memory.
+			var timeout <-chan time.Time
+			if r.timer != nil {
+				timeout = r.timer.C
+			}
+			select {
+			case rec, ok = <-r.c:
+			case <-timeout:
+				return nil, io.EOF
+			case <-r.budget.exhausted():
+				return nil, io.EOF
+			}
+		}
+		if !ok {
+			return nil, io.EOF
+		}
+	}
+	cr, isClear := rec.(clearRecord)
+	if isClear != r.clear {
+		r.pending = rec
+		return nil, io.EOF
+	}
+	r.n++
+	r.size += recordSize(rec)
+	if isClear {
+		return cr.Record, nil
+	}
+	return rec, nil
+}
+
+// drain discards records until the channel is closed and returns how many
+// there were. Their memory is released as they are discarded, so that
+// senders aren't held up until the channel is closed.
+func (r *runIterator) drain() int {
+	var n int
+	if r.pending != nil {
+		n++
+		r.budget.release(recordSize(r.pending))
+		r.pending = nil
+	}
+	for rec := range r.c {
+		n++
+		r.budget.release(recordSize(rec))
+	}
+	return n
+}
+
+// recordOverhead is roughly the number of bytes a queued record uses, apart
+// from its keys.
+const recordOverhead = 96
+
+// recordSize estimates the memory used by rec while it is queued.
+func recordSize(rec gopilosa.Record) int64 {
+	switch r := rec.(type) {
+	case gopilosa.Column:
+		return recordOverhead + int64(len(r.RowKey)+len(r.ColumnKey))
+	case gopilosa.FieldValue:
+		return recordOverhead + int64(len(r.ColumnKey))
+	case clearRecord:
+		return recordSize(r.Record)
+	}
+	return recordOverhead
+}
+
+// defaultMemoryLimit is the default memory budget for queued records (see
+// OptPilosaMemoryLimit).
+const defaultMemoryLimit = 256 << 20
+
+// memBudget limits the memory used by records which are queued for import
+// across all of an Index's fields. A nil *memBudget has no limit.
+type memBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+	stats Statter
+
+	// full is closed while a sender is waiting for memory.
+	full   chan struct{}
+	isFull bool
+}
+
+// newMemBudget returns a memBudget which allows limit bytes to be used, or
+// nil if limit is 0.
+func newMemBudget(limit int64, stats Statter) *memBudget {
+	if limit <= 0 {
+		return nil
+	}
+	b := &memBudget{limit: limit, stats: stats, full: make(chan struct{})}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes can be used without going over the limit. A
+// record larger than the limit is let through once nothing else is queued.
+func (b *memBudget) acquire(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used > 0 && b.used+n > b.limit {
+		b.stats.Count("index.BackPressure", 1, 1)
+	}
+	for b.used > 0 && b.used+n > b.limit {
+		if !b.isFull {
+			close(b.full)
+			b.isFull = true
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+// tryAcquire uses n bytes if that can be done without going over the limit,
+// and reports whether it did.
+func (b *memBudget) tryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// release frees n bytes, and wakes any senders waiting for memory.
+func (b *memBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	used := b.used
+	if b.isFull {
+		// any sender which still doesn't fit closes it again
+		b.full = make(chan struct{})
+		b.isFull = false
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	b.stats.Gauge("index.QueuedBytes", float64(used), 1)
+}
+
+// exhausted returns a channel which is closed while a sender is waiting for
+// memory.
+func (b *memBudget) exhausted() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.full
+}
+
 type pilosaOptions struct {
-	importOptions []gopilosa.ImportOption
-	clientOptions []gopilosa.ClientOption
+	importOptions     []gopilosa.ImportOption
+	clientOptions     []gopilosa.ClientOption
+	timeQuantum       gopilosa.TimeQuantum
+	fieldTimeQuantums map[string]gopilosa.TimeQuantum
+	intRanges         map[string]IntRange
+	intDiscovery      *uint
+	memoryLimit       *uint64
+	flushInterval     time.Duration
+	stats             Statter
 }
 
 type PilosaOption func(opt *pilosaOptions) error
@@ -301,3 +1252,110 @@ func OptPilosaClientOptions(options ...gopilosa.ClientOption) PilosaOption {
 		return nil
 	}
 }
+
+// OptPilosaTimeQuantum sets the time quantum of the time fields which the
+// Indexer creates when it is given timestamped data for a new field. The
+// default is gopilosa.TimeQuantumYearMonthDayHour.
+func OptPilosaTimeQuantum(quantum gopilosa.TimeQuantum) PilosaOption {
+	return func(pilosaOpt *pilosaOptions) error {
+		if err := validateTimeQuantum(quantum); err != nil {
+			return err
+		}
+		pilosaOpt.timeQuantum = quantum
+		return nil
+	}
+}
+
+// OptPilosaFieldTimeQuantum sets the time quantum for a single time field,
+// overriding OptPilosaTimeQuantum. It may be passed more than once.
+func OptPilosaFieldTimeQuantum(field string, quantum gopilosa.TimeQuantum) PilosaOption {
+	return func(pilosaOpt *pilosaOptions) error {
+		if err := validateTimeQuantum(quantum); err != nil {
+			return errors.Wrapf(err, "field '%s'", field)
+		}
+		if pilosaOpt.fieldTimeQuantums == nil {
+			pilosaOpt.fieldTimeQuantums = make(map[string]gopilosa.TimeQuantum)
+		}
+		pilosaOpt.fieldTimeQuantums[field] = quantum
+		return nil
+	}
+}
+
+// OptPilosaIntRange sets the bounds of the int field which the Indexer
+// creates if it is given values for field and it doesn't exist. It may be
+// passed more than once.
+func OptPilosaIntRange(field string, min, max int64) PilosaOption {
+	return func(pilosaOpt *pilosaOptions) error {
+		if min > max {
+			return errors.Errorf("field '%s': min %d is greater than max %d", field, min, max)
+		}
+		if pilosaOpt.intRanges == nil {
+			pilosaOpt.intRanges = make(map[string]IntRange)
+		}
+		pilosaOpt.intRanges[field] = IntRange{Min: min, Max: max}
+		return nil
+	}
+}
+
+// OptPilosaIntDiscovery sets the number of values which the Indexer holds
+// back when it is given values for a new int field without bounds from
+// OptPilosaIntRange. Once it has n values (or is flushed, or the values held
+// back reach the memory limit), it creates the field with bounds that leave
+// plenty of room around them. Zero disables
+// discovery, so that new int fields are created with the full int64 range.
+// The default is the batch size.
+func OptPilosaIntDiscovery(n uint) PilosaOption {
+	return func(pilosaOpt *pilosaOptions) error {
+		pilosaOpt.intDiscovery = &n
+		return nil
+	}
+}
+
+// OptPilosaMemoryLimit sets the number of bytes which records queued for
+// import may use across all fields (estimated from the number of records and
+// the length of their keys), including values held back by
+// OptPilosaIntDiscovery. Once it is reached, adding to the Indexer blocks
+// until imports in progress have finished. The default is 256MiB, and zero
+// means no limit. Each field's importer also holds up to a batch of records
+// which it is importing.
+func OptPilosaMemoryLimit(bytes uint64) PilosaOption {
+	return func(pilosaOpt *pilosaOptions) error {
+		pilosaOpt.memoryLimit = &bytes
+		return nil
+	}
+}
+
+// OptPilosaFlushInterval makes each field's importer import the records it
+// has read once interval has passed since it started reading them and
+// nothing more is queued, rather than waiting for a full batch or a Flush.
+// By default, it waits.
+func OptPilosaFlushInterval(interval time.Duration) PilosaOption {
+	return func(pilosaOpt *pilosaOptions) error {
+		if interval < 0 {
+			return errors.Errorf("negative flush interval %v", interval)
+		}
+		pilosaOpt.flushInterval = interval
+		return nil
+	}
+}
+
+// OptPilosaStats sets the Statter to which the Indexer reports the depth of
+// each field's queue (the "index.QueueDepth" gauge, tagged with the field),
+// the memory used by queued records ("index.QueuedBytes"), and how often
+// adding records blocks ("index.BackPressure").
+func OptPilosaStats(stats Statter) PilosaOption {
+	return func(pilosaOpt *pilosaOptions) error {
+		pilosaOpt.stats = stats
+		return nil
+	}
+}
+
+func validateTimeQuantum(quantum gopilosa.TimeQuantum) error {
+	switch quantum {
+	case gopilosa.TimeQuantumYear, gopilosa.TimeQuantumMonth, gopilosa.TimeQuantumDay, gopilosa.TimeQuantumHour,
+		gopilosa.TimeQuantumYearMonth, gopilosa.TimeQuantumMonthDay, gopilosa.TimeQuantumDayHour,
+		gopilosa.TimeQuantumYearMonthDay, gopilosa.TimeQuantumMonthDayHour, gopilosa.TimeQuantumYearMonthDayHour:
+		return nil
+	}
+	return errors.Errorf("invalid time quantum '%s'", quantum)
+}
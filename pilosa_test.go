@@ -35,6 +35,8 @@ package pdk_test
 import (
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -69,6 +71,21 @@ func TestSetupPilosa(t *testing.T) {
 
 	indexer.AddColumn("field1", uint64(0), uint64(0))
 	indexer.AddValue("field3", uint64(0), 97)
+
+	// everything added so far should be queryable after a flush, and the
+	// indexer should continue to accept data afterwards.
+	err = indexer.Flush()
+	if err != nil {
+		t.Fatalf("flushing indexer: %v", err)
+	}
+	resp, err := indexer.Client().Query(index.Field("field1").Row(0))
+	if err != nil {
+		t.Fatalf("querying after flush: %v", err)
+	}
+	if cols := resp.Result().Row().Columns; len(cols) != 1 || cols[0] != 0 {
+		t.Fatalf("unexpected columns after flush: %v", cols)
+	}
+
 	indexer.AddColumnTimestamp("fieldtime", uint64(0), uint64(0), time.Date(2018, time.February, 22, 9, 0, 0, 0, time.UTC))
 	indexer.AddColumnTimestamp("fieldtime", uint64(2), uint64(0), time.Date(2018, time.February, 24, 9, 0, 0, 0, time.UTC))
 	indexer.AddValue("field3", uint64(0), 100)
@@ -116,7 +133,7 @@ func TestSetupPilosa(t *testing.T) {
 
 	idx := schema.Index("newindex")
 	fieldtime := idx.Field("fieldtime")
-	resp, err := client.Query(fieldtime.RowRange(0, time.Date(2018, time.February, 21, 9, 0, 0, 0, time.UTC), time.Date(2018, time.February, 23, 9, 0, 0, 0, time.UTC)))
+	resp, err = client.Query(fieldtime.RowRange(0, time.Date(2018, time.February, 21, 9, 0, 0, 0, time.UTC), time.Date(2018, time.February, 23, 9, 0, 0, 0, time.UTC)))
 	if err != nil {
 		t.Fatalf("executing range query: %v", err)
 	}
@@ -155,3 +172,354 @@ func TestSetupPilosa(t *testing.T) {
 	}
 
 }
+
+func TestIndexImportErrors(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	schema := gopilosa.NewSchema()
+	index := schema.Index("importerrors")
+	index.Field("small", gopilosa.OptFieldTypeInt(0, 10))
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, index.Name(), schema, 10, pdk.OptPilosaClientOptions(gopilosa.OptClientRetries(0)))
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+
+	// values outside the field's bounds are rejected up front, so make the
+	// import fail by removing the field from under the indexer.
+	err = indexer.Client().DeleteField(index.Field("small"))
+	if err != nil {
+		t.Fatalf("deleting field: %v", err)
+	}
+	err = indexer.AddValue("small", uint64(1), 5)
+	if err != nil {
+		t.Fatalf("adding value: %v", err)
+	}
+	err = indexer.Close()
+	ierrs, ok := err.(pdk.ImportErrors)
+	if !ok {
+		t.Fatalf("expected ImportErrors from Close, but got %T: %v", err, err)
+	}
+	if len(ierrs) != 1 || ierrs[0].Field != "small" {
+		t.Fatalf("unexpected import errors: %v", ierrs)
+	}
+	select {
+	case err, ok := <-indexer.Errors():
+		if !ok || err.(*pdk.ImportError).Field != "small" {
+			t.Fatalf("expected import error on channel, got: %v", err)
+		}
+	default:
+		t.Fatalf("no error delivered on channel")
+	}
+}
+
+func TestIndexTimeQuantum(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	_, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "quantum", nil, 10, pdk.OptPilosaTimeQuantum("YQ"))
+	if err == nil {
+		t.Fatalf("expected error for invalid time quantum")
+	}
+
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "quantum", nil, 10,
+		pdk.OptPilosaTimeQuantum(gopilosa.TimeQuantumYearMonthDay),
+		pdk.OptPilosaFieldTimeQuantum("hourly", gopilosa.TimeQuantumDayHour))
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	ts := time.Date(2018, time.February, 22, 9, 0, 0, 0, time.UTC)
+	for _, field := range []string{"daily", "hourly"} {
+		if err := indexer.AddColumnTimestamp(field, uint64(1), uint64(2), ts); err != nil {
+			t.Fatalf("adding timestamped column to %s: %v", field, err)
+		}
+	}
+	if err := indexer.Close(); err != nil {
+		t.Fatalf("closing indexer: %v", err)
+	}
+
+	schema, err := indexer.Client().Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	fields := schema.Index("quantum").Fields()
+	for field, exp := range map[string]gopilosa.TimeQuantum{
+		"daily":  gopilosa.TimeQuantumYearMonthDay,
+		"hourly": gopilosa.TimeQuantumDayHour,
+	} {
+		if q := fields[field].Options().TimeQuantum(); q != exp {
+			t.Errorf("field %s: expected quantum %s, got %s", field, exp, q)
+		}
+	}
+	resp, err := indexer.Client().Query(fields["daily"].Range(2, ts.Add(-time.Hour*24), ts.Add(time.Hour*24)))
+	if err != nil {
+		t.Fatalf("querying range: %v", err)
+	}
+	if cols := resp.Result().Row().Columns; len(cols) != 1 || cols[0] != 1 {
+		t.Fatalf("unexpected range result: %v", cols)
+	}
+}
+
+func TestIndexIntRanges(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	schema := gopilosa.NewSchema()
+	index := schema.Index("intranges")
+	index.Field("small", gopilosa.OptFieldTypeInt(0, 10))
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, index.Name(), schema, 10,
+		pdk.OptPilosaIntDiscovery(3),
+		pdk.OptPilosaIntRange("fixed", -5, 5))
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+
+	err = indexer.AddValue("small", uint64(1), 1000)
+	rerr, ok := err.(*pdk.RangeError)
+	if !ok {
+		t.Fatalf("expected RangeError, got %T: %v", err, err)
+	}
+	if rerr.Field != "small" || rerr.Value != 1000 || rerr.Bounds != (pdk.IntRange{Min: 0, Max: 10}) {
+		t.Fatalf("unexpected range error: %#v", rerr)
+	}
+	if err := indexer.AddValue("small", uint64(1), 7); err != nil {
+		t.Fatalf("adding value in range: %v", err)
+	}
+
+	// the bounds of new fields are discovered from their first values
+	for col, val := range []int64{97, -3, 40} {
+		if err := indexer.AddValue("discovered", uint64(col), val); err != nil {
+			t.Fatalf("adding value %d: %v", val, err)
+		}
+	}
+	// this one is outside of the discovered bounds
+	if _, ok := indexer.AddValue("discovered", uint64(4), 1<<40).(*pdk.RangeError); !ok {
+		t.Fatalf("expected RangeError for value outside discovered bounds")
+	}
+	// fields which are still being discovered are created on flush
+	if err := indexer.AddValue("flushed", uint64(0), 12); err != nil {
+		t.Fatalf("adding value: %v", err)
+	}
+	if err := indexer.AddValue("fixed", uint64(0), 6); err == nil {
+		t.Fatalf("expected error adding value outside of OptPilosaIntRange")
+	}
+	if err := indexer.Close(); err != nil {
+		t.Fatalf("closing indexer: %v", err)
+	}
+
+	ranges := indexer.(*pdk.Index).IntRanges()
+	if exp := (pdk.IntRange{Min: -3, Max: 1 << 40}); ranges["discovered"] != exp {
+		t.Errorf("unexpected observed range: %v", ranges["discovered"])
+	}
+
+	schema, err = indexer.Client().Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	fields := schema.Index("intranges").Fields()
+	for field, exp := range map[string]pdk.IntRange{
+		"discovered": {Min: -4095, Max: 131071},
+		"flushed":    {Min: 0, Max: 16383},
+		"fixed":      {Min: -5, Max: 5},
+	} {
+		f, ok := fields[field]
+		if !ok {
+			t.Errorf("field %s wasn't created", field)
+			continue
+		}
+		if opts := f.Options(); opts.Min() != exp.Min || opts.Max() != exp.Max {
+			t.Errorf("field %s: expected bounds %v, got [%d, %d]", field, exp, opts.Min(), opts.Max())
+		}
+	}
+	resp, err := indexer.Client().Query(fields["discovered"].Sum(fields["discovered"].NotNull()))
+	if err != nil {
+		t.Fatalf("querying sum: %v", err)
+	}
+	if sum := resp.Result().Value(); sum != 134 {
+		t.Errorf("unexpected sum of discovered values: %d", sum)
+	}
+}
+
+// gaugeStatter records the last value of each gauge, and counts.
+type gaugeStatter struct {
+	pdk.NopStatter
+	mu     sync.Mutex
+	gauges map[string]float64
+	counts map[string]int64
+}
+
+func (s *gaugeStatter) Count(name string, value int64, rate float64, tags ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[name] += value
+}
+
+func (s *gaugeStatter) Gauge(name string, value float64, rate float64, tags ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauges[strings.Join(append([]string{name}, tags...), ",")] = value
+}
+
+func TestIndexMemoryLimit(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	stats := &gaugeStatter{gauges: make(map[string]float64), counts: make(map[string]int64)}
+	// room for about 20 records, across fields which each import in batches
+	// of 100.
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "memlimit", nil, 100,
+		pdk.OptPilosaMemoryLimit(2000),
+		pdk.OptPilosaIntDiscovery(0),
+		pdk.OptPilosaStats(stats))
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		for col := uint64(0); col < 1000; col++ {
+			if err := indexer.AddColumn("a", col, col%3); err != nil {
+				done <- err
+				return
+			}
+			if err := indexer.AddColumn("b", col, "key"); err != nil {
+				done <- err
+				return
+			}
+			if err := indexer.AddValue("c", col, int64(col)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- indexer.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("indexing: %v", err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("indexing with a memory limit didn't finish")
+	}
+
+	client := indexer.Client()
+	schema, err := client.Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	index := schema.Index("memlimit")
+	resp, err := client.Query(index.BatchQuery(
+		index.Count(index.Field("a").Row(1)),
+		index.Count(index.Field("b").Row("key")),
+		index.Field("c").Sum(index.Field("c").NotNull())))
+	if err != nil {
+		t.Fatalf("querying: %v", err)
+	}
+	results := resp.Results()
+	if results[0].Count() != 333 || results[1].Count() != 1000 || results[2].Value() != 999*1000/2 {
+		t.Errorf("unexpected results: %d, %d, %d", results[0].Count(), results[1].Count(), results[2].Value())
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.counts["index.BackPressure"] == 0 {
+		t.Errorf("expected adding to block at some point")
+	}
+	if queued, ok := stats.gauges["index.QueuedBytes"]; !ok || queued != 0 {
+		t.Errorf("expected nothing to be queued after closing, got %v", queued)
+	}
+	for _, field := range []string{"a", "b", "c"} {
+		if _, ok := stats.gauges["index.QueueDepth,field:"+field]; !ok {
+			t.Errorf("no queue depth reported for %s: %v", field, stats.gauges)
+		}
+	}
+}
+
+func TestIndexMemoryLimitDiscovery(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	stats := &gaugeStatter{gauges: make(map[string]float64), counts: make(map[string]int64)}
+	// room for about 20 values, while each field holds back up to 100.
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "memdiscovery", nil, 100,
+		pdk.OptPilosaMemoryLimit(2000),
+		pdk.OptPilosaIntDiscovery(100),
+		pdk.OptPilosaStats(stats))
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	fields := []string{"a", "b", "c", "d"}
+	for col := uint64(0); col < 30; col++ {
+		for _, field := range fields {
+			if err := indexer.AddValue(field, col, int64(col)); err != nil {
+				t.Fatalf("adding value: %v", err)
+			}
+		}
+	}
+	// the fields were created before all of their values were discovered,
+	// rather than holding 120 values.
+	schema, err := indexer.Client().Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	if n := len(schema.Index("memdiscovery").Fields()); n == 0 {
+		t.Fatalf("expected fields to be created while adding values")
+	}
+	if err := indexer.Close(); err != nil {
+		t.Fatalf("closing indexer: %v", err)
+	}
+
+	index := schema.Index("memdiscovery")
+	for _, field := range fields {
+		resp, err := indexer.Client().Query(index.Field(field).Sum(index.Field(field).NotNull()))
+		if err != nil {
+			t.Fatalf("querying sum of %s: %v", field, err)
+		}
+		if sum := resp.Result().Value(); sum != 29*30/2 {
+			t.Errorf("unexpected sum of %s: %d", field, sum)
+		}
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if queued := stats.gauges["index.QueuedBytes"]; queued != 0 {
+		t.Errorf("expected nothing to be queued after closing, got %v", queued)
+	}
+}
+
+func TestIndexFlushInterval(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "interval", nil, 1000,
+		pdk.OptPilosaFlushInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	defer indexer.Close()
+	for col := uint64(0); col < 3; col++ {
+		if err := indexer.AddColumn("f", col, uint64(0)); err != nil {
+			t.Fatalf("adding column: %v", err)
+		}
+	}
+
+	// the columns are imported without a full batch or a Flush
+	client := indexer.Client()
+	schema, err := client.Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	index := schema.Index("interval")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := client.Query(index.Count(index.Field("f").Row(0)))
+		if err != nil {
+			t.Fatalf("querying: %v", err)
+		}
+		if resp.Result().Count() == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("columns weren't imported, count is %d", resp.Result().Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
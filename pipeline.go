@@ -33,6 +33,7 @@
 package pdk
 
 import (
+	"context"
 	"io"
 	"time"
 
@@ -71,6 +72,47 @@ type Source interface {
 	Record() (interface{}, error)
 }
 
+// ContextSource is an optional interface for a Source which may block waiting
+// for data (e.g. a stream). RecordContext works like Record, but gives up and
+// returns ctx.Err() if ctx is done before a record is available, so that the
+// Ingester can shut down promptly.
+type ContextSource interface {
+	Source
+	RecordContext(ctx context.Context) (interface{}, error)
+}
+
+// Checkpoint identifies the position of a single record in a
+// CheckpointSource. Its contents are only meaningful to the source which
+// produced it.
+type Checkpoint interface{}
+
+// CheckpointSource is an optional interface which a Source may implement so
+// that an interrupted ingest can resume from the last durable point rather
+// than starting over. The Ingester calls CheckpointRecord instead of Record,
+// and hands the returned Checkpoints back to Commit only after the Indexer has
+// confirmed that everything derived from those records has been imported.
+// Commit may receive checkpoints out of order when parsing concurrently, so
+// implementations must only persist a position once every record before it
+// has been committed as well (see OffsetTracker). Like RecordContext,
+// CheckpointRecord should return ctx.Err() if ctx is done while it is waiting
+// for a record.
+type CheckpointSource interface {
+	Source
+	CheckpointRecord(ctx context.Context) (interface{}, Checkpoint, error)
+	Commit(cps []Checkpoint) error
+}
+
+// AckSource is an optional interface for a CheckpointSource which needs to
+// know the outcome of each record as soon as it has been processed, e.g. to
+// report it to the client which sent it. After handling a record, the
+// Ingester calls Ack with its Checkpoint and nil if it was mapped and handed
+// to the Indexer, or a *StageError for the error which stopped it. The
+// records may not have been imported yet - that is what Commit is for.
+type AckSource interface {
+	CheckpointSource
+	Ack(cp Checkpoint, err error)
+}
+
 // Peeker is an interface for peeking ahead at the next record
 // to be returned by Source.Record().
 type Peeker interface {
@@ -92,13 +134,36 @@ type RecordMapper interface {
 	Map(record *Entity) (PilosaRecord, error)
 }
 
-// Indexer puts stuff into Pilosa.
+// AckMapper is an optional interface for a RecordMapper which needs to know
+// whether the records it mapped were indexed. After handing a record to the
+// Indexer, the Ingester calls Ack with the Entity it was mapped from, the
+// PilosaRecord, and nil, or the first error the Indexer returned for it. An
+// error returned by Ack is reported as the record's error.
+type AckMapper interface {
+	RecordMapper
+	Ack(record *Entity, pr PilosaRecord, err error) error
+}
+
+// Indexer puts stuff into Pilosa. The Add methods return an error if the data
+// can't be accepted at all (e.g. the field couldn't be created). Data is
+// imported asynchronously, so failures which happen during import are
+// delivered on the Errors channel as they occur, and returned from the next
+// call to Flush or Close.
 type Indexer interface {
-	AddColumn(field string, col, row uint64OrString)
-	AddColumnTimestamp(field string, col, row uint64OrString, ts time.Time)
-	AddValue(field string, col uint64OrString, val int64)
-	// AddRowAttr(field string, row uint64, key string, value AttrVal)
-	// AddColAttr(col uint64, key string, value AttrVal)
+	AddColumn(field string, col, row uint64OrString) error
+	AddColumnTimestamp(field string, col, row uint64OrString, ts time.Time) error
+	AddColumnType(field string, typ FieldType, col, row uint64OrString) error
+	AddValue(field string, col uint64OrString, val int64) error
+	ClearColumn(field string, col, row uint64OrString) error
+	ClearValue(field string, col uint64OrString) error
+	DeleteColumn(col uint64OrString) error
+	AddColAttr(col uint64OrString, key string, value interface{}) error
+	AddRowAttr(field string, row uint64OrString, key string, value interface{}) error
+
+	// Flush blocks until everything added so far has been imported, and
+	// returns an error if any of it could not be.
+	Flush() error
+	Errors() <-chan error
 	Close() error
 	Client() *gopilosa.Client
 }
@@ -109,3 +174,43 @@ type Indexer interface {
 type Transformer interface {
 	Transform(e *Entity) error
 }
+
+// Stage names the step of the ingest pipeline at which a record failed.
+type Stage string
+
+// Stages of the ingest pipeline which can reject a record.
+const (
+	StageParse     Stage = "parse"
+	StageTransform Stage = "transform"
+	StageMap       Stage = "map"
+	// StageIndex is for records which the Indexer rejected, such as those
+	// with values outside the bounds of an int field (see RangeError).
+	StageIndex Stage = "index"
+)
+
+// StageError is the error the Ingester acknowledges a record with (see
+// AckSource). Stage is where the record failed, which tells problems with the
+// record itself apart from those of the Indexer, which may pass if the record
+// is sent again. Err keeps the error's message, and is its Cause.
+type StageError struct {
+	Stage Stage
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns Err, so that errors.Cause sees through a StageError.
+func (e *StageError) Cause() error {
+	return e.Err
+}
+
+// DeadLetterSink receives records which the Ingester could not index, so that
+// they can be inspected and replayed once the problem is fixed. rec is the
+// record exactly as it was returned from the Source. Implementations should be
+// thread safe.
+type DeadLetterSink interface {
+	DeadLetter(rec interface{}, stage Stage, err error) error
+}
@@ -38,6 +38,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"strings"
@@ -54,6 +55,13 @@ type KeyMapper interface {
 	MapResult(field string, res interface{}) (interface{}, error)
 }
 
+// ColumnAttrMapper is implemented by KeyMappers which can map the column
+// attributes returned alongside query results (see the columnAttrs query
+// parameter) to their mapped counterparts.
+type ColumnAttrMapper interface {
+	MapColumnAttrs(sets []*pilosa.ColumnAttrSet) ([]*pilosa.ColumnAttrSet, error)
+}
+
 // Proxy describes the functionality for proxying requests.
 type Proxy interface {
 	ProxyRequest(orig *http.Request, origbody []byte) (*http.Response, error)
@@ -94,6 +102,24 @@ func NewPilosaForwarder(phost string, t Translator, colTranslator ...FieldTransl
 	return f
 }
 
+// SetDecimals tells the forwarder how many decimal places are kept in each
+// int field (see CollapsingMapper.Decimals), so that it can scale constants in
+// queries up, and Sum, Min, and Max results back down.
+func (p *pilosaForwarder) SetDecimals(decimals map[string]int) {
+	if pkm, ok := p.km.(*PilosaKeyMapper); ok {
+		pkm.Decimals = decimals
+	}
+}
+
+// SetUntranslated tells the forwarder which fields have rows that aren't
+// translated by the Translator (see PilosaKeyMapper.Untranslated), so that it
+// passes their rows through as they are.
+func (p *pilosaForwarder) SetUntranslated(fields map[string]bool) {
+	if pkm, ok := p.km.(*PilosaKeyMapper); ok {
+		pkm.Untranslated = fields
+	}
+}
+
 func (p *pilosaForwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	body, err := ioutil.ReadAll(req.Body)
@@ -124,9 +150,14 @@ func (p *pilosaForwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// decode pilosa response for inspection
+	// decode pilosa response for inspection. pilosa.QueryResponse only
+	// names its column attributes "columnAttrs" when encoding, so they're
+	// decoded separately.
 	dec := json.NewDecoder(resp.Body)
-	pilosaResp := &pilosa.QueryResponse{}
+	pilosaResp := &struct {
+		Results     []interface{}           `json:"results"`
+		ColumnAttrs []*pilosa.ColumnAttrSet `json:"columnAttrs"`
+	}{}
 	err = dec.Decode(pilosaResp)
 	if err != nil {
 		log.Printf("decoding json: %v", err)
@@ -156,6 +187,16 @@ func (p *pilosaForwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			mappedResp.Results[i] = mappedResult
 		}
 	}
+	if len(pilosaResp.ColumnAttrs) > 0 {
+		mappedResp.ColumnAttrSets = pilosaResp.ColumnAttrs
+		if cam, ok := p.km.(ColumnAttrMapper); ok {
+			mappedResp.ColumnAttrSets, err = cam.MapColumnAttrs(pilosaResp.ColumnAttrs)
+			if err != nil {
+				http.Error(w, "mapping column attributes: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
 
 	// Allow cross-domain requests
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -206,6 +247,16 @@ func (p *pilosaProxy) ProxyRequest(orig *http.Request, origbody []byte) (*http.R
 type PilosaKeyMapper struct {
 	t Translator
 	c FieldTranslator
+
+	// Decimals maps int fields to the number of decimal places their values
+	// keep (see CollapsingMapper.Decimals).
+	Decimals map[string]int
+
+	// Untranslated holds fields whose rows are left as they are in requests
+	// and results: fields with keys, which Pilosa translates itself, and
+	// fields whose rows are ids already (see Spec.Untranslated and
+	// CollapsingMapper.Untranslated).
+	Untranslated map[string]bool
 }
 
 // NewPilosaKeyMapper returns a PilosaKeyMapper.
@@ -222,10 +273,6 @@ func NewPilosaKeyMapper(t Translator, colTranslator ...FieldTranslator) *PilosaK
 // MapResult converts the result of a single top level query (one element of
 // QueryResponse.Results) to its mapped counterpart.
 func (p *PilosaKeyMapper) MapResult(field string, res interface{}) (mappedRes interface{}, err error) {
-	log.Printf("mapping result: '%#v'", res)
-	defer func() {
-		log.Printf("mapped result: '%#v'", mappedRes)
-	}()
 	switch result := res.(type) {
 	case uint64:
 		// Count
@@ -233,6 +280,18 @@ func (p *PilosaKeyMapper) MapResult(field string, res interface{}) (mappedRes in
 	case []interface{}:
 		return p.mapSliceInterfaceResult(field, result)
 	case map[string]interface{}:
+		if _, ok := result["value"]; ok {
+			// Sum/Min/Max
+			return p.mapValCountResult(field, result)
+		}
+		if _, ok := result["count"]; ok {
+			// MinRow/MaxRow
+			return p.mapPairResult(field, result)
+		}
+		if _, ok := result["rows"]; ok {
+			// Rows
+			return p.mapRowsResult(field, result)
+		}
 		// Bitmap/Intersect/Difference/Union
 		return p.mapBitmapResult(field, result)
 	case bool:
@@ -245,6 +304,21 @@ func (p *PilosaKeyMapper) MapResult(field string, res interface{}) (mappedRes in
 	return mappedRes, nil
 }
 
+// mapValCountResult scales the value of a Sum, Min, or Max result back down
+// if its field keeps decimal places.
+func (p *PilosaKeyMapper) mapValCountResult(field string, result map[string]interface{}) (mappedRes interface{}, err error) {
+	decimals, ok := p.Decimals[field]
+	if !ok {
+		return result, nil
+	}
+	val, ok := result["value"].(float64)
+	if !ok {
+		return result, errors.Errorf("value should be a number but is %T, %#v", result["value"], result["value"])
+	}
+	result["value"] = val / math.Pow10(decimals)
+	return result, nil
+}
+
 func (p *PilosaKeyMapper) mapBitmapResult(field string, result map[string]interface{}) (mappedRes interface{}, err error) {
 	colkey := "columns"
 	cols, ok := result[colkey]
@@ -270,8 +344,11 @@ func (p *PilosaKeyMapper) mapSliceInterfaceResult(field string, res []interface{
 	if len(res) == 0 {
 		return res, nil
 	}
-	switch res[0].(type) {
+	switch first := res[0].(type) {
 	case map[string]interface{}:
+		if _, ok := first["group"]; ok {
+			return p.mapGroupByResult(res)
+		}
 		return p.mapTopNResult(field, res)
 	default:
 		return mappedRes, errors.Errorf("unexpected result type in slice: %T, %#v", res[0], res[0])
@@ -279,26 +356,173 @@ func (p *PilosaKeyMapper) mapSliceInterfaceResult(field string, res []interface{
 }
 
 func (p *PilosaKeyMapper) mapColumnSlice(field string, result []interface{}) (mappedRes interface{}, err error) {
-	cols := make([]interface{}, len(result))
+	if p.c == nil {
+		return result, nil
+	}
+	ids := make([]uint64, len(result))
 	for i, icol := range result {
 		col, ok := icol.(float64)
 		if !ok {
 			return nil, errors.Errorf("expected float64, but got %T %#v", icol, icol)
 		}
-		colV, err := p.c.Get(uint64(col))
-		if err != nil {
-			return nil, errors.Wrap(err, "translating column id to value")
-		}
-		cols[i] = colV
+		ids[i] = uint64(col)
+	}
+	cols, err := p.c.GetMany(ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "translating column ids to values")
 	}
 	return cols, nil
 }
 
+// mapPairResult translates the row id of a MinRow or MaxRow result.
+func (p *PilosaKeyMapper) mapPairResult(field string, result map[string]interface{}) (mappedRes interface{}, err error) {
+	id, ok := result["id"]
+	if !ok || p.t == nil || field == "" || p.Untranslated[field] {
+		return result, nil
+	}
+	if result["count"] == float64(0) {
+		// there are no rows, so the id means nothing
+		return result, nil
+	}
+	result["id"], err = p.rowValue(field, id)
+	return result, err
+}
+
+// mapRowsResult translates the row ids of a Rows result.
+func (p *PilosaKeyMapper) mapRowsResult(field string, result map[string]interface{}) (mappedRes interface{}, err error) {
+	rows, ok := result["rows"].([]interface{})
+	if !ok || p.t == nil || p.Untranslated[field] {
+		return result, nil
+	}
+	mapped, err := p.rowValues(field, rows)
+	if err != nil {
+		return result, err
+	}
+	result["rows"] = mapped
+	return result, nil
+}
+
+// mapGroupByResult translates the row ids in each group of a GroupBy result.
+// Each group names the fields of its rows.
+func (p *PilosaKeyMapper) mapGroupByResult(result []interface{}) (mappedRes interface{}, err error) {
+	if p.t == nil {
+		return result, nil
+	}
+	for _, igc := range result {
+		gc, ok := igc.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("expected group count, but got %T %#v", igc, igc)
+		}
+		group, ok := gc["group"].([]interface{})
+		if !ok {
+			return nil, errors.Errorf("expected list of rows in group, but got %#v", gc["group"])
+		}
+		for _, ifr := range group {
+			fr, ok := ifr.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("expected field row, but got %T %#v", ifr, ifr)
+			}
+			field, _ := fr["field"].(string)
+			id, ok := fr["rowID"]
+			if !ok || p.Untranslated[field] {
+				// keyed by Pilosa, or already an id
+				continue
+			}
+			if fr["rowID"], err = p.rowValue(field, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// rowValue translates the row id in a result back to the value it was mapped
+// from.
+func (p *PilosaKeyMapper) rowValue(field string, id interface{}) (interface{}, error) {
+	fid, ok := id.(float64)
+	if !ok {
+		return nil, errors.Errorf("expected row id, but got %T %#v", id, id)
+	}
+	val, err := p.t.Get(field, uint64(fid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "translating row %d of %s", uint64(fid), field)
+	}
+	if b, ok := val.([]byte); ok {
+		return string(b), nil
+	}
+	return val, nil
+}
+
+// rowValues translates a list of row ids in a result back to the values they
+// were mapped from, with a single call to the Translator.
+func (p *PilosaKeyMapper) rowValues(field string, ids []interface{}) ([]interface{}, error) {
+	uids := make([]uint64, len(ids))
+	for i, id := range ids {
+		fid, ok := id.(float64)
+		if !ok {
+			return nil, errors.Errorf("expected row id, but got %T %#v", id, id)
+		}
+		uids[i] = uint64(fid)
+	}
+	vals, err := p.t.GetMany(field, uids)
+	if err != nil {
+		return nil, errors.Wrapf(err, "translating rows of %s", field)
+	}
+	for i, val := range vals {
+		if b, ok := val.([]byte); ok {
+			vals[i] = string(b)
+		}
+	}
+	return vals, nil
+}
+
+// MapColumnAttrs implements ColumnAttrMapper. Column ids are translated with
+// the column translator, if there is one, and returned as keys, which is how
+// Pilosa returns the attributes of keyed columns.
+func (p *PilosaKeyMapper) MapColumnAttrs(sets []*pilosa.ColumnAttrSet) ([]*pilosa.ColumnAttrSet, error) {
+	if p.c == nil {
+		return sets, nil
+	}
+	mapped := make([]*pilosa.ColumnAttrSet, len(sets))
+	ids := make([]uint64, 0, len(sets))
+	for i, set := range sets {
+		if set.Key != "" {
+			mapped[i] = set
+			continue
+		}
+		ids = append(ids, set.ID)
+	}
+	if len(ids) == 0 {
+		return mapped, nil
+	}
+	colVs, err := p.c.GetMany(ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "translating column ids to values")
+	}
+	for i, set := range sets {
+		if mapped[i] != nil {
+			continue
+		}
+		colV := colVs[0]
+		colVs = colVs[1:]
+		key := fmt.Sprint(colV)
+		if b, ok := colV.([]byte); ok {
+			key = string(b)
+		}
+		mapped[i] = &pilosa.ColumnAttrSet{Key: key, Attrs: set.Attrs}
+	}
+	return mapped, nil
+}
+
 func (p *PilosaKeyMapper) mapTopNResult(field string, result []interface{}) (mappedRes interface{}, err error) {
+	if p.Untranslated[field] {
+		return result, nil
+	}
 	mr := make([]struct {
 		Key   interface{}
 		Count uint64
 	}, len(result))
+	ids := make([]uint64, len(result))
 	for i, intpair := range result {
 		if pair, ok := intpair.(map[string]interface{}); ok {
 			pairkey, gotKey := pair["id"]
@@ -311,29 +535,30 @@ func (p *PilosaKeyMapper) mapTopNResult(field string, result []interface{}) (map
 			if !(isKeyFloat && isCountFloat) {
 				return nil, fmt.Errorf("expected pilosa.Pair, but have wrong value types: got %v", pair)
 			}
-			keyVal, err := p.t.Get(field, uint64(keyFloat))
-			if err != nil {
-				return nil, errors.Wrap(err, "translator.Get")
-			}
-
-			switch kv := keyVal.(type) {
-			case []byte:
-				mr[i].Key = string(kv)
-			default:
-				mr[i].Key = keyVal
-			}
+			ids[i] = uint64(keyFloat)
 			mr[i].Count = uint64(countFloat)
 		} else {
 			return nil, fmt.Errorf("unknown type in inner slice: %v", intpair)
 		}
 	}
+	keyVals, err := p.t.GetMany(field, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "translator.GetMany")
+	}
+	for i, keyVal := range keyVals {
+		switch kv := keyVal.(type) {
+		case []byte:
+			mr[i].Key = string(kv)
+		default:
+			mr[i].Key = keyVal
+		}
+	}
 	mappedRes = mr
 	return mappedRes, nil
 }
 
 // MapRequest takes a request body and returns a mapped version of that body.
 func (p *PilosaKeyMapper) MapRequest(body []byte) ([]byte, error) {
-	log.Printf("mapping request: '%s'", body)
 	query, err := pql.ParseString(string(body))
 	if err != nil {
 		return nil, errors.Wrap(err, "parsing string")
@@ -344,30 +569,77 @@ func (p *PilosaKeyMapper) MapRequest(body []byte) ([]byte, error) {
 			return nil, errors.Wrap(err, "mapping call")
 		}
 	}
-	log.Printf("mapped request: '%s'", query.String())
 	return []byte(query.String()), nil
 }
 
+// mapCall translates the row and column values in call and its children to
+// the ids they were mapped to. The arguments which hold rows and columns
+// depend on the call, as they do in Pilosa's own key translation.
 func (p *PilosaKeyMapper) mapCall(call *pql.Call) error {
-	if call.Name == "Row" {
-		var field string
-		var value interface{}
-		for k, v := range call.Args {
-			if !strings.HasPrefix(k, "_") {
-				field = k
-				value = v
-				break
+	for field, arg := range call.Args {
+		if cond, ok := arg.(*pql.Condition); ok {
+			if err := p.scaleCondition(field, cond); err != nil {
+				return errors.Wrapf(err, "scaling condition on %s", field)
 			}
 		}
-		if value == nil {
+	}
+	var colArg, rowArg, field string
+	switch call.Name {
+	case "SetColumnAttrs":
+		colArg = "_col"
+	case "Set", "Clear", "Row", "Range", "ClearRow", "Store":
+		colArg = "_col"
+		field, _ = call.FieldArg()
+		rowArg = field
+		if call.Name == "Row" && field == "" {
 			return errors.Errorf("no field with non-nil value in Row call: %s", call)
 		}
-		id, err := p.t.GetID(field, value)
+	case "SetRowAttrs":
+		field, _ = call.Args["_field"].(string)
+		rowArg = "_row"
+	case "Rows":
+		field, _ = call.Args["_field"].(string)
+		rowArg = "previous"
+		colArg = "column"
+	case "TopN":
+		field, _ = call.Args["_field"].(string)
+		if err := p.mapRowList(call, "ids", func(int) string { return field }); err != nil {
+			return err
+		}
+	case "GroupBy":
+		if filter, ok, err := call.CallArg("filter"); err != nil {
+			return errors.Wrap(err, "getting filter")
+		} else if ok {
+			if err := p.mapCall(filter); err != nil {
+				return errors.Wrap(err, "mapping filter")
+			}
+		}
+		// each previous row belongs to the field of the corresponding
+		// Rows call
+		err := p.mapRowList(call, "previous", func(i int) string {
+			if i >= len(call.Children) {
+				return ""
+			}
+			f, _ := call.Children[i].Args["_field"].(string)
+			return f
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if col, ok := call.Args[colArg].(string); ok && colArg != "" && p.c != nil {
+		id, err := p.c.GetID(col)
 		if err != nil {
-			return errors.Wrap(err, "getting ID")
+			return errors.Wrapf(err, "getting column ID for '%s'", col)
 		}
-		call.Args[field] = id
-		return nil
+		call.Args[colArg] = id
+	}
+	if val, ok := call.Args[rowArg]; ok && rowArg != "" && field != "" {
+		mapped, err := p.mapRow(field, val)
+		if err != nil {
+			return errors.Wrapf(err, "mapping row of %s", field)
+		}
+		call.Args[rowArg] = mapped
 	}
 	for _, child := range call.Children {
 		if err := p.mapCall(child); err != nil {
@@ -377,6 +649,126 @@ func (p *PilosaKeyMapper) mapCall(call *pql.Call) error {
 	return nil
 }
 
+// mapRow translates the row value val of field to its id. Numbers are
+// translated as the strings the mapper stores them as. Values of fields which
+// keep decimal places are scaled instead, and range conditions, booleans, and
+// rows of Untranslated fields are left alone.
+func (p *PilosaKeyMapper) mapRow(field string, val interface{}) (interface{}, error) {
+	switch val.(type) {
+	case *pql.Condition, bool, nil:
+		return val, nil
+	}
+	if p.Untranslated[field] {
+		return val, nil
+	}
+	if decimals, ok := p.Decimals[field]; ok {
+		return scaleConst(val, decimals, math.Round)
+	}
+	if p.t == nil {
+		return val, nil
+	}
+	// the mapper translates numeric rows in the form literalString gives
+	// them, so numbers in the query are converted the same way.
+	switch tval := val.(type) {
+	case int64:
+		val = literalString(I64(tval))
+	case uint64:
+		val = literalString(U64(tval))
+	case float64:
+		val = literalString(F64(tval))
+	}
+	id, err := p.t.GetID(field, val)
+	return id, errors.Wrap(err, "getting ID")
+}
+
+// mapRowList maps each element of the list argument arg of call as a row of
+// the field returned by fieldOf for its position.
+func (p *PilosaKeyMapper) mapRowList(call *pql.Call, arg string, fieldOf func(i int) string) error {
+	val, ok := call.Args[arg]
+	if !ok {
+		return nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return errors.Errorf("'%s' argument must be a list, but got %T", arg, val)
+	}
+	for i, elem := range list {
+		field := fieldOf(i)
+		if field == "" {
+			return errors.Errorf("no field for element %d of '%s' in %s", i, arg, call)
+		}
+		mapped, err := p.mapRow(field, elem)
+		if err != nil {
+			return errors.Wrapf(err, "mapping %s", arg)
+		}
+		list[i] = mapped
+	}
+	return nil
+}
+
+// scaleCondition converts the constants in a range query condition on field
+// to the units stored in Pilosa if field keeps decimal places. Constants with
+// more decimal places than the field keeps are rounded in whichever direction
+// leaves the set of matching values unchanged.
+func (p *PilosaKeyMapper) scaleCondition(field string, cond *pql.Condition) error {
+	decimals, ok := p.Decimals[field]
+	if !ok {
+		return nil
+	}
+	if cond.Op == pql.BETWEEN {
+		vals, ok := cond.Value.([]interface{})
+		if !ok || len(vals) != 2 {
+			return errors.Errorf("expected a pair of values but got %#v", cond.Value)
+		}
+		lo, err := scaleConst(vals[0], decimals, math.Ceil)
+		if err != nil {
+			return err
+		}
+		hi, err := scaleConst(vals[1], decimals, math.Floor)
+		if err != nil {
+			return err
+		}
+		cond.Value = []interface{}{lo, hi}
+		return nil
+	}
+	round := math.Round
+	switch cond.Op {
+	case pql.GT, pql.LTE:
+		round = math.Floor
+	case pql.GTE, pql.LT:
+		round = math.Ceil
+	}
+	val, err := scaleConst(cond.Value, decimals, round)
+	if err != nil {
+		return err
+	}
+	cond.Value = val
+	return nil
+}
+
+// scaleConst multiplies the number val by 10^decimals, using round to get an
+// integer if the result isn't one.
+func scaleConst(val interface{}, decimals int, round func(float64) float64) (int64, error) {
+	switch tval := val.(type) {
+	case int64:
+		return Int64izeScaled(I64(tval), decimals)
+	case uint64:
+		return Int64izeScaled(U64(tval), decimals)
+	case float64:
+		scaled := tval * math.Pow10(decimals)
+		// 19.99*100 is 1998.9999999999998, which should be treated as 1999
+		// rather than rounded.
+		if nearest := math.Round(scaled); math.Abs(scaled-nearest) < 1e-9*math.Max(1, math.Abs(scaled)) {
+			scaled = nearest
+		} else {
+			scaled = round(scaled)
+		}
+		return Int64izeScaled(F64(scaled), 0)
+	default:
+		return 0, errors.Errorf("expected a number but got %T %#v", val, val)
+	}
+}
+
 // GetFields interprets body as pql queries and then tries to determine the
 // field of each. Some queries do not have fields, and the empty string will be
 // returned for these.
@@ -389,13 +781,23 @@ func GetFields(body []byte) ([]string, error) {
 	fields := make([]string, len(query.Calls))
 
 	for i, call := range query.Calls {
-		if field, ok := call.Args["field"].(string); ok {
-			fields[i] = field
-		} else if field, ok := call.Args["_field"].(string); ok {
-			fields[i] = field
-		} else {
-			fields[i] = ""
-		}
+		fields[i] = callField(call)
 	}
 	return fields, nil
 }
+
+// callField returns the field which call's result belongs to, or the empty
+// string if there isn't one.
+func callField(call *pql.Call) string {
+	if field, ok := call.Args["field"].(string); ok {
+		return field
+	} else if field, ok := call.Args["_field"].(string); ok {
+		return field
+	}
+	switch call.Name {
+	case "Set", "Clear", "Row", "Range", "ClearRow", "Store":
+		field, _ := call.FieldArg()
+		return field
+	}
+	return ""
+}
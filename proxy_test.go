@@ -0,0 +1,428 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pilosa/pdk"
+	ptest "github.com/pilosa/pilosa/test"
+)
+
+func TestPilosaKeyMapperDecimals(t *testing.T) {
+	km := pdk.NewPilosaKeyMapper(pdk.NewMapTranslator())
+	km.Decimals = map[string]int{"price": 2}
+
+	for query, exp := range map[string]string{
+		"Row(price > 19.99)":         "Row(price > 1999)",
+		"Row(price > 19.995)":        "Row(price > 1999)",
+		"Row(price >= 19.995)":       "Row(price >= 2000)",
+		"Row(price < 19.995)":        "Row(price < 2000)",
+		"Row(price <= 19.995)":       "Row(price <= 1999)",
+		"Row(price == 20)":           "Row(price == 2000)",
+		"Row(price >< [1.5, 2.555])": "Row(price >< [150,255])",
+		"Count(Row(price != 0.1))":   "Count(Row(price != 10))",
+		"Row(other > 19.99)":         "Row(other > 19.99)",
+	} {
+		mapped, err := km.MapRequest([]byte(query))
+		if err != nil {
+			t.Fatalf("mapping %s: %v", query, err)
+		}
+		if string(mapped) != exp {
+			t.Errorf("mapping %s: expected %s, got %s", query, exp, mapped)
+		}
+	}
+
+	res, err := km.MapResult("price", map[string]interface{}{"value": float64(3998), "count": float64(2)})
+	if err != nil {
+		t.Fatalf("mapping result: %v", err)
+	}
+	if exp := map[string]interface{}{"value": 39.98, "count": float64(2)}; !reflect.DeepEqual(res, exp) {
+		t.Errorf("unexpected result: %v", res)
+	}
+}
+
+func TestPilosaForwarderDecimals(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	schema := gopilosa.NewSchema()
+	index := schema.Index("decimals")
+	index.Field("price", gopilosa.OptFieldTypeInt(0, 1000000))
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, index.Name(), schema, 10)
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	cm := pdk.NewCollapsingMapper()
+	cm.Decimals = map[string]int{"price": 2}
+	for _, price := range []float64{19.99, 5.25, 20.01} {
+		pr, err := cm.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"price": pdk.F64(price)}})
+		if err != nil {
+			t.Fatalf("mapping: %v", err)
+		}
+		if err := indexer.AddValue(pr.Vals[0].Field, pr.Col, pr.Vals[0].Value); err != nil {
+			t.Fatalf("adding value: %v", err)
+		}
+	}
+	if err := indexer.Close(); err != nil {
+		t.Fatalf("closing indexer: %v", err)
+	}
+
+	fwd := pdk.NewPilosaForwarder(cluster[0].URL(), cm.Translator)
+	fwd.SetDecimals(cm.Decimals)
+	proxy := httptest.NewServer(fwd)
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/index/decimals/query", "text/plain", strings.NewReader("Sum(field=price) Max(field=price) Count(Row(price > 19.99))"))
+	if err != nil {
+		t.Fatalf("querying proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	results := struct {
+		Results []interface{}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	exp := []interface{}{
+		map[string]interface{}{"value": 45.25, "count": float64(3)},
+		map[string]interface{}{"value": 20.01, "count": float64(1)},
+		float64(1),
+	}
+	if !reflect.DeepEqual(results.Results, exp) {
+		t.Errorf("unexpected results: %v", results.Results)
+	}
+}
+
+func TestPilosaForwarderUntranslated(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	spec, err := pdk.ParseSpec([]byte(`
+subject: [id]
+fields:
+  - path: [color]
+  - path: [tag]
+    keys: true
+  - path: [group]
+    ids: true
+`))
+	if err != nil {
+		t.Fatalf("parsing spec: %v", err)
+	}
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "untranslated", spec.Schema("untranslated"), 10)
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	parser.EntitySubjecter = pdk.SubjectPath(spec.Subject)
+	mapper := pdk.NewSpecMapper(spec)
+	mapper.ColTranslator = pdk.NewMapFieldTranslator()
+	ingester := pdk.NewIngester(&sliceSource{recs: []map[string]interface{}{
+		{"id": "a", "color": "red", "tag": "x", "group": 12},
+		{"id": "b", "color": "blue", "tag": "y", "group": 12},
+		{"id": "c", "color": "red", "tag": "x", "group": 7},
+	}}, parser, mapper, indexer)
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+	if err := ingester.Run(); err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+
+	fwd := pdk.NewPilosaForwarder(cluster[0].URL(), mapper.Translator, mapper.ColTranslator)
+	fwd.SetUntranslated(spec.Untranslated())
+	proxy := httptest.NewServer(fwd)
+	defer proxy.Close()
+	resp, err := http.Post(proxy.URL+"/index/untranslated/query", "text/plain", strings.NewReader("Count(Row(tag=x)) Count(Row(group=12)) Rows(group) Count(Row(color=red))"))
+	if err != nil {
+		t.Fatalf("querying proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	results := struct {
+		Results []interface{}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	exp := []interface{}{
+		float64(2),
+		float64(2),
+		map[string]interface{}{"rows": []interface{}{float64(7), float64(12)}},
+		float64(2),
+	}
+	if !reflect.DeepEqual(results.Results, exp) {
+		t.Errorf("unexpected results: %#v", results.Results)
+	}
+}
+
+// hexMapper adds a "hex" attribute to the rows of the color field.
+type hexMapper struct {
+	*pdk.CollapsingMapper
+}
+
+func (m hexMapper) Map(e *pdk.Entity) (pdk.PilosaRecord, error) {
+	pr, err := m.CollapsingMapper.Map(e)
+	for _, row := range pr.Rows {
+		if row.Field == "color" {
+			color, _ := m.Translator.Get("color", row.ID.(uint64))
+			pr.AddRowAttr(row.Field, row.ID, "hex", map[string]string{"red": "#f00", "blue": "#00f"}[string(color.(pdk.S))])
+		}
+	}
+	return pr, err
+}
+
+func TestPilosaForwarderAttrs(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	// a batch size smaller than the number of attributes sends some of them
+	// before the indexer is closed.
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "attrs", nil, 2)
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	parser.EntitySubjecter = pdk.SubjectPath([]string{"id"})
+	cm := pdk.NewCollapsingMapper()
+	cm.ColTranslator = pdk.NewMapFieldTranslator()
+	cm.ColAttrs = map[string]bool{"name": true, "age": true}
+	ingester := pdk.NewIngester(&sliceSource{recs: []map[string]interface{}{
+		{"id": "a", "color": "red", "name": "Alice", "age": 31},
+		{"id": "b", "color": "red", "name": "Bob"},
+		{"id": "c", "color": "blue", "name": "Carol"},
+	}}, parser, hexMapper{cm}, indexer)
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+	if err := ingester.Run(); err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+
+	fwd := pdk.NewPilosaForwarder(cluster[0].URL(), cm.Translator, cm.ColTranslator)
+	proxy := httptest.NewServer(fwd)
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/index/attrs/query?columnAttrs=true", "text/plain", strings.NewReader("Row(color=red)"))
+	if err != nil {
+		t.Fatalf("querying proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	results := struct {
+		Results     []map[string]interface{}
+		ColumnAttrs []map[string]interface{}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	exp := []map[string]interface{}{{
+		"attrs":   map[string]interface{}{"hex": "#f00"},
+		"columns": []interface{}{"a", "b"},
+	}}
+	if !reflect.DeepEqual(results.Results, exp) {
+		t.Errorf("unexpected results: %v", results.Results)
+	}
+	expAttrs := []map[string]interface{}{
+		{"key": "a", "attrs": map[string]interface{}{"name": "Alice", "age": float64(31)}},
+		{"key": "b", "attrs": map[string]interface{}{"name": "Bob"}},
+	}
+	if !reflect.DeepEqual(results.ColumnAttrs, expAttrs) {
+		t.Errorf("unexpected column attributes: %v", results.ColumnAttrs)
+	}
+}
+
+func TestPilosaKeyMapperMapRequest(t *testing.T) {
+	trans := pdk.NewMapTranslator()
+	cols := pdk.NewMapFieldTranslator()
+	for _, v := range []string{"red", "blue"} {
+		if _, err := trans.GetID("color", v); err != nil {
+			t.Fatalf("getting id: %v", err)
+		}
+	}
+	for _, v := range []string{"x", "y"} {
+		if _, err := trans.GetID("tags", v); err != nil {
+			t.Fatalf("getting id: %v", err)
+		}
+	}
+	for _, v := range []string{"a", "b"} {
+		if _, err := cols.GetID(v); err != nil {
+			t.Fatalf("getting id: %v", err)
+		}
+	}
+	km := pdk.NewPilosaKeyMapper(trans, cols)
+	km.Decimals = map[string]int{"price": 2}
+	km.Untranslated = map[string]bool{"group": true}
+
+	for query, exp := range map[string]string{
+		`Row(color=blue)`: `Row(color=1)`,
+		`Row(group=12)`:   `Row(group=12)`,
+		`Count(Union(Row(color=red), Row(tags=y)))`:                                `Count(Union(Row(color=0), Row(tags=1)))`,
+		`Set('b', color=blue)`:                                                     `Set(_col=1, color=1)`,
+		`Set(7, color=red, 2019-01-01T00:00)`:                                      `Set(_col=7, _timestamp="2019-01-01T00:00", color=0)`,
+		`Set('a', price=19.99)`:                                                    `Set(_col=0, price=1999)`,
+		`Clear('a', tags=x)`:                                                       `Clear(_col=0, tags=0)`,
+		`ClearRow(tags=y)`:                                                         `ClearRow(tags=1)`,
+		`Store(Row(color=red), tags=y)`:                                            `Store(Row(color=0), tags=1)`,
+		`Range(color=blue, from=2019-01-01T00:00, to=2019-02-01T00:00)`:            `Range(color=1, from="2019-01-01T00:00", to="2019-02-01T00:00")`,
+		`TopN(tags, Row(color=blue), n=2, ids=[y])`:                                `TopN(Row(color=1), _field="tags", ids=[1], n=2)`,
+		`Rows(color, previous=red, column='b')`:                                    `Rows(_field="color", column=1, previous=0)`,
+		`GroupBy(Rows(color), Rows(tags), previous=[blue, x], filter=Row(tags=y))`: `GroupBy(Rows(_field="color"), Rows(_field="tags"), filter=Row(tags=1), previous=[1,0])`,
+		`SetRowAttrs(color, "blue", hex="#00f")`:                                   `SetRowAttrs(_field="color", _row=1, hex="#00f")`,
+		`SetColumnAttrs('b', name="Bob")`:                                          `SetColumnAttrs(_col=1, name="Bob")`,
+		`Sum(Row(color=red), field=price)`:                                         `Sum(Row(color=0), field="price")`,
+		`Row(done=true)`:                                                           `Row(done=true)`,
+	} {
+		mapped, err := km.MapRequest([]byte(query))
+		if err != nil {
+			t.Fatalf("mapping %s: %v", query, err)
+		}
+		if string(mapped) != exp {
+			t.Errorf("mapping %s: expected %s, got %s", query, exp, mapped)
+		}
+	}
+
+	for _, query := range []string{`Row(from=1)`, `GroupBy(Rows(color), previous=[red, x])`, `TopN(tags, ids=x)`} {
+		if _, err := km.MapRequest([]byte(query)); err == nil {
+			t.Errorf("expected error mapping %s", query)
+		}
+	}
+
+	fields, err := pdk.GetFields([]byte(`Set('a', color=red) TopN(tags) MinRow(field=color) Count(Row(color=red))`))
+	if err != nil {
+		t.Fatalf("getting fields: %v", err)
+	}
+	if exp := []string{"color", "tags", "color", ""}; !reflect.DeepEqual(fields, exp) {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
+
+func TestPilosaForwarderPQL(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	// Pilosa 1.4 loses bits which were imported with roaring imports when
+	// more are Set in the same row, so this imports them normally.
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "pql", nil, 10,
+		pdk.OptPilosaImportOptions(gopilosa.OptImportRoaring(false)))
+	if err != nil {
+		t.Fatalf("SetupPilosa: %v", err)
+	}
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	parser.EntitySubjecter = pdk.SubjectPath([]string{"id"})
+	cm := pdk.NewCollapsingMapper()
+	cm.ColTranslator = pdk.NewMapFieldTranslator()
+	cm.FieldTypes = map[string]pdk.FieldType{"size": pdk.FieldTypeSet}
+	ingester := pdk.NewIngester(&sliceSource{recs: []map[string]interface{}{
+		{"id": "a", "color": "red", "tags": []interface{}{"x", "y"}, "size": 3},
+		{"id": "b", "color": "red", "tags": []interface{}{"y"}, "size": 3},
+		{"id": "c", "color": "blue", "tags": []interface{}{"x"}, "size": 2.5},
+	}}, parser, cm, indexer)
+	ingester.Stats = pdk.NopStatter{}
+	ingester.Log = pdk.NopLogger{}
+	if err := ingester.Run(); err != nil {
+		t.Fatalf("running ingester: %v", err)
+	}
+
+	proxy := httptest.NewServer(pdk.NewPilosaForwarder(cluster[0].URL(), cm.Translator, cm.ColTranslator))
+	defer proxy.Close()
+	query := func(pql string) []interface{} {
+		t.Helper()
+		resp, err := http.Post(proxy.URL+"/index/pql/query", "text/plain", strings.NewReader(pql))
+		if err != nil {
+			t.Fatalf("querying proxy: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("querying %s: status %d", pql, resp.StatusCode)
+		}
+		results := struct {
+			Results []interface{}
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return results.Results
+	}
+
+	// writes are translated, and green and d are new
+	query(`Set('d', color=green) Set('d', tags=x) Clear('a', tags=x) SetRowAttrs(color, "green", hex="#0f0")`)
+
+	results := query(`Row(color=green) Rows(tags) MinRow(field=tags) Count(Row(tags=x)) TopN(tags, n=5, ids=[y])`)
+	if minRow, ok := results[2].(map[string]interface{}); !ok || minRow["id"] != "x" {
+		t.Errorf("unexpected MinRow result: %#v", results[2])
+	}
+	results = append(results[:2], results[3:]...)
+	exp := []interface{}{
+		map[string]interface{}{"attrs": map[string]interface{}{"hex": "#0f0"}, "columns": []interface{}{"d"}},
+		map[string]interface{}{"rows": []interface{}{"x", "y"}},
+		float64(2),
+		[]interface{}{map[string]interface{}{"Key": "y", "Count": float64(2)}},
+	}
+	if !reflect.DeepEqual(results, exp) {
+		t.Errorf("unexpected results:\n%#v\nexpected:\n%#v", results, exp)
+	}
+
+	results = query(`GroupBy(Rows(color), Rows(tags), filter=Row(tags=y)) Rows(color, previous=red)`)
+	exp = []interface{}{
+		[]interface{}{
+			map[string]interface{}{"count": float64(2), "group": []interface{}{
+				map[string]interface{}{"field": "color", "rowID": "red"},
+				map[string]interface{}{"field": "tags", "rowID": "y"},
+			}},
+		},
+		map[string]interface{}{"rows": []interface{}{"blue", "green"}},
+	}
+	if !reflect.DeepEqual(results, exp) {
+		t.Errorf("unexpected results:\n%#v\nexpected:\n%#v", results, exp)
+	}
+	// numeric rows of set fields are translated like the mapper translates
+	// them.
+	results = query(`Count(Row(size=3)) Row(size=2.5)`)
+	exp = []interface{}{
+		float64(2),
+		map[string]interface{}{"attrs": map[string]interface{}{}, "columns": []interface{}{"c"}},
+	}
+	if !reflect.DeepEqual(results, exp) {
+		t.Errorf("unexpected results:\n%#v\nexpected:\n%#v", results, exp)
+	}
+}
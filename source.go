@@ -33,6 +33,7 @@
 package pdk
 
 import (
+	"io"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -103,3 +104,82 @@ func (p *PeekingSource) Record() (interface{}, error) {
 func NewPeekingSource(source Source) *PeekingSource {
 	return &PeekingSource{Source: source}
 }
+
+// ParallelSource is a Source which reads records from several of a
+// RawSource's readers at once. Records from each reader are returned in order,
+// but records from different readers are interleaved.
+type ParallelSource struct {
+	rs      RawSource
+	open    func(NamedReadCloser) (Source, error)
+	records chan parallelRecord
+}
+
+type parallelRecord struct {
+	rec interface{}
+	err error
+}
+
+// NewParallelSource returns a ParallelSource which reads up to concurrency of
+// rs's readers at once, using open to get a Source for each. Reading a reader
+// stops at the first error from its Source, which is returned by Record.
+func NewParallelSource(rs RawSource, concurrency int, open func(NamedReadCloser) (Source, error)) *ParallelSource {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	p := &ParallelSource{
+		rs:      rs,
+		open:    open,
+		records: make(chan parallelRecord, 100),
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.read()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(p.records)
+	}()
+	return p
+}
+
+func (p *ParallelSource) read() {
+	for {
+		r, err := p.rs.NextReader()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			p.records <- parallelRecord{err: errors.Wrap(err, "getting next reader")}
+			return
+		}
+		src, err := p.open(r)
+		if err != nil {
+			r.Close()
+			p.records <- parallelRecord{err: errors.Wrapf(err, "opening %s", r.Name())}
+			continue
+		}
+		for {
+			rec, err := src.Record()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				p.records <- parallelRecord{err: errors.Wrapf(err, "reading %s", r.Name())}
+				break
+			}
+			p.records <- parallelRecord{rec: rec}
+		}
+		r.Close()
+	}
+}
+
+// Record implements Source.
+func (p *ParallelSource) Record() (interface{}, error) {
+	rec, ok := <-p.records
+	if !ok {
+		return nil, io.EOF
+	}
+	return rec.rec, rec.err
+}
@@ -33,7 +33,15 @@
 package pdk_test
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/pilosa/pdk"
@@ -117,3 +125,80 @@ func TestSourcePeek(t *testing.T) {
 		t.Fatal("Error expected")
 	}
 }
+
+// memRawSource is a pdk.RawSource of strings.
+type memRawSource struct {
+	mu    sync.Mutex
+	datas []string
+}
+
+type memReader struct {
+	io.Reader
+	name   string
+	closed *int32
+}
+
+func (m memReader) Name() string                 { return m.name }
+func (m memReader) Meta() map[string]interface{} { return nil }
+func (m memReader) Close() error                 { atomic.AddInt32(m.closed, 1); return nil }
+
+func (m *memRawSource) NextReader() (pdk.NamedReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.datas) == 0 {
+		return nil, io.EOF
+	}
+	r := memReader{Reader: strings.NewReader(m.datas[0]), name: fmt.Sprintf("r%d", len(m.datas)), closed: &closedReaders}
+	m.datas = m.datas[1:]
+	return r, nil
+}
+
+var closedReaders int32
+
+// lineSource returns each line of a reader, or an error for a line "err".
+type lineSource struct {
+	*bufio.Scanner
+}
+
+func (l lineSource) Record() (interface{}, error) {
+	if !l.Scan() {
+		return nil, io.EOF
+	}
+	if l.Text() == "err" {
+		return nil, errors.New("bad line")
+	}
+	return l.Text(), nil
+}
+
+func TestParallelSource(t *testing.T) {
+	closedReaders = 0
+	rs := &memRawSource{datas: []string{"a\nb\nc", "d", "", "e\nf\nerr\ng", "h\ni"}}
+	src := pdk.NewParallelSource(rs, 3, func(r pdk.NamedReadCloser) (pdk.Source, error) {
+		return lineSource{bufio.NewScanner(r)}, nil
+	})
+	got := make([]string, 0)
+	errs := 0
+	for {
+		rec, err := src.Record()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if !strings.Contains(err.Error(), "reading r2: bad line") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			errs++
+			continue
+		}
+		got = append(got, rec.(string))
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e", "f", "h", "i"}) {
+		t.Fatalf("unexpected records: %v", got)
+	}
+	if errs != 1 {
+		t.Fatalf("expected one error, got %d", errs)
+	}
+	if closedReaders != 5 {
+		t.Fatalf("expected all 5 readers to be closed, got %d", closedReaders)
+	}
+}
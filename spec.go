@@ -0,0 +1,579 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Spec declares how records are indexed in Pilosa. Rather than deriving a
+// field from every path in a record (as CollapsingMapper does), only the
+// paths in Fields are indexed, each into a field of a fixed name and type, no
+// matter which Go type the parser produced for a particular value. A Spec is
+// usually loaded from a YAML or JSON file with LoadSpec.
+type Spec struct {
+	// Subject is the path to the value in each record which identifies its
+	// column.
+	Subject []string `yaml:"subject"`
+
+	// Timestamp is the path to the Time in each record which is used as the
+	// timestamp of rows in time fields.
+	Timestamp []string `yaml:"timestamp"`
+
+	// Ignore lists paths (and everything beneath them) which are not indexed.
+	// This only matters when Strict is set, since paths which aren't in
+	// Fields are never indexed.
+	Ignore [][]string `yaml:"ignore"`
+
+	// Strict causes records which have values at paths that are not in
+	// Fields, Ignore, Subject or Timestamp to fail to map.
+	Strict bool `yaml:"strict"`
+
+	Fields []*FieldSpec `yaml:"fields"`
+}
+
+// FieldSpec declares the Pilosa field for a single path in a record.
+type FieldSpec struct {
+	// Path is the sequence of keys leading to the value in each record.
+	// Lists along the path are treated as sets of values.
+	Path []string `yaml:"path"`
+
+	// Field is the Pilosa field name. It defaults to the elements of Path
+	// joined with dashes.
+	Field string `yaml:"field"`
+
+	// Type is the type of the field. It defaults to set.
+	Type FieldType `yaml:"type"`
+
+	// CacheType and CacheSize configure the cache for set and mutex fields.
+	// They default to ranked and 100000.
+	CacheType gopilosa.CacheType `yaml:"cache_type"`
+	CacheSize int                `yaml:"cache_size"`
+
+	// Min and Max are the bounds of an int field. Values outside of them
+	// cause the record to fail to map.
+	Min *int64 `yaml:"min"`
+	Max *int64 `yaml:"max"`
+
+	// Decimals is the number of decimal places of each value which are kept
+	// in an int field. Values are multiplied by 10^Decimals and rounded, so
+	// Min and Max are in those units too. See Spec.Decimals.
+	Decimals int `yaml:"decimals"`
+
+	// Keys makes a set, mutex, or time field use Pilosa row keys - each
+	// value is used as the key as is, rather than being translated to a row
+	// id by the mapper's Translator.
+	Keys bool `yaml:"keys"`
+
+	// IDs means that values are row ids already, and are used without
+	// translation. Values must be non-negative integers.
+	IDs bool `yaml:"ids"`
+
+	// Quantum is the time quantum of a time field. It defaults to YMDH.
+	Quantum gopilosa.TimeQuantum `yaml:"quantum"`
+}
+
+var validFieldName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,63}$`)
+
+// LoadSpec reads a Spec from a YAML or JSON file.
+func LoadSpec(filename string) (*Spec, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading spec")
+	}
+	return ParseSpec(data)
+}
+
+// ParseSpec decodes a Spec from YAML or JSON (which YAML is a superset of),
+// fills in defaults, and validates it.
+func ParseSpec(data []byte) (*Spec, error) {
+	spec := &Spec{}
+	err := yaml.UnmarshalStrict(data, spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding spec")
+	}
+	return spec, errors.Wrap(spec.Validate(), "validating spec")
+}
+
+// Validate fills in defaults for any unset options in s, and returns an error
+// if s is invalid.
+func (s *Spec) Validate() error {
+	fields := make(map[string]bool)
+	paths := make(map[string]bool)
+	for i, f := range s.Fields {
+		if err := f.validate(); err != nil {
+			return errors.Wrapf(err, "field %d (%v)", i, f.Path)
+		}
+		if fields[f.Field] {
+			return errors.Errorf("field '%s' is declared more than once", f.Field)
+		}
+		fields[f.Field] = true
+		if paths[pathKey(f.Path)] {
+			return errors.Errorf("path %v is declared more than once", f.Path)
+		}
+		paths[pathKey(f.Path)] = true
+	}
+	return nil
+}
+
+func (f *FieldSpec) validate() error {
+	if len(f.Path) == 0 {
+		return errors.New("path is required")
+	}
+	if f.Field == "" {
+		f.Field = strings.Join(f.Path, "-")
+	}
+	if !validFieldName.MatchString(f.Field) {
+		return errors.Errorf("invalid field name '%s'", f.Field)
+	}
+	if f.Type == "" {
+		f.Type = FieldTypeSet
+	}
+	switch f.Type {
+	case FieldTypeSet, FieldTypeMutex, FieldTypeBool, FieldTypeInt, FieldTypeTime:
+	default:
+		return errors.Errorf("unknown field type '%s'", f.Type)
+	}
+	if f.Keys && f.IDs {
+		return errors.New("keys and ids are mutually exclusive")
+	}
+	if (f.Keys || f.IDs) && (f.Type == FieldTypeBool || f.Type == FieldTypeInt) {
+		return errors.Errorf("keys and ids don't apply to %s fields", f.Type)
+	}
+	if f.CacheType != "" || f.CacheSize != 0 {
+		if f.Type != FieldTypeSet && f.Type != FieldTypeMutex {
+			return errors.Errorf("cache options don't apply to %s fields", f.Type)
+		}
+	}
+	switch f.CacheType {
+	case gopilosa.CacheTypeDefault:
+		f.CacheType = gopilosa.CacheTypeRanked
+	case gopilosa.CacheTypeRanked, gopilosa.CacheTypeLRU, gopilosa.CacheTypeNone:
+	default:
+		return errors.Errorf("unknown cache type '%s'", f.CacheType)
+	}
+	if f.CacheSize < 0 {
+		return errors.Errorf("negative cache size %d", f.CacheSize)
+	} else if f.CacheSize == 0 {
+		f.CacheSize = 100000
+	}
+	if (f.Min != nil || f.Max != nil) && f.Type != FieldTypeInt {
+		return errors.Errorf("min and max don't apply to %s fields", f.Type)
+	}
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		return errors.Errorf("min %d is greater than max %d", *f.Min, *f.Max)
+	}
+	if f.Decimals != 0 && f.Type != FieldTypeInt {
+		return errors.Errorf("decimals don't apply to %s fields", f.Type)
+	}
+	if f.Decimals < 0 || f.Decimals > 18 {
+		return errors.Errorf("decimals must be between 0 and 18, not %d", f.Decimals)
+	}
+	if f.Quantum != "" && f.Type != FieldTypeTime {
+		return errors.Errorf("quantum doesn't apply to %s fields", f.Type)
+	}
+	if f.Type == FieldTypeTime {
+		if f.Quantum == "" {
+			f.Quantum = gopilosa.TimeQuantumYearMonthDayHour
+		}
+		if err := validateTimeQuantum(f.Quantum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// options returns the go-pilosa options for creating the field.
+func (f *FieldSpec) options() []gopilosa.FieldOption {
+	var opts []gopilosa.FieldOption
+	switch f.Type {
+	case FieldTypeSet:
+		opts = append(opts, gopilosa.OptFieldTypeSet(f.CacheType, f.CacheSize))
+	case FieldTypeMutex:
+		opts = append(opts, gopilosa.OptFieldTypeMutex(f.CacheType, f.CacheSize))
+	case FieldTypeBool:
+		opts = append(opts, gopilosa.OptFieldTypeBool())
+	case FieldTypeInt:
+		limits := []int64{math.MinInt64, math.MaxInt64}
+		if f.Min != nil {
+			limits[0] = *f.Min
+		}
+		if f.Max != nil {
+			limits[1] = *f.Max
+		}
+		opts = append(opts, gopilosa.OptFieldTypeInt(limits...))
+	case FieldTypeTime:
+		opts = append(opts, gopilosa.OptFieldTypeTime(f.Quantum))
+	}
+	if f.Keys {
+		opts = append(opts, gopilosa.OptFieldKeys(true))
+	}
+	return opts
+}
+
+// Schema returns a Pilosa schema containing an index with every field in s.
+// Pass it to SetupPilosa so that the fields are created up front with the
+// declared options.
+func (s *Spec) Schema(index string) *gopilosa.Schema {
+	schema := gopilosa.NewSchema()
+	idx := schema.Index(index)
+	for _, f := range s.Fields {
+		idx.Field(f.Field, f.options()...)
+	}
+	return schema
+}
+
+// Decimals returns the Decimals of each int field in s which keeps decimal
+// places, for use with PilosaKeyMapper.Decimals.
+func (s *Spec) Decimals() map[string]int {
+	decimals := make(map[string]int)
+	for _, f := range s.Fields {
+		if f.Decimals > 0 {
+			decimals[f.Field] = f.Decimals
+		}
+	}
+	return decimals
+}
+
+// Untranslated returns the fields of s with Keys or IDs, whose rows aren't
+// translated, for use with PilosaKeyMapper.Untranslated.
+func (s *Spec) Untranslated() map[string]bool {
+	fields := make(map[string]bool)
+	for _, f := range s.Fields {
+		if f.Keys || f.IDs {
+			fields[f.Field] = true
+		}
+	}
+	return fields
+}
+
+func pathKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// SpecMapper is a RecordMapper which indexes the values at each of the paths
+// declared in a Spec into the declared field. Values are converted to the
+// field's type, so (for example) 7 and "7" map to the same row, and "7" can be
+// stored in an int field.
+type SpecMapper struct {
+	Spec          *Spec
+	Translator    Translator
+	ColTranslator FieldTranslator
+	Nexter        INexter
+}
+
+// NewSpecMapper gets a SpecMapper for spec with the same default components
+// as NewCollapsingMapper.
+func NewSpecMapper(spec *Spec) *SpecMapper {
+	return &SpecMapper{
+		Spec:          spec,
+		Translator:    NewMapTranslator(),
+		ColTranslator: NewNexterFieldTranslator(),
+		Nexter:        NewNexter(),
+	}
+}
+
+// Mapper returns a SpecMapper for s which shares the Translator,
+// ColTranslator, and Nexter of cm. This lets ingest commands build a
+// CollapsingMapper as usual and swap in a SpecMapper when given a Spec. If s
+// has no Timestamp, it takes cm's TimestampPath.
+func (s *Spec) Mapper(cm *CollapsingMapper) *SpecMapper {
+	if len(s.Timestamp) == 0 {
+		s.Timestamp = cm.TimestampPath
+	}
+	return &SpecMapper{
+		Spec:          s,
+		Translator:    cm.Translator,
+		ColTranslator: cm.ColTranslator,
+		Nexter:        cm.Nexter,
+	}
+}
+
+// Map implements the RecordMapper interface.
+func (m *SpecMapper) Map(e *Entity) (PilosaRecord, error) {
+	pr := PilosaRecord{}
+	var err error
+	pr.Col, err = mapCol(e, m.ColTranslator, m.Nexter)
+	if err != nil {
+		return pr, err
+	}
+	ts, err := popTime(e, m.Spec.Timestamp)
+	if err != nil {
+		return pr, errors.Wrap(err, "getting timestamp")
+	}
+	if m.Spec.Strict {
+		if err := m.checkPaths(e, nil); err != nil {
+			return pr, err
+		}
+	}
+	for _, f := range m.Spec.Fields {
+		lits, err := literalsAt(e, f.Path)
+		if err != nil {
+			return pr, errors.Wrapf(err, "getting values at %v", f.Path)
+		}
+		for _, lit := range lits {
+			if err := m.mapLit(f, lit, ts, &pr); err != nil {
+				return pr, errors.Wrapf(err, "mapping '%v' to field '%s'", lit, f.Field)
+			}
+		}
+	}
+	return pr, nil
+}
+
+func (m *SpecMapper) mapLit(f *FieldSpec, lit Literal, ts time.Time, pr *PilosaRecord) error {
+	switch f.Type {
+	case FieldTypeSet, FieldTypeMutex, FieldTypeTime:
+		row, err := m.row(f, lit)
+		if err != nil {
+			return err
+		}
+		switch {
+		case f.Type == FieldTypeTime && !ts.IsZero():
+			pr.AddRowTime(f.Field, row, ts)
+		case f.Type == FieldTypeMutex:
+			pr.AddRowType(f.Field, f.Type, row)
+		default:
+			pr.AddRow(f.Field, row)
+		}
+	case FieldTypeBool:
+		b, err := boolValue(lit)
+		if err != nil {
+			return err
+		}
+		if b {
+			pr.AddRowType(f.Field, f.Type, uint64(1))
+		} else {
+			pr.AddRowType(f.Field, f.Type, uint64(0))
+		}
+	case FieldTypeInt:
+		val, err := intValue(lit, f.Decimals)
+		if err != nil {
+			return err
+		}
+		if (f.Min != nil && val < *f.Min) || (f.Max != nil && val > *f.Max) {
+			return errors.Errorf("%d is out of range", val)
+		}
+		pr.AddVal(f.Field, val)
+	}
+	return nil
+}
+
+// row gets the row id or key for lit in the field f.
+func (m *SpecMapper) row(f *FieldSpec, lit Literal) (uint64OrString, error) {
+	if f.IDs {
+		return uintValue(lit)
+	}
+	str := literalString(lit)
+	if f.Keys {
+		return str, nil
+	}
+	if m.Translator == nil {
+		return nil, errors.New("field without keys or ids needs a Translator")
+	}
+	id, err := m.Translator.GetID(f.Field, S(str))
+	return id, errors.Wrap(err, "translating")
+}
+
+// checkPaths returns an error if obj (at path) has any values which aren't
+// declared or ignored by the Spec.
+func (m *SpecMapper) checkPaths(obj Object, path []string) error {
+	for _, ig := range m.Spec.Ignore {
+		if hasPrefix(path, ig) {
+			return nil
+		}
+	}
+	switch tobj := obj.(type) {
+	case *Entity:
+		for prop, child := range tobj.Objects {
+			if err := m.checkPaths(child, append(path[:len(path):len(path)], string(prop))); err != nil {
+				return err
+			}
+		}
+	case Objects:
+		for _, child := range tobj {
+			if err := m.checkPaths(child, path); err != nil {
+				return err
+			}
+		}
+	default:
+		key := pathKey(path)
+		for _, f := range m.Spec.Fields {
+			if pathKey(f.Path) == key {
+				return nil
+			}
+		}
+		return errors.Errorf("value at undeclared path %v", path)
+	}
+	return nil
+}
+
+func hasPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, item := range prefix {
+		if path[i] != item {
+			return false
+		}
+	}
+	return true
+}
+
+// literalsAt returns all the Literals at path in obj. Lists along the way are
+// flattened, so there may be more than one.
+func literalsAt(obj Object, path []string) ([]Literal, error) {
+	switch tobj := obj.(type) {
+	case *Entity:
+		if len(path) == 0 {
+			return nil, errors.New("found an object rather than a value")
+		}
+		child, ok := tobj.Objects[Property(path[0])]
+		if !ok {
+			return nil, nil
+		}
+		return literalsAt(child, path[1:])
+	case Objects:
+		var lits []Literal
+		for _, child := range tobj {
+			clits, err := literalsAt(child, path)
+			if err != nil {
+				return nil, err
+			}
+			lits = append(lits, clits...)
+		}
+		return lits, nil
+	case Literal:
+		if len(path) > 0 {
+			return nil, nil
+		}
+		return []Literal{tobj}, nil
+	default:
+		return nil, errors.Errorf("unexpected object type %T", obj)
+	}
+}
+
+// literalString converts lit to a string such that equal values of different
+// types (e.g. 7 and "7") have the same representation.
+func literalString(lit Literal) string {
+	switch tlit := lit.(type) {
+	case S:
+		return string(tlit)
+	case B:
+		return strconv.FormatBool(bool(tlit))
+	case F32:
+		return strconv.FormatFloat(float64(tlit), 'f', -1, 32)
+	case F64:
+		return strconv.FormatFloat(float64(tlit), 'f', -1, 64)
+	case Time:
+		return time.Time(tlit).UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprintf("%v", lit)
+	}
+}
+
+// intValue converts lit to an int64 which keeps decimals decimal places (see
+// Int64izeScaled).
+func intValue(lit Literal, decimals int) (int64, error) {
+	switch tlit := lit.(type) {
+	case F32, F64, I, I8, I16, I32, I64, U, U8, U16, U32, U64:
+		return Int64izeScaled(lit, decimals)
+	case S:
+		if i, err := strconv.ParseInt(string(tlit), 10, 64); err == nil {
+			return Int64izeScaled(I64(i), decimals)
+		}
+		f, err := strconv.ParseFloat(string(tlit), 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "parsing number")
+		}
+		return Int64izeScaled(F64(f), decimals)
+	case B:
+		if tlit {
+			return 1, nil
+		}
+		return 0, nil
+	case Time:
+		return time.Time(tlit).Unix(), nil
+	default:
+		return 0, errors.Errorf("can't convert %T to an integer", lit)
+	}
+}
+
+func uintValue(lit Literal) (uint64, error) {
+	switch tlit := lit.(type) {
+	case U:
+		return uint64(tlit), nil
+	case U64:
+		return uint64(tlit), nil
+	case S:
+		u, err := strconv.ParseUint(string(tlit), 10, 64)
+		return u, errors.Wrap(err, "parsing id")
+	case F32, F64:
+		f := Float64ize(lit)
+		if f < 0 || f != float64(uint64(f)) {
+			return 0, errors.Errorf("%v is not a valid id", f)
+		}
+		return uint64(f), nil
+	case I, I8, I16, I32, I64, U8, U16, U32:
+		i := Int64ize(lit)
+		if i < 0 {
+			return 0, errors.Errorf("%d is not a valid id", i)
+		}
+		return uint64(i), nil
+	default:
+		return 0, errors.Errorf("can't convert %T to an id", lit)
+	}
+}
+
+func boolValue(lit Literal) (bool, error) {
+	switch tlit := lit.(type) {
+	case B:
+		return bool(tlit), nil
+	case S:
+		b, err := strconv.ParseBool(string(tlit))
+		return b, errors.Wrap(err, "parsing bool")
+	case F32, F64, I, I8, I16, I32, I64, U, U8, U16, U32, U64:
+		return Float64ize(lit) != 0, nil
+	default:
+		return false, errors.Errorf("can't convert %T to a bool", lit)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pilosa/pdk"
+	ptest "github.com/pilosa/pilosa/test"
+)
+
+var testSpec = `
+subject: [id]
+timestamp: [ts]
+strict: true
+ignore:
+  - [debug]
+fields:
+  - path: [color]
+  - path: [user, name]
+    field: username
+    keys: true
+  - path: [size]
+    type: mutex
+    cache_type: lru
+    cache_size: 10
+  - path: [active]
+    type: bool
+  - path: [age]
+    type: int
+    min: 0
+    max: 150
+  - path: [tags]
+    type: time
+    quantum: YMD
+  - path: [group]
+    ids: true
+`
+
+func TestParseSpec(t *testing.T) {
+	spec, err := pdk.ParseSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatalf("parsing spec: %v", err)
+	}
+	if !reflect.DeepEqual(spec.Subject, []string{"id"}) || !spec.Strict || len(spec.Fields) != 7 {
+		t.Fatalf("unexpected spec: %#v", spec)
+	}
+	color := spec.Fields[0]
+	if color.Field != "color" || color.Type != pdk.FieldTypeSet || color.CacheType != gopilosa.CacheTypeRanked || color.CacheSize != 100000 {
+		t.Errorf("unexpected defaults: %#v", color)
+	}
+	if f := spec.Fields[5]; f.Quantum != gopilosa.TimeQuantumYearMonthDay {
+		t.Errorf("unexpected quantum: %v", f.Quantum)
+	}
+
+	// JSON works too
+	spec, err = pdk.ParseSpec([]byte(`{"fields": [{"path": ["a", "b"], "type": "int"}]}`))
+	if err != nil {
+		t.Fatalf("parsing json spec: %v", err)
+	}
+	if f := spec.Fields[0]; f.Field != "a-b" || f.Type != pdk.FieldTypeInt {
+		t.Errorf("unexpected field from json: %#v", f)
+	}
+
+	for _, tst := range []struct {
+		spec   string
+		expErr string
+	}{
+		{`fields: [{path: []}]`, "path is required"},
+		{`fields: [{path: [Color]}]`, "invalid field name"},
+		{`fields: [{path: [a], type: float}]`, "unknown field type"},
+		{`fields: [{path: [a], keys: true, ids: true}]`, "mutually exclusive"},
+		{`fields: [{path: [a], type: int, keys: true}]`, "don't apply to int"},
+		{`fields: [{path: [a], type: bool, cache_size: 5}]`, "cache options"},
+		{`fields: [{path: [a], cache_type: big}]`, "unknown cache type"},
+		{`fields: [{path: [a], min: 1}]`, "min and max"},
+		{`fields: [{path: [a], type: int, min: 2, max: 1}]`, "greater than max"},
+		{`fields: [{path: [a], quantum: YMD}]`, "quantum doesn't apply"},
+		{`fields: [{path: [a], type: time, quantum: YQ}]`, "invalid time quantum"},
+		{`fields: [{path: [a]}, {path: [b], field: a}]`, "declared more than once"},
+		{`fields: [{path: [a]}, {path: [a], field: b}]`, "declared more than once"},
+		{`fields: [{path: [a], decimals: 2}]`, "decimals don't apply"},
+		{`fields: [{path: [a], type: int, decimals: 19}]`, "between 0 and 18"},
+		{`fields: [{path: [a], colour: red}]`, "decoding spec"},
+	} {
+		_, err := pdk.ParseSpec([]byte(tst.spec))
+		if err == nil || !strings.Contains(err.Error(), tst.expErr) {
+			t.Errorf("spec %s: expected error containing '%s', got %v", tst.spec, tst.expErr, err)
+		}
+	}
+}
+
+func TestSpecMapper(t *testing.T) {
+	spec, err := pdk.ParseSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatalf("parsing spec: %v", err)
+	}
+	ts := time.Date(2018, time.February, 22, 9, 0, 0, 0, time.UTC)
+	mapper := pdk.NewSpecMapper(spec)
+	mapper.ColTranslator = nil
+	mapper.Nexter = nil
+
+	e := &pdk.Entity{
+		Subject: "sub",
+		Objects: map[pdk.Property]pdk.Object{
+			"color":  pdk.S("7"),
+			"user":   &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"name": pdk.S("bob")}},
+			"size":   pdk.F64(3),
+			"active": pdk.S("true"),
+			"age":    pdk.S("42"),
+			"tags":   pdk.Objects{pdk.S("a"), pdk.S("b")},
+			"group":  pdk.F64(12),
+			"ts":     pdk.Time(ts),
+			"debug":  &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"x": pdk.I(1)}},
+		},
+	}
+	pr, err := mapper.Map(e)
+	if err != nil {
+		t.Fatalf("mapping: %v", err)
+	}
+	if pr.Col != "sub" {
+		t.Errorf("unexpected column: %v", pr.Col)
+	}
+	exp := []pdk.Row{
+		{Field: "color", ID: uint64(0)},
+		{Field: "username", ID: "bob"},
+		{Field: "size", ID: uint64(0), FieldType: pdk.FieldTypeMutex},
+		{Field: "active", ID: uint64(1), FieldType: pdk.FieldTypeBool},
+		{Field: "tags", ID: uint64(0), Time: ts},
+		{Field: "tags", ID: uint64(1), Time: ts},
+		{Field: "group", ID: uint64(12)},
+	}
+	if !reflect.DeepEqual(pr.Rows, exp) {
+		t.Errorf("unexpected rows:\n%v\nexpected:\n%v", pr.Rows, exp)
+	}
+	if !reflect.DeepEqual(pr.Vals, []pdk.Val{{Field: "age", Value: 42}}) {
+		t.Errorf("unexpected vals: %v", pr.Vals)
+	}
+
+	// a number and a string with the same value map to the same row
+	pr, err = mapper.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"color": pdk.I(7)}})
+	if err != nil {
+		t.Fatalf("mapping: %v", err)
+	}
+	if !reflect.DeepEqual(pr.Rows, []pdk.Row{{Field: "color", ID: uint64(0)}}) {
+		t.Errorf("unexpected rows for numeric color: %v", pr.Rows)
+	}
+
+	for name, objs := range map[string]map[pdk.Property]pdk.Object{
+		"undeclared":   {"shape": pdk.S("round")},
+		"out of range": {"age": pdk.I(200)},
+		"bad bool":     {"active": pdk.S("maybe")},
+		"bad id":       {"group": pdk.I(-1)},
+		"not a value":  {"user": &pdk.Entity{Objects: map[pdk.Property]pdk.Object{"name": &pdk.Entity{}}}},
+	} {
+		if _, err := mapper.Map(&pdk.Entity{Objects: objs}); err == nil {
+			t.Errorf("%s: expected error mapping %v", name, objs)
+		}
+	}
+}
+
+func TestSpecMapperDecimals(t *testing.T) {
+	spec, err := pdk.ParseSpec([]byte(`fields: [{path: [price], type: int, decimals: 2, max: 100000}]`))
+	if err != nil {
+		t.Fatalf("parsing spec: %v", err)
+	}
+	if decimals := spec.Decimals(); !reflect.DeepEqual(decimals, map[string]int{"price": 2}) {
+		t.Errorf("unexpected decimals: %v", decimals)
+	}
+	mapper := pdk.NewSpecMapper(spec)
+	for _, price := range []pdk.Object{pdk.F64(19.99), pdk.S("19.99"), pdk.F32(19.99)} {
+		pr, err := mapper.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"price": price}})
+		if err != nil {
+			t.Fatalf("mapping %v: %v", price, err)
+		}
+		if !reflect.DeepEqual(pr.Vals, []pdk.Val{{Field: "price", Value: 1999}}) {
+			t.Errorf("unexpected vals for %#v: %v", price, pr.Vals)
+		}
+	}
+	if _, err := mapper.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"price": pdk.I(1001)}}); err == nil {
+		t.Errorf("expected error mapping value which is out of range once scaled")
+	}
+}
+
+func TestSpecSchema(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	spec, err := pdk.ParseSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatalf("parsing spec: %v", err)
+	}
+	indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "spec", spec.Schema("spec"), 10)
+	if err != nil {
+		t.Fatalf("setting up pilosa: %v", err)
+	}
+	defer indexer.Close()
+	schema, err := indexer.Client().Schema()
+	if err != nil {
+		t.Fatalf("getting schema: %v", err)
+	}
+	fields := schema.Index("spec").Fields()
+	for name, exp := range map[string]gopilosa.FieldType{
+		"color":    gopilosa.FieldTypeSet,
+		"username": gopilosa.FieldTypeSet,
+		"size":     gopilosa.FieldTypeMutex,
+		"active":   gopilosa.FieldTypeBool,
+		"age":      gopilosa.FieldTypeInt,
+		"tags":     gopilosa.FieldTypeTime,
+		"group":    gopilosa.FieldTypeSet,
+	} {
+		f, ok := fields[name]
+		if !ok {
+			t.Errorf("field %s wasn't created", name)
+			continue
+		}
+		if typ := f.Options().Type(); typ != exp {
+			t.Errorf("field %s: expected type %s, got %s", name, exp, typ)
+		}
+	}
+	if !fields["username"].Options().Keys() {
+		t.Errorf("expected username to use keys")
+	}
+	if opts := fields["age"].Options(); opts.Min() != 0 || opts.Max() != 150 {
+		t.Errorf("unexpected age range: %d-%d", opts.Min(), opts.Max())
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk
+
+import (
+	"time"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pkg/errors"
+)
+
+// TimeOptions configures how timestamps are found in records and indexed. It
+// is meant to be included in the Main of an ingest command so that each of its
+// fields becomes a command line flag.
+type TimeOptions struct {
+	Layouts []string `help:"Go time layouts (e.g. 2006-01-02T15:04:05Z07:00) to try against string values. Values which match are parsed as timestamps."`
+	Path    []string `help:"Path to the timestamp in each record. Every row the record sets is imported with this time into a Pilosa time field."`
+	Unit    string   `help:"Unit of numeric timestamps at path: s, ms, us, or ns. Leave blank if timestamps are strings."`
+	Quantum string   `help:"Time quantum (e.g. YMDH) of the time fields which are created for timestamped rows."`
+}
+
+var timeUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// Setup configures parser and mapper to handle timestamps as described by o,
+// and returns the options which should be passed to SetupPilosa.
+func (o TimeOptions) Setup(parser *GenericParser, mapper *CollapsingMapper) ([]PilosaOption, error) {
+	parser.TimeLayouts = o.Layouts
+	mapper.TimestampPath = o.Path
+	if o.Unit != "" {
+		unit, ok := timeUnits[o.Unit]
+		if !ok {
+			return nil, errors.Errorf("unknown time unit '%s'", o.Unit)
+		}
+		if len(o.Path) == 0 {
+			return nil, errors.New("a time unit requires a timestamp path")
+		}
+		if parser.EpochProperties == nil {
+			parser.EpochProperties = make(map[string]time.Duration)
+		}
+		parser.EpochProperties[o.Path[len(o.Path)-1]] = unit
+	}
+	if o.Quantum == "" {
+		return nil, nil
+	}
+	return []PilosaOption{OptPilosaTimeQuantum(gopilosa.TimeQuantum(o.Quantum))}, nil
+}
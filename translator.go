@@ -42,9 +42,16 @@ import (
 // Translator describes the functionality for mapping arbitrary values in a
 // given Pilosa field to row ids and back. Implementations should be threadsafe
 // and generate ids monotonically.
+//
+// GetIDs and GetMany are the batch forms of GetID and Get. They return one
+// result for each argument, in the same order, and let implementations do
+// their lookups and allocations in a single pass rather than one value at a
+// time.
 type Translator interface {
 	Get(field string, id uint64) (interface{}, error)
 	GetID(field string, val interface{}) (uint64, error)
+	GetIDs(field string, vals []interface{}) ([]uint64, error)
+	GetMany(field string, ids []uint64) ([]interface{}, error)
 }
 
 // FieldTranslator works like a Translator, but the methods don't take fields as
@@ -53,6 +60,8 @@ type Translator interface {
 type FieldTranslator interface {
 	Get(id uint64) (interface{}, error)
 	GetID(val interface{}) (uint64, error)
+	GetIDs(vals []interface{}) ([]uint64, error)
+	GetMany(ids []uint64) ([]interface{}, error)
 }
 
 // MapTranslator is an in-memory implementation of Translator using maps.
@@ -99,6 +108,22 @@ func (m *MapTranslator) GetID(field string, val interface{}) (id uint64, err err
 	return m.getFieldTranslator(field).GetID(val)
 }
 
+// GetMany returns the values mapped to each of the given ids in the given
+// field.
+func (m *MapTranslator) GetMany(field string, ids []uint64) ([]interface{}, error) {
+	vals, err := m.getFieldTranslator(field).GetMany(ids)
+	if err != nil {
+		return nil, errors.Wrapf(err, "field '%v'", field)
+	}
+	return vals, nil
+}
+
+// GetIDs returns the integer ids associated with each of the given values in
+// the given field, allocating new IDs for any which are not found.
+func (m *MapTranslator) GetIDs(field string, vals []interface{}) ([]uint64, error) {
+	return m.getFieldTranslator(field).GetIDs(vals)
+}
+
 // MapFieldTranslator is an in-memory implementation of FieldTranslator using
 // sync.Map and a slice.
 type MapFieldTranslator struct {
@@ -122,12 +147,26 @@ func NewMapFieldTranslator() *MapFieldTranslator {
 func (m *MapFieldTranslator) Get(id uint64) (interface{}, error) {
 	m.l.RLock()
 	defer m.l.RUnlock()
-	if uint64(len(m.s)) < id {
+	if uint64(len(m.s)) <= id {
 		return nil, fmt.Errorf("requested unknown id in MapTranslator")
 	}
 	return m.s[id], nil
 }
 
+// GetMany returns the values mapped to each of the given ids.
+func (m *MapFieldTranslator) GetMany(ids []uint64) ([]interface{}, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	vals := make([]interface{}, len(ids))
+	for i, id := range ids {
+		if uint64(len(m.s)) <= id {
+			return nil, errors.Errorf("requested unknown id %d in MapTranslator", id)
+		}
+		vals[i] = m.s[id]
+	}
+	return vals, nil
+}
+
 // GetID returns the integer id associated with the given value. It allocates a
 // new ID if the value is not found.
 func (m *MapFieldTranslator) GetID(val interface{}) (id uint64, err error) {
@@ -159,6 +198,60 @@ func (m *MapFieldTranslator) GetID(val interface{}) (id uint64, err error) {
 	return nextid, nil
 }
 
+// GetIDs returns the integer ids associated with each of the given values. Any
+// values which are not found are allocated new IDs while holding the lock
+// once, rather than once per value.
+func (m *MapFieldTranslator) GetIDs(vals []interface{}) (ids []uint64, err error) {
+	ids = make([]uint64, len(vals))
+	keys := make([]string, len(vals))
+	missing := make([]int, 0)
+	for i, val := range vals {
+		keys[i] = fmt.Sprintf("%s", val)
+		if ids[i], err = m.load(keys[i]); err == errNotMapped {
+			missing = append(missing, i)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(missing) == 0 {
+		return ids, nil
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, i := range missing {
+		// re-check, the value may have been allocated since the first load,
+		// either concurrently or earlier in this batch.
+		if ids[i], err = m.load(keys[i]); err == nil {
+			continue
+		} else if err != errNotMapped {
+			return nil, err
+		}
+		nextid := m.n.Next()
+		m.s = append(m.s, vals[i])
+		if uint64(len(m.s)) != nextid+1 {
+			panic(fmt.Sprintf("unexpected length of slice, nextid: %d, len: %d", nextid, len(m.s)))
+		}
+		m.m.Store(keys[i], nextid)
+		ids[i] = nextid
+	}
+	return ids, nil
+}
+
+var errNotMapped = errors.New("value not mapped")
+
+// load returns the id stored for key, or errNotMapped if there isn't one.
+func (m *MapFieldTranslator) load(key string) (uint64, error) {
+	idv, ok := m.m.Load(key)
+	if !ok {
+		return 0, errNotMapped
+	}
+	id, ok := idv.(uint64)
+	if !ok {
+		return 0, errors.Errorf("Got non uint64 value back from MapTranslator: %v", idv)
+	}
+	return id, nil
+}
+
 // NexterFrameTranslator satisfies the FieldTranslator interface, but simply
 // allocates a new contiguous id every time GetID(val) is called. It does not
 // store any mapping and Get(id) always returns an error. Pilosa requires column
@@ -186,3 +279,18 @@ func (n *NexterFrameTranslator) GetID(val interface{}) (id uint64, err error) {
 func (n *NexterFrameTranslator) Get(id uint64) (interface{}, error) {
 	return nil, errors.New("the NexterFrameTranslator \"Get\" method should not be used - cannot map ids back to values")
 }
+
+// GetIDs for the NexterFrameTranslator returns a new id for each of vals.
+func (n *NexterFrameTranslator) GetIDs(vals []interface{}) (ids []uint64, err error) {
+	ids = make([]uint64, len(vals))
+	for i := range vals {
+		ids[i] = n.n.Next()
+	}
+	return ids, nil
+}
+
+// GetMany always returns nil, and a non-nil error for the
+// NexterFrameTranslator.
+func (n *NexterFrameTranslator) GetMany(ids []uint64) ([]interface{}, error) {
+	return nil, errors.New("the NexterFrameTranslator \"GetMany\" method should not be used - cannot map ids back to values")
+}
@@ -71,6 +71,30 @@ func TestMapTranslator(t *testing.T) {
 	test.MustBe(t, "thing3", val, "Get2-0")
 }
 
+func TestMapTranslatorBatch(t *testing.T) {
+	mt := NewMapTranslator()
+	_, err := mt.GetID("field1", "a")
+	test.ErrNil(t, err, "GetID")
+
+	ids, err := mt.GetIDs("field1", []interface{}{"b", "a", "c", "b"})
+	test.ErrNil(t, err, "GetIDs")
+	test.MustBe(t, []uint64{1, 0, 2, 1}, ids, "GetIDs")
+	id, err := mt.GetID("field1", "c")
+	test.ErrNil(t, err, "GetID after GetIDs")
+	test.MustBe(t, uint64(2), id, "GetID after GetIDs")
+
+	vals, err := mt.GetMany("field1", []uint64{2, 0, 1})
+	test.ErrNil(t, err, "GetMany")
+	test.MustBe(t, []interface{}{"c", "a", "b"}, vals, "GetMany")
+	if _, err = mt.GetMany("field1", []uint64{0, 3}); err == nil {
+		t.Fatal("expected error getting unknown id")
+	}
+
+	ids, err = NewNexterFieldTranslator().GetIDs([]interface{}{"a", "a"})
+	test.ErrNil(t, err, "NexterFrameTranslator.GetIDs")
+	test.MustBe(t, []uint64{0, 1}, ids, "NexterFrameTranslator.GetIDs")
+}
+
 func TestConcMapTranslator(t *testing.T) {
 	bt := NewMapTranslator()
 
@@ -0,0 +1,432 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+// Package unpack provides a pdk.RawSource which decompresses the readers of
+// another RawSource, and expands the archives among them into their members.
+package unpack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pilosa/pdk"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// Keys which RawSource adds to the Meta of the readers it returns.
+const (
+	// MetaCompression is the compression format a reader was decompressed
+	// from, e.g. "gzip".
+	MetaCompression = "compression"
+	// MetaArchive is the name of the archive a reader is a member of.
+	MetaArchive = "archive"
+	// MetaMember is the name of a reader within its archive.
+	MetaMember = "member"
+)
+
+// RawSource is a pdk.RawSource which decompresses gzip, bzip2, zstd and xz
+// data from another RawSource, and returns one reader for each regular file in
+// tar and zip archives. Formats are detected by their magic bytes (or, for
+// tar files without a ustar header, a .tar or .tgz extension), so other data
+// is passed through unchanged.
+//
+// A member of an archive is named <archive name>/<member name>, e.g.
+// "dump.tar.gz/2019/01.json". Readers for archive members must be closed:
+// NextReader waits for a tar member to be closed before returning the next,
+// since they're read from the same stream, and an archive stays open until all
+// of its members are closed.
+type RawSource struct {
+	rs pdk.RawSource
+
+	mu       sync.Mutex
+	archives []archive // archives being expanded, innermost last
+}
+
+// NewRawSource returns a RawSource which unpacks the readers of rs.
+func NewRawSource(rs pdk.RawSource) *RawSource {
+	return &RawSource{rs: rs}
+}
+
+// NextReader implements pdk.RawSource.
+func (s *RawSource) NextReader() (pdk.NamedReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		var r pdk.NamedReadCloser
+		var err error
+		if n := len(s.archives); n > 0 {
+			arc := s.archives[n-1]
+			r, err = arc.next()
+			if err != nil {
+				arc.Close()
+				s.archives = s.archives[:n-1]
+				if err == io.EOF {
+					continue
+				}
+				return nil, errors.Wrapf(err, "reading archive %s", arc.name())
+			}
+		} else {
+			r, err = s.rs.NextReader()
+			if err != nil {
+				return nil, err
+			}
+		}
+		r, arc, err := open(r)
+		if err != nil {
+			return nil, err
+		}
+		if arc != nil {
+			s.archives = append(s.archives, arc)
+			continue
+		}
+		return r, nil
+	}
+}
+
+// reader is the pdk.NamedReadCloser for decompressed data and archive members.
+type reader struct {
+	io.Reader
+	closers []io.Closer
+	name    string
+	meta    map[string]interface{}
+
+	// inner is the name used to detect the format of the data, which is the
+	// name without extensions for the compression already undone.
+	inner string
+}
+
+func (r *reader) Name() string                 { return r.name }
+func (r *reader) Meta() map[string]interface{} { return r.meta }
+
+// Close closes the readers which r reads through, innermost first.
+func (r *reader) Close() (err error) {
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func copyMeta(meta map[string]interface{}, kvs ...interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(meta)+len(kvs)/2)
+	for k, v := range meta {
+		ret[k] = v
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		ret[kvs[i].(string)] = kvs[i+1]
+	}
+	return ret
+}
+
+type format int
+
+const (
+	plain format = iota
+	formatGzip
+	formatBzip2
+	formatZstd
+	formatXz
+	formatTar
+	formatZip
+)
+
+var formatNames = map[format]string{
+	formatGzip:  "gzip",
+	formatBzip2: "bzip2",
+	formatZstd:  "zstd",
+	formatXz:    "xz",
+}
+
+// Packed reports whether data named name which starts with head is compressed
+// or an archive, and so would be unpacked by a RawSource. Head should be the
+// first 512 bytes of the data, or all of it if it's shorter.
+func Packed(head []byte, name string) bool {
+	return detect(head, name) != plain
+}
+
+// PackedName reports whether name has the extension of a compression or archive
+// format which RawSource unpacks.
+func PackedName(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gz", ".tgz", ".bz2", ".tbz", ".tbz2", ".zst", ".tzst", ".xz", ".txz", ".tar", ".zip":
+		return true
+	}
+	return false
+}
+
+// detect returns the format of data which starts with head and is named name.
+func detect(head []byte, name string) format {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatGzip
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return formatBzip2
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return formatZstd
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return formatXz
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip
+	case len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar")):
+		return formatTar
+	}
+	if ext := strings.ToLower(path.Ext(name)); ext == ".tar" && len(head) >= 512 {
+		return formatTar
+	}
+	return plain
+}
+
+// trimExt returns name without the extension of a compression format.
+func trimExt(name string) string {
+	ext := path.Ext(name)
+	switch strings.ToLower(ext) {
+	case ".tgz", ".tbz", ".tbz2", ".txz", ".tzst":
+		return strings.TrimSuffix(name, ext) + ".tar"
+	case ".gz", ".bz2", ".zst", ".xz":
+		return strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// open undoes any compression of r. It returns an archive if r is one, and
+// otherwise a reader of the decompressed data.
+func open(nr pdk.NamedReadCloser) (pdk.NamedReadCloser, archive, error) {
+	r, ok := nr.(*reader)
+	if !ok {
+		r = &reader{
+			Reader:  nr,
+			closers: []io.Closer{nr},
+			name:    nr.Name(),
+			meta:    nr.Meta(),
+			inner:   nr.Name(),
+		}
+	}
+	for {
+		br := bufio.NewReaderSize(r.Reader, 512)
+		head, _ := br.Peek(512) // the error is returned by the first Read
+		f := detect(head, r.inner)
+		var dec io.Reader
+		var closer io.Closer
+		var err error
+		switch f {
+		case plain:
+			r.Reader = br
+			return r, nil, nil
+		case formatTar:
+			return nil, &tarArchive{members: members{r: r}, tr: tar.NewReader(br)}, nil
+		case formatZip:
+			arc, err := newZipArchive(r, nr, br)
+			if err != nil {
+				r.Close()
+				return nil, nil, errors.Wrapf(err, "opening zip archive %s", r.name)
+			}
+			return nil, arc, nil
+		case formatGzip:
+			var gz *gzip.Reader
+			gz, err = gzip.NewReader(br)
+			dec, closer = gz, gz
+		case formatBzip2:
+			dec = bzip2.NewReader(br)
+		case formatZstd:
+			var zr *zstd.Decoder
+			zr, err = zstd.NewReader(br)
+			if err == nil {
+				dec, closer = zr, closeFunc(func() error { zr.Close(); return nil })
+			}
+		case formatXz:
+			dec, err = xz.NewReader(br)
+		}
+		if err != nil {
+			r.Close()
+			return nil, nil, errors.Wrapf(err, "opening %s data in %s", formatNames[f], r.name)
+		}
+		r.Reader = dec
+		if closer != nil {
+			r.closers = append([]io.Closer{closer}, r.closers...)
+		}
+		r.meta = copyMeta(r.meta, MetaCompression, formatNames[f])
+		r.inner = trimExt(r.inner)
+	}
+}
+
+type closeFunc func() error
+
+func (f closeFunc) Close() error { return f() }
+
+// archive is a tar or zip file being expanded.
+type archive interface {
+	// next returns the next regular file in the archive, or io.EOF.
+	next() (pdk.NamedReadCloser, error)
+	name() string
+	io.Closer
+}
+
+// members tracks the open members of an archive, so that the archive is only
+// closed once they all are.
+type members struct {
+	r  *reader
+	wg sync.WaitGroup
+}
+
+// member returns a reader for the member of the archive named name, which
+// reads from rc and calls done once it's closed.
+func (m *members) member(rc io.ReadCloser, name string, done func()) *reader {
+	m.wg.Add(1)
+	var once sync.Once
+	return &reader{
+		Reader: rc,
+		closers: []io.Closer{rc, closeFunc(func() error {
+			once.Do(func() {
+				m.wg.Done()
+				if done != nil {
+					done()
+				}
+			})
+			return nil
+		})},
+		name:  m.r.name + "/" + name,
+		meta:  copyMeta(m.r.meta, MetaArchive, m.r.name, MetaMember, name),
+		inner: name,
+	}
+}
+
+func (m *members) name() string { return m.r.name }
+
+// Close closes the archive once all of its members are closed.
+func (m *members) Close() error {
+	go func() {
+		m.wg.Wait()
+		m.r.Close()
+	}()
+	return nil
+}
+
+type tarArchive struct {
+	members
+	tr *tar.Reader
+
+	// closed is closed once the last member returned is closed, since the next
+	// member can't be read before then.
+	closed chan struct{}
+}
+
+func (a *tarArchive) next() (pdk.NamedReadCloser, error) {
+	if a.closed != nil {
+		<-a.closed
+	}
+	for {
+		hdr, err := a.tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		closed := make(chan struct{})
+		a.closed = closed
+		return a.member(ioutil.NopCloser(a.tr), hdr.Name, func() { close(closed) }), nil
+	}
+}
+
+type zipArchive struct {
+	members
+	files []*zip.File
+}
+
+// fileReaderAt is satisfied by *os.File, and the file.RawSource readers which
+// embed one.
+type fileReaderAt interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// newZipArchive reads a zip archive from orig if it's an unread file, and
+// otherwise copies br to a temporary file to read it from there.
+func newZipArchive(r *reader, orig pdk.NamedReadCloser, br io.Reader) (*zipArchive, error) {
+	if f, ok := orig.(fileReaderAt); ok && r.Reader == orig {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, errors.Wrap(err, "statting")
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return nil, errors.Wrap(err, "reading directory")
+		}
+		return &zipArchive{members: members{r: r}, files: zr.File}, nil
+	}
+	tmp, err := ioutil.TempFile("", "pdk-unpack-")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating temp file")
+	}
+	r.closers = append(r.closers, closeFunc(func() error {
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	}))
+	size, err := io.Copy(tmp, br)
+	if err != nil {
+		return nil, errors.Wrap(err, "copying to temp file")
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading directory")
+	}
+	return &zipArchive{members: members{r: r}, files: zr.File}, nil
+}
+
+func (a *zipArchive) next() (pdk.NamedReadCloser, error) {
+	for len(a.files) > 0 {
+		f := a.files[0]
+		a.files = a.files[1:]
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening %s", f.Name)
+		}
+		return a.member(rc, f.Name, nil), nil
+	}
+	return nil, io.EOF
+}
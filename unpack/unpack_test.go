@@ -0,0 +1,257 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package unpack_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pilosa/pdk/file"
+	"github.com/pilosa/pdk/unpack"
+	"github.com/ulikunitz/xz"
+)
+
+// bzip2Data is `{"a":4}\n` compressed with bzip2, for which the standard
+// library has no writer.
+var bzip2Data = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xbc, 0x7c,
+	0x53, 0x40, 0x00, 0x00, 0x03, 0x59, 0x80, 0x00, 0x10, 0x10, 0x00, 0x04,
+	0x10, 0x20, 0x00, 0x00, 0x0a, 0x20, 0x00, 0x22, 0x03, 0x65, 0x08, 0x60,
+	0x11, 0x4a, 0x1f, 0x17, 0x72, 0x45, 0x38, 0x50, 0x90, 0xbc, 0x7c, 0x53,
+	0x40,
+}
+
+func TestRawSource(t *testing.T) {
+	d, err := ioutil.TempDir("", "testunpack")
+	if err != nil {
+		t.Fatalf("getting temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+
+	files := map[string][]byte{
+		"a.json":      []byte(`{"a":1}` + "\n"),
+		"b.json.gz":   gzipData(t, `{"a":2}`+"\n"),
+		"c.json.zst":  zstdData(t, `{"a":3}`+"\n"),
+		"d.json.bz2":  bzip2Data,
+		"e.json.xz":   xzData(t, `{"a":5}`+"\n"),
+		"f.tgz":       gzipData(t, string(tarData(t, "sub/", "", "sub/x.json", `{"a":6}`, "sub/y.json.gz", string(gzipData(t, `{"a":7}`))))),
+		"g.zip":       zipData(t, "z.json", `{"a":8}`),
+		"h.tar":       tarData(t, "t.json", `{"a":9}`),
+		"i.zip.gz":    gzipData(t, string(zipData(t, "w.json", `{"a":10}`))),
+		"j.tar":       nil, // an empty file named like an archive is passed through
+		"k.json.zst2": []byte("not zstd"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(d, name), data, 0644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	rs, err := file.NewRawSource(d)
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	src := unpack.NewRawSource(rs)
+
+	got := make(map[string]string)
+	metas := make(map[string]map[string]interface{})
+	for {
+		r, err := src.NextReader()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("getting reader: %v", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading %s: %v", r.Name(), err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("closing %s: %v", r.Name(), err)
+		}
+		got[r.Name()] = string(data)
+		meta := r.Meta()
+		delete(meta, file.MetaPath)
+		metas[r.Name()] = meta
+	}
+
+	exp := map[string]string{
+		"a.json":              `{"a":1}` + "\n",
+		"b.json.gz":           `{"a":2}` + "\n",
+		"c.json.zst":          `{"a":3}` + "\n",
+		"d.json.bz2":          `{"a":4}` + "\n",
+		"e.json.xz":           `{"a":5}` + "\n",
+		"f.tgz/sub/x.json":    `{"a":6}`,
+		"f.tgz/sub/y.json.gz": `{"a":7}`,
+		"g.zip/z.json":        `{"a":8}`,
+		"h.tar/t.json":        `{"a":9}`,
+		"i.zip.gz/w.json":     `{"a":10}`,
+		"j.tar":               "",
+		"k.json.zst2":         "not zstd",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected contents:\n%v\nexp:\n%v", got, exp)
+	}
+
+	expMeta := map[string]map[string]interface{}{
+		"b.json.gz":           {unpack.MetaCompression: "gzip"},
+		"f.tgz/sub/y.json.gz": {unpack.MetaCompression: "gzip", unpack.MetaArchive: "f.tgz", unpack.MetaMember: "sub/y.json.gz"},
+		"g.zip/z.json":        {unpack.MetaArchive: "g.zip", unpack.MetaMember: "z.json"},
+	}
+	for name, exp := range expMeta {
+		if !reflect.DeepEqual(metas[name], exp) {
+			t.Errorf("unexpected meta for %s: %v", name, metas[name])
+		}
+	}
+}
+
+func TestRawSourceCorrupt(t *testing.T) {
+	d, err := ioutil.TempDir("", "testunpackcorrupt")
+	if err != nil {
+		t.Fatalf("getting temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	data := gzipData(t, `{"a":1}`)
+	if err := ioutil.WriteFile(filepath.Join(d, "a.json.gz"), data[:len(data)-6], 0644); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	rs, err := file.NewRawSource(d)
+	if err != nil {
+		t.Fatalf("getting raw source: %v", err)
+	}
+	r, err := unpack.NewRawSource(rs).NextReader()
+	if err != nil {
+		t.Fatalf("getting reader: %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatalf("expected error reading truncated gzip data")
+	}
+}
+
+func gzipData(t *testing.T, s string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatalf("writing gzip: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func zstdData(t *testing.T, s string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("getting zstd writer: %v", err)
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatalf("writing zstd: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing zstd: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func xzData(t *testing.T, s string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := xz.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("getting xz writer: %v", err)
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatalf("writing xz: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing xz: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// tarData returns a tar file of name, contents pairs. Names ending in a slash
+// are directories.
+func tarData(t *testing.T, kvs ...string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for i := 0; i < len(kvs); i += 2 {
+		hdr := &tar.Header{Name: kvs[i], Mode: 0644, Size: int64(len(kvs[i+1])), Typeflag: tar.TypeReg}
+		if kvs[i][len(kvs[i])-1] == '/' {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatalf("writing tar header: %v", err)
+		}
+		if _, err := io.WriteString(w, kvs[i+1]); err != nil {
+			t.Fatalf("writing tar: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// zipData returns a zip file of name, contents pairs.
+func zipData(t *testing.T, kvs ...string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for i := 0; i < len(kvs); i += 2 {
+		fw, err := w.Create(kvs[i])
+		if err != nil {
+			t.Fatalf("creating zip member: %v", err)
+		}
+		if _, err := io.WriteString(fw, kvs[i+1]); err != nil {
+			t.Fatalf("writing zip: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing zip: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// UpsertMapper wraps a RecordMapper so that each record replaces whatever was
+// indexed for the previous record with the same subject, rather than adding
+// to it. It remembers the last PilosaRecord indexed for every subject in
+// Store, and adds a clear to each record for every row and value which the
+// previous record had and it doesn't. Records are only stored once the
+// Ingester acknowledges that they were indexed (see AckMapper).
+//
+// The column for a subject must be the same each time it is mapped, so the
+// wrapped mapper should use a ColTranslator or column keys. Records for the
+// same subject must be mapped in order, so the Ingester's ParseConcurrency
+// should be 1. Records with timestamped rows are rejected, since Pilosa only
+// clears the standard view of a time field.
+type UpsertMapper struct {
+	Mapper RecordMapper
+	Store  RecordStore
+
+	// DeletePath, if set, is the path to a boolean which marks a record as a
+	// tombstone when it is true. The column of a tombstone is cleared in
+	// every field (see PilosaRecord.Delete), and the subject is forgotten.
+	// Like a timestamp, the value at DeletePath isn't indexed itself.
+	DeletePath []string
+
+	mu sync.Mutex
+}
+
+// NewUpsertMapper returns an UpsertMapper wrapping mapper which remembers
+// records in memory. Records which were indexed before a restart aren't
+// cleared unless Store is replaced with a persistent RecordStore, such as the
+// one in the leveldb package.
+func NewUpsertMapper(mapper RecordMapper) *UpsertMapper {
+	return &UpsertMapper{
+		Mapper: mapper,
+		Store:  NewMapRecordStore(),
+	}
+}
+
+// Map implements the RecordMapper interface.
+func (m *UpsertMapper) Map(e *Entity) (PilosaRecord, error) {
+	if e.Subject == "" {
+		return PilosaRecord{}, errors.New("upserting requires records to have a subject")
+	}
+	subject := string(e.Subject)
+	tombstone := false
+	if obj, ok := popObject(e, m.DeletePath); ok {
+		lit, ok := obj.(Literal)
+		if !ok {
+			return PilosaRecord{}, errors.Errorf("value at %v is a %T, not a Literal", m.DeletePath, obj)
+		}
+		var err error
+		tombstone, err = boolValue(lit)
+		if err != nil {
+			return PilosaRecord{}, errors.Wrapf(err, "getting tombstone flag at %v", m.DeletePath)
+		}
+	}
+	pr, err := m.Mapper.Map(e)
+	if err != nil {
+		return pr, err
+	}
+	for _, row := range pr.Rows {
+		if !row.Time.IsZero() {
+			return PilosaRecord{}, errors.Errorf("can't upsert timestamped row in '%s'", row.Field)
+		}
+	}
+	if tombstone {
+		pr.Rows, pr.Vals = nil, nil
+		pr.Delete = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, ok, err := m.Store.Get(subject)
+	if err != nil {
+		return pr, errors.Wrap(err, "getting previous record")
+	}
+	if ok {
+		// Even a tombstone clears these, since they may not have been
+		// imported for DeleteColumn to find yet.
+		pr.ClearRows, pr.ClearVals = clears(prev, pr)
+	}
+	return pr, nil
+}
+
+// Ack implements the AckMapper interface. If pr was indexed, it is stored as
+// the last record for its subject, or the subject is forgotten if pr is a
+// tombstone.
+func (m *UpsertMapper) Ack(e *Entity, pr PilosaRecord, err error) error {
+	if err != nil {
+		return nil
+	}
+	subject := string(e.Subject)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pr.Delete {
+		err = m.Store.Delete(subject)
+	} else {
+		err = m.Store.Put(subject, pr)
+	}
+	return errors.Wrap(err, "storing record")
+}
+
+// clears returns the rows and the int fields which prev sets and pr doesn't.
+func clears(prev, pr PilosaRecord) (rows []Row, vals []string) {
+	type fieldRow struct {
+		field string
+		id    uint64OrString
+	}
+	has := make(map[fieldRow]bool, len(pr.Rows))
+	for _, row := range pr.Rows {
+		has[fieldRow{row.Field, row.ID}] = true
+	}
+	for _, row := range prev.Rows {
+		if !has[fieldRow{row.Field, row.ID}] {
+			rows = append(rows, Row{Field: row.Field, ID: row.ID})
+		}
+	}
+	hasVal := make(map[string]bool, len(pr.Vals))
+	for _, val := range pr.Vals {
+		hasVal[val.Field] = true
+	}
+	for _, val := range prev.Vals {
+		if !hasVal[val.Field] {
+			vals = append(vals, val.Field)
+		}
+	}
+	return rows, vals
+}
+
+// RecordStore remembers the last PilosaRecord indexed for each subject.
+// Implementations should be thread safe.
+type RecordStore interface {
+	// Get returns the record for subject, and false if there isn't one.
+	Get(subject string) (PilosaRecord, bool, error)
+	Put(subject string, pr PilosaRecord) error
+	Delete(subject string) error
+}
+
+// MapRecordStore is an in-memory RecordStore.
+type MapRecordStore struct {
+	mu      sync.RWMutex
+	records map[string]PilosaRecord
+}
+
+// NewMapRecordStore returns an empty MapRecordStore.
+func NewMapRecordStore() *MapRecordStore {
+	return &MapRecordStore{records: make(map[string]PilosaRecord)}
+}
+
+// Get implements RecordStore.
+func (s *MapRecordStore) Get(subject string) (PilosaRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pr, ok := s.records[subject]
+	return pr, ok, nil
+}
+
+// Put implements RecordStore. Only the rows and values of pr are kept.
+func (s *MapRecordStore) Put(subject string, pr PilosaRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[subject] = PilosaRecord{Col: pr.Col, Rows: pr.Rows, Vals: pr.Vals}
+	return nil
+}
+
+// Delete implements RecordStore.
+func (s *MapRecordStore) Delete(subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, subject)
+	return nil
+}
+
+// UpsertOptions configures upserting. Like TimeOptions, it is meant to be
+// included in the Main of an ingest command.
+type UpsertOptions struct {
+	Enabled    bool     `help:"Treat each record as the new state of its subject: values which the previous record for the subject had and it doesn't are cleared."`
+	DeletePath []string `help:"Path to a boolean which marks a record as a tombstone. Everything indexed for the subject of a tombstone is cleared. Implies --upsert.enabled."`
+	Dir        string   `help:"Directory in which the last record indexed for each subject is kept, so that upserts still clear what was indexed before a restart."`
+}
+
+// Upserting reports whether o enables upserting.
+func (o UpsertOptions) Upserting() bool {
+	return o.Enabled || len(o.DeletePath) > 0
+}
+
+// Check returns an error if o enables upserting along with timestamps, which
+// would put rows in time fields that upserts couldn't clear.
+func (o UpsertOptions) Check(t TimeOptions) error {
+	if o.Upserting() && len(t.Path) > 0 {
+		return errors.New("upserting can't be combined with a timestamp path, since only the standard view of a time field is cleared")
+	}
+	return nil
+}
+
+// Wrap returns mapper wrapped in an UpsertMapper which remembers records in
+// store if o enables upserting, and mapper itself otherwise. If store is nil,
+// records are remembered in memory.
+func (o UpsertOptions) Wrap(mapper RecordMapper, store RecordStore) RecordMapper {
+	if !o.Upserting() {
+		return mapper
+	}
+	um := NewUpsertMapper(mapper)
+	um.DeletePath = o.DeletePath
+	if store != nil {
+		um.Store = store
+	}
+	return um
+}
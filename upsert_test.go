@@ -0,0 +1,195 @@
+// Copyright 2017 Pilosa Corp.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived
+// from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING,
+// BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH
+// DAMAGE.
+
+package pdk_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pilosa/pdk"
+	ptest "github.com/pilosa/pilosa/test"
+)
+
+func TestUpsertMapper(t *testing.T) {
+	cm := pdk.NewCollapsingMapper()
+	cm.Translator = nil
+	cm.ColTranslator = nil
+	cm.Nexter = nil
+	um := pdk.NewUpsertMapper(cm)
+	um.DeletePath = []string{"deleted"}
+
+	mapEntity := func(objs map[pdk.Property]pdk.Object) pdk.PilosaRecord {
+		t.Helper()
+		e := &pdk.Entity{Subject: "a", Objects: objs}
+		pr, err := um.Map(e)
+		if err != nil {
+			t.Fatalf("mapping %v: %v", objs, err)
+		}
+		if err := um.Ack(e, pr, nil); err != nil {
+			t.Fatalf("acknowledging %v: %v", objs, err)
+		}
+		return pr
+	}
+
+	pr := mapEntity(map[pdk.Property]pdk.Object{"color": pdk.S("red"), "size": pdk.I(3)})
+	if len(pr.ClearRows) != 0 || len(pr.ClearVals) != 0 {
+		t.Errorf("unexpected clears for first record: %v %v", pr.ClearRows, pr.ClearVals)
+	}
+	// a record which wasn't indexed isn't stored.
+	e := &pdk.Entity{Subject: "a", Objects: map[pdk.Property]pdk.Object{"color": pdk.S("green")}}
+	pr, err := um.Map(e)
+	if err != nil {
+		t.Fatalf("mapping: %v", err)
+	}
+	if err := um.Ack(e, pr, errors.New("import failed")); err != nil {
+		t.Fatalf("acknowledging failure: %v", err)
+	}
+	pr = mapEntity(map[pdk.Property]pdk.Object{"color": pdk.S("blue"), "deleted": pdk.B(false)})
+	if exp := []pdk.Row{{Field: "color", ID: "red"}}; !reflect.DeepEqual(pr.ClearRows, exp) {
+		t.Errorf("unexpected cleared rows: %v", pr.ClearRows)
+	}
+	if exp := []string{"size"}; !reflect.DeepEqual(pr.ClearVals, exp) {
+		t.Errorf("unexpected cleared vals: %v", pr.ClearVals)
+	}
+	if len(pr.Rows) != 1 || pr.Rows[0].Field != "color" {
+		t.Errorf("the tombstone flag shouldn't be indexed: %v", pr.Rows)
+	}
+
+	pr = mapEntity(map[pdk.Property]pdk.Object{"deleted": pdk.S("true")})
+	if exp := []pdk.Row{{Field: "color", ID: "blue"}}; !reflect.DeepEqual(pr.ClearRows, exp) || len(pr.Rows) != 0 || len(pr.Vals) != 0 || !pr.Delete {
+		t.Errorf("unexpected tombstone record: %#v", pr)
+	}
+	if _, ok, _ := um.Store.Get("a"); ok {
+		t.Errorf("tombstoned subject is still stored")
+	}
+
+	if _, err := um.Map(&pdk.Entity{Objects: map[pdk.Property]pdk.Object{"color": pdk.S("red")}}); err == nil {
+		t.Errorf("expected error upserting record without subject")
+	}
+}
+
+func TestIngesterUpsert(t *testing.T) {
+	cluster := ptest.MustRunCluster(t, 1)
+	defer cluster.Close()
+
+	parser := pdk.NewDefaultGenericParser()
+	parser.Stats = pdk.NopStatter{}
+	parser.EntitySubjecter = pdk.SubjectPath([]string{"id"})
+	cm := pdk.NewCollapsingMapper()
+	cm.ColTranslator = pdk.NewMapFieldTranslator()
+	mapper := pdk.UpsertOptions{DeletePath: []string{"deleted"}}.Wrap(cm, nil)
+
+	ingest := func(recs ...map[string]interface{}) {
+		t.Helper()
+		indexer, err := pdk.SetupPilosa([]string{cluster[0].URL()}, "upsert", nil, 100)
+		if err != nil {
+			t.Fatalf("setting up pilosa: %v", err)
+		}
+		ingester := pdk.NewIngester(&sliceSource{recs: recs}, parser, mapper, indexer)
+		ingester.Stats = pdk.NopStatter{}
+		ingester.Log = pdk.NopLogger{}
+		if err := ingester.Run(); err != nil {
+			t.Fatalf("running ingester: %v", err)
+		}
+	}
+	check := func(exp map[string]int64) {
+		t.Helper()
+		client, err := gopilosa.NewClient([]string{cluster[0].URL()})
+		if err != nil {
+			t.Fatalf("getting client: %v", err)
+		}
+		schema, err := client.Schema()
+		if err != nil {
+			t.Fatalf("getting schema: %v", err)
+		}
+		index := schema.Index("upsert")
+		for _, fv := range [][2]string{{"color", "red"}, {"color", "blue"}, {"tags", "x"}, {"tags", "y"}} {
+			id, err := cm.Translator.GetID(fv[0], pdk.S(fv[1]))
+			if err != nil {
+				t.Fatalf("getting id: %v", err)
+			}
+			resp, err := client.Query(index.Count(index.Field(fv[0]).Row(id)))
+			if err != nil {
+				t.Fatalf("querying: %v", err)
+			}
+			if count := resp.Result().Count(); count != exp[fv[1]] {
+				t.Errorf("%s=%s: expected count %d, got %d", fv[0], fv[1], exp[fv[1]], count)
+			}
+		}
+		size := index.Field("size")
+		resp, err := client.Query(size.Sum(size.NotNull()))
+		if err != nil {
+			t.Fatalf("querying sum: %v", err)
+		}
+		if res := resp.Result(); res.Count() != exp["size.count"] || res.Value() != exp["size"] {
+			t.Errorf("size: expected sum %d of %d values, got %d of %d", exp["size"], exp["size.count"], res.Value(), res.Count())
+		}
+	}
+
+	// every version of "a" is imported in the same batches, so the last one
+	// only wins if sets and clears are imported in order.
+	ingest(
+		map[string]interface{}{"id": "a", "color": "red", "tags": []interface{}{"x", "y"}, "size": 3},
+		map[string]interface{}{"id": "a", "color": "blue", "tags": []interface{}{"x"}},
+		map[string]interface{}{"id": "a", "color": "red", "tags": []interface{}{"y"}, "size": 5},
+		map[string]interface{}{"id": "b", "color": "blue", "size": 1},
+	)
+	check(map[string]int64{"red": 1, "blue": 1, "y": 1, "size": 6, "size.count": 2})
+
+	// with nothing remembered, as after a restart, a tombstone still clears
+	// everything indexed for its subject.
+	mapper = pdk.UpsertOptions{DeletePath: []string{"deleted"}}.Wrap(cm, nil)
+	ingest(map[string]interface{}{"id": "a", "deleted": true})
+	check(map[string]int64{"blue": 1, "size": 1, "size.count": 1})
+}
+
+func TestUpsertMapperTime(t *testing.T) {
+	cm := pdk.NewCollapsingMapper()
+	cm.Translator = nil
+	cm.ColTranslator = nil
+	cm.Nexter = nil
+	cm.TimestampPath = []string{"ts"}
+	um := pdk.NewUpsertMapper(cm)
+
+	ts := pdk.Time(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+	e := &pdk.Entity{Subject: "a", Objects: map[pdk.Property]pdk.Object{"ts": ts, "color": pdk.S("red")}}
+	if _, err := um.Map(e); err == nil {
+		t.Fatal("expected an error mapping a timestamped record")
+	}
+	if _, ok, _ := um.Store.Get("a"); ok {
+		t.Error("timestamped record was stored")
+	}
+}
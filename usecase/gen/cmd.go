@@ -1,6 +1,7 @@
 package gen
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -36,6 +37,12 @@ func NewMain() *Main {
 
 // Run begins generating data and ingesting it to Pilosa.
 func (m *Main) Run() error {
+	return m.RunContext(context.Background())
+}
+
+// RunContext works like Run, but stops ingesting once ctx is done, after
+// flushing everything which has already been read.
+func (m *Main) RunContext(ctx context.Context) error {
 	if m.Seed == -1 {
 		m.Seed = time.Now().UnixNano()
 	}
@@ -62,5 +69,5 @@ func (m *Main) Run() error {
 		err = pdk.StartMappingProxy(m.Proxy, pdk.NewPilosaForwarder(m.PilosaHosts[0], mapper.Translator))
 		log.Fatal(errors.Wrap(err, "starting mapping proxy"))
 	}()
-	return errors.Wrap(ingester.Run(), "running ingester")
+	return errors.Wrap(ingester.RunContext(ctx), "running ingester")
 }
@@ -98,6 +98,30 @@ func (t *translator) GetID(field string, val interface{}) (uint64, error) {
 	}
 }
 
+func (t *translator) GetMany(field string, ids []uint64) ([]interface{}, error) {
+	vals := make([]interface{}, len(ids))
+	for i, id := range ids {
+		val, err := t.Get(field, id)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+func (t *translator) GetIDs(field string, vals []interface{}) ([]uint64, error) {
+	ids := make([]uint64, len(vals))
+	for i, val := range vals {
+		id, err := t.GetID(field, val)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
 var months = map[string]uint64{
 	"January":   0,
 	"February":  1,